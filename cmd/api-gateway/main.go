@@ -18,13 +18,24 @@ import (
 	"github.com/nikola43/aureo-vpn/pkg/auth"
 	"github.com/nikola43/aureo-vpn/pkg/blockchain"
 	"github.com/nikola43/aureo-vpn/pkg/config"
+	"github.com/nikola43/aureo-vpn/pkg/crypto"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/enrollment"
 	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/hdwallet"
 	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/maintenance"
 	"github.com/nikola43/aureo-vpn/pkg/metrics"
 	"github.com/nikola43/aureo-vpn/pkg/middleware"
+	"github.com/nikola43/aureo-vpn/pkg/nodeapi"
 	"github.com/nikola43/aureo-vpn/pkg/operator"
+	"github.com/nikola43/aureo-vpn/pkg/payment"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"github.com/nikola43/aureo-vpn/pkg/pricing"
+	"github.com/nikola43/aureo-vpn/pkg/quota"
 	"github.com/nikola43/aureo-vpn/pkg/rewards"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+	"github.com/redis/go-redis/v9"
 )
 
 const version = "1.0.0"
@@ -78,38 +89,160 @@ func main() {
 		cfg.JWT.AccessTokenDuration,
 		cfg.JWT.RefreshTokenDuration,
 	)
-	authService := auth.NewService(tokenService)
 
-	// Initialize blockchain service (optional - can be nil for development)
-	// In production, configure with real RPC endpoints and private keys
+	// Revoked access tokens and failed logins are shared between gateway
+	// instances through Redis
+	var revocations auth.RevocationList
+	var loginAttempts auth.AttemptStore
+	if cfg.Redis.Enabled {
+		redisClient := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr(),
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		defer redisClient.Close()
+		revocations = auth.NewRedisRevocationList(redisClient)
+		loginAttempts = auth.NewRedisAttemptStore(redisClient)
+	} else {
+		log.Warn("redis disabled, revoked access tokens and failed logins are only known to this instance")
+		revocations = auth.NewMemoryRevocationList()
+		loginAttempts = auth.NewMemoryAttemptStore()
+	}
+	loginGuard := auth.NewLoginGuard(loginAttempts, auth.LoginGuardConfig{
+		MaxAttempts:      cfg.Security.MaxLoginAttempts,
+		MaxAttemptsPerIP: cfg.Security.MaxLoginAttemptsPerIP,
+		LockoutDuration:  cfg.Security.LockoutDuration,
+	}, log)
+
+	// Two-factor secrets are encrypted at rest
+	var encryption *crypto.EncryptionService
+	if cfg.Security.EncryptionKey != "" {
+		key, err := cfg.Security.EncryptionKeyBytes()
+		if err == nil {
+			encryption, err = crypto.NewEncryptionService(key)
+		}
+		if err != nil {
+			log.Error("failed to initialize encryption", "error", err)
+			os.Exit(1)
+		}
+	} else {
+		log.Warn("ENCRYPTION_KEY not set, two-factor authentication is unavailable")
+	}
+	authService := auth.NewService(tokenService, revocations, encryption, loginGuard)
+
+	// Initialize blockchain service. Without one, operator payouts are
+	// disabled and subscription payments are not confirmed.
 	var blockchainService *blockchain.Service
-	// Example configuration (commented out for security):
-	// blockchainCfg := blockchain.Config{
-	// 	EthereumRPCURL:     os.Getenv("ETHEREUM_RPC_URL"),
-	// 	EthereumPrivateKey: os.Getenv("ETHEREUM_PRIVATE_KEY"),
-	// 	EthereumChainID:    1, // Mainnet
-	// 	BitcoinRPCURL:      os.Getenv("BITCOIN_RPC_URL"),
-	// 	BitcoinRPCUser:     os.Getenv("BITCOIN_RPC_USER"),
-	// 	BitcoinRPCPassword: os.Getenv("BITCOIN_RPC_PASSWORD"),
-	// }
-	// blockchainService, err = blockchain.NewService(blockchainCfg, log)
-	// if err != nil {
-	// 	log.Warn("failed to initialize blockchain service, using mock mode", "error", err)
-	// }
+	if cfg.Blockchain.Enabled() {
+		blockchainService, err = blockchain.NewService(blockchain.Config{
+			EthereumRPCURL:      cfg.Blockchain.EthereumRPCURL,
+			EthereumPrivateKey:  cfg.Blockchain.EthereumPrivateKey,
+			EthereumChainID:     cfg.Blockchain.EthereumChainID,
+			BitcoinRPCURL:       cfg.Blockchain.BitcoinRPCURL,
+			BitcoinRPCUser:      cfg.Blockchain.BitcoinRPCUser,
+			BitcoinRPCPassword:  cfg.Blockchain.BitcoinRPCPassword,
+			LitecoinRPCURL:      cfg.Blockchain.LitecoinRPCURL,
+			LitecoinRPCUser:     cfg.Blockchain.LitecoinRPCUser,
+			LitecoinRPCPassword: cfg.Blockchain.LitecoinRPCPassword,
+		}, log)
+		if err != nil {
+			log.Error("failed to initialize blockchain service", "error", err)
+			os.Exit(1)
+		}
+		defer blockchainService.Close()
+	}
+
+	// Initialize subscription plans
+	planService := plans.NewService()
+	if err := planService.InitializePlans(context.Background()); err != nil {
+		log.Error("failed to initialize plans", "error", err)
+		os.Exit(1)
+	}
 
 	// Initialize reward service
-	rewardService := rewards.NewRewardService(log, blockchainService)
+	rates, err := pricing.NewProvider(cfg.Pricing)
+	if err != nil {
+		log.Error("failed to initialize exchange rate provider", "error", err)
+		os.Exit(1)
+	}
+	rewardService := rewards.NewRewardService(log, rates)
 
 	// Initialize reward tiers
 	if err := rewardService.InitializeRewardTiers(); err != nil {
 		log.Warn("failed to initialize reward tiers", "error", err)
 	}
 
-	// Initialize operator service
-	operatorService := operator.NewService(log, rewardService)
+	// Start payout worker. Payouts can only be sent and confirmed with a
+	// blockchain service, so without one operators are not paid out.
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	defer stopWorker()
+	if cfg.Payouts.Enabled {
+		if blockchainService != nil {
+			payoutWorker := rewards.NewPayoutWorker(log, rewardService, blockchainService, cfg.Payouts)
+			go payoutWorker.Run(workerCtx)
+		} else {
+			log.Warn("blockchain service not configured, operator payouts are disabled")
+		}
+	}
+
+	// Initialize subscription payments. Deposits are only detected when a
+	// blockchain service is configured.
+	wallets, err := hdwallet.LoadWallets(cfg.Payments.XPubs)
+	if err != nil {
+		log.Error("failed to load payment wallets", "error", err)
+		os.Exit(1)
+	}
+	paymentProcessor := payment.NewCryptoPaymentProcessor(rates, wallets, planService)
+	if len(wallets) > 0 {
+		for symbol := range wallets {
+			if !cfg.Blockchain.Supports(symbol) {
+				log.Warn("no RPC configured for payment currency, its payments will not be confirmed", "currency", symbol)
+			}
+		}
+		if blockchainService != nil {
+			watcher := payment.NewWatcher(paymentProcessor, blockchainService, cfg.Payments.WatchInterval, cfg.Payments.UnderpaymentTolerance, cfg.Payments.LateGracePeriod)
+			go watcher.Run(workerCtx)
+		}
+	}
+
+	// Initialize node enrollment service. New nodes get a one-time join
+	// token to enroll with the control server.
+	enrollmentService := enrollment.NewService(log, cfg.VPN.JoinTokenTTL)
+
+	// Initialize node API client used to provision peers on nodes. Without a
+	// key, peers are provisioned by the owning node's peer sync instead.
+	var peerController session.PeerController
+	var peerLimiter quota.PeerLimiter
+	if cfg.VPN.NodeAPIPrivateKey != "" {
+		nodeClient, err := nodeapi.NewClient(cfg.VPN.NodeAPIPrivateKey, cfg.VPN.NodeAPITimeout)
+		if err != nil {
+			log.Error("failed to initialize node API client", "error", err)
+			os.Exit(1)
+		}
+		peerController = nodeClient
+		peerLimiter = nodeClient
+		log.Info("node API client initialized", "gateway_public_key", nodeClient.PublicKey())
+	} else {
+		log.Warn("NODE_API_PRIVATE_KEY not set, relying on node peer sync")
+	}
+
+	// Initialize session service
+	sessionService := session.NewService(log, peerController, rewardService, planService, cfg.VPN.DeviceLimitPolicy)
+
+	// Initialize node maintenance and operator services. Draining nodes are
+	// put into maintenance by the control server.
+	maintenanceService := maintenance.NewService(log, sessionService)
+	operatorService := operator.NewService(log, rewardService, enrollmentService, maintenanceService)
+
+	// Start data cap enforcement. Throttling needs the node API; without it
+	// users over their cap are disconnected.
+	quotaService := quota.NewService(log, planService, sessionService, peerLimiter, cfg.Quota)
+	if cfg.Quota.Enabled {
+		go quotaService.Run(workerCtx)
+	}
 
 	// Initialize handlers
-	handlers := api.NewHandlers(authService, operatorService)
+	handlers := api.NewHandlers(authService, operatorService, sessionService, paymentProcessor, planService, quotaService, enrollmentService, maintenanceService)
 
 	// Create Fiber app with production configuration
 	app := fiber.New(fiber.Config{
@@ -185,21 +318,32 @@ func main() {
 	// API v1 routes
 	v1 := app.Group("/api/v1")
 
+	// Protected routes require authentication
+	authMiddleware := middleware.AuthMiddleware(authService)
+
 	// Public routes
 	authRoutes := v1.Group("/auth")
 	authRoutes.Post("/register", handlers.Register)
 	authRoutes.Post("/login", handlers.Login)
 	authRoutes.Post("/refresh", handlers.RefreshToken)
+	authRoutes.Post("/2fa/verify", handlers.VerifyTwoFactorLogin)
+	authRoutes.Post("/logout", authMiddleware, handlers.Logout)
+	authRoutes.Get("/sessions", authMiddleware, handlers.ListAuthSessions)
+	authRoutes.Delete("/sessions/:id", authMiddleware, handlers.RevokeAuthSession)
 
-	// Protected routes (require authentication)
-	authMiddleware := middleware.AuthMiddleware(tokenService)
+	v1.Get("/plans", handlers.ListPlans)
 
 	userRoutes := v1.Group("/user", authMiddleware)
 	userRoutes.Get("/profile", handlers.GetProfile)
 	userRoutes.Put("/profile", handlers.UpdateProfile)
 	userRoutes.Get("/sessions", handlers.GetActiveSessions)
 	userRoutes.Get("/stats", handlers.GetStats)
+	userRoutes.Get("/plan", handlers.GetUserPlan)
+	userRoutes.Get("/quota", handlers.GetUserQuota)
 	userRoutes.Put("/password", handlers.ChangePassword)
+	userRoutes.Post("/2fa/setup", handlers.SetupTwoFactor)
+	userRoutes.Post("/2fa/enable", handlers.EnableTwoFactor)
+	userRoutes.Post("/2fa/disable", handlers.DisableTwoFactor)
 
 	nodeRoutes := v1.Group("/nodes", authMiddleware)
 	nodeRoutes.Get("/", handlers.ListNodes)
@@ -216,11 +360,21 @@ func main() {
 	configRoutes.Get("/:id", handlers.GetConfig)
 	configRoutes.Get("/", handlers.ListConfigs)
 
+	paymentRoutes := v1.Group("/payments", authMiddleware)
+	paymentRoutes.Get("/currencies", handlers.GetPaymentCurrencies)
+	paymentRoutes.Post("/", handlers.CreatePayment)
+	paymentRoutes.Get("/", handlers.ListPayments)
+	paymentRoutes.Get("/:id", handlers.GetPayment)
+
 	// Operator routes (require authentication)
 	operatorRoutes := v1.Group("/operator", authMiddleware)
 	operatorRoutes.Post("/register", handlers.RegisterOperator)
 	operatorRoutes.Post("/nodes", handlers.CreateOperatorNode)
 	operatorRoutes.Get("/nodes", handlers.GetOperatorNodes)
+	operatorRoutes.Post("/nodes/:id/join-token", handlers.IssueOperatorJoinToken)
+	operatorRoutes.Post("/nodes/:id/drain", handlers.DrainOperatorNode)
+	operatorRoutes.Get("/nodes/:id/drain", handlers.GetOperatorNodeDrain)
+	operatorRoutes.Delete("/nodes/:id/drain", handlers.ResumeOperatorNode)
 	operatorRoutes.Get("/stats", handlers.GetOperatorStats)
 	operatorRoutes.Get("/earnings", handlers.GetOperatorEarnings)
 	operatorRoutes.Get("/payouts", handlers.GetOperatorPayouts)
@@ -238,6 +392,12 @@ func main() {
 	adminRoutes.Post("/nodes", handlers.CreateNode)
 	adminRoutes.Put("/nodes/:id", handlers.UpdateNode)
 	adminRoutes.Delete("/nodes/:id", handlers.DeleteNode)
+	adminRoutes.Post("/nodes/:id/join-tokens", handlers.IssueNodeJoinToken)
+	adminRoutes.Get("/nodes/:id/join-tokens", handlers.ListNodeJoinTokens)
+	adminRoutes.Delete("/join-tokens/:id", handlers.RevokeJoinToken)
+	adminRoutes.Post("/nodes/:id/drain", handlers.DrainNode)
+	adminRoutes.Get("/nodes/:id/drain", handlers.GetNodeDrain)
+	adminRoutes.Delete("/nodes/:id/drain", handlers.ResumeNode)
 
 	adminRoutes.Get("/users", handlers.ListAllUsers)
 	adminRoutes.Get("/users/:id", handlers.GetUser)
@@ -281,6 +441,7 @@ func main() {
 
 	case sig := <-shutdown:
 		log.Info("shutting down", "signal", sig.String())
+		stopWorker()
 
 		// Create shutdown context with timeout
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
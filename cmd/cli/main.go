@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -8,6 +9,10 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/enrollment"
+	"github.com/nikola43/aureo-vpn/pkg/ledger"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/maintenance"
 	"github.com/nikola43/aureo-vpn/pkg/models"
 	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
 	"github.com/spf13/cobra"
@@ -44,6 +49,10 @@ func main() {
 	nodeCmd.AddCommand(
 		createNodeCmd(),
 		listNodesCmd(),
+		joinTokenCmd(),
+		drainNodeCmd(),
+		drainStatusCmd(),
+		resumeNodeCmd(),
 		deleteNodeCmd(),
 	)
 
@@ -68,6 +77,17 @@ func main() {
 		createUserCmd(),
 	)
 
+	// Ledger commands
+	ledgerCmd := &cobra.Command{
+		Use:   "ledger",
+		Short: "Inspect the operator earnings ledger",
+	}
+
+	ledgerCmd.AddCommand(
+		reconcileLedgerCmd(),
+		operatorBalanceCmd(),
+	)
+
 	// Stats command
 	statsCmd := &cobra.Command{
 		Use:   "stats",
@@ -75,7 +95,7 @@ func main() {
 		Run:   runStats,
 	}
 
-	rootCmd.AddCommand(nodeCmd, configCmd, userCmd, statsCmd)
+	rootCmd.AddCommand(nodeCmd, configCmd, userCmd, ledgerCmd, statsCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -107,6 +127,7 @@ func createNodeCmd() *cobra.Command {
 		city        string
 		wgPort      int
 		ovpnPort    int
+		tokenTTL    time.Duration
 	)
 
 	cmd := &cobra.Command{
@@ -118,12 +139,6 @@ func createNodeCmd() *cobra.Command {
 			}
 			defer database.Close()
 
-			// Generate keypair
-			keyPair, err := wireguard.GenerateKeyPair()
-			if err != nil {
-				log.Fatalf("Failed to generate keypair: %v", err)
-			}
-
 			node := &models.VPNNode{
 				Name:              name,
 				Hostname:          hostname,
@@ -133,11 +148,9 @@ func createNodeCmd() *cobra.Command {
 				City:              city,
 				WireGuardPort:     wgPort,
 				OpenVPNPort:       ovpnPort,
-				PublicKey:         keyPair.PublicKey,
 				Status:            "offline",
 				IsActive:          true,
 				SupportsWireGuard: true,
-				SupportsOpenVPN:   true,
 				MaxConnections:    1000,
 			}
 
@@ -146,10 +159,17 @@ func createNodeCmd() *cobra.Command {
 				log.Fatalf("Failed to create node: %v", err)
 			}
 
+			// The node generates its keys when it enrolls with this token
+			token, record, err := enrollment.NewService(logger.Global(), tokenTTL).IssueToken(context.Background(), node.ID, nil)
+			if err != nil {
+				log.Fatalf("Failed to issue join token: %v", err)
+			}
+
 			fmt.Printf("Node created successfully!\n")
 			fmt.Printf("ID: %s\n", node.ID)
 			fmt.Printf("Name: %s\n", node.Name)
-			fmt.Printf("Public Key: %s\n", node.PublicKey)
+			fmt.Printf("Join Token: %s\n", token)
+			fmt.Printf("Expires: %s\n", record.ExpiresAt.Format(time.RFC3339))
 		},
 	}
 
@@ -161,6 +181,7 @@ func createNodeCmd() *cobra.Command {
 	cmd.Flags().StringVar(&city, "city", "", "City name (required)")
 	cmd.Flags().IntVar(&wgPort, "wg-port", 51820, "WireGuard port")
 	cmd.Flags().IntVar(&ovpnPort, "ovpn-port", 1194, "OpenVPN port")
+	cmd.Flags().DurationVar(&tokenTTL, "token-ttl", enrollment.DefaultTokenTTL, "How long the join token can be used")
 
 	cmd.MarkFlagRequired("name")
 	cmd.MarkFlagRequired("hostname")
@@ -203,6 +224,142 @@ func listNodesCmd() *cobra.Command {
 	}
 }
 
+func joinTokenCmd() *cobra.Command {
+	var tokenTTL time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "token [node-id]",
+		Short: "Issue a new join token for a VPN node",
+		Long:  "Issue a new join token for a VPN node, revoking its unused ones. Use it to enroll a node again, e.g. after its identity was lost.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connectDB(); err != nil {
+				log.Fatalf("Failed to connect to database: %v", err)
+			}
+			defer database.Close()
+
+			nodeID, err := uuid.Parse(args[0])
+			if err != nil {
+				log.Fatalf("Invalid node ID: %v", err)
+			}
+
+			token, record, err := enrollment.NewService(logger.Global(), tokenTTL).IssueToken(context.Background(), nodeID, nil)
+			if err != nil {
+				log.Fatalf("Failed to issue join token: %v", err)
+			}
+
+			fmt.Printf("Join Token: %s\n", token)
+			fmt.Printf("Expires: %s\n", record.ExpiresAt.Format(time.RFC3339))
+		},
+	}
+
+	cmd.Flags().DurationVar(&tokenTTL, "token-ttl", enrollment.DefaultTokenTTL, "How long the join token can be used")
+
+	return cmd
+}
+
+func drainNodeCmd() *cobra.Command {
+	var (
+		timeout time.Duration
+		reason  string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "drain [node-id]",
+		Short: "Drain a VPN node for maintenance",
+		Long:  "Stop a VPN node from receiving new sessions and ask its clients to reconnect elsewhere. The control server puts the node into maintenance once its clients have left or the timeout passed.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connectDB(); err != nil {
+				log.Fatalf("Failed to connect to database: %v", err)
+			}
+			defer database.Close()
+
+			nodeID, err := uuid.Parse(args[0])
+			if err != nil {
+				log.Fatalf("Invalid node ID: %v", err)
+			}
+
+			drain, err := maintenance.NewService(logger.Global(), nil).Drain(context.Background(), nodeID, timeout, reason, nil)
+			if err != nil {
+				log.Fatalf("Failed to drain node: %v", err)
+			}
+
+			fmt.Println("Node draining")
+			fmt.Printf("Active Sessions: %d\n", drain.SessionsAtStart)
+			fmt.Printf("Deadline: %s\n", drain.Deadline.Format(time.RFC3339))
+		},
+	}
+
+	cmd.Flags().DurationVar(&timeout, "timeout", maintenance.DefaultDrainTimeout, "How long clients get to leave the node")
+	cmd.Flags().StringVar(&reason, "reason", "", "Reason for the maintenance")
+
+	return cmd
+}
+
+func drainStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "drain-status [node-id]",
+		Short: "Show the drain progress of a VPN node",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connectDB(); err != nil {
+				log.Fatalf("Failed to connect to database: %v", err)
+			}
+			defer database.Close()
+
+			nodeID, err := uuid.Parse(args[0])
+			if err != nil {
+				log.Fatalf("Invalid node ID: %v", err)
+			}
+
+			status, err := maintenance.NewService(logger.Global(), nil).Status(context.Background(), nodeID)
+			if err != nil {
+				log.Fatalf("Failed to get drain status: %v", err)
+			}
+
+			fmt.Printf("Node Status: %s\n", status.NodeStatus)
+			fmt.Printf("Drain: %s\n", status.State)
+			fmt.Printf("Active Sessions: %d\n", status.ActiveSessions)
+			if drain := status.Drain; drain != nil {
+				if drain.Reason != "" {
+					fmt.Printf("Reason: %s\n", drain.Reason)
+				}
+				fmt.Printf("Deadline: %s\n", drain.Deadline.Format(time.RFC3339))
+				if drain.CompletedAt != nil {
+					fmt.Printf("Completed: %s (%d sessions ended)\n", drain.CompletedAt.Format(time.RFC3339), drain.SessionsEnded)
+				}
+			}
+		},
+	}
+}
+
+func resumeNodeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resume [node-id]",
+		Short: "Return a draining or maintenance VPN node to service",
+		Long:  "Return a draining or maintenance VPN node to service. The node comes back online with its next heartbeat.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connectDB(); err != nil {
+				log.Fatalf("Failed to connect to database: %v", err)
+			}
+			defer database.Close()
+
+			nodeID, err := uuid.Parse(args[0])
+			if err != nil {
+				log.Fatalf("Invalid node ID: %v", err)
+			}
+
+			if err := maintenance.NewService(logger.Global(), nil).Resume(context.Background(), nodeID); err != nil {
+				log.Fatalf("Failed to resume node: %v", err)
+			}
+
+			fmt.Println("Node returned to service")
+		},
+	}
+}
+
 func deleteNodeCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "delete [node-id]",
@@ -371,6 +528,93 @@ func createUserCmd() *cobra.Command {
 	}
 }
 
+func reconcileLedgerCmd() *cobra.Command {
+	var fix bool
+
+	cmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Check the ledger against earnings, payouts and cached balances",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connectDB(); err != nil {
+				log.Fatalf("Failed to connect to database: %v", err)
+			}
+			defer database.Close()
+
+			db := database.GetDB()
+			drifts, err := ledger.Reconcile(db)
+			if err != nil {
+				log.Fatalf("Failed to reconcile ledger: %v", err)
+			}
+
+			if len(drifts) == 0 {
+				fmt.Println("Ledger is consistent")
+				return
+			}
+
+			fmt.Printf("Found %d discrepancies:\n\n", len(drifts))
+			for _, drift := range drifts {
+				fmt.Println(drift)
+			}
+
+			if fix {
+				// Only cached balances can be repaired; the ledger itself is append-only
+				refreshed := 0
+				for _, drift := range drifts {
+					switch drift.Kind {
+					case "operator_balance":
+						err = ledger.RefreshOperator(db, drift.Reference)
+					case "node_balance":
+						err = ledger.RefreshNode(db, drift.Reference)
+					default:
+						continue
+					}
+					if err != nil {
+						log.Fatalf("Failed to refresh %s: %v", drift.Reference, err)
+					}
+					refreshed++
+				}
+				fmt.Printf("\nRefreshed %d cached balances from the ledger\n", refreshed)
+			}
+
+			os.Exit(1)
+		},
+	}
+
+	cmd.Flags().BoolVar(&fix, "fix", false, "Refresh drifted cached balances from the ledger")
+
+	return cmd
+}
+
+func operatorBalanceCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "balance [operator-id]",
+		Short: "Show an operator's ledger balances",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			operatorID, err := uuid.Parse(args[0])
+			if err != nil {
+				log.Fatalf("Invalid operator ID: %v", err)
+			}
+
+			if err := connectDB(); err != nil {
+				log.Fatalf("Failed to connect to database: %v", err)
+			}
+			defer database.Close()
+
+			balances, err := ledger.GetOperatorBalances(database.GetDB(), operatorID)
+			if err != nil {
+				log.Fatalf("Failed to load balances: %v", err)
+			}
+
+			fmt.Printf("Operator: %s\n", operatorID)
+			fmt.Printf("  Earned:    $%s\n", balances.Earned)
+			fmt.Printf("  Payable:   $%s\n", balances.Payable)
+			fmt.Printf("  In flight: $%s\n", balances.InFlight)
+			fmt.Printf("  Paid:      $%s\n", balances.Paid)
+		},
+	}
+}
+
 func runStats(cmd *cobra.Command, args []string) {
 	if err := connectDB(); err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
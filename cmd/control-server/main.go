@@ -6,9 +6,12 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/nikola43/aureo-vpn/internal/control"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/nodeapi"
 )
 
 func main() {
@@ -33,8 +36,39 @@ func main() {
 	}
 	defer database.Close()
 
+	// Node certificates and control API responses are signed with this key.
+	// Nodes trust the key they enrolled with, so it must not change.
+	if config.SigningKey == "" {
+		log.Fatal("CONTROL_SIGNING_KEY is required (generate one with: openssl rand -base64 32)")
+	}
+	authority, err := controlapi.NewAuthority(config.SigningKey)
+	if err != nil {
+		log.Fatalf("Invalid CONTROL_SIGNING_KEY: %v", err)
+	}
+	log.Printf("Control public key: %s", authority.PublicKey())
+
+	// Node health endpoints are probed with the API gateway's node API key
+	var nodeAPI *nodeapi.Client
+	if config.NodeAPIPrivateKey != "" {
+		nodeAPI, err = nodeapi.NewClient(config.NodeAPIPrivateKey, config.ProbeTimeout)
+		if err != nil {
+			log.Fatalf("Invalid NODE_API_PRIVATE_KEY: %v", err)
+		}
+	} else {
+		log.Println("NODE_API_PRIVATE_KEY not set, only probing node VPN ports")
+	}
+
 	// Create and start control server
-	controlServer := control.NewServer()
+	controlServer := control.NewServer(control.Config{
+		APIPort:          config.APIPort,
+		Authority:        authority,
+		EarningsInterval: config.EarningsInterval,
+		MetricsRetention: config.MetricsRetention,
+
+		NodeAPI:               nodeAPI,
+		ProbeTimeout:          config.ProbeTimeout,
+		ProbeFailureThreshold: config.ProbeFailureThreshold,
+	})
 	if err := controlServer.Start(); err != nil {
 		log.Fatalf("Failed to start control server: %v", err)
 	}
@@ -61,6 +95,22 @@ type Config struct {
 	DBPassword string
 	DBName     string
 	DBSSLMode  string
+
+	// Control API
+	APIPort    int
+	SigningKey string
+
+	// Running sessions accrue operator earnings at this interval
+	EarningsInterval time.Duration
+
+	// Node performance samples are kept this long
+	MetricsRetention time.Duration
+
+	// Health probes of nodes. Nodes failing ProbeFailureThreshold probes in
+	// a row are degraded.
+	NodeAPIPrivateKey     string
+	ProbeTimeout          time.Duration
+	ProbeFailureThreshold int
 }
 
 func loadConfig() Config {
@@ -71,6 +121,16 @@ func loadConfig() Config {
 		DBPassword: getEnv("DB_PASSWORD", "postgres"),
 		DBName:     getEnv("DB_NAME", "aureo_vpn"),
 		DBSSLMode:  getEnv("DB_SSL_MODE", "disable"),
+
+		APIPort:    getEnvAsInt("CONTROL_API_PORT", controlapi.DefaultPort),
+		SigningKey: getEnv("CONTROL_SIGNING_KEY", ""),
+
+		EarningsInterval: getEnvAsDuration("EARNINGS_INTERVAL", control.DefaultEarningsInterval),
+		MetricsRetention: getEnvAsDuration("METRICS_RETENTION", control.DefaultMetricsRetention),
+
+		NodeAPIPrivateKey:     getEnv("NODE_API_PRIVATE_KEY", ""),
+		ProbeTimeout:          getEnvAsDuration("PROBE_TIMEOUT", control.DefaultProbeTimeout),
+		ProbeFailureThreshold: getEnvAsInt("PROBE_FAILURE_THRESHOLD", control.DefaultProbeFailureThreshold),
 	}
 }
 
@@ -92,3 +152,15 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return value
 }
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
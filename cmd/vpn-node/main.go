@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/nikola43/aureo-vpn/internal/node"
-	"github.com/nikola43/aureo-vpn/pkg/database"
+	pkgconfig "github.com/nikola43/aureo-vpn/pkg/config"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+	"github.com/nikola43/aureo-vpn/pkg/shaping"
+	"github.com/nikola43/aureo-vpn/pkg/telemetry"
 )
 
 func main() {
@@ -18,30 +24,49 @@ func main() {
 	// Load configuration
 	config := loadConfig()
 
-	// Connect to database
-	dbConfig := database.Config{
-		Host:     config.DBHost,
-		Port:     config.DBPort,
-		User:     config.DBUser,
-		Password: config.DBPassword,
-		DBName:   config.DBName,
-		SSLMode:  config.DBSSLMode,
-		TimeZone: "UTC",
+	// The node's identity is kept in the state directory once it has
+	// enrolled with its join token
+	identity, err := loadIdentity(config)
+	if err != nil {
+		log.Fatalf("Failed to load node identity: %v", err)
 	}
+	nodeID := identity.NodeID()
 
-	if err := database.Connect(dbConfig); err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+	// The node only talks to the control server, which checks it still
+	// accepts the identity
+	control, err := controlapi.NewClient(config.ControlURL, identity, 10*time.Second)
+	if err != nil {
+		log.Fatalf("Failed to create control API client: %v", err)
 	}
-	defer database.Close()
-
-	// Parse node ID
-	nodeID, err := uuid.Parse(config.NodeID)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	nodeInfo, err := control.Node(ctx)
+	cancel()
 	if err != nil {
-		log.Fatalf("Invalid node ID: %v", err)
+		log.Fatalf("Control server refused node %s: %v", nodeID, err)
+	}
+	log.Printf("Authenticated with the control server as node %s (%s)", nodeInfo.Name, nodeID)
+
+	// Per-peer speed limits are applied with tc on the WireGuard interface
+	var shaper shaping.Shaper
+	if config.BandwidthShaping {
+		shaper = shaping.NewTCShaper("wg0")
 	}
 
 	// Create and start node service
-	nodeService := node.NewService(nodeID)
+	nodeService := node.NewService(control, wireguard.NewBackend("wg0"), node.Config{
+		API: node.APIConfig{
+			Port:             config.APIPort,
+			GatewayPublicKey: config.GatewayPublicKey,
+		},
+		VPN: pkgconfig.VPNConfig{
+			SessionTimeout: config.SessionTimeout,
+		},
+		KeyFile: filepath.Join(config.StateDir, "wireguard.key"),
+		Shaper:  shaper,
+
+		// Host metrics are reported with every heartbeat
+		Telemetry: telemetry.NewCollector(telemetry.Config{Interface: config.PublicInterface}),
+	})
 	if err := nodeService.Start(); err != nil {
 		log.Fatalf("Failed to start node service: %v", err)
 	}
@@ -62,25 +87,76 @@ func main() {
 }
 
 type Config struct {
-	NodeID     string
-	DBHost     string
-	DBPort     int
-	DBUser     string
-	DBPassword string
-	DBName     string
-	DBSSLMode  string
+	// Control plane enrollment. JoinToken is only needed until the node has
+	// enrolled; ControlPublicKey pins the control server's signing key. The
+	// node's identity and WireGuard key are kept in StateDir.
+	ControlURL       string
+	ControlPublicKey string
+	JoinToken        string
+	StateDir         string
+
+	// Node API
+	APIPort          int
+	GatewayPublicKey string
+
+	// Sessions without a WireGuard handshake for this long are disconnected
+	SessionTimeout time.Duration
+
+	// Rate limit peers to their plan's speed
+	BandwidthShaping bool
+
+	// Network interface whose throughput is reported, all but loopback when empty
+	PublicInterface string
 }
 
 func loadConfig() Config {
 	return Config{
-		NodeID:     getEnv("NODE_ID", ""),
-		DBHost:     getEnv("DB_HOST", "localhost"),
-		DBPort:     getEnvAsInt("DB_PORT", 5432),
-		DBUser:     getEnv("DB_USER", "postgres"),
-		DBPassword: getEnv("DB_PASSWORD", "postgres"),
-		DBName:     getEnv("DB_NAME", "aureo_vpn"),
-		DBSSLMode:  getEnv("DB_SSL_MODE", "disable"),
+		ControlURL:       getEnv("CONTROL_URL", "http://localhost:8090"),
+		ControlPublicKey: getEnv("CONTROL_PUBLIC_KEY", ""),
+		JoinToken:        getEnv("JOIN_TOKEN", ""),
+		StateDir:         getEnv("STATE_DIR", "/var/lib/aureo-vpn"),
+
+		APIPort:          getEnvAsInt("NODE_API_PORT", 8081),
+		GatewayPublicKey: getEnv("GATEWAY_PUBLIC_KEY", ""),
+
+		SessionTimeout:   getEnvAsDuration("SESSION_TIMEOUT", node.DefaultSessionTimeout),
+		BandwidthShaping: getEnv("BANDWIDTH_SHAPING", "true") == "true",
+		PublicInterface:  getEnv("PUBLIC_INTERFACE", "eth0"),
+	}
+}
+
+// loadIdentity loads the node's identity from the state directory, enrolling
+// with the join token if there is none yet
+func loadIdentity(config Config) (*controlapi.Identity, error) {
+	path := filepath.Join(config.StateDir, "identity.json")
+
+	identity, err := controlapi.LoadIdentity(path)
+	if err == nil {
+		if config.ControlPublicKey != "" && identity.Certificate.Issuer != config.ControlPublicKey {
+			return nil, fmt.Errorf("identity in %s was issued by another control server", path)
+		}
+		return identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if config.JoinToken == "" {
+		return nil, fmt.Errorf("node is not enrolled, set JOIN_TOKEN to the token issued for it")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	identity, err = controlapi.Enroll(ctx, config.ControlURL, config.JoinToken, config.ControlPublicKey, 15*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll: %w", err)
 	}
+	if err := identity.Save(path); err != nil {
+		return nil, fmt.Errorf("failed to save identity: %w", err)
+	}
+
+	log.Printf("Enrolled as node %s, identity saved to %s", identity.NodeID(), path)
+	return identity, nil
 }
 
 func getEnv(key, defaultValue string) string {
@@ -101,3 +177,15 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return value
 }
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
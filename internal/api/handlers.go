@@ -1,33 +1,49 @@
 package api
 
 import (
-	"encoding/json"
-	"fmt"
-	"os/exec"
+	"errors"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/nikola43/aureo-vpn/pkg/auth"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/enrollment"
 	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/maintenance"
 	"github.com/nikola43/aureo-vpn/pkg/models"
 	"github.com/nikola43/aureo-vpn/pkg/metrics"
 	"github.com/nikola43/aureo-vpn/pkg/operator"
+	"github.com/nikola43/aureo-vpn/pkg/payment"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"github.com/nikola43/aureo-vpn/pkg/quota"
+	"github.com/nikola43/aureo-vpn/pkg/session"
 )
 
 // Handlers holds all API handlers
 type Handlers struct {
 	authService     *auth.Service
 	operatorService *operator.Service
+	sessionService  *session.Service
+	payments        *payment.CryptoPaymentProcessor
+	plans           *plans.Service
+	quota           *quota.Service
+	enrollments     *enrollment.Service
+	drains          *maintenance.Service
 }
 
 // NewHandlers creates new API handlers
-func NewHandlers(authService *auth.Service, operatorService *operator.Service) *Handlers {
+func NewHandlers(authService *auth.Service, operatorService *operator.Service, sessionService *session.Service, payments *payment.CryptoPaymentProcessor, plans *plans.Service, quota *quota.Service, enrollments *enrollment.Service, drains *maintenance.Service) *Handlers {
 	return &Handlers{
 		authService:     authService,
 		operatorService: operatorService,
+		sessionService:  sessionService,
+		payments:        payments,
+		plans:           plans,
+		quota:           quota,
+		enrollments:     enrollments,
+		drains:          drains,
 	}
 }
 
@@ -40,6 +56,9 @@ func (h *Handlers) Register(c *fiber.Ctx) error {
 		})
 	}
 
+	req.IPAddress = c.IP()
+	req.UserAgent = c.Get("User-Agent")
+
 	resp, err := h.authService.Register(req)
 	if err != nil {
 		metrics.LoginAttempts.WithLabelValues("failed").Inc()
@@ -63,42 +82,269 @@ func (h *Handlers) Login(c *fiber.Ctx) error {
 		})
 	}
 
+	req.IPAddress = c.IP()
+	req.UserAgent = c.Get("User-Agent")
+
 	resp, err := h.authService.Login(req)
 	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return loginBlocked(c, appErr)
+		}
 		metrics.LoginAttempts.WithLabelValues("failed").Inc()
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
 
+	// The sign-in is completed with a two-factor code
+	if resp.MFARequired {
+		metrics.LoginAttempts.WithLabelValues("mfa_required").Inc()
+		return c.JSON(resp)
+	}
+
 	metrics.LoginAttempts.WithLabelValues("success").Inc()
 
 	return c.JSON(resp)
 }
 
-// RefreshToken handles token refresh
-func (h *Handlers) RefreshToken(c *fiber.Ctx) error {
-	var req struct {
-		RefreshToken string `json:"refresh_token"`
+// VerifyTwoFactorLogin completes a login with a two-factor code
+func (h *Handlers) VerifyTwoFactorLogin(c *fiber.Ctx) error {
+	var req auth.TwoFactorLoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	req.IPAddress = c.IP()
+	req.UserAgent = c.Get("User-Agent")
+
+	resp, err := h.authService.VerifyTwoFactorLogin(c.UserContext(), req)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return loginBlocked(c, appErr)
+		}
+		metrics.LoginAttempts.WithLabelValues("failed").Inc()
+		if errors.Is(err, auth.ErrInvalidMFAToken) || errors.Is(err, auth.ErrInvalidTwoFactorCode) ||
+			errors.Is(err, auth.ErrInactiveUser) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to verify two-factor code",
+		})
+	}
+
+	metrics.LoginAttempts.WithLabelValues("success").Inc()
+
+	return c.JSON(resp)
+}
+
+// loginBlocked responds to a login refused after too many failed attempts
+func loginBlocked(c *fiber.Ctx, appErr *apperrors.AppError) error {
+	metrics.LoginAttempts.WithLabelValues("blocked").Inc()
+	if retryAfter, ok := appErr.Details["retry_after"].(int); ok {
+		c.Set("Retry-After", strconv.Itoa(retryAfter))
 	}
+	return c.Status(appErr.StatusCode).JSON(fiber.Map{
+		"error":   appErr.Message,
+		"code":    appErr.Code,
+		"details": appErr.Details,
+	})
+}
 
+// RefreshToken exchanges a refresh token for a new token pair. The refresh
+// token is rotated: the one sent can't be used again.
+func (h *Handlers) RefreshToken(c *fiber.Ctx) error {
+	var req auth.RefreshRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "invalid request body",
 		})
 	}
 
-	accessToken, err := h.authService.RefreshToken(req.RefreshToken)
+	req.IPAddress = c.IP()
+	req.UserAgent = c.Get("User-Agent")
+
+	resp, err := h.authService.RefreshToken(c.UserContext(), req)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": err.Error(),
+		if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) ||
+			errors.Is(err, auth.ErrInactiveUser) || errors.Is(err, auth.ErrUserNotFound) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to refresh token",
 		})
 	}
 
 	metrics.TokenGenerations.WithLabelValues("access").Inc()
+	metrics.TokenGenerations.WithLabelValues("refresh").Inc()
+
+	return c.JSON(fiber.Map{
+		"access_token":  resp.AccessToken,
+		"refresh_token": resp.RefreshToken,
+	})
+}
+
+// Logout signs out the session the access token belongs to
+func (h *Handlers) Logout(c *fiber.Ctx) error {
+	claims := c.Locals("claims").(*auth.Claims)
+
+	if err := h.authService.Logout(c.UserContext(), claims); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to log out",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "logged out",
+	})
+}
+
+// ListAuthSessions returns the devices the user is signed in on
+func (h *Handlers) ListAuthSessions(c *fiber.Ctx) error {
+	claims := c.Locals("claims").(*auth.Claims)
+
+	tokens, err := h.authService.ListSessions(c.UserContext(), claims.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch sessions",
+		})
+	}
+
+	sessions := make([]fiber.Map, 0, len(tokens))
+	for _, token := range tokens {
+		sessions = append(sessions, fiber.Map{
+			"id":           token.FamilyID,
+			"device_name":  token.DeviceName,
+			"ip_address":   token.IPAddress,
+			"user_agent":   token.UserAgent,
+			"signed_in_at": token.SignedInAt,
+			"last_used_at": token.LastUsedAt,
+			"expires_at":   token.ExpiresAt,
+			"current":      token.FamilyID == claims.SessionID,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"sessions": sessions,
+		"count":    len(sessions),
+	})
+}
+
+// RevokeAuthSession signs one of the user's devices out
+func (h *Handlers) RevokeAuthSession(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	sessionID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid session ID",
+		})
+	}
+
+	if err := h.authService.RevokeSession(c.UserContext(), userID, sessionID); err != nil {
+		if errors.Is(err, auth.ErrSessionNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to revoke session",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "session revoked",
+	})
+}
+
+// SetupTwoFactor generates a TOTP secret for the user's authenticator app
+func (h *Handlers) SetupTwoFactor(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	setup, err := h.authService.SetupTwoFactor(c.UserContext(), userID)
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(setup)
+}
+
+// EnableTwoFactor enables two-factor authentication with a code from the
+// user's authenticator app and returns their recovery codes
+func (h *Handlers) EnableTwoFactor(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	codes, err := h.authService.EnableTwoFactor(c.UserContext(), userID, req.Code)
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"two_factor_enabled": true,
+		"recovery_codes":     codes,
+	})
+}
+
+// DisableTwoFactor disables two-factor authentication after checking the
+// user's password
+func (h *Handlers) DisableTwoFactor(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if err := h.authService.DisableTwoFactor(c.UserContext(), userID, req.Password); err != nil {
+		return twoFactorError(c, err)
+	}
 
 	return c.JSON(fiber.Map{
-		"access_token": accessToken,
+		"two_factor_enabled": false,
+	})
+}
+
+// twoFactorError maps two-factor setup errors to responses
+func twoFactorError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredentials), errors.Is(err, auth.ErrInvalidTwoFactorCode):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, auth.ErrTwoFactorEnabled), errors.Is(err, auth.ErrTwoFactorNotEnabled),
+		errors.Is(err, auth.ErrTwoFactorNotSetUp):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, auth.ErrTwoFactorUnavailable):
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, auth.ErrUserNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "user not found",
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "two-factor authentication request failed",
 	})
 }
 
@@ -130,9 +376,9 @@ func (h *Handlers) ListNodes(c *fiber.Ctx) error {
 
 	if protocol := c.Query("protocol"); protocol != "" {
 		if protocol == "wireguard" {
-			query = query.Where("supports_wireguard = ?", true)
+			query = query.Where("supports_wire_guard = ?", true)
 		} else if protocol == "openvpn" {
-			query = query.Where("supports_openvpn = ?", true)
+			query = query.Where("supports_open_vpn = ?", true)
 		}
 	}
 
@@ -151,25 +397,11 @@ func (h *Handlers) ListNodes(c *fiber.Ctx) error {
 
 // GetBestNode returns the best available node based on load and latency
 func (h *Handlers) GetBestNode(c *fiber.Ctx) error {
-	db := database.GetDB()
-
 	protocol := c.Query("protocol", "wireguard")
 	country := c.Query("country")
 
-	query := db.Where("is_active = ? AND status = ?", true, "online")
-
-	if country != "" {
-		query = query.Where("country_code = ?", country)
-	}
-
-	if protocol == "wireguard" {
-		query = query.Where("supports_wireguard = ?", true)
-	} else if protocol == "openvpn" {
-		query = query.Where("supports_openvpn = ?", true)
-	}
-
-	var node models.VPNNode
-	if err := query.Order("load_score ASC").First(&node).Error; err != nil {
+	node, err := h.sessionService.SelectNode(protocol, country)
+	if err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "no available nodes found",
 		})
@@ -192,9 +424,24 @@ func (h *Handlers) GetActiveSessions(c *fiber.Ctx) error {
 		})
 	}
 
+	// Clients of draining nodes are asked to reconnect elsewhere
+	migrate := fiber.Map{}
+	for i := range sessions {
+		hint, err := h.drains.MigrateHint(c.Context(), &sessions[i])
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to fetch sessions",
+			})
+		}
+		if hint != nil {
+			migrate[sessions[i].ID.String()] = hint
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"sessions": sessions,
 		"count":    len(sessions),
+		"migrate":  migrate,
 	})
 }
 
@@ -345,7 +592,7 @@ func (h *Handlers) CreateOperatorNode(c *fiber.Ctx) error {
 		})
 	}
 
-	node, publicKey, err := h.operatorService.CreateNode(c.Context(), op.ID, req)
+	node, joinToken, err := h.operatorService.CreateNode(c.Context(), op.ID, req)
 	if err != nil {
 		if appErr, ok := err.(*apperrors.AppError); ok {
 			return c.Status(appErr.StatusCode).JSON(fiber.Map{
@@ -359,13 +606,13 @@ func (h *Handlers) CreateOperatorNode(c *fiber.Ctx) error {
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"node":       node,
-		"public_key": publicKey,
-		"message":    "Node created successfully. Configure your node software with these credentials.",
+		"join_token": joinToken,
+		"message":    "Node created successfully. Start your node with JOIN_TOKEN set to the join token to enroll it.",
 	})
 }
 
-// GetOperatorNodes returns all nodes for an operator
-func (h *Handlers) GetOperatorNodes(c *fiber.Ctx) error {
+// IssueOperatorJoinToken issues a new join token for one of the operator's nodes
+func (h *Handlers) IssueOperatorJoinToken(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uuid.UUID)
 
 	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
@@ -375,21 +622,34 @@ func (h *Handlers) GetOperatorNodes(c *fiber.Ctx) error {
 		})
 	}
 
-	nodes, err := h.operatorService.GetOperatorNodes(c.Context(), op.ID)
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
+		})
+	}
+
+	token, record, err := h.operatorService.IssueJoinToken(c.UserContext(), op.ID, nodeID)
 	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to fetch nodes",
+			"error": "failed to issue join token",
 		})
 	}
 
-	return c.JSON(fiber.Map{
-		"nodes": nodes,
-		"count": len(nodes),
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"join_token": token,
+		"token":      record,
 	})
 }
 
-// GetOperatorStats returns comprehensive statistics for an operator
-func (h *Handlers) GetOperatorStats(c *fiber.Ctx) error {
+// DrainOperatorNode stops one of the operator's nodes from receiving new
+// sessions and puts it into maintenance once its clients have left
+func (h *Handlers) DrainOperatorNode(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uuid.UUID)
 
 	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
@@ -399,58 +659,40 @@ func (h *Handlers) GetOperatorStats(c *fiber.Ctx) error {
 		})
 	}
 
-	stats, err := h.operatorService.GetOperatorStats(c.Context(), op.ID)
+	nodeID, err := uuid.Parse(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to fetch stats",
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
 		})
 	}
 
-	return c.JSON(stats)
-}
-
-// GetOperatorEarnings returns earnings history
-func (h *Handlers) GetOperatorEarnings(c *fiber.Ctx) error {
-	userID := c.Locals("user_id").(uuid.UUID)
-
-	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
+	timeout, reason, err := parseDrainRequest(c)
 	if err != nil {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "You must be a registered operator",
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
 		})
 	}
 
-	// Parse pagination
-	limit := 50
-	offset := 0
-	if l := c.Query("limit"); l != "" {
-		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
-			limit = parsed
-		}
-	}
-	if o := c.Query("offset"); o != "" {
-		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
-			offset = parsed
-		}
-	}
-
-	earnings, total, err := h.operatorService.GetOperatorEarnings(c.Context(), op.ID, limit, offset)
+	drain, err := h.operatorService.DrainNode(c.UserContext(), op.ID, nodeID, timeout, reason)
 	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to fetch earnings",
+			"error": "failed to drain node",
 		})
 	}
 
-	return c.JSON(fiber.Map{
-		"earnings": earnings,
-		"total":    total,
-		"limit":    limit,
-		"offset":   offset,
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"drain": drain,
 	})
 }
 
-// GetOperatorPayouts returns payout history
-func (h *Handlers) GetOperatorPayouts(c *fiber.Ctx) error {
+// GetOperatorNodeDrain returns the drain progress of one of the operator's
+// nodes
+func (h *Handlers) GetOperatorNodeDrain(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uuid.UUID)
 
 	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
@@ -460,37 +702,31 @@ func (h *Handlers) GetOperatorPayouts(c *fiber.Ctx) error {
 		})
 	}
 
-	// Parse pagination
-	limit := 50
-	offset := 0
-	if l := c.Query("limit"); l != "" {
-		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
-			limit = parsed
-		}
-	}
-	if o := c.Query("offset"); o != "" {
-		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
-			offset = parsed
-		}
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
+		})
 	}
 
-	payouts, total, err := h.operatorService.GetOperatorPayouts(c.Context(), op.ID, limit, offset)
+	status, err := h.operatorService.NodeDrainStatus(c.UserContext(), op.ID, nodeID)
 	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to fetch payouts",
+			"error": "failed to fetch drain status",
 		})
 	}
 
-	return c.JSON(fiber.Map{
-		"payouts": payouts,
-		"total":   total,
-		"limit":   limit,
-		"offset":  offset,
-	})
+	return c.JSON(status)
 }
 
-// RequestOperatorPayout handles manual payout requests
-func (h *Handlers) RequestOperatorPayout(c *fiber.Ctx) error {
+// ResumeOperatorNode returns one of the operator's draining or maintenance
+// nodes to service
+func (h *Handlers) ResumeOperatorNode(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uuid.UUID)
 
 	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
@@ -500,25 +736,210 @@ func (h *Handlers) RequestOperatorPayout(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := h.operatorService.RequestPayout(c.Context(), op.ID); err != nil {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
+		})
+	}
+
+	if err := h.operatorService.ResumeNode(c.UserContext(), op.ID, nodeID); err != nil {
 		if appErr, ok := err.(*apperrors.AppError); ok {
 			return c.Status(appErr.StatusCode).JSON(fiber.Map{
 				"error": appErr.Message,
 			})
 		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to process payout request",
+			"error": "failed to resume node",
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Payout request submitted successfully. Processing may take 24-48 hours.",
+		"message": "node returned to service",
 	})
 }
 
-// GetOperatorDashboard returns comprehensive dashboard data
-func (h *Handlers) GetOperatorDashboard(c *fiber.Ctx) error {
-	userID := c.Locals("user_id").(uuid.UUID)
+// parseDrainRequest reads the optional drain timeout, a duration such as
+// "45m", and reason from the request body
+func parseDrainRequest(c *fiber.Ctx) (time.Duration, string, error) {
+	var req struct {
+		Timeout string `json:"timeout"`
+		Reason  string `json:"reason"`
+	}
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return 0, "", errors.New("invalid request body")
+		}
+	}
+
+	var timeout time.Duration
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 {
+			return 0, "", errors.New("timeout must be a positive duration such as 30m")
+		}
+		timeout = d
+	}
+
+	return timeout, req.Reason, nil
+}
+
+// GetOperatorNodes returns all nodes for an operator
+func (h *Handlers) GetOperatorNodes(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You must be a registered operator",
+		})
+	}
+
+	nodes, err := h.operatorService.GetOperatorNodes(c.Context(), op.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch nodes",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"nodes": nodes,
+		"count": len(nodes),
+	})
+}
+
+// GetOperatorStats returns comprehensive statistics for an operator
+func (h *Handlers) GetOperatorStats(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You must be a registered operator",
+		})
+	}
+
+	stats, err := h.operatorService.GetOperatorStats(c.Context(), op.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch stats",
+		})
+	}
+
+	return c.JSON(stats)
+}
+
+// GetOperatorEarnings returns earnings history
+func (h *Handlers) GetOperatorEarnings(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You must be a registered operator",
+		})
+	}
+
+	// Parse pagination
+	limit := 50
+	offset := 0
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	earnings, total, err := h.operatorService.GetOperatorEarnings(c.Context(), op.ID, limit, offset)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch earnings",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"earnings": earnings,
+		"total":    total,
+		"limit":    limit,
+		"offset":   offset,
+	})
+}
+
+// GetOperatorPayouts returns payout history
+func (h *Handlers) GetOperatorPayouts(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You must be a registered operator",
+		})
+	}
+
+	// Parse pagination
+	limit := 50
+	offset := 0
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	payouts, total, err := h.operatorService.GetOperatorPayouts(c.Context(), op.ID, limit, offset)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch payouts",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"payouts": payouts,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// RequestOperatorPayout handles manual payout requests
+func (h *Handlers) RequestOperatorPayout(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You must be a registered operator",
+		})
+	}
+
+	if err := h.operatorService.RequestPayout(c.Context(), op.ID); err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to process payout request",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Payout request submitted successfully. Processing may take 24-48 hours.",
+	})
+}
+
+// GetOperatorDashboard returns comprehensive dashboard data
+func (h *Handlers) GetOperatorDashboard(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
 
 	op, err := h.operatorService.GetOperatorByUserID(c.Context(), userID)
 	if err != nil {
@@ -573,6 +994,165 @@ func (h *Handlers) VerifyOperator(c *fiber.Ctx) error {
 	})
 }
 
+// IssueNodeJoinToken issues a new join token for a node (admin only). Earlier
+// unused tokens for the node are revoked.
+func (h *Handlers) IssueNodeJoinToken(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
+		})
+	}
+
+	token, record, err := h.enrollments.IssueToken(c.UserContext(), nodeID, &userID)
+	if err != nil {
+		if errors.Is(err, enrollment.ErrNodeNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to issue join token",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"join_token": token,
+		"token":      record,
+	})
+}
+
+// ListNodeJoinTokens lists the join tokens issued for a node (admin only)
+func (h *Handlers) ListNodeJoinTokens(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
+		})
+	}
+
+	tokens, err := h.enrollments.ListTokens(c.UserContext(), nodeID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch join tokens",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"tokens": tokens,
+		"count":  len(tokens),
+	})
+}
+
+// RevokeJoinToken revokes an unused join token (admin only)
+func (h *Handlers) RevokeJoinToken(c *fiber.Ctx) error {
+	tokenID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid token ID",
+		})
+	}
+
+	if err := h.enrollments.RevokeToken(c.UserContext(), tokenID); err != nil {
+		if errors.Is(err, enrollment.ErrTokenNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to revoke join token",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "join token revoked",
+	})
+}
+
+// DrainNode stops a node from receiving new sessions and puts it into
+// maintenance once its clients have left or the timeout passed (admin only)
+func (h *Handlers) DrainNode(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
+		})
+	}
+
+	timeout, reason, err := parseDrainRequest(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	drain, err := h.drains.Drain(c.UserContext(), nodeID, timeout, reason, &userID)
+	if err != nil {
+		return drainErrorResponse(c, err, "failed to drain node")
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"drain": drain,
+	})
+}
+
+// GetNodeDrain returns the drain progress of a node (admin only)
+func (h *Handlers) GetNodeDrain(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
+		})
+	}
+
+	status, err := h.drains.Status(c.UserContext(), nodeID)
+	if err != nil {
+		return drainErrorResponse(c, err, "failed to fetch drain status")
+	}
+
+	return c.JSON(status)
+}
+
+// ResumeNode returns a draining or maintenance node to service (admin only)
+func (h *Handlers) ResumeNode(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid node ID",
+		})
+	}
+
+	if err := h.drains.Resume(c.UserContext(), nodeID); err != nil {
+		return drainErrorResponse(c, err, "failed to resume node")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "node returned to service",
+	})
+}
+
+// drainErrorResponse writes the response for a maintenance error
+func drainErrorResponse(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, maintenance.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, maintenance.ErrAlreadyDraining), errors.Is(err, maintenance.ErrNotDraining):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+}
+
 // ReadinessCheck performs a comprehensive readiness check
 func (h *Handlers) ReadinessCheck(c *fiber.Ctx) error {
 	// Check database connection
@@ -656,25 +1236,263 @@ func (h *Handlers) GetNode(c *fiber.Ctx) error {
 
 // CreateSession creates a new VPN session
 func (h *Handlers) CreateSession(c *fiber.Ctx) error {
-	return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
-		"error": "create session not implemented yet",
-	})
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	var req session.CreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+	req.ClientIP = c.IP()
+
+	result, err := h.sessionService.Create(c.Context(), userID, req)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error":   appErr.Message,
+				"code":    appErr.Code,
+				"details": appErr.Details,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to create session",
+		})
+	}
+
+	metrics.ConnectionsTotal.WithLabelValues(result.Session.Protocol, result.Node.Name, "success").Inc()
+
+	response := fiber.Map{
+		"session": result.Session,
+		"node":    result.Node,
+		"config":  result.Config,
+	}
+	if len(result.Evicted) > 0 {
+		response["evicted"] = result.Evicted
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(response)
 }
 
 // DisconnectSession disconnects an active VPN session
 func (h *Handlers) DisconnectSession(c *fiber.Ctx) error {
-	return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
-		"error": "disconnect session not implemented yet",
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	sessionID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid session ID",
+		})
+	}
+
+	sess, err := h.sessionService.Disconnect(c.Context(), userID, sessionID)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to disconnect session",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Session disconnected successfully",
+		"session_id":       sess.ID,
+		"duration_seconds": int64(sess.Duration().Seconds()),
+		"data_used_gb":     sess.DataUsedGB,
 	})
 }
 
 // GetSession returns session details
 func (h *Handlers) GetSession(c *fiber.Ctx) error {
-	return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
-		"error": "get session not implemented yet",
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	sessionID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid session ID",
+		})
+	}
+
+	sess, err := h.sessionService.Get(c.Context(), userID, sessionID)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch session",
+		})
+	}
+
+	response := fiber.Map{
+		"session":          sess,
+		"node":             sess.Node,
+		"duration_seconds": int64(sess.Duration().Seconds()),
+	}
+
+	// Tell clients of a draining node to reconnect elsewhere
+	if sess.Status == "active" {
+		hint, err := h.drains.MigrateHint(c.Context(), sess)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to fetch session",
+			})
+		}
+		if hint != nil {
+			response["migrate"] = hint
+		}
+	}
+
+	return c.JSON(response)
+}
+
+// ListPlans lists the subscription plans
+func (h *Handlers) ListPlans(c *fiber.Ctx) error {
+	catalog, err := h.plans.List(c.Context())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch plans",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"plans": catalog,
+	})
+}
+
+// GetUserPlan returns the plan the user is currently entitled to
+func (h *Handlers) GetUserPlan(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	user, plan, err := h.plans.ForUser(c.Context(), userID)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch plan",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"plan":                plan,
+		"subscription_expiry": user.SubscriptionExpiry,
+		"data_transferred_gb": user.DataTransferredGB,
+	})
+}
+
+// GetUserQuota returns the user's data usage in the current billing cycle
+func (h *Handlers) GetUserQuota(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	usage, err := h.quota.Usage(c.Context(), userID)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch usage",
+		})
+	}
+
+	return c.JSON(usage)
+}
+
+// GetPaymentCurrencies lists the cryptocurrencies subscriptions can be paid with
+func (h *Handlers) GetPaymentCurrencies(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"cryptocurrencies": h.payments.GetSupportedCryptocurrencies(),
 	})
 }
 
+// CreatePayment creates a cryptocurrency payment for a subscription
+func (h *Handlers) CreatePayment(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	var req struct {
+		Cryptocurrency   string `json:"cryptocurrency"`
+		SubscriptionTier string `json:"subscription_tier"`
+		DurationMonths   int    `json:"duration_months"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	p, err := h.payments.CreatePayment(c.Context(), userID, req.Cryptocurrency, req.SubscriptionTier, req.DurationMonths)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to create payment",
+		})
+	}
+
+	qrCode, _ := h.payments.GetPaymentQRCode(p)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"payment": p,
+		"qr_code": qrCode,
+		"invoice": h.payments.GenerateInvoice(p),
+	})
+}
+
+// ListPayments returns the user's payment history
+func (h *Handlers) ListPayments(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	payments, err := h.payments.GetPaymentHistory(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch payments",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"payments": payments,
+		"count":    len(payments),
+	})
+}
+
+// GetPayment returns one of the user's payments and its status
+func (h *Handlers) GetPayment(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	paymentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid payment ID",
+		})
+	}
+
+	p, err := h.payments.GetPayment(c.Context(), userID, paymentID)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error": appErr.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch payment",
+		})
+	}
+
+	return c.JSON(p)
+}
+
 // GenerateConfig generates VPN configuration
 func (h *Handlers) GenerateConfig(c *fiber.Ctx) error {
 	var req struct {
@@ -694,35 +1512,54 @@ func (h *Handlers) GenerateConfig(c *fiber.Ctx) error {
 		})
 	}
 
-	// Call the peer registration script
-	cmd := exec.Command("/opt/aureo-vpn/add-wireguard-peer.sh", req.PublicKey)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": fmt.Sprintf("failed to register peer: %s", string(output)),
-		})
+	createReq := session.CreateRequest{
+		Protocol:  "wireguard",
+		PublicKey: req.PublicKey,
+		ClientIP:  c.IP(),
 	}
 
-	// Parse JSON output from script
-	var config map[string]interface{}
-	outputStr := string(output)
+	if req.NodeID != "" {
+		nodeID, err := uuid.Parse(req.NodeID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid node ID",
+			})
+		}
+		createReq.NodeID = &nodeID
+	}
+
+	userID := c.Locals("user_id").(uuid.UUID)
 
-	// Find JSON start
-	jsonStart := strings.Index(outputStr, "{")
-	if jsonStart == -1 {
+	result, err := h.sessionService.Create(c.Context(), userID, createReq)
+	if err != nil {
+		if appErr, ok := err.(*apperrors.AppError); ok {
+			return c.Status(appErr.StatusCode).JSON(fiber.Map{
+				"error":   appErr.Message,
+				"code":    appErr.Code,
+				"details": appErr.Details,
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to parse configuration",
+			"error": "failed to register peer",
 		})
 	}
 
-	jsonStr := outputStr[jsonStart:]
-	if err := json.Unmarshal([]byte(jsonStr), &config); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to parse configuration",
-		})
+	metrics.ConnectionsTotal.WithLabelValues(result.Session.Protocol, result.Node.Name, "success").Inc()
+
+	response := fiber.Map{
+		"session_id":        result.Session.ID,
+		"node_id":           result.Node.ID,
+		"client_ip":         result.Config.ClientIP,
+		"dns":               result.Config.DNS,
+		"server_public_key": result.Config.ServerPublicKey,
+		"server_endpoint":   result.Config.ServerEndpoint,
+		"allowed_ips":       result.Config.AllowedIPs,
+	}
+	if len(result.Evicted) > 0 {
+		response["evicted"] = result.Evicted
 	}
 
-	return c.JSON(config)
+	return c.JSON(response)
 }
 
 // GetConfig returns a specific configuration
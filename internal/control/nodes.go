@@ -0,0 +1,291 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+	"gorm.io/gorm"
+)
+
+// heldStatuses are node statuses heartbeats do not reset to online
+var heldStatuses = []string{"degraded", "draining", "maintenance"}
+
+// Register records the WireGuard public key, node API port and protocols a
+// node started with. Nodes keep their private key, so any key stored by earlier
+// versions is dropped.
+func (s *Server) Register(ctx context.Context, nodeID uuid.UUID, req controlapi.RegisterRequest) error {
+	protocols := req.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{controlapi.ProtocolWireGuard}
+	}
+
+	// An API port of 0 is stored too: it marks the node API as disabled.
+	// Protocols the node does not report are neither offered nor probed.
+	updates := map[string]interface{}{
+		"public_key":            req.PublicKey,
+		"private_key_encrypted": "",
+		"api_port":              req.APIPort,
+		"supports_wire_guard":   slices.Contains(protocols, controlapi.ProtocolWireGuard),
+		"supports_open_vpn":     slices.Contains(protocols, controlapi.ProtocolOpenVPN),
+	}
+
+	if err := s.db.WithContext(ctx).Model(&models.VPNNode{}).Where("id = ?", nodeID).
+		Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to register node: %w", err)
+	}
+	return nil
+}
+
+// Heartbeat marks a node online and refreshes its operator's node stats.
+// Degraded nodes stay degraded until they pass a health probe, and draining
+// and maintenance nodes until they are returned to service. Heartbeats
+// carrying host telemetry update the node's CPU and memory usage, rescore it
+// right away and add a sample to its performance metrics.
+func (s *Server) Heartbeat(ctx context.Context, nodeID uuid.UUID, hb controlapi.Heartbeat) error {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"last_heartbeat":      now,
+		"status":              gorm.Expr("CASE WHEN status IN ? THEN status ELSE ? END", heldStatuses, "online"),
+		"current_connections": hb.Connections,
+	}
+	if hb.Telemetry != nil {
+		updates["cpu_usage"] = hb.Telemetry.CPUPercent
+		updates["memory_usage"] = hb.Telemetry.MemoryPercent
+	}
+
+	if err := s.db.WithContext(ctx).Model(&models.VPNNode{}).Where("id = ?", nodeID).
+		Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to record heartbeat: %w", err)
+	}
+
+	var node models.VPNNode
+	if err := s.db.WithContext(ctx).First(&node, nodeID).Error; err != nil {
+		return fmt.Errorf("failed to load node: %w", err)
+	}
+
+	if hb.Telemetry != nil {
+		node.LoadScore = node.CalculateLoadScore()
+		if err := s.db.WithContext(ctx).Model(&node).UpdateColumn("load_score", node.LoadScore).Error; err != nil {
+			return fmt.Errorf("failed to update load score: %w", err)
+		}
+		if err := s.recordMetric(ctx, &node, hb, now); err != nil {
+			return err
+		}
+	}
+
+	if node.OperatorID != nil {
+		var operator models.NodeOperator
+		if err := s.db.WithContext(ctx).First(&operator, node.OperatorID).Error; err == nil {
+			operator.UpdateStats(s.db)
+		}
+	}
+
+	return nil
+}
+
+// recordMetric adds the telemetry of a heartbeat to the node's performance
+// metrics
+func (s *Server) recordMetric(ctx context.Context, node *models.VPNNode, hb controlapi.Heartbeat, at time.Time) error {
+	t := hb.Telemetry
+	at = at.UTC()
+
+	metric := &models.NodePerformanceMetric{
+		ID:                uuid.New(),
+		NodeID:            node.ID,
+		MetricDate:        at.Truncate(24 * time.Hour),
+		Hour:              at.Hour(),
+		UptimeMinutes:     int(t.UptimeSeconds / 60),
+		ConnectionsServed: hb.Connections,
+		SampledAt:         at,
+		HeartbeatVersion:  hb.Version,
+		CPUUsage:          t.CPUPercent,
+		MemoryUsage:       t.MemoryPercent,
+		LoadAverage1:      t.Load1,
+		LoadAverage5:      t.Load5,
+		LoadAverage15:     t.Load15,
+		RxMbps:            t.RxMbps,
+		TxMbps:            t.TxMbps,
+		ConntrackCount:    t.ConntrackCount,
+		ConntrackMax:      t.ConntrackMax,
+		Peers:             t.Peers,
+		ActivePeers:       t.ActivePeers,
+		LoadScore:         node.LoadScore,
+	}
+	if err := s.db.WithContext(ctx).Create(metric).Error; err != nil {
+		return fmt.Errorf("failed to record performance metric: %w", err)
+	}
+	return nil
+}
+
+// Sessions returns a node's active sessions with the bandwidth limit of each
+// peer, or only the session using publicKey if it is set
+func (s *Server) Sessions(ctx context.Context, nodeID uuid.UUID, publicKey string) ([]controlapi.Session, error) {
+	query := s.db.WithContext(ctx).Where("node_id = ? AND status = ?", nodeID, "active")
+	if publicKey != "" {
+		query = query.Where("public_key = ?", publicKey)
+	}
+
+	var sessions []models.Session
+	if err := query.Find(&sessions).Error; err != nil {
+		return nil, fmt.Errorf("failed to load sessions: %w", err)
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	var userIDs []uuid.UUID
+	for _, sess := range sessions {
+		if !seen[sess.UserID] {
+			seen[sess.UserID] = true
+			userIDs = append(userIDs, sess.UserID)
+		}
+	}
+
+	userPlans, err := s.plans.ForUsers(ctx, userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load plans: %w", err)
+	}
+
+	result := make([]controlapi.Session, 0, len(sessions))
+	for i := range sessions {
+		result = append(result, nodeSession(&sessions[i], userPlans[sessions[i].UserID]))
+	}
+	return result, nil
+}
+
+// Keepalives records the latest handshakes of a node's sessions
+func (s *Server) Keepalives(ctx context.Context, nodeID uuid.UUID, keepalives []controlapi.Keepalive) error {
+	for _, k := range keepalives {
+		if err := s.db.WithContext(ctx).Model(&models.Session{}).
+			Where("id = ? AND node_id = ? AND status = ?", k.SessionID, nodeID, "active").
+			UpdateColumn("last_keepalive", k.At).Error; err != nil {
+			return fmt.Errorf("failed to update keepalive of session %s: %w", k.SessionID, err)
+		}
+	}
+	return nil
+}
+
+// EndSession ends an active session on a node and settles its earnings. The
+// node has already removed the peer.
+func (s *Server) EndSession(ctx context.Context, nodeID, sessionID uuid.UUID, status string) error {
+	var sess models.Session
+	if err := s.db.WithContext(ctx).Where("id = ? AND node_id = ? AND status = ?", sessionID, nodeID, "active").
+		First(&sess).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return controlapi.ErrSessionNotFound
+		}
+		return fmt.Errorf("failed to load session: %w", err)
+	}
+
+	if err := s.sessions.End(ctx, &sess, status); err != nil {
+		if apperrors.Is(err, session.ErrSessionNotActive) {
+			return controlapi.ErrSessionNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// LimitSession records a throttle on the active session using publicKey and
+// returns the session with its resulting bandwidth limit
+func (s *Server) LimitSession(ctx context.Context, nodeID uuid.UUID, publicKey string, rateKbps int) (*controlapi.Session, error) {
+	var sess models.Session
+	if err := s.db.WithContext(ctx).Where("node_id = ? AND public_key = ? AND status = ?", nodeID, publicKey, "active").
+		First(&sess).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, controlapi.ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("failed to load session: %w", err)
+	}
+
+	if err := s.db.WithContext(ctx).Model(&sess).UpdateColumn("rate_limit_kbps", rateKbps).Error; err != nil {
+		return nil, fmt.Errorf("failed to save rate limit: %w", err)
+	}
+	sess.RateLimitKbps = rateKbps
+
+	_, plan, err := s.plans.ForUser(ctx, sess.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := nodeSession(&sess, plan)
+	return &result, nil
+}
+
+// ReportTraffic adds a node's traffic to its sessions, rolls it into each
+// user's lifetime and billing cycle totals and updates the node's bandwidth.
+// Traffic reported for sessions of other nodes is ignored.
+func (s *Server) ReportTraffic(ctx context.Context, nodeID uuid.UUID, report controlapi.TrafficReport) error {
+	const gb = 1024 * 1024 * 1024
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, t := range report.Sessions {
+			var sess models.Session
+			if err := tx.Select("id", "user_id").Where("id = ? AND node_id = ?", t.SessionID, nodeID).
+				First(&sess).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					continue
+				}
+				return err
+			}
+
+			bytes := t.BytesSent + t.BytesReceived
+			if err := tx.Model(&models.Session{}).Where("id = ?", sess.ID).UpdateColumns(map[string]interface{}{
+				"bytes_sent":     gorm.Expr("bytes_sent + ?", t.BytesSent),
+				"bytes_received": gorm.Expr("bytes_received + ?", t.BytesReceived),
+				"data_used_gb":   gorm.Expr("(bytes_sent + bytes_received + ?) / ?", bytes, float64(gb)),
+			}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&models.User{}).Where("id = ?", sess.UserID).UpdateColumns(map[string]interface{}{
+				"data_transferred_gb": gorm.Expr("data_transferred_gb + ?", float64(bytes)/gb),
+				"cycle_data_gb":       gorm.Expr("cycle_data_gb + ?", float64(bytes)/gb),
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&models.VPNNode{}).Where("id = ?", nodeID).UpdateColumns(map[string]interface{}{
+			"bandwidth_usage_gbps": report.BandwidthMbps / 1000.0, // Convert Mbps to Gbps
+			"total_bandwidth_kb":   gorm.Expr("total_bandwidth_kb + ?", report.Bytes/1024),
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record traffic: %w", err)
+	}
+	return nil
+}
+
+// nodeSession returns what a node needs to know about a session. plan is the
+// user's plan, nil if unknown.
+func nodeSession(sess *models.Session, plan *models.Plan) controlapi.Session {
+	return controlapi.Session{
+		ID:            sess.ID,
+		UserID:        sess.UserID,
+		Protocol:      sess.Protocol,
+		PublicKey:     sess.PublicKey,
+		TunnelIP:      sess.TunnelIP,
+		LastKeepalive: sess.LastKeepalive,
+		RateKbps:      sessionRate(sess, plan),
+	}
+}
+
+// sessionRate returns the bandwidth limit for a session in kbit/s, 0 if
+// unlimited: the plan's speed, or less if the session was throttled
+func sessionRate(sess *models.Session, plan *models.Plan) int {
+	rate := 0
+	if plan != nil {
+		rate = plan.SpeedLimitKbps()
+	}
+	if sess.RateLimitKbps > 0 && (rate == 0 || sess.RateLimitKbps < rate) {
+		rate = sess.RateLimitKbps
+	}
+	return rate
+}
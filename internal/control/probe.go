@@ -0,0 +1,211 @@
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/models"
+)
+
+const (
+	// DefaultProbeTimeout bounds each probe of a node
+	DefaultProbeTimeout = 5 * time.Second
+
+	// DefaultProbeFailureThreshold is how many health checks in a row a node
+	// may fail before it is marked degraded
+	DefaultProbeFailureThreshold = 3
+
+	// maxConcurrentProbes limits how many nodes are probed at once
+	maxConcurrentProbes = 16
+
+	// udpProbeWait is how long to wait for a reply or the ICMP error a
+	// closed UDP port answers with
+	udpProbeWait = time.Second
+
+	// handshakeInitiationSize is the size of a WireGuard handshake initiation
+	handshakeInitiationSize = 148
+
+	// openVPNHardResetClient is the opcode of the packet an OpenVPN client
+	// opens a session with, P_CONTROL_HARD_RESET_CLIENT_V2
+	openVPNHardResetClient = 7
+)
+
+// probedStatuses are the node statuses probes move between
+var probedStatuses = []string{"online", "degraded"}
+
+// probeFunc probes a node, returning the lowest round trip measured
+type probeFunc func(ctx context.Context, node *models.VPNNode) (time.Duration, error)
+
+// probeNodes probes nodes and updates their latency and status. Nodes
+// failing the configured number of consecutive probes are degraded until a
+// probe succeeds again.
+func (s *Server) probeNodes(nodes []models.VPNNode) {
+	sem := make(chan struct{}, maxConcurrentProbes)
+	var wg sync.WaitGroup
+
+	for i := range nodes {
+		node := &nodes[i]
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			rtt, err := s.probe(s.ctx, node)
+			s.recordProbe(node, rtt, err)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// recordProbe stores the outcome of probing a node
+func (s *Server) recordProbe(node *models.VPNNode, rtt time.Duration, probeErr error) {
+	updates := map[string]interface{}{
+		"last_health_check": time.Now(),
+	}
+
+	status := "online"
+	if probeErr == nil {
+		if rtt > 0 {
+			updates["latency"] = int(rtt.Milliseconds())
+		}
+		updates["probe_failures"] = 0
+		updates["last_probe_error"] = ""
+	} else {
+		failures := node.ProbeFailures + 1
+		updates["probe_failures"] = failures
+		updates["last_probe_error"] = probeErr.Error()
+		if failures >= s.config.ProbeFailureThreshold {
+			status = "degraded"
+		}
+	}
+	updates["status"] = status
+
+	// Nodes drained or taken offline while the probe ran keep their status
+	previous := node.Status
+	result := s.db.Model(node).Where("status IN ?", probedStatuses).Updates(updates)
+	if result.Error != nil {
+		log.Printf("Failed to record probe of node %s: %v", node.Name, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	switch {
+	case status == previous:
+	case status == "degraded":
+		log.Printf("Node %s marked as degraded after %d failed probes: %v", node.Name, s.config.ProbeFailureThreshold, probeErr)
+	case previous == "degraded":
+		log.Printf("Node %s recovered", node.Name)
+	default:
+		log.Printf("Node %s is back online", node.Name)
+	}
+}
+
+// probeNode checks the UDP ports of the protocols a node reported serving
+// and, if the control server holds the node API key and the node serves the
+// API, its authenticated health endpoint
+func (s *Server) probeNode(ctx context.Context, node *models.VPNNode) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.ProbeTimeout)
+	defer cancel()
+
+	var rtt time.Duration
+	measured := func(d time.Duration) {
+		if rtt == 0 || d < rtt {
+			rtt = d
+		}
+	}
+
+	if node.SupportsWireGuard {
+		if _, err := probeUDP(ctx, net.JoinHostPort(node.PublicIP, strconv.Itoa(node.WireGuardPort)), wireGuardProbe()); err != nil {
+			return 0, fmt.Errorf("wireguard: %w", err)
+		}
+	}
+
+	if node.SupportsOpenVPN {
+		d, err := probeUDP(ctx, net.JoinHostPort(node.PublicIP, strconv.Itoa(node.OpenVPNPort)), openVPNProbe())
+		if err != nil {
+			return 0, fmt.Errorf("openvpn: %w", err)
+		}
+		if d > 0 {
+			measured(d)
+		}
+	}
+
+	if s.nodeAPI != nil && node.APIPort != 0 {
+		start := time.Now()
+		if _, err := s.nodeAPI.Health(ctx, node); err != nil {
+			return 0, fmt.Errorf("health: %w", err)
+		}
+		measured(time.Since(start))
+	}
+
+	return rtt, nil
+}
+
+// wireGuardProbe returns a WireGuard handshake initiation: message type 1
+// with three reserved zero bytes, then a random sender index and payload
+// that fail the responder's MAC check
+func wireGuardProbe() []byte {
+	msg := make([]byte, handshakeInitiationSize)
+	rand.Read(msg[4:])
+	msg[0] = 1
+	return msg
+}
+
+// openVPNProbe returns an OpenVPN client hard reset with a random session
+// ID, no acknowledgements and packet ID 0
+func openVPNProbe() []byte {
+	msg := make([]byte, 14)
+	msg[0] = openVPNHardResetClient << 3
+	rand.Read(msg[1:9])
+	return msg
+}
+
+// probeUDP sends msg to addr. VPN servers may silently drop packets they
+// cannot authenticate, so the port only counts as unreachable when the host
+// answers with an ICMP port unreachable error. The round trip is returned
+// when the server replies, and 0 when it stays silent.
+func probeUDP(ctx context.Context, addr string, msg []byte) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(udpProbeWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	start := time.Now()
+	if _, err := conn.Write(msg); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 64)
+	if _, err := conn.Read(buf); err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return 0, fmt.Errorf("port unreachable")
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return time.Since(start), nil
+}
@@ -2,40 +2,130 @@ package control
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/enrollment"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/maintenance"
 	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/nodeapi"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"github.com/nikola43/aureo-vpn/pkg/rewards"
+	"github.com/nikola43/aureo-vpn/pkg/session"
 	"gorm.io/gorm"
 )
 
 // Server manages the control plane for VPN infrastructure
 type Server struct {
-	db     *gorm.DB
-	ctx    context.Context
-	cancel context.CancelFunc
+	db          *gorm.DB
+	config      Config
+	enrollments *enrollment.Service
+	sessions    *session.Service
+	drains      *maintenance.Service
+	rewards     *rewards.RewardService
+	plans       *plans.Service
+	apiServer   *controlapi.Server
+	nodeAPI     *nodeapi.Client
+	probe       probeFunc
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
+// Config holds the control server configuration
+type Config struct {
+	// APIPort is the port of the control API nodes enroll and report through
+	APIPort int
+
+	// Authority signs node certificates and control API responses
+	Authority *controlapi.Authority
+
+	// EarningsInterval is the checkpoint period for earnings of running sessions
+	EarningsInterval time.Duration
+
+	// MetricsRetention is how long node performance samples are kept
+	MetricsRetention time.Duration
+
+	// NodeAPI probes the authenticated health endpoint of nodes. Only their
+	// VPN ports are probed when nil.
+	NodeAPI *nodeapi.Client
+
+	// ProbeTimeout bounds each health probe of a node, and nodes failing
+	// ProbeFailureThreshold probes in a row are marked degraded
+	ProbeTimeout          time.Duration
+	ProbeFailureThreshold int
+}
+
+const (
+	// DefaultEarningsInterval is how often long sessions accrue operator earnings
+	DefaultEarningsInterval = time.Hour
+
+	// DefaultMetricsRetention keeps a week of node performance samples
+	DefaultMetricsRetention = 7 * 24 * time.Hour
+)
+
 // NewServer creates a new control server
-func NewServer() *Server {
+func NewServer(cfg Config) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Server{
-		db:     database.GetDB(),
-		ctx:    ctx,
-		cancel: cancel,
+	if cfg.APIPort == 0 {
+		cfg.APIPort = controlapi.DefaultPort
+	}
+	if cfg.EarningsInterval <= 0 {
+		cfg.EarningsInterval = DefaultEarningsInterval
+	}
+	if cfg.MetricsRetention <= 0 {
+		cfg.MetricsRetention = DefaultMetricsRetention
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = DefaultProbeTimeout
+	}
+	if cfg.ProbeFailureThreshold <= 0 {
+		cfg.ProbeFailureThreshold = DefaultProbeFailureThreshold
 	}
+
+	s := &Server{
+		db:          database.GetDB(),
+		config:      cfg,
+		enrollments: enrollment.NewService(logger.Global(), 0),
+		rewards:     rewards.NewRewardService(logger.Global(), nil),
+		plans:       plans.NewService(),
+		nodeAPI:     cfg.NodeAPI,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	// Nodes end the sessions they disconnect through the control API after
+	// removing the peer themselves, and the control server settles earnings
+	s.sessions = session.NewService(logger.Global(), nil, s.rewards, s.plans, "")
+	s.drains = maintenance.NewService(logger.Global(), s.sessions)
+	s.apiServer = controlapi.NewServer(s, cfg.Authority)
+	s.probe = s.probeNode
+
+	return s
 }
 
 // Start starts the control server
 func (s *Server) Start() error {
 	log.Println("Starting Control Server...")
 
+	go func() {
+		if err := s.apiServer.ListenAndServe(fmt.Sprintf(":%d", s.config.APIPort)); err != nil {
+			log.Printf("Control API stopped: %v", err)
+		}
+	}()
+	log.Printf("Control API listening on port %d", s.config.APIPort)
+
 	// Start background tasks
 	go s.healthCheckLoop()
 	go s.loadBalancerLoop()
 	go s.cleanupLoop()
+	go s.earningsLoop()
+	go s.drainLoop()
 
 	log.Println("Control Server started successfully")
 	return nil
@@ -45,7 +135,41 @@ func (s *Server) Start() error {
 func (s *Server) Stop() error {
 	log.Println("Stopping Control Server...")
 	s.cancel()
-	return nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.apiServer.Shutdown(ctx)
+}
+
+// Enroll redeems a node's join token for its identity
+func (s *Server) Enroll(ctx context.Context, token, identityKey string) (uuid.UUID, error) {
+	node, err := s.enrollments.Redeem(ctx, token, identityKey)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return node.ID, nil
+}
+
+// IdentityKey returns the identity key of an active enrolled node. Deleted
+// and deactivated nodes have none.
+func (s *Server) IdentityKey(ctx context.Context, nodeID uuid.UUID) (string, error) {
+	var node models.VPNNode
+	err := s.db.WithContext(ctx).Select("identity_key").
+		Where("id = ? AND is_active = ?", nodeID, true).
+		First(&node).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	return node.IdentityKey, err
+}
+
+// Node returns a node's record
+func (s *Server) Node(ctx context.Context, nodeID uuid.UUID) (*models.VPNNode, error) {
+	var node models.VPNNode
+	if err := s.db.WithContext(ctx).First(&node, nodeID).Error; err != nil {
+		return nil, err
+	}
+	return &node, nil
 }
 
 // healthCheckLoop performs periodic health checks on all nodes
@@ -58,34 +182,42 @@ func (s *Server) healthCheckLoop() {
 		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
-			s.performHealthChecks()
+			s.CheckHealth()
 		}
 	}
 }
 
-func (s *Server) performHealthChecks() {
+// CheckHealth marks nodes without a recent heartbeat offline and
+// actively probes the others
+func (s *Server) CheckHealth() {
 	var nodes []models.VPNNode
 	s.db.Where("is_active = ?", true).Find(&nodes)
 
+	var alive []models.VPNNode
 	for _, node := range nodes {
+		// Draining nodes keep their status until they go into maintenance,
+		// and nodes in maintenance until they are returned to service
+		if node.Status == "draining" || node.Status == "maintenance" {
+			continue
+		}
+
 		// Check if node is healthy based on last heartbeat
 		if time.Since(node.LastHeartbeat) > 2*time.Minute {
-			// Mark node as offline
-			s.db.Model(&node).Updates(map[string]interface{}{
-				"status": "offline",
-			})
-			log.Printf("Node %s marked as offline (no heartbeat)", node.Name)
-		} else if node.Status != "online" {
-			// Mark node as online if it was offline but is now sending heartbeats
-			s.db.Model(&node).Updates(map[string]interface{}{
-				"status": "online",
-			})
-			log.Printf("Node %s is back online", node.Name)
+			if node.Status != "offline" {
+				log.Printf("Node %s marked as offline (no heartbeat)", node.Name)
+			}
+			s.db.Model(&node).Where("status NOT IN ?", []string{"draining", "maintenance"}).
+				Updates(map[string]interface{}{
+					"status":            "offline",
+					"last_health_check": time.Now(),
+				})
+			continue
 		}
-
-		// Update last health check time
-		s.db.Model(&node).UpdateColumn("last_health_check", time.Now())
+		alive = append(alive, node)
 	}
+
+	// A node sending heartbeats may still fail to carry traffic
+	s.probeNodes(alive)
 }
 
 // loadBalancerLoop periodically updates load scores for nodes
@@ -121,6 +253,55 @@ func (s *Server) updateLoadScores() {
 	}
 }
 
+// earningsLoop periodically records operator earnings for long sessions
+func (s *Server) earningsLoop() {
+	ticker := time.NewTicker(s.config.EarningsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkpointEarnings()
+		}
+	}
+}
+
+// checkpointEarnings records earnings for the sessions of operator-owned
+// nodes. Nodes only report traffic, so they cannot settle their own earnings.
+func (s *Server) checkpointEarnings() {
+	var nodeIDs []uuid.UUID
+	if err := s.db.Model(&models.VPNNode{}).Where("operator_id IS NOT NULL").Pluck("id", &nodeIDs).Error; err != nil {
+		log.Printf("Failed to load operator nodes: %v", err)
+		return
+	}
+
+	for _, nodeID := range nodeIDs {
+		if err := s.rewards.CheckpointNode(s.ctx, nodeID, s.config.EarningsInterval); err != nil {
+			log.Printf("Failed to checkpoint earnings of node %s: %v", nodeID, err)
+		}
+	}
+}
+
+// drainLoop puts draining nodes into maintenance once their sessions have
+// left or their deadline passed
+func (s *Server) drainLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.drains.ProcessDrains(s.ctx); err != nil {
+				log.Printf("Failed to process node drains: %v", err)
+			}
+		}
+	}
+}
+
 // cleanupLoop performs periodic cleanup of old sessions and data
 func (s *Server) cleanupLoop() {
 	ticker := time.NewTicker(1 * time.Hour)
@@ -154,6 +335,14 @@ func (s *Server) performCleanup() {
 		log.Printf("Cleaned up %d expired configs", result.RowsAffected)
 	}
 
+	// Clean up node performance samples past retention
+	result = s.db.Where("sampled_at < ?", time.Now().Add(-s.config.MetricsRetention)).
+		Delete(&models.NodePerformanceMetric{})
+
+	if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d old performance metrics", result.RowsAffected)
+	}
+
 	// Find and fix orphaned sessions (sessions where node is offline)
 	var orphanedSessions []models.Session
 	s.db.Joins("JOIN vpn_nodes ON vpn_nodes.id = sessions.node_id").
@@ -210,9 +399,9 @@ func (s *Server) GetBestNode(protocol, country string) (*models.VPNNode, error)
 	}
 
 	if protocol == "wireguard" {
-		query = query.Where("supports_wireguard = ?", true)
+		query = query.Where("supports_wire_guard = ?", true)
 	} else if protocol == "openvpn" {
-		query = query.Where("supports_openvpn = ?", true)
+		query = query.Where("supports_open_vpn = ?", true)
 	}
 
 	var node models.VPNNode
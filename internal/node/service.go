@@ -2,56 +2,124 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/config"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
 	"github.com/nikola43/aureo-vpn/pkg/metrics"
 	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/nodeapi"
 	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
-	"gorm.io/gorm"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+	"github.com/nikola43/aureo-vpn/pkg/shaping"
+	"github.com/nikola43/aureo-vpn/pkg/telemetry"
 )
 
-// Service manages VPN node operations
+// Service manages VPN node operations. The node has no database access:
+// it reports to and learns its sessions from the control server.
 type Service struct {
 	nodeID         uuid.UUID
-	db             *gorm.DB
-	wgManager      *wireguard.Manager
+	nodeName       string
+	control        *controlapi.Client
+	wgManager      wireguard.Backend
+	config         Config
+	apiServer      *nodeapi.Server
 	activeSessions map[uuid.UUID]*SessionInfo
 	mu             sync.RWMutex
 	ctx            context.Context
 	cancel         context.CancelFunc
 
+	// Bandwidth shaping
+	shaper  shaping.Shaper
+	limits  map[string]peerLimit // Applied limits by peer public key
+	limitMu sync.Mutex
+
 	// Traffic monitoring
-	lastBytesSent     int64
-	lastBytesReceived int64
-	lastTrafficCheck  time.Time
-	trafficMu         sync.RWMutex
+	peerCounters       map[string]peerCounters // Last sampled counters by peer public key
+	lastTrafficCheck   time.Time
+	currentTrafficMbps float64
+	trafficMu          sync.RWMutex
+
+	// Traffic not yet reported to the control server
+	pendingSessions map[uuid.UUID]peerCounters
+	pendingBytes    int64
+	reportMu        sync.Mutex
+}
+
+// peerCounters holds a peer's byte counters as reported by WireGuard
+type peerCounters struct {
+	sent     int64
+	received int64
 }
 
 // SessionInfo holds session information
 type SessionInfo struct {
-	Session       *models.Session
+	Session       *controlapi.Session
 	PublicKey     string
 	LastKeepalive time.Time
 }
 
-// NewService creates a new VPN node service
-func NewService(nodeID uuid.UUID) *Service {
+const (
+	// DefaultSessionTimeout is used when no session idle timeout is configured
+	DefaultSessionTimeout = 10 * time.Minute
+
+	// trafficReportInterval is how often sampled traffic is reported to the
+	// control server
+	trafficReportInterval = 10 * time.Second
+)
+
+// Config holds the node service configuration
+type Config struct {
+	API APIConfig
+	VPN config.VPNConfig // SessionTimeout is the idle timeout after the last handshake
+
+	// KeyFile holds the WireGuard private key, generated on first start. The
+	// key is regenerated on every start when empty.
+	KeyFile string
+
+	// Shaper applies the per-peer speed limits of the users' plans. Peers are
+	// not rate limited when nil.
+	Shaper shaping.Shaper
+
+	// Telemetry samples the host metrics reported with each heartbeat. Only
+	// peer counts are reported when nil.
+	Telemetry *telemetry.Collector
+}
+
+// APIConfig configures the node API the API gateway uses to provision peers
+type APIConfig struct {
+	Port             int
+	GatewayPublicKey string // The API is disabled when empty
+}
+
+// NewService creates a new VPN node service that manages peers through
+// backend and reports to the control server through control
+func NewService(control *controlapi.Client, backend wireguard.Backend, cfg Config) *Service {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	if cfg.VPN.SessionTimeout <= 0 {
+		cfg.VPN.SessionTimeout = DefaultSessionTimeout
+	}
+
 	return &Service{
-		nodeID:         nodeID,
-		db:             database.GetDB(),
-		wgManager:      wireguard.NewManager("wg0"),
-		activeSessions: make(map[uuid.UUID]*SessionInfo),
-		ctx:            ctx,
-		cancel:         cancel,
+		nodeID:          control.NodeID(),
+		control:         control,
+		wgManager:       backend,
+		shaper:          cfg.Shaper,
+		limits:          make(map[string]peerLimit),
+		activeSessions:  make(map[uuid.UUID]*SessionInfo),
+		pendingSessions: make(map[uuid.UUID]peerCounters),
+		config:          cfg,
+		ctx:             ctx,
+		cancel:          cancel,
 	}
 }
 
@@ -60,59 +128,60 @@ func (s *Service) Start() error {
 	log.Println("Starting VPN Node Service...")
 
 	// Load node configuration
-	var node models.VPNNode
-	if err := s.db.First(&node, s.nodeID).Error; err != nil {
+	node, err := s.control.Node(s.ctx)
+	if err != nil {
 		return fmt.Errorf("failed to load node: %w", err)
 	}
+	s.nodeName = node.Name
 
-	// Generate server keypair if not exists
-	var privateKey string
-	if node.PublicKey == "" {
-		keyPair, err := wireguard.GenerateKeyPair()
-		if err != nil {
-			return fmt.Errorf("failed to generate keypair: %w", err)
-		}
-
-		node.PublicKey = keyPair.PublicKey
-		privateKey = keyPair.PrivateKey
-		// Store private key securely (in production, use KMS/Vault)
-		// For now, store in PrivateKeyEncrypted field
-		if err := s.db.Model(&node).Updates(map[string]interface{}{
-			"public_key":            keyPair.PublicKey,
-			"private_key_encrypted": keyPair.PrivateKey,
-		}).Error; err != nil {
-			return fmt.Errorf("failed to save keypair: %w", err)
-		}
-	} else {
-		// Load existing private key from database
-		var storedNode models.VPNNode
-		if err := s.db.Select("private_key_encrypted").First(&storedNode, s.nodeID).Error; err != nil {
-			return fmt.Errorf("failed to load private key: %w", err)
-		}
-		privateKey = storedNode.PrivateKeyEncrypted
+	privateKey, err := s.loadPrivateKey()
+	if err != nil {
+		return fmt.Errorf("failed to load WireGuard key: %w", err)
+	}
+	publicKey, err := wireguard.DerivePublicKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("invalid WireGuard key: %w", err)
+	}
 
-		// If no private key exists, generate a new one
-		if privateKey == "" {
-			keyPair, err := wireguard.GenerateKeyPair()
-			if err != nil {
-				return fmt.Errorf("failed to generate keypair: %w", err)
-			}
-			privateKey = keyPair.PrivateKey
+	// Setup WireGuard interface
+	if err := s.setupWireGuard(node, privateKey); err != nil {
+		return fmt.Errorf("failed to setup WireGuard: %w", err)
+	}
 
-			if err := s.db.Model(&node).UpdateColumn("private_key_encrypted", privateKey).Error; err != nil {
-				return fmt.Errorf("failed to save private key: %w", err)
-			}
+	// Limits left from a previous run are cleared here and rebuilt from the
+	// active sessions by the first peer sync
+	if s.shaper != nil {
+		if err := s.shaper.Setup(); err != nil {
+			log.Printf("Failed to set up bandwidth shaping, peers will not be rate limited: %v", err)
+			s.shaper = nil
 		}
 	}
 
-	// Setup WireGuard interface
-	if err := s.setupWireGuard(&node, privateKey); err != nil {
-		return fmt.Errorf("failed to setup WireGuard: %w", err)
+	// Serve the node API so the gateway can provision peers directly
+	apiPort, err := s.startAPIServer(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to start node API: %w", err)
 	}
 
+	// Clients and the gateway need the public key to reach the node
+	if err := s.control.Register(s.ctx, controlapi.RegisterRequest{
+		PublicKey: publicKey,
+		APIPort:   apiPort,
+		Protocols: []string{controlapi.ProtocolWireGuard},
+	}); err != nil {
+		return fmt.Errorf("failed to register with the control server: %w", err)
+	}
+
+	// Resume monitoring sessions that survived a restart, then announce the
+	// node before accepting new ones
+	s.rehydrateSessions()
+	s.sendHeartbeat()
+	s.syncPeers()
+
 	// Start background tasks
 	go s.heartbeatLoop()
 	go s.sessionMonitor()
+	go s.peerSyncLoop()
 	go s.metricsCollector()
 	go s.trafficMonitor()
 
@@ -125,16 +194,93 @@ func (s *Service) Stop() error {
 	log.Println("Stopping VPN Node Service...")
 	s.cancel()
 
-	// Disconnect all sessions
+	if s.apiServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.apiServer.Shutdown(ctx); err != nil {
+			log.Printf("Failed to stop node API: %v", err)
+		}
+		cancel()
+	}
+
+	// Report the traffic of the last seconds so it is not lost
+	s.updateTrafficStats()
+	s.reportTraffic(context.Background())
+
+	// Stop monitoring sessions without ending them or removing their peers,
+	// so clients stay connected across a restart. The restarted node
+	// rehydrates them; sessions that never come back are ended by the idle
+	// timeout and peer sync.
 	s.mu.Lock()
 	for sessionID := range s.activeSessions {
-		s.disconnectSession(sessionID)
+		s.untrackSession(sessionID)
 	}
 	s.mu.Unlock()
 
 	return nil
 }
 
+// loadPrivateKey reads the WireGuard private key from the key file,
+// generating and saving it on first start
+func (s *Service) loadPrivateKey() (string, error) {
+	path := s.config.KeyFile
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			privateKey := strings.TrimSpace(string(data))
+			return privateKey, wireguard.ValidatePrivateKey(privateKey)
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	keyPair, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate keypair: %w", err)
+	}
+
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(path, []byte(keyPair.PrivateKey+"\n"), 0600); err != nil {
+			return "", err
+		}
+		log.Printf("Generated WireGuard key, saved to %s", path)
+	}
+
+	return keyPair.PrivateKey, nil
+}
+
+// startAPIServer starts the authenticated node API and returns its port, 0
+// if the API is disabled
+func (s *Service) startAPIServer(privateKey string) (int, error) {
+	if s.config.API.GatewayPublicKey == "" {
+		log.Println("GATEWAY_PUBLIC_KEY not set, node API disabled; peers are provisioned by peer sync only")
+		return 0, nil
+	}
+
+	port := s.config.API.Port
+	if port == 0 {
+		port = nodeapi.DefaultPort
+	}
+
+	server, err := nodeapi.NewServer(nodePeers{Backend: s.wgManager, s: s}, privateKey, s.config.API.GatewayPublicKey)
+	if err != nil {
+		return 0, err
+	}
+	s.apiServer = server
+
+	go func() {
+		if err := server.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			log.Printf("Node API stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Node API listening on port %d", port)
+	return port, nil
+}
+
 // setupWireGuard configures the WireGuard interface
 func (s *Service) setupWireGuard(node *models.VPNNode, privateKey string) error {
 	config := wireguard.ServerConfig{
@@ -156,132 +302,169 @@ func (s *Service) setupWireGuard(node *models.VPNNode, privateKey string) error
 	return s.wgManager.SetupInterface(config)
 }
 
-// CreateSession creates a new VPN session
-func (s *Service) CreateSession(userID uuid.UUID, protocol string) (*models.Session, error) {
+// trackSession starts monitoring a session. Callers must hold s.mu.
+func (s *Service) trackSession(sess *controlapi.Session) {
+	s.activeSessions[sess.ID] = &SessionInfo{
+		Session:       sess,
+		PublicKey:     sess.PublicKey,
+		LastKeepalive: sess.LastKeepalive,
+	}
+	metrics.ActiveConnections.WithLabelValues(sess.Protocol, s.nodeName).Inc()
+}
+
+// rehydrateSessions tracks the active sessions recorded for this node. Their
+// keepalive is moved forward to now so node downtime does not count as idle time.
+func (s *Service) rehydrateSessions() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Load node
-	var node models.VPNNode
-	if err := s.db.First(&node, s.nodeID).Error; err != nil {
-		return nil, fmt.Errorf("failed to load node: %w", err)
-	}
-
-	// Check if node has capacity
-	if node.CurrentConnections >= node.MaxConnections {
-		return nil, fmt.Errorf("node at maximum capacity")
+	sessions, err := s.control.Sessions(s.ctx)
+	if err != nil {
+		log.Printf("Failed to load active sessions: %v", err)
+		return
 	}
 
-	// Generate client keypair
-	keyPair, err := wireguard.GenerateKeyPair()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate keypair: %w", err)
+	now := time.Now()
+	for i := range sessions {
+		if _, ok := s.activeSessions[sessions[i].ID]; ok {
+			continue
+		}
+		if sessions[i].LastKeepalive.Before(now) {
+			sessions[i].LastKeepalive = now
+		}
+		s.trackSession(&sessions[i])
 	}
 
-	// Allocate IP address
-	var usedIPs []string
-	s.db.Model(&models.Session{}).
-		Where("node_id = ? AND status = ?", s.nodeID, "active").
-		Pluck("tunnel_ip", &usedIPs)
+	log.Printf("Rehydrated %d active sessions", len(sessions))
+}
 
-	tunnelIP, err := wireguard.AllocateClientIP(node.InternalIP+"/24", usedIPs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to allocate IP: %w", err)
+// untrackSession stops monitoring a session. Callers must hold s.mu.
+func (s *Service) untrackSession(sessionID uuid.UUID) {
+	sessionInfo, ok := s.activeSessions[sessionID]
+	if !ok {
+		return
 	}
+	delete(s.activeSessions, sessionID)
+	metrics.ActiveConnections.WithLabelValues(sessionInfo.Session.Protocol, s.nodeName).Dec()
+}
 
-	// Create session
-	session := &models.Session{
-		UserID:             userID,
-		NodeID:             s.nodeID,
-		Protocol:           protocol,
-		TunnelIP:           tunnelIP,
-		PublicKey:          keyPair.PublicKey,
-		PrivateKey:         keyPair.PrivateKey, // Encrypted in production
-		Status:             "active",
-		ConnectedAt:        time.Now(),
-		LastKeepalive:      time.Now(),
-		KillSwitchEnabled:  true,
-		DNSLeakProtection:  true,
-	}
+// DisconnectSession disconnects a VPN session
+func (s *Service) DisconnectSession(sessionID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if err := s.db.Create(session).Error; err != nil {
-		return nil, fmt.Errorf("failed to create session: %w", err)
+	return s.disconnectSession(sessionID)
+}
+
+func (s *Service) disconnectSession(sessionID uuid.UUID) error {
+	sessionInfo, ok := s.activeSessions[sessionID]
+	if !ok {
+		return fmt.Errorf("session not found")
 	}
 
-	// Add peer to WireGuard
-	peer := wireguard.PeerConfig{
-		PublicKey:           keyPair.PublicKey,
-		AllowedIPs:          []string{tunnelIP},
-		PersistentKeepalive: 25,
+	if err := s.removePeer(sessionInfo.PublicKey); err != nil {
+		log.Printf("Failed to remove peer of session %s: %v", sessionID, err)
 	}
 
-	if err := s.wgManager.AddPeer(peer); err != nil {
-		s.db.Delete(session)
-		return nil, fmt.Errorf("failed to add peer: %w", err)
+	// Settle the session's traffic before it ends. Not s.ctx: sessions are
+	// also ended while the service is stopping.
+	s.reportTraffic(context.Background())
+	err := s.control.EndSession(context.Background(), sessionID, "disconnected")
+	if err != nil && !errors.Is(err, controlapi.ErrSessionNotFound) {
+		return fmt.Errorf("failed to end session: %w", err)
 	}
 
-	// Update node connection count
-	s.db.Model(&node).UpdateColumn("current_connections", gorm.Expr("current_connections + ?", 1))
+	s.untrackSession(sessionID)
 
-	// Store in active sessions
-	s.activeSessions[session.ID] = &SessionInfo{
-		Session:       session,
-		PublicKey:     keyPair.PublicKey,
-		LastKeepalive: time.Now(),
-	}
+	log.Printf("Disconnected session %s", sessionID)
+	return nil
+}
 
-	// Update metrics
-	metrics.ActiveConnections.WithLabelValues(protocol, node.Name).Inc()
-	metrics.ConnectionsTotal.WithLabelValues(protocol, node.Name, "success").Inc()
+// peerSyncLoop periodically reconciles WireGuard peers with the node's sessions
+func (s *Service) peerSyncLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
 
-	log.Printf("Created session %s for user %s", session.ID, userID)
-	return session, nil
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.syncPeers()
+		}
+	}
 }
 
-// DisconnectSession disconnects a VPN session
-func (s *Service) DisconnectSession(sessionID uuid.UUID) error {
+// syncPeers makes the interface match the active sessions recorded for this
+// node. Sessions created or ended by the API gateway are picked up here.
+func (s *Service) syncPeers() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.disconnectSession(sessionID)
-}
-
-func (s *Service) disconnectSession(sessionID uuid.UUID) error {
-	sessionInfo, ok := s.activeSessions[sessionID]
-	if !ok {
-		return fmt.Errorf("session not found")
+	// Read the interface before the sessions: a peer is only ever added after
+	// its session is committed, so it can never look like a stray peer below.
+	stats, err := s.wgManager.GetInterfaceStats()
+	if err != nil {
+		log.Printf("Failed to read WireGuard peers: %v", err)
+		return
 	}
 
-	// Remove peer from WireGuard
-	if err := s.wgManager.RemovePeer(sessionInfo.PublicKey); err != nil {
-		log.Printf("Failed to remove peer: %v", err)
+	active, err := s.control.Sessions(s.ctx)
+	if err != nil {
+		log.Printf("Failed to load sessions for peer sync: %v", err)
+		return
+	}
+	var sessions []controlapi.Session
+	for _, sess := range active {
+		if sess.Protocol == "wireguard" {
+			sessions = append(sessions, sess)
+		}
 	}
 
-	// Update session in database
-	now := time.Now()
-	updates := map[string]interface{}{
-		"status":          "disconnected",
-		"disconnected_at": &now,
+	present := make(map[string]bool, len(stats.Peers))
+	for _, peer := range stats.Peers {
+		present[peer.PublicKey] = true
+	}
+
+	var add []wireguard.PeerConfig
+	wanted := make(map[string]bool, len(sessions))
+	for _, sess := range sessions {
+		wanted[sess.PublicKey] = true
+		if !present[sess.PublicKey] {
+			add = append(add, wireguard.PeerConfig{
+				PublicKey:           sess.PublicKey,
+				AllowedIPs:          []string{session.HostAddress(sess.TunnelIP)},
+				PersistentKeepalive: session.DefaultPersistentKeepalive,
+			})
+		}
 	}
 
-	if err := s.db.Model(&models.Session{}).Where("id = ?", sessionID).Updates(updates).Error; err != nil {
-		return fmt.Errorf("failed to update session: %w", err)
+	var remove []string
+	for publicKey := range present {
+		if !wanted[publicKey] {
+			remove = append(remove, publicKey)
+		}
 	}
 
-	// Update node connection count
-	s.db.Model(&models.VPNNode{}).Where("id = ?", s.nodeID).
-		UpdateColumn("current_connections", gorm.Expr("current_connections - ?", 1))
+	if err := s.wgManager.UpdatePeers(add, remove); err != nil {
+		log.Printf("Failed to sync peers (%d to add, %d to remove): %v", len(add), len(remove), err)
+		return
+	}
 
-	// Remove from active sessions
-	delete(s.activeSessions, sessionID)
+	for i := range sessions {
+		if _, ok := s.activeSessions[sessions[i].ID]; !ok {
+			s.trackSession(&sessions[i])
+		}
+	}
 
-	// Update metrics
-	var node models.VPNNode
-	s.db.First(&node, s.nodeID)
-	metrics.ActiveConnections.WithLabelValues(sessionInfo.Session.Protocol, node.Name).Dec()
+	// Sessions ended elsewhere, e.g. through the API gateway
+	for sessionID, sessionInfo := range s.activeSessions {
+		if !wanted[sessionInfo.PublicKey] {
+			s.untrackSession(sessionID)
+		}
+	}
 
-	log.Printf("Disconnected session %s", sessionID)
-	return nil
+	s.reconcileLimits(sessions)
 }
 
 // heartbeatLoop sends periodic heartbeats to the control server
@@ -300,44 +483,41 @@ func (s *Service) heartbeatLoop() {
 }
 
 func (s *Service) sendHeartbeat() {
-	// Count active WireGuard peers
-	peerCount := s.countActivePeers()
+	hb := controlapi.Heartbeat{Version: controlapi.HeartbeatVersion}
 
-	updates := map[string]interface{}{
-		"last_heartbeat":      time.Now(),
-		"status":              "online",
-		"current_connections": peerCount,
+	if s.config.Telemetry != nil {
+		sample, err := s.config.Telemetry.Sample()
+		if err != nil {
+			log.Printf("Failed to sample host telemetry: %v", err)
+		}
+		hb.Telemetry = sample
 	}
 
-	if err := s.db.Model(&models.VPNNode{}).Where("id = ?", s.nodeID).Updates(updates).Error; err != nil {
-		log.Printf("Failed to send heartbeat: %v", err)
-		return
+	peers, activePeers := s.countPeers()
+	hb.Connections = peers
+	if hb.Telemetry != nil {
+		hb.Telemetry.Peers = peers
+		hb.Telemetry.ActivePeers = activePeers
 	}
 
-	// Update operator stats (pending payout, etc.) every heartbeat
-	var node models.VPNNode
-	if err := s.db.First(&node, s.nodeID).Error; err == nil && node.OperatorID != nil {
-		var operator models.NodeOperator
-		if err := s.db.First(&operator, node.OperatorID).Error; err == nil {
-			operator.UpdateStats(s.db)
-		}
+	if err := s.control.Heartbeat(s.ctx, hb); err != nil {
+		log.Printf("Failed to send heartbeat: %v", err)
 	}
 }
 
-// countActivePeers counts the number of active WireGuard peers
-func (s *Service) countActivePeers() int {
-	cmd := exec.Command("wg", "show", "wg0", "peers")
-	output, err := cmd.Output()
+// countPeers counts the WireGuard peers and those that handshook within
+// telemetry.HandshakeWindow
+func (s *Service) countPeers() (peers, active int) {
+	stats, err := s.wgManager.GetInterfaceStats()
 	if err != nil {
-		return 0
+		return 0, 0
 	}
-
-	// Count non-empty lines (each line is a peer public key)
-	peers := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(peers) == 1 && peers[0] == "" {
-		return 0
+	for _, peer := range stats.Peers {
+		if time.Since(peer.LatestHandshake) <= telemetry.HandshakeWindow {
+			active++
+		}
 	}
-	return len(peers)
+	return len(stats.Peers), active
 }
 
 // sessionMonitor monitors active sessions
@@ -355,14 +535,44 @@ func (s *Service) sessionMonitor() {
 	}
 }
 
+// checkInactiveSessions records each peer's latest handshake as its session's
+// keepalive and disconnects sessions idle for longer than the session timeout
 func (s *Service) checkInactiveSessions() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Without handshake data every session would look idle
+	stats, err := s.wgManager.GetInterfaceStats()
+	if err != nil {
+		log.Printf("Failed to read WireGuard peers: %v", err)
+		return
+	}
+
+	handshakes := make(map[string]time.Time, len(stats.Peers))
+	for _, peer := range stats.Peers {
+		handshakes[peer.PublicKey] = peer.LatestHandshake
+	}
+
+	var keepalives []controlapi.Keepalive
+	for sessionID, sessionInfo := range s.activeSessions {
+		if handshake := handshakes[sessionInfo.PublicKey]; handshake.After(sessionInfo.LastKeepalive) {
+			sessionInfo.LastKeepalive = handshake
+			sessionInfo.Session.LastKeepalive = handshake
+			keepalives = append(keepalives, controlapi.Keepalive{SessionID: sessionID, At: handshake})
+		}
+	}
+
+	// The idle sessions disconnected below are ended by the control server,
+	// so the keepalives of the others are recorded first
+	if len(keepalives) > 0 {
+		if err := s.control.Keepalives(s.ctx, keepalives); err != nil {
+			log.Printf("Failed to record keepalives of %d sessions: %v", len(keepalives), err)
+		}
+	}
+
 	for sessionID, sessionInfo := range s.activeSessions {
-		// Disconnect sessions with no keepalive for 10 minutes
-		if time.Since(sessionInfo.LastKeepalive) > 10*time.Minute {
-			log.Printf("Session %s inactive, disconnecting", sessionID)
+		if time.Since(sessionInfo.LastKeepalive) > s.config.VPN.SessionTimeout {
+			log.Printf("Session %s inactive since %s, disconnecting", sessionID, sessionInfo.LastKeepalive.Format(time.RFC3339))
 			s.disconnectSession(sessionID)
 		}
 	}
@@ -383,16 +593,14 @@ func (s *Service) metricsCollector() {
 	}
 }
 
+// collectMetrics exports the node's status as recorded by the control server,
+// which also computes its load score
 func (s *Service) collectMetrics() {
-	var node models.VPNNode
-	if err := s.db.First(&node, s.nodeID).Error; err != nil {
+	node, err := s.control.Node(s.ctx)
+	if err != nil {
 		return
 	}
 
-	// Update load score
-	loadScore := node.CalculateLoadScore()
-	s.db.Model(&node).UpdateColumn("load_score", loadScore)
-
 	// Update metrics
 	status := 0.0
 	if node.Status == "online" {
@@ -400,21 +608,20 @@ func (s *Service) collectMetrics() {
 	}
 
 	metrics.NodeStatus.WithLabelValues(node.Name, node.Country, node.City).Set(status)
-	metrics.NodeLoad.WithLabelValues(node.Name).Set(loadScore)
+	metrics.NodeLoad.WithLabelValues(node.Name).Set(node.LoadScore)
 	metrics.NodeCPUUsage.WithLabelValues(node.Name).Set(node.CPUUsage)
 	metrics.NodeMemoryUsage.WithLabelValues(node.Name).Set(node.MemoryUsage)
 	metrics.NodeBandwidth.WithLabelValues(node.Name).Set(node.BandwidthUsageGbps)
 }
 
-// trafficMonitor monitors WireGuard traffic and calculates real-time bandwidth usage
+// trafficMonitor monitors WireGuard traffic and calculates real-time bandwidth
+// usage, reporting it to the control server every trafficReportInterval
 func (s *Service) trafficMonitor() {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
-	// Initialize last check time
-	s.trafficMu.Lock()
-	s.lastTrafficCheck = time.Now()
-	s.trafficMu.Unlock()
+	report := time.NewTicker(trafficReportInterval)
+	defer report.Stop()
 
 	for {
 		select {
@@ -422,6 +629,8 @@ func (s *Service) trafficMonitor() {
 			return
 		case <-ticker.C:
 			s.updateTrafficStats()
+		case <-report.C:
+			s.reportTraffic(s.ctx)
 		}
 	}
 }
@@ -434,58 +643,115 @@ func (s *Service) updateTrafficStats() {
 		return
 	}
 
-	// Calculate total bytes from all peers
-	var totalBytesSent, totalBytesReceived int64
-	for _, peer := range stats.Peers {
-		totalBytesSent += peer.BytesSent
-		totalBytesReceived += peer.BytesReceived
-	}
-
 	s.trafficMu.Lock()
 	now := time.Now()
 	timeDiff := now.Sub(s.lastTrafficCheck).Seconds()
 
-	// Calculate rate (bytes per second)
-	var currentTrafficMbps float64
-	if timeDiff > 0 && s.lastTrafficCheck.Unix() > 0 {
-		bytesSentDiff := totalBytesSent - s.lastBytesSent
-		bytesReceivedDiff := totalBytesReceived - s.lastBytesReceived
+	// The first sample only sets the baseline: counters of peers that outlived
+	// a restart of this process were already accounted for
+	baseline := s.lastTrafficCheck.IsZero()
 
-		// Total bytes per second (sent + received)
-		bytesPerSecond := float64(bytesSentDiff+bytesReceivedDiff) / timeDiff
+	counters := make(map[string]peerCounters, len(stats.Peers))
+	deltas := make(map[string]peerCounters, len(stats.Peers))
+	var bytesTransferredSinceLastCheck int64
+	for _, peer := range stats.Peers {
+		current := peerCounters{sent: peer.BytesSent, received: peer.BytesReceived}
+		counters[peer.PublicKey] = current
+		if baseline {
+			continue
+		}
 
-		// Convert to Mbps (megabits per second)
-		currentTrafficMbps = (bytesPerSecond * 8) / 1_000_000
+		// Peers added since the last sample start from zero
+		delta := current.since(s.peerCounters[peer.PublicKey])
+		if delta.sent > 0 || delta.received > 0 {
+			deltas[peer.PublicKey] = delta
+			bytesTransferredSinceLastCheck += delta.sent + delta.received
+		}
 	}
 
-	// Calculate bytes transferred since last check
-	var bytesTransferredSinceLastCheck int64
-	if s.lastTrafficCheck.Unix() > 0 {
-		bytesSentDiff := totalBytesSent - s.lastBytesSent
-		bytesReceivedDiff := totalBytesReceived - s.lastBytesReceived
-		bytesTransferredSinceLastCheck = bytesSentDiff + bytesReceivedDiff
+	// Calculate rate (bytes per second) and convert to Mbps (megabits per second)
+	var currentTrafficMbps float64
+	if timeDiff > 0 && !baseline {
+		bytesPerSecond := float64(bytesTransferredSinceLastCheck) / timeDiff
+		currentTrafficMbps = (bytesPerSecond * 8) / 1_000_000
 	}
 
 	// Update tracking variables
-	s.lastBytesSent = totalBytesSent
-	s.lastBytesReceived = totalBytesReceived
+	s.peerCounters = counters
 	s.lastTrafficCheck = now
+	s.currentTrafficMbps = currentTrafficMbps
 	s.trafficMu.Unlock()
 
-	// Update node's bandwidth usage and total traffic in database
-	if bytesTransferredSinceLastCheck > 0 {
-		kbTransferred := bytesTransferredSinceLastCheck / 1024
-		s.db.Model(&models.VPNNode{}).
-			Where("id = ?", s.nodeID).
-			Updates(map[string]interface{}{
-				"bandwidth_usage_gbps": currentTrafficMbps / 1000.0, // Convert Mbps to Gbps
-				"total_bandwidth_kb":   gorm.Expr("total_bandwidth_kb + ?", kbTransferred),
-			})
-	} else {
-		s.db.Model(&models.VPNNode{}).
-			Where("id = ?", s.nodeID).
-			UpdateColumn("bandwidth_usage_gbps", currentTrafficMbps/1000.0) // Convert Mbps to Gbps
+	s.recordSessionTraffic(deltas, bytesTransferredSinceLastCheck)
+}
+
+// since returns the bytes transferred since the previous sample. WireGuard
+// counters restart from zero when the interface or peer is recreated, in which
+// case everything counted since the reset is new traffic.
+func (c peerCounters) since(prev peerCounters) peerCounters {
+	delta := c
+	if c.sent >= prev.sent {
+		delta.sent = c.sent - prev.sent
+	}
+	if c.received >= prev.received {
+		delta.received = c.received - prev.received
 	}
+	return delta
+}
+
+// recordSessionTraffic adds per-peer traffic to the owning sessions' traffic
+// awaiting the next report. bytes is all traffic, including stray peers.
+func (s *Service) recordSessionTraffic(deltas map[string]peerCounters, bytes int64) {
+	// Resolve the sessions first: s.mu is never taken while holding reportMu
+	sessionDeltas := make(map[uuid.UUID]peerCounters, len(deltas))
+	if len(deltas) > 0 {
+		s.mu.RLock()
+		for sessionID, sessionInfo := range s.activeSessions {
+			if delta, ok := deltas[sessionInfo.PublicKey]; ok {
+				sessionDeltas[sessionID] = delta
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	s.reportMu.Lock()
+	defer s.reportMu.Unlock()
+
+	s.pendingBytes += bytes
+	for sessionID, delta := range sessionDeltas {
+		pending := s.pendingSessions[sessionID]
+		pending.sent += delta.sent
+		pending.received += delta.received
+		s.pendingSessions[sessionID] = pending
+	}
+}
+
+// reportTraffic sends the traffic recorded since the last report to the
+// control server, which adds it to the sessions and their users' totals.
+// Traffic that cannot be reported is kept for the next report.
+func (s *Service) reportTraffic(ctx context.Context) {
+	s.reportMu.Lock()
+	defer s.reportMu.Unlock()
+
+	report := controlapi.TrafficReport{
+		BandwidthMbps: s.GetCurrentTrafficMbps(),
+		Bytes:         s.pendingBytes,
+	}
+	for sessionID, pending := range s.pendingSessions {
+		report.Sessions = append(report.Sessions, controlapi.SessionTraffic{
+			SessionID:     sessionID,
+			BytesSent:     pending.sent,
+			BytesReceived: pending.received,
+		})
+	}
+
+	if err := s.control.ReportTraffic(ctx, report); err != nil {
+		log.Printf("Failed to report traffic: %v", err)
+		return
+	}
+
+	s.pendingBytes = 0
+	s.pendingSessions = make(map[uuid.UUID]peerCounters)
 }
 
 // GetConnectedUsers returns the number of currently connected users
@@ -497,9 +763,7 @@ func (s *Service) GetConnectedUsers() int {
 
 // GetCurrentTrafficMbps returns the current traffic rate in Mbps
 func (s *Service) GetCurrentTrafficMbps() float64 {
-	var node models.VPNNode
-	if err := s.db.First(&node, s.nodeID).Error; err != nil {
-		return 0
-	}
-	return node.BandwidthUsageGbps * 1000.0 // Convert Gbps to Mbps
+	s.trafficMu.RLock()
+	defer s.trafficMu.RUnlock()
+	return s.currentTrafficMbps
 }
@@ -0,0 +1,791 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/internal/control"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
+	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/ledger"
+	applogger "github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+	"github.com/nikola43/aureo-vpn/pkg/rewards"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+	"github.com/nikola43/aureo-vpn/pkg/shaping"
+	"github.com/nikola43/aureo-vpn/pkg/telemetry"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDB points the global database at a fresh SQLite file
+func setupTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "node.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+
+	testModels := []interface{}{
+		&models.User{}, &models.NodeReward{}, &models.NodeOperator{}, &models.VPNNode{},
+		&models.Session{}, &models.OperatorEarning{}, &models.OperatorPayout{},
+		&models.JournalEntry{}, &models.LedgerPosting{}, &models.Plan{},
+		&models.NodePerformanceMetric{},
+	}
+
+	// SQLite cannot parse the UUID column defaults used for Postgres. IDs
+	// are assigned by the BeforeCreate hooks anyway.
+	for _, model := range testModels {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatalf("Failed to parse model: %v", err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DefaultValue == "gen_random_uuid()" || field.DefaultValue == "uuid_generate_v4()" {
+				field.HasDefaultValue = false
+				field.DefaultValue = ""
+				field.DefaultValueInterface = nil
+			}
+		}
+	}
+
+	if err := db.AutoMigrate(testModels...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+
+	database.DB = db
+	t.Cleanup(func() { database.DB = nil })
+
+	return db
+}
+
+// newTestService creates an online node and a service backed by a fake
+// interface, reporting to a control server over the control API
+func newTestService(t *testing.T) (*Service, *wireguard.FakeBackend, *gorm.DB) {
+	t.Helper()
+
+	db := setupTestDB(t)
+
+	keyPair, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate node keys: %v", err)
+	}
+	identityKey, identityPublicKey, err := controlapi.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate identity key: %v", err)
+	}
+
+	node := &models.VPNNode{
+		Name:              "test-node-1",
+		Hostname:          "node1.test",
+		Country:           "Testland",
+		CountryCode:       "TL",
+		City:              "Test City",
+		PublicIP:          "192.0.2.10",
+		InternalIP:        "10.8.0.1",
+		Status:            "online",
+		IsActive:          true,
+		SupportsWireGuard: true,
+		WireGuardPort:     51820,
+		MaxConnections:    10,
+		PublicKey:         keyPair.PublicKey,
+		IdentityKey:       identityPublicKey,
+	}
+	if err := db.Create(node).Error; err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	if err := plans.NewService().InitializePlans(context.Background()); err != nil {
+		t.Fatalf("Failed to create plans: %v", err)
+	}
+
+	client := newControlClient(t, node.ID, identityKey, identityPublicKey)
+	backend := wireguard.NewFakeBackend("wg0")
+	s := NewService(client, backend, Config{})
+	s.nodeName = node.Name
+	t.Cleanup(s.cancel)
+
+	return s, backend, db
+}
+
+// newControlClient serves the control API and returns a client for an
+// enrolled node
+func newControlClient(t *testing.T, nodeID uuid.UUID, identityKey, identityPublicKey string) *controlapi.Client {
+	t.Helper()
+
+	signingKey, _, err := controlapi.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate signing key: %v", err)
+	}
+	authority, err := controlapi.NewAuthority(signingKey)
+	if err != nil {
+		t.Fatalf("NewAuthority failed: %v", err)
+	}
+
+	server := controlapi.NewServer(control.NewServer(control.Config{Authority: authority}), authority)
+	ts := httptest.NewServer(server.Handler())
+	t.Cleanup(ts.Close)
+
+	identity := &controlapi.Identity{
+		PrivateKey:  identityKey,
+		Certificate: *authority.Issue(nodeID, identityPublicKey),
+	}
+	client, err := controlapi.NewClient(ts.URL, identity, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	return client
+}
+
+// createTestSession creates a session on the node the way the API gateway
+// does, leaving the peer to the node's peer sync
+func createTestSession(t *testing.T, s *Service, userID uuid.UUID) *models.Session {
+	t.Helper()
+
+	sessions := session.NewService(applogger.Global(), nil, nil, plans.NewService(), "")
+	result, err := sessions.Create(context.Background(), userID, session.CreateRequest{
+		NodeID:   &s.nodeID,
+		Protocol: "wireguard",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	s.syncPeers()
+	return result.Session
+}
+
+func createTestUser(t *testing.T, db *gorm.DB) uuid.UUID {
+	t.Helper()
+
+	user := &models.User{
+		Email:        uuid.NewString() + "@example.com",
+		PasswordHash: "hash",
+		Username:     uuid.NewString(),
+
+		SubscriptionTier:   "ultimate",
+		SubscriptionExpiry: time.Now().Add(30 * 24 * time.Hour),
+	}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	return user.ID
+}
+
+func TestStartRegistersWithControlServer(t *testing.T) {
+	s, _, db := newTestService(t)
+	s.config.KeyFile = filepath.Join(t.TempDir(), "wireguard.key")
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	s.Stop()
+
+	var node models.VPNNode
+	db.First(&node, s.nodeID)
+	if node.Status != "online" || node.LastHeartbeat.IsZero() {
+		t.Errorf("Expected the node to be online after its first heartbeat, got %q", node.Status)
+	}
+	if node.PrivateKeyEncrypted != "" {
+		t.Error("Expected the WireGuard private key to stay on the node")
+	}
+
+	// The key survives a restart
+	publicKey := node.PublicKey
+	restarted := NewService(s.control, wireguard.NewFakeBackend("wg0"), Config{KeyFile: s.config.KeyFile})
+	if err := restarted.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	restarted.Stop()
+
+	db.First(&node, s.nodeID)
+	if node.PublicKey != publicKey {
+		t.Errorf("Expected public key %s to be kept, got %s", publicKey, node.PublicKey)
+	}
+}
+
+func TestSyncPeersAddsSessions(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	first := createTestSession(t, s, userID)
+	second := createTestSession(t, s, userID)
+
+	if first.TunnelIP == second.TunnelIP {
+		t.Errorf("Expected distinct tunnel IPs, both got %s", first.TunnelIP)
+	}
+
+	peer, ok := backend.Peer(first.PublicKey)
+	if !ok {
+		t.Fatal("Expected peer to be added to the interface")
+	}
+	if len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0] != "10.8.0.2/32" {
+		t.Errorf("Expected peer allowed IPs [10.8.0.2/32], got %v", peer.AllowedIPs)
+	}
+
+	s.sendHeartbeat()
+
+	var node models.VPNNode
+	db.First(&node, s.nodeID)
+	if node.CurrentConnections != 2 {
+		t.Errorf("Expected 2 current connections, got %d", node.CurrentConnections)
+	}
+
+	if s.GetConnectedUsers() != 2 {
+		t.Errorf("Expected 2 tracked sessions, got %d", s.GetConnectedUsers())
+	}
+}
+
+func TestSyncPeersRetriesWhenPeerFails(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	backend.SetError(errors.New("interface down"))
+	sess := createTestSession(t, s, userID)
+
+	if s.GetConnectedUsers() != 0 {
+		t.Errorf("Expected no tracked sessions while the interface is down, got %d", s.GetConnectedUsers())
+	}
+
+	backend.SetError(nil)
+	s.syncPeers()
+
+	if _, ok := backend.Peer(sess.PublicKey); !ok {
+		t.Error("Expected the peer to be added by the next sync")
+	}
+	if s.GetConnectedUsers() != 1 {
+		t.Errorf("Expected 1 tracked session, got %d", s.GetConnectedUsers())
+	}
+}
+
+func TestHeartbeatReportsTelemetry(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	// A host at a quarter of its CPU with half of its memory in use
+	proc := t.TempDir()
+	files := map[string]string{
+		"uptime":  "600.00 1200.00\n",
+		"stat":    "cpu  100 0 100 600 0 0 0 0 0 0\ncpu0 100 0 100 600 0 0 0 0 0 0\n",
+		"loadavg": "0.50 0.40 0.30 1/100 1000\n",
+		"meminfo": "MemTotal: 1000 kB\nMemFree: 100 kB\nMemAvailable: 500 kB\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(proc, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	s.config.Telemetry = telemetry.NewCollector(telemetry.Config{ProcPath: proc})
+
+	active := createTestSession(t, s, userID)
+	createTestSession(t, s, userID)
+	backend.Handshake(active.PublicKey, "198.51.100.1:51820", time.Now())
+
+	s.sendHeartbeat()
+
+	var node models.VPNNode
+	db.First(&node, s.nodeID)
+	if node.CPUUsage != 25 || node.MemoryUsage != 50 {
+		t.Errorf("Expected 25%% CPU and 50%% memory usage, got %.1f%% and %.1f%%", node.CPUUsage, node.MemoryUsage)
+	}
+
+	// 40% of 2/10 connections plus 30% of CPU and memory usage
+	if node.LoadScore < 30.4 || node.LoadScore > 30.6 {
+		t.Errorf("Expected a load score of 30.5, got %f", node.LoadScore)
+	}
+
+	var metrics []models.NodePerformanceMetric
+	db.Where("node_id = ?", s.nodeID).Find(&metrics)
+	if len(metrics) != 1 {
+		t.Fatalf("Expected 1 performance metric, got %d", len(metrics))
+	}
+	metric := metrics[0]
+	if metric.HeartbeatVersion != controlapi.HeartbeatVersion || metric.UptimeMinutes != 10 {
+		t.Errorf("Expected a version %d sample after 10 minutes uptime, got %+v", controlapi.HeartbeatVersion, metric)
+	}
+	if metric.Peers != 2 || metric.ActivePeers != 1 {
+		t.Errorf("Expected 2 peers with 1 active, got %d and %d", metric.Peers, metric.ActivePeers)
+	}
+	if metric.LoadAverage1 != 0.5 || metric.LoadScore != node.LoadScore {
+		t.Errorf("Expected the load average and score to be recorded, got %+v", metric)
+	}
+}
+
+func TestCheckInactiveSessions(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	idle := createTestSession(t, s, userID)
+	active := createTestSession(t, s, userID)
+
+	stale := time.Now().Add(-11 * time.Minute)
+	s.activeSessions[idle.ID].LastKeepalive = stale
+	s.activeSessions[active.ID].LastKeepalive = stale
+
+	// Only the active peer has handshaken recently
+	handshake := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := backend.Handshake(active.PublicKey, "198.51.100.7:51820", handshake); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	s.checkInactiveSessions()
+
+	if _, ok := backend.Peer(idle.PublicKey); ok {
+		t.Error("Expected idle peer to be removed")
+	}
+	if _, ok := backend.Peer(active.PublicKey); !ok {
+		t.Error("Expected active peer to be kept")
+	}
+
+	var stored models.Session
+	db.First(&stored, idle.ID)
+	if stored.Status != "disconnected" || stored.DisconnectedAt == nil {
+		t.Errorf("Expected idle session to be disconnected, got status %q", stored.Status)
+	}
+
+	var kept models.Session
+	db.First(&kept, active.ID)
+	if kept.Status != "active" || !kept.LastKeepalive.Equal(handshake) {
+		t.Errorf("Expected active session with keepalive %s, got status %q and %s", handshake, kept.Status, kept.LastKeepalive)
+	}
+
+	if s.GetConnectedUsers() != 1 {
+		t.Errorf("Expected 1 tracked session, got %d", s.GetConnectedUsers())
+	}
+}
+
+func TestCheckInactiveSessionsKeepsSessionsWhenStatsFail(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	sess := createTestSession(t, s, userID)
+	s.activeSessions[sess.ID].LastKeepalive = time.Now().Add(-time.Hour)
+
+	backend.SetError(errors.New("interface down"))
+	s.checkInactiveSessions()
+
+	if s.GetConnectedUsers() != 1 {
+		t.Errorf("Expected session to be kept when peer stats are unavailable, got %d tracked", s.GetConnectedUsers())
+	}
+}
+
+func TestStopKeepsSessions(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	sess := createTestSession(t, s, userID)
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	if s.GetConnectedUsers() != 0 {
+		t.Errorf("Expected no tracked sessions after stopping, got %d", s.GetConnectedUsers())
+	}
+	if _, ok := backend.Peer(sess.PublicKey); !ok {
+		t.Error("Expected the peer to stay on the interface")
+	}
+
+	var kept models.Session
+	db.First(&kept, sess.ID)
+	if kept.Status != "active" {
+		t.Errorf("Expected the session to stay active across a restart, got %s", kept.Status)
+	}
+}
+
+func TestRestartReusesInterface(t *testing.T) {
+	s, backend, db := newTestService(t)
+	s.config.KeyFile = filepath.Join(t.TempDir(), "wireguard.key")
+	userID := createTestUser(t, db)
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	sess := createTestSession(t, s, userID)
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	// The restarted process finds the interface still up with its peers
+	restarted := NewService(s.control, backend, Config{KeyFile: s.config.KeyFile})
+	if err := restarted.Start(); err != nil {
+		t.Fatalf("Start after restart failed: %v", err)
+	}
+	t.Cleanup(func() { restarted.Stop() })
+
+	if backend.Setups() != 2 {
+		t.Errorf("Expected the interface to be set up on both starts, got %d", backend.Setups())
+	}
+	if _, ok := backend.Peer(sess.PublicKey); !ok {
+		t.Error("Expected the peer to survive the restart")
+	}
+	if restarted.GetConnectedUsers() != 1 {
+		t.Errorf("Expected the session to be tracked again, got %d", restarted.GetConnectedUsers())
+	}
+
+	var kept models.Session
+	db.First(&kept, sess.ID)
+	if kept.Status != "active" {
+		t.Errorf("Expected the session to stay active, got %s", kept.Status)
+	}
+}
+
+func TestRehydrateSessions(t *testing.T) {
+	s, _, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	sess := createTestSession(t, s, userID)
+	db.Model(&models.Session{}).Where("id = ?", sess.ID).
+		UpdateColumn("last_keepalive", time.Now().Add(-time.Hour))
+
+	// A restarted node starts with no tracked sessions
+	restarted := NewService(s.control, wireguard.NewFakeBackend("wg0"), Config{})
+	restarted.nodeName = s.nodeName
+	t.Cleanup(restarted.cancel)
+
+	restarted.rehydrateSessions()
+
+	info, ok := restarted.activeSessions[sess.ID]
+	if !ok {
+		t.Fatal("Expected session to be rehydrated")
+	}
+	if time.Since(info.LastKeepalive) > time.Minute {
+		t.Errorf("Expected downtime not to count as idle time, keepalive is %s", info.LastKeepalive)
+	}
+
+	restarted.checkInactiveSessions()
+	if restarted.GetConnectedUsers() != 1 {
+		t.Errorf("Expected rehydrated session to survive the first check, got %d tracked", restarted.GetConnectedUsers())
+	}
+}
+
+func TestShapePeersToPlanSpeed(t *testing.T) {
+	s, backend, db := newTestService(t)
+	shaper := shaping.NewFakeShaper()
+	s.shaper = shaper
+
+	user := &models.User{
+		Email:            uuid.NewString() + "@example.com",
+		PasswordHash:     "hash",
+		Username:         uuid.NewString(),
+		SubscriptionTier: models.FreePlan,
+	}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	sess := createTestSession(t, s, user.ID)
+	ip := session.HostIP(sess.TunnelIP)
+	if rate := shaper.Limits()[ip]; rate != 20000 {
+		t.Fatalf("Expected the free plan's 20 Mbps limit, got %d kbps", rate)
+	}
+
+	// Throttled by the gateway, then restored
+	if err := s.SetPeerRateLimit(sess.PublicKey, 256); err != nil {
+		t.Fatalf("SetPeerRateLimit failed: %v", err)
+	}
+	if rate := shaper.Limits()[ip]; rate != 256 {
+		t.Errorf("Expected the peer to be throttled to 256 kbps, got %d", rate)
+	}
+
+	// A restarted node rebuilds the limits from the sessions
+	restarted := NewService(s.control, backend, Config{Shaper: shaper})
+	restarted.nodeName = s.nodeName
+	t.Cleanup(restarted.cancel)
+	shaper.Setup()
+	restarted.syncPeers()
+	if rate := shaper.Limits()[ip]; rate != 256 {
+		t.Errorf("Expected the throttled limit to be restored after restart, got %d kbps", rate)
+	}
+
+	if err := restarted.SetPeerRateLimit(sess.PublicKey, 0); err != nil {
+		t.Fatalf("SetPeerRateLimit failed: %v", err)
+	}
+	if rate := shaper.Limits()[ip]; rate != 20000 {
+		t.Errorf("Expected the plan's limit after lifting the throttle, got %d kbps", rate)
+	}
+
+	// Upgrading to a plan without a speed limit removes it on the next sync
+	db.Model(user).Updates(map[string]interface{}{
+		"subscription_tier":   "ultimate",
+		"subscription_expiry": time.Now().Add(time.Hour),
+	})
+	restarted.syncPeers()
+	if _, ok := shaper.Limits()[ip]; ok {
+		t.Error("Expected the ultimate plan's peer not to be limited")
+	}
+
+	db.Model(user).Update("subscription_tier", "basic")
+	restarted.syncPeers()
+	if err := restarted.DisconnectSession(sess.ID); err != nil {
+		t.Fatalf("DisconnectSession failed: %v", err)
+	}
+	if len(shaper.Limits()) != 0 {
+		t.Errorf("Expected the limit to be removed with the peer, got %v", shaper.Limits())
+	}
+}
+
+func TestUpdateTrafficStats(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	sess := createTestSession(t, s, userID)
+
+	// The first sample only establishes the baseline
+	s.updateTrafficStats()
+
+	if err := backend.Transfer(sess.PublicKey, 3*1024*1024, 1024*1024); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+
+	s.trafficMu.Lock()
+	s.lastTrafficCheck = time.Now().Add(-time.Second)
+	s.trafficMu.Unlock()
+
+	s.updateTrafficStats()
+	s.reportTraffic(context.Background())
+
+	var node models.VPNNode
+	db.First(&node, s.nodeID)
+	if node.TotalBandwidthKB != 4096 {
+		t.Errorf("Expected 4096 KB of traffic, got %d", node.TotalBandwidthKB)
+	}
+	if node.BandwidthUsageGbps <= 0 {
+		t.Errorf("Expected positive bandwidth usage, got %f", node.BandwidthUsageGbps)
+	}
+
+	mbps := s.GetCurrentTrafficMbps()
+	if mbps < 30 || mbps > 34 {
+		t.Errorf("Expected about 33.5 Mbps, got %f", mbps)
+	}
+}
+
+func TestUpdateTrafficStatsPerSession(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	first := createTestSession(t, s, userID)
+	second := createTestSession(t, s, userID)
+
+	s.updateTrafficStats()
+
+	const mb = 1024 * 1024
+	backend.Transfer(first.PublicKey, 2*mb, 6*mb)
+	backend.Transfer(second.PublicKey, mb, mb)
+	s.updateTrafficStats()
+
+	// Recreating the interface restarts counters from zero
+	backend.ResetCounters()
+	backend.Transfer(first.PublicKey, mb, mb)
+	s.updateTrafficStats()
+	s.reportTraffic(context.Background())
+
+	var stored models.Session
+	db.First(&stored, first.ID)
+	if stored.BytesReceived != 3*mb || stored.BytesSent != 7*mb {
+		t.Errorf("Expected 3 MB received and 7 MB sent, got %d and %d", stored.BytesReceived, stored.BytesSent)
+	}
+	if want := 10.0 / 1024; stored.DataUsedGB != want {
+		t.Errorf("Expected %f GB used, got %f", want, stored.DataUsedGB)
+	}
+
+	var user models.User
+	db.First(&user, userID)
+	if want := 12.0 / 1024; user.DataTransferredGB < want-1e-9 || user.DataTransferredGB > want+1e-9 {
+		t.Errorf("Expected user total of %f GB, got %f", want, user.DataTransferredGB)
+	}
+}
+
+func TestReportTrafficKeepsUnreportedTraffic(t *testing.T) {
+	s, backend, db := newTestService(t)
+	userID := createTestUser(t, db)
+
+	sess := createTestSession(t, s, userID)
+	s.updateTrafficStats()
+
+	const mb = 1024 * 1024
+	backend.Transfer(sess.PublicKey, mb, mb)
+	s.updateTrafficStats()
+
+	// A report the control server refuses is sent again with the next one
+	db.Model(&models.VPNNode{}).Where("id = ?", s.nodeID).UpdateColumn("is_active", false)
+	s.reportTraffic(context.Background())
+	db.Model(&models.VPNNode{}).Where("id = ?", s.nodeID).UpdateColumn("is_active", true)
+
+	backend.Transfer(sess.PublicKey, mb, 0)
+	s.updateTrafficStats()
+	s.reportTraffic(context.Background())
+
+	var stored models.Session
+	db.First(&stored, sess.ID)
+	if stored.BytesReceived != 2*mb || stored.BytesSent != mb {
+		t.Errorf("Expected 2 MB received and 1 MB sent, got %d and %d", stored.BytesReceived, stored.BytesSent)
+	}
+}
+
+func TestControlPlaneScopesSessionsToNode(t *testing.T) {
+	s, _, db := newTestService(t)
+	userID := createTestUser(t, db)
+	sess := createTestSession(t, s, userID)
+
+	// Another enrolled node cannot see, end or report traffic for the session
+	identityKey, identityPublicKey, _ := controlapi.GenerateKey()
+	other := &models.VPNNode{
+		Name:        "test-node-2",
+		Hostname:    "node2.test",
+		Country:     "Testland",
+		CountryCode: "TL",
+		City:        "Test City",
+		PublicIP:    "192.0.2.11",
+		InternalIP:  "10.9.0.1",
+		IsActive:    true,
+		IdentityKey: identityPublicKey,
+	}
+	if err := db.Create(other).Error; err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	client := newControlClient(t, other.ID, identityKey, identityPublicKey)
+	ctx := context.Background()
+
+	sessions, err := client.Sessions(ctx)
+	if err != nil {
+		t.Fatalf("Sessions failed: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("Expected no sessions for the other node, got %d", len(sessions))
+	}
+
+	if err := client.EndSession(ctx, sess.ID, "disconnected"); !errors.Is(err, controlapi.ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+
+	report := controlapi.TrafficReport{Sessions: []controlapi.SessionTraffic{{SessionID: sess.ID, BytesSent: 1 << 30}}}
+	if err := client.ReportTraffic(ctx, report); err != nil {
+		t.Fatalf("ReportTraffic failed: %v", err)
+	}
+
+	var stored models.Session
+	db.First(&stored, sess.ID)
+	if stored.Status != "active" || stored.BytesSent != 0 {
+		t.Errorf("Expected the session to be untouched, got status %q and %d bytes sent", stored.Status, stored.BytesSent)
+	}
+}
+
+// createTestOperator makes the service's node operator-owned
+func createTestOperator(t *testing.T, s *Service, db *gorm.DB) *models.NodeOperator {
+	t.Helper()
+
+	operator := &models.NodeOperator{
+		UserID:        createTestUser(t, db),
+		WalletAddress: "0x" + uuid.NewString(),
+		Status:        "active",
+	}
+	if err := db.Create(operator).Error; err != nil {
+		t.Fatalf("Failed to create operator: %v", err)
+	}
+	if err := db.Model(&models.VPNNode{}).Where("id = ?", s.nodeID).
+		UpdateColumn("operator_id", operator.ID).Error; err != nil {
+		t.Fatalf("Failed to assign operator: %v", err)
+	}
+	return operator
+}
+
+func TestDisconnectRecordsEarnings(t *testing.T) {
+	s, backend, db := newTestService(t)
+	operator := createTestOperator(t, s, db)
+	userID := createTestUser(t, db)
+
+	sess := createTestSession(t, s, userID)
+
+	s.updateTrafficStats()
+	backend.Transfer(sess.PublicKey, 512*1024*1024, 512*1024*1024)
+	s.updateTrafficStats()
+
+	if err := s.DisconnectSession(sess.ID); err != nil {
+		t.Fatalf("DisconnectSession failed: %v", err)
+	}
+
+	// Settling an already settled session must not pay it again
+	if err := rewards.NewRewardService(applogger.Global(), nil).RecordSessionEnd(context.Background(), sess.ID); err != nil {
+		t.Fatalf("RecordSessionEnd failed: %v", err)
+	}
+
+	var earnings []models.OperatorEarning
+	db.Where("session_id = ?", sess.ID).Find(&earnings)
+	if len(earnings) != 1 {
+		t.Fatalf("Expected 1 earning, got %d", len(earnings))
+	}
+	if earnings[0].BandwidthGB != 1 || earnings[0].AmountUSD <= 0 {
+		t.Errorf("Expected a positive earning for 1 GB, got %f USD for %f GB", earnings[0].AmountUSD, earnings[0].BandwidthGB)
+	}
+
+	var stored models.NodeOperator
+	db.First(&stored, operator.ID)
+	if stored.PendingPayout != earnings[0].AmountUSD {
+		t.Errorf("Expected pending payout %f from the ledger, got %f", earnings[0].AmountUSD, stored.PendingPayout)
+	}
+
+	drifts, err := ledger.Reconcile(db)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("Expected the ledger to match, got %v", drifts)
+	}
+}
+
+func TestCheckpointNodeEarnings(t *testing.T) {
+	s, _, db := newTestService(t)
+	createTestOperator(t, s, db)
+	userID := createTestUser(t, db)
+
+	sess := createTestSession(t, s, userID)
+
+	const gb = 1024 * 1024 * 1024
+	db.Model(&models.Session{}).Where("id = ?", sess.ID).Updates(map[string]interface{}{
+		"connected_at":   time.Now().Add(-3 * time.Hour),
+		"bytes_received": 2 * gb,
+	})
+
+	ctx := context.Background()
+	rewardService := rewards.NewRewardService(applogger.Global(), nil)
+	for i := 0; i < 2; i++ {
+		if err := rewardService.CheckpointNode(ctx, s.nodeID, time.Hour); err != nil {
+			t.Fatalf("CheckpointNode failed: %v", err)
+		}
+	}
+
+	var count int64
+	db.Model(&models.OperatorEarning{}).Where("session_id = ?", sess.ID).Count(&count)
+	if count != 1 {
+		t.Fatalf("Expected 1 checkpoint earning after repeated checkpoints, got %d", count)
+	}
+
+	db.Model(&models.Session{}).Where("id = ?", sess.ID).UpdateColumn("bytes_sent", gb)
+	if err := s.DisconnectSession(sess.ID); err != nil {
+		t.Fatalf("DisconnectSession failed: %v", err)
+	}
+
+	var earnings []models.OperatorEarning
+	db.Where("session_id = ?", sess.ID).Order("period_end").Find(&earnings)
+	if len(earnings) != 2 {
+		t.Fatalf("Expected checkpoint and final earnings, got %d", len(earnings))
+	}
+	if earnings[0].BandwidthGB != 2 || earnings[1].BandwidthGB != 1 {
+		t.Errorf("Expected 2 GB then 1 GB, got %f and %f", earnings[0].BandwidthGB, earnings[1].BandwidthGB)
+	}
+	if !earnings[1].PeriodStart.Equal(earnings[0].PeriodEnd) {
+		t.Errorf("Expected final period to start at %s, got %s", earnings[0].PeriodEnd, earnings[1].PeriodStart)
+	}
+}
@@ -0,0 +1,160 @@
+package node
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
+	"github.com/nikola43/aureo-vpn/pkg/metrics"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+)
+
+// peerLimit is the bandwidth limit applied to a peer
+type peerLimit struct {
+	tunnelIP string
+	rateKbps int
+}
+
+// nodePeers is the PeerManager behind the node API. Peers the gateway adds
+// and removes are shaped like those found by peer sync, and the gateway can
+// throttle them below their plan's speed.
+type nodePeers struct {
+	wireguard.Backend
+	s *Service
+}
+
+func (p nodePeers) AddPeer(peer wireguard.PeerConfig) error {
+	return p.s.addPeer(peer)
+}
+
+func (p nodePeers) RemovePeer(publicKey string) error {
+	return p.s.removePeer(publicKey)
+}
+
+func (p nodePeers) SetPeerRateLimit(publicKey string, rateKbps int) error {
+	return p.s.SetPeerRateLimit(publicKey, rateKbps)
+}
+
+// addPeer adds a peer and applies its session's bandwidth limit. A peer that
+// cannot be shaped now is shaped by the next peer sync.
+func (s *Service) addPeer(peer wireguard.PeerConfig) error {
+	if err := s.wgManager.AddPeer(peer); err != nil {
+		return err
+	}
+	if err := s.shapePeer(peer.PublicKey); err != nil {
+		log.Printf("Failed to shape peer %s: %v", peer.PublicKey, err)
+	}
+	return nil
+}
+
+// removePeer removes a peer and its bandwidth limit
+func (s *Service) removePeer(publicKey string) error {
+	if err := s.wgManager.RemovePeer(publicKey); err != nil {
+		return err
+	}
+	if err := s.setLimit(publicKey, "", 0); err != nil {
+		log.Printf("Failed to remove limit of peer %s: %v", publicKey, err)
+	}
+	return nil
+}
+
+// SetPeerRateLimit throttles a peer to rateKbps, or restores its plan's speed
+// when rateKbps is 0. The control server records the rate on the session so
+// peer sync keeps it.
+func (s *Service) SetPeerRateLimit(publicKey string, rateKbps int) error {
+	if s.shaper == nil {
+		return fmt.Errorf("bandwidth shaping is disabled on this node")
+	}
+
+	sess, err := s.control.LimitSession(s.ctx, publicKey, rateKbps)
+	if err != nil {
+		return fmt.Errorf("failed to save rate limit: %w", err)
+	}
+	return s.setLimit(publicKey, sess.TunnelIP, sess.RateKbps)
+}
+
+// shapePeer applies the bandwidth limit of the active session using publicKey
+func (s *Service) shapePeer(publicKey string) error {
+	if s.shaper == nil {
+		return nil
+	}
+
+	sess, err := s.control.PeerSession(s.ctx, publicKey)
+	if err != nil {
+		return fmt.Errorf("no active session for peer %s: %w", publicKey, err)
+	}
+	return s.setLimit(publicKey, sess.TunnelIP, sess.RateKbps)
+}
+
+// reconcileLimits makes the peer limits match the active sessions' plans,
+// removing the limits of peers without a session. Plan changes and limits
+// that failed to apply earlier are picked up here.
+func (s *Service) reconcileLimits(sessions []controlapi.Session) {
+	if s.shaper == nil {
+		return
+	}
+
+	wanted := make(map[string]bool, len(sessions))
+	for _, sess := range sessions {
+		wanted[sess.PublicKey] = true
+		if err := s.setLimit(sess.PublicKey, sess.TunnelIP, sess.RateKbps); err != nil {
+			log.Printf("Failed to shape session %s: %v", sess.ID, err)
+		}
+	}
+
+	s.limitMu.Lock()
+	var stale []string
+	for publicKey := range s.limits {
+		if !wanted[publicKey] {
+			stale = append(stale, publicKey)
+		}
+	}
+	s.limitMu.Unlock()
+
+	for _, publicKey := range stale {
+		if err := s.setLimit(publicKey, "", 0); err != nil {
+			log.Printf("Failed to remove limit of peer %s: %v", publicKey, err)
+		}
+	}
+}
+
+// setLimit changes a peer's bandwidth limit if it differs from the applied
+// one. A rate of 0 removes the limit; tunnelIP is only needed to add one.
+func (s *Service) setLimit(publicKey, tunnelIP string, rateKbps int) error {
+	if s.shaper == nil {
+		return nil
+	}
+
+	s.limitMu.Lock()
+	defer s.limitMu.Unlock()
+
+	current, ok := s.limits[publicKey]
+	if ok && current.rateKbps == rateKbps && (rateKbps == 0 || current.tunnelIP == tunnelIP) {
+		return nil
+	}
+
+	// The peer moved to another tunnel IP, or is no longer limited
+	if ok && (rateKbps == 0 || current.tunnelIP != tunnelIP) {
+		if err := s.shaper.Unlimit(current.tunnelIP); err != nil {
+			metrics.ShapingErrors.WithLabelValues(s.nodeName, "unlimit").Inc()
+			return err
+		}
+		delete(s.limits, publicKey)
+	}
+
+	if rateKbps > 0 {
+		if err := s.shaper.Limit(tunnelIP, rateKbps); err != nil {
+			metrics.ShapingErrors.WithLabelValues(s.nodeName, "limit").Inc()
+			return err
+		}
+		s.limits[publicKey] = peerLimit{tunnelIP: tunnelIP, rateKbps: rateKbps}
+	}
+
+	total := 0
+	for _, limit := range s.limits {
+		total += limit.rateKbps
+	}
+	metrics.ShapedPeers.WithLabelValues(s.nodeName).Set(float64(len(s.limits)))
+	metrics.ShapedRate.WithLabelValues(s.nodeName).Set(float64(total))
+	return nil
+}
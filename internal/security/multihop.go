@@ -1,18 +1,21 @@
 package security
 
 import (
+	"context"
 	"fmt"
 	"log"
 
 	"github.com/google/uuid"
 	"github.com/nikola43/aureo-vpn/pkg/database"
 	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
 	"gorm.io/gorm"
 )
 
 // MultiHopManager handles multi-hop (double VPN) routing
 type MultiHopManager struct {
-	db *gorm.DB
+	db    *gorm.DB
+	plans *plans.Service
 }
 
 // HopChain represents a chain of VPN hops
@@ -30,12 +33,17 @@ type HopChain struct {
 // NewMultiHopManager creates a new multi-hop manager
 func NewMultiHopManager() *MultiHopManager {
 	return &MultiHopManager{
-		db: database.GetDB(),
+		db:    database.GetDB(),
+		plans: plans.NewService(),
 	}
 }
 
 // CreateDoubleVPNChain creates a double VPN connection chain
 func (m *MultiHopManager) CreateDoubleVPNChain(userID uuid.UUID, entryCountry, exitCountry string) (*HopChain, error) {
+	if err := m.plans.Require(context.Background(), userID, plans.FeatureMultiHop); err != nil {
+		return nil, err
+	}
+
 	log.Printf("Creating double VPN chain: %s -> %s", entryCountry, exitCountry)
 
 	// Get entry node (first hop)
@@ -87,6 +95,10 @@ func (m *MultiHopManager) CreateTripleVPNChain(userID uuid.UUID, countries []str
 		return nil, fmt.Errorf("triple VPN requires exactly 3 countries")
 	}
 
+	if err := m.plans.Require(context.Background(), userID, plans.FeatureMultiHop); err != nil {
+		return nil, err
+	}
+
 	log.Printf("Creating triple VPN chain: %s -> %s -> %s", countries[0], countries[1], countries[2])
 
 	// Get entry node
@@ -140,6 +152,10 @@ func (m *MultiHopManager) CreateTripleVPNChain(userID uuid.UUID, countries []str
 
 // GetOptimalMultiHopRoute finds the optimal multi-hop route based on latency
 func (m *MultiHopManager) GetOptimalMultiHopRoute(userID uuid.UUID, targetCountry string) (*HopChain, error) {
+	if err := m.plans.Require(context.Background(), userID, plans.FeatureMultiHop); err != nil {
+		return nil, err
+	}
+
 	// Get all available nodes for multi-hop
 	var nodes []models.VPNNode
 	m.db.Where("status = ? AND is_active = ? AND supports_multihop = ?",
@@ -13,13 +13,17 @@ var (
 	ErrExpiredToken = errors.New("token has expired")
 )
 
+// mfaChallengeDuration is how long a user has to enter their two-factor code
+const mfaChallengeDuration = 5 * time.Minute
+
 // Claims represents JWT claims
 type Claims struct {
 	UserID    uuid.UUID `json:"user_id"`
 	Email     string    `json:"email"`
 	Username  string    `json:"username"`
 	IsAdmin   bool      `json:"is_admin"`
-	TokenType string    `json:"token_type"` // access, refresh
+	TokenType string    `json:"token_type"` // access or mfa
+	SessionID uuid.UUID `json:"sid"`        // Refresh token family the token was issued for
 	jwt.RegisteredClaims
 }
 
@@ -41,44 +45,61 @@ func NewTokenService(secretKey string, accessDuration, refreshDuration time.Dura
 
 // GenerateAccessToken generates an access token for a user
 func (t *TokenService) GenerateAccessToken(userID uuid.UUID, email, username string, isAdmin bool) (string, error) {
-	claims := Claims{
+	token, _, err := t.issueAccessToken(userID, email, username, isAdmin, uuid.Nil)
+	return token, err
+}
+
+// issueAccessToken generates an access token with a unique ID (jti) so it can
+// be revoked, tied to the sign-in session (refresh token family) it was
+// issued for
+func (t *TokenService) issueAccessToken(userID uuid.UUID, email, username string, isAdmin bool, sessionID uuid.UUID) (string, *Claims, error) {
+	now := time.Now()
+	claims := &Claims{
 		UserID:    userID,
 		Email:     email,
 		Username:  username,
 		IsAdmin:   isAdmin,
 		TokenType: "access",
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(t.accessTokenDuration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.accessTokenDuration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 			Issuer:    "aureo-vpn",
 			Subject:   userID.String(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(t.secretKey)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.secretKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
 }
 
-// GenerateRefreshToken generates a refresh token for a user
-func (t *TokenService) GenerateRefreshToken(userID uuid.UUID, email, username string, isAdmin bool) (string, error) {
-	claims := Claims{
+// issueChallengeToken generates a short-lived token for the second step of
+// a sign-in that needs a two-factor code. It can't be used as an access token.
+func (t *TokenService) issueChallengeToken(userID uuid.UUID) (string, *Claims, error) {
+	now := time.Now()
+	claims := &Claims{
 		UserID:    userID,
-		Email:     email,
-		Username:  username,
-		IsAdmin:   isAdmin,
-		TokenType: "refresh",
+		TokenType: "mfa",
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(t.refreshTokenDuration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaChallengeDuration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 			Issuer:    "aureo-vpn",
 			Subject:   userID.String(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(t.secretKey)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.secretKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
 }
 
 // VerifyToken verifies and parses a JWT token
@@ -105,32 +126,3 @@ func (t *TokenService) VerifyToken(tokenString string) (*Claims, error) {
 
 	return claims, nil
 }
-
-// RefreshAccessToken generates a new access token from a valid refresh token
-func (t *TokenService) RefreshAccessToken(refreshToken string) (string, error) {
-	claims, err := t.VerifyToken(refreshToken)
-	if err != nil {
-		return "", err
-	}
-
-	if claims.TokenType != "refresh" {
-		return "", ErrInvalidToken
-	}
-
-	return t.GenerateAccessToken(claims.UserID, claims.Email, claims.Username, claims.IsAdmin)
-}
-
-// GenerateTokenPair generates both access and refresh tokens
-func (t *TokenService) GenerateTokenPair(userID uuid.UUID, email, username string, isAdmin bool) (accessToken, refreshToken string, err error) {
-	accessToken, err = t.GenerateAccessToken(userID, email, username, isAdmin)
-	if err != nil {
-		return "", "", err
-	}
-
-	refreshToken, err = t.GenerateRefreshToken(userID, email, username, isAdmin)
-	if err != nil {
-		return "", "", err
-	}
-
-	return accessToken, refreshToken, nil
-}
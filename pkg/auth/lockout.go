@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+// AttemptStore counts failed sign-in attempts and blocks keys (an account or
+// an IP address) that failed too often
+type AttemptStore interface {
+	// Fail records a failed attempt and returns the failures within window
+	// of each other
+	Fail(ctx context.Context, key string, window time.Duration) (int, error)
+
+	// Lock blocks key for d
+	Lock(ctx context.Context, key string, d time.Duration) error
+
+	// Locked returns how long key stays blocked, 0 if it isn't
+	Locked(ctx context.Context, key string) (time.Duration, error)
+
+	// Reset clears the failures and block of key
+	Reset(ctx context.Context, key string) error
+}
+
+// RedisAttemptStore keeps failed attempts in Redis, shared by every gateway
+// instance
+type RedisAttemptStore struct {
+	redis *redis.Client
+}
+
+// NewRedisAttemptStore creates an attempt store backed by Redis
+func NewRedisAttemptStore(redisClient *redis.Client) *RedisAttemptStore {
+	return &RedisAttemptStore{redis: redisClient}
+}
+
+// Fail records a failed attempt
+func (r *RedisAttemptStore) Fail(ctx context.Context, key string, window time.Duration) (int, error) {
+	failsKey := "login:fails:" + key
+	count, err := r.redis.Incr(ctx, failsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	if err := r.redis.Expire(ctx, failsKey, window).Err(); err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// Lock blocks key for d
+func (r *RedisAttemptStore) Lock(ctx context.Context, key string, d time.Duration) error {
+	return r.redis.Set(ctx, "login:lock:"+key, 1, d).Err()
+}
+
+// Locked returns how long key stays blocked
+func (r *RedisAttemptStore) Locked(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := r.redis.PTTL(ctx, "login:lock:"+key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// Negative TTLs mean the key doesn't exist or never expires
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// Reset clears the failures and block of key
+func (r *RedisAttemptStore) Reset(ctx context.Context, key string) error {
+	return r.redis.Del(ctx, "login:fails:"+key, "login:lock:"+key).Err()
+}
+
+// attempts are the failed attempts of a key in a MemoryAttemptStore
+type attempts struct {
+	count       int
+	windowEnds  time.Time
+	lockedUntil time.Time
+}
+
+// MemoryAttemptStore keeps failed attempts in memory (for development and
+// single-instance deployments)
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*attempts
+}
+
+// NewMemoryAttemptStore creates an in-memory attempt store
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]*attempts)}
+}
+
+// Fail records a failed attempt
+func (m *MemoryAttemptStore) Fail(ctx context.Context, key string, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for k, a := range m.attempts {
+		if now.After(a.windowEnds) && now.After(a.lockedUntil) {
+			delete(m.attempts, k)
+		}
+	}
+
+	a, ok := m.attempts[key]
+	if !ok {
+		a = &attempts{}
+		m.attempts[key] = a
+	}
+	if now.After(a.windowEnds) {
+		a.count = 0
+	}
+	a.count++
+	a.windowEnds = now.Add(window)
+	return a.count, nil
+}
+
+// Lock blocks key for d
+func (m *MemoryAttemptStore) Lock(ctx context.Context, key string, d time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok {
+		a = &attempts{}
+		m.attempts[key] = a
+	}
+	a.lockedUntil = time.Now().Add(d)
+	return nil
+}
+
+// Locked returns how long key stays blocked
+func (m *MemoryAttemptStore) Locked(ctx context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok {
+		return 0, nil
+	}
+	if remaining := time.Until(a.lockedUntil); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+// Reset clears the failures and block of key
+func (m *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+	return nil
+}
+
+// LoginGuardConfig holds the limits on failed sign-in attempts
+type LoginGuardConfig struct {
+	MaxAttempts      int           // Failures before an account is locked
+	MaxAttemptsPerIP int           // Failures before an IP address is locked
+	LockoutDuration  time.Duration // How long a lock lasts, and the window failures are counted in
+}
+
+// LoginGuard protects sign-ins against password guessing. Failures are
+// counted per account and per IP address. Each failure on an account after
+// the first delays the next attempt, doubling every time, until the account
+// is locked. Accounts are tracked by email whether or not it exists, so the
+// responses don't reveal which emails are registered.
+type LoginGuard struct {
+	store  AttemptStore
+	config LoginGuardConfig
+	log    *logger.Logger
+}
+
+// NewLoginGuard creates a login guard. Zero limits use the defaults of 5
+// attempts per account, 20 per IP address and a 15 minute lockout.
+func NewLoginGuard(store AttemptStore, config LoginGuardConfig, log *logger.Logger) *LoginGuard {
+	if store == nil {
+		store = NewMemoryAttemptStore()
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.MaxAttemptsPerIP <= 0 {
+		config.MaxAttemptsPerIP = 20
+	}
+	if config.LockoutDuration <= 0 {
+		config.LockoutDuration = 15 * time.Minute
+	}
+	if log == nil {
+		log = logger.Global()
+	}
+	return &LoginGuard{store: store, config: config, log: log}
+}
+
+// Check returns an error if the account or IP address may not attempt a
+// sign-in yet. Blocked attempts are logged as failed. If the store is
+// unavailable the attempt is allowed.
+func (g *LoginGuard) Check(ctx context.Context, event, email, ip string) error {
+	var wait time.Duration
+	for _, key := range g.keys(email, ip) {
+		locked, err := g.store.Locked(ctx, key)
+		if err != nil {
+			g.log.Warn("failed to check login lockout", "error", err)
+			continue
+		}
+		if locked > wait {
+			wait = locked
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+
+	g.log.LogAuth(event+"_blocked", "", ip, false)
+	return tooManyAttempts(wait)
+}
+
+// Failed records a failed attempt, delaying or locking the account or IP
+// address as needed. userID is empty if the email isn't registered.
+func (g *LoginGuard) Failed(ctx context.Context, event, userID, email, ip string) {
+	g.log.LogAuth(event, userID, ip, false)
+
+	if ip != "" {
+		count, err := g.store.Fail(ctx, ipKey(ip), g.config.LockoutDuration)
+		if err != nil {
+			g.log.Warn("failed to record failed login", "error", err)
+		} else if count >= g.config.MaxAttemptsPerIP {
+			g.lock(ctx, "ip", ipKey(ip), g.config.LockoutDuration, userID, ip)
+		}
+	}
+
+	count, err := g.store.Fail(ctx, accountKey(email), g.config.LockoutDuration)
+	if err != nil {
+		g.log.Warn("failed to record failed login", "error", err)
+		return
+	}
+	if count >= g.config.MaxAttempts {
+		g.lock(ctx, "account", accountKey(email), g.config.LockoutDuration, userID, ip)
+	} else if delay := g.delay(count); delay > 0 {
+		if err := g.store.Lock(ctx, accountKey(email), delay); err != nil {
+			g.log.Warn("failed to delay login", "error", err)
+		}
+	}
+}
+
+// Succeeded records a successful attempt, clearing the account's failures.
+// The IP address's failures are kept, so one valid account doesn't let an IP
+// keep guessing others.
+func (g *LoginGuard) Succeeded(ctx context.Context, event, userID, email, ip string) {
+	g.log.LogAuth(event, userID, ip, true)
+
+	if err := g.store.Reset(ctx, accountKey(email)); err != nil {
+		g.log.Warn("failed to reset failed logins", "error", err)
+	}
+}
+
+// Challenged records a correct password for an account that still needs a
+// two-factor code. Its failures are kept until the code is verified.
+func (g *LoginGuard) Challenged(ctx context.Context, event, userID, ip string) {
+	g.log.LogAuth(event+"_mfa_required", userID, ip, true)
+}
+
+// lock blocks key for d and records the lockout
+func (g *LoginGuard) lock(ctx context.Context, scope, key string, d time.Duration, userID, ip string) {
+	if err := g.store.Lock(ctx, key, d); err != nil {
+		g.log.Warn("failed to lock login", "scope", scope, "error", err)
+		return
+	}
+	g.log.LogAuth(scope+"_locked", userID, ip, false)
+	metrics.LoginLockouts.WithLabelValues(scope).Inc()
+}
+
+// delay returns how long to wait after count failures on an account: nothing
+// after the first, then 1s, 2s, 4s and so on
+func (g *LoginGuard) delay(count int) time.Duration {
+	if count < 2 {
+		return 0
+	}
+	delay := time.Second << (count - 2)
+	if delay <= 0 || delay > g.config.LockoutDuration {
+		return g.config.LockoutDuration
+	}
+	return delay
+}
+
+func (g *LoginGuard) keys(email, ip string) []string {
+	keys := []string{accountKey(email)}
+	if ip != "" {
+		keys = append(keys, ipKey(ip))
+	}
+	return keys
+}
+
+// accountKey identifies an account by its email, hashed to keep it out of
+// the store
+func accountKey(email string) string {
+	return "account:" + hashToken(strings.ToLower(strings.TrimSpace(email)))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// tooManyAttempts is returned for sign-ins that are delayed or locked
+func tooManyAttempts(wait time.Duration) *apperrors.AppError {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	return apperrors.New(apperrors.ErrCodeRateLimit, "Too many failed login attempts, try again later", http.StatusTooManyRequests).
+		WithDetails(map[string]interface{}{
+			"retry_after": seconds,
+		})
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RevocationList records access tokens, by jti, that were revoked before they
+// expire. Entries are only kept until the token would have expired anyway.
+type RevocationList interface {
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// RedisRevocationList keeps revoked token IDs in Redis, shared by every
+// gateway instance
+type RedisRevocationList struct {
+	redis *redis.Client
+}
+
+// NewRedisRevocationList creates a revocation list backed by Redis
+func NewRedisRevocationList(redisClient *redis.Client) *RedisRevocationList {
+	return &RedisRevocationList{redis: redisClient}
+}
+
+// Revoke adds jti to the list until expiresAt
+func (r *RedisRevocationList) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return r.redis.Set(ctx, revocationKey(jti), 1, ttl).Err()
+}
+
+// IsRevoked reports whether jti is on the list
+func (r *RedisRevocationList) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := r.redis.Exists(ctx, revocationKey(jti)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func revocationKey(jti string) string {
+	return "revoked:jti:" + jti
+}
+
+// MemoryRevocationList keeps revoked token IDs in memory (for development and
+// single-instance deployments)
+type MemoryRevocationList struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// NewMemoryRevocationList creates an in-memory revocation list
+func NewMemoryRevocationList() *MemoryRevocationList {
+	return &MemoryRevocationList{revoked: make(map[string]time.Time)}
+}
+
+// Revoke adds jti to the list until expiresAt
+func (m *MemoryRevocationList) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, until := range m.revoked {
+		if !until.After(now) {
+			delete(m.revoked, id)
+		}
+	}
+	if expiresAt.After(now) {
+		m.revoked[jti] = expiresAt
+	}
+	return nil
+}
+
+// IsRevoked reports whether jti is on the list
+func (m *MemoryRevocationList) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until, ok := m.revoked[jti]
+	return ok && until.After(time.Now()), nil
+}
@@ -1,12 +1,21 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/nikola43/aureo-vpn/pkg/crypto"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/metrics"
 	"github.com/nikola43/aureo-vpn/pkg/models"
 	"gorm.io/gorm"
 )
@@ -16,6 +25,11 @@ var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrUserExists        = errors.New("user already exists")
 	ErrInactiveUser      = errors.New("user account is inactive")
+
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; the session has been signed out")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrTokenRevoked        = errors.New("token has been revoked")
 )
 
 // Service handles authentication operations
@@ -23,36 +37,77 @@ type Service struct {
 	db             *gorm.DB
 	tokenService   *TokenService
 	passwordHasher *crypto.PasswordHasher
+	revocations    RevocationList
+	encryption     *crypto.EncryptionService
+	guard          *LoginGuard
+	log            *logger.Logger
+
+	// Hash checked for unknown emails, so they take as long as wrong passwords
+	dummyHashOnce sync.Once
+	dummyHash     string
 }
 
-// NewService creates a new authentication service
-func NewService(tokenService *TokenService) *Service {
+// NewService creates a new authentication service. Revoked access tokens are
+// kept in revocations, or in memory when it is nil. Two-factor secrets are
+// encrypted with encryption; without it two-factor authentication can't be
+// enabled. Failed logins are limited by guard, or a guard with the default
+// limits when it is nil.
+func NewService(tokenService *TokenService, revocations RevocationList, encryption *crypto.EncryptionService, guard *LoginGuard) *Service {
+	if revocations == nil {
+		revocations = NewMemoryRevocationList()
+	}
+	if guard == nil {
+		guard = NewLoginGuard(nil, LoginGuardConfig{}, nil)
+	}
 	return &Service{
 		db:             database.GetDB(),
 		tokenService:   tokenService,
 		passwordHasher: crypto.NewPasswordHasher(),
+		revocations:    revocations,
+		encryption:     encryption,
+		guard:          guard,
+		log:            logger.Global(),
 	}
 }
 
+// DeviceInfo identifies the device a sign-in belongs to
+type DeviceInfo struct {
+	DeviceName string `json:"device_name"`
+	IPAddress  string `json:"-"`
+	UserAgent  string `json:"-"`
+}
+
 // RegisterRequest represents a user registration request
 type RegisterRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required,min=8"`
 	Username string `json:"username" validate:"required,min=3,max=50"`
 	FullName string `json:"full_name"`
+	DeviceInfo
 }
 
 // LoginRequest represents a login request
 type LoginRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
+	DeviceInfo
+}
+
+// RefreshRequest represents a request to exchange a refresh token
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+	DeviceInfo
 }
 
-// AuthResponse represents an authentication response
+// AuthResponse represents an authentication response. When the user has
+// two-factor authentication enabled, login only returns an MFA token to
+// complete the sign-in with a code.
 type AuthResponse struct {
-	AccessToken  string       `json:"access_token"`
-	RefreshToken string       `json:"refresh_token"`
-	User         *models.User `json:"user"`
+	AccessToken  string       `json:"access_token,omitempty"`
+	RefreshToken string       `json:"refresh_token,omitempty"`
+	User         *models.User `json:"user,omitempty"`
+	MFARequired  bool         `json:"mfa_required,omitempty"`
+	MFAToken     string       `json:"mfa_token,omitempty"`
 }
 
 // Register creates a new user account
@@ -83,40 +138,31 @@ func (s *Service) Register(req RegisterRequest) (*AuthResponse, error) {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	// Generate tokens
-	accessToken, refreshToken, err := s.tokenService.GenerateTokenPair(
-		user.ID,
-		user.Email,
-		user.Username,
-		user.IsAdmin,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate tokens: %w", err)
-	}
-
-	return &AuthResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		User:         &user,
-	}, nil
+	// Start a sign-in session for the device
+	return s.issueTokens(&user, uuid.New(), time.Now(), req.DeviceInfo)
 }
 
-// Login authenticates a user and returns tokens
+// Login authenticates a user and returns tokens. Failed attempts are limited
+// per account and IP address; errors are the same whether or not the email
+// is registered.
 func (s *Service) Login(req LoginRequest) (*AuthResponse, error) {
+	ctx := context.Background()
+
+	if err := s.guard.Check(ctx, "login", req.Email, req.IPAddress); err != nil {
+		return nil, err
+	}
+
 	// Find user by email
 	var user models.User
 	if err := s.db.Where("email = ?", req.Email).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s.passwordHasher.VerifyPassword(req.Password, s.unknownUserHash())
+			s.guard.Failed(ctx, "login", "", req.Email, req.IPAddress)
 			return nil, ErrInvalidCredentials
 		}
 		return nil, fmt.Errorf("failed to find user: %w", err)
 	}
 
-	// Check if user is active
-	if !user.IsActive {
-		return nil, ErrInactiveUser
-	}
-
 	// Verify password
 	valid, err := s.passwordHasher.VerifyPassword(req.Password, user.PasswordHash)
 	if err != nil {
@@ -124,30 +170,248 @@ func (s *Service) Login(req LoginRequest) (*AuthResponse, error) {
 	}
 
 	if !valid {
+		s.guard.Failed(ctx, "login", user.ID.String(), req.Email, req.IPAddress)
 		return nil, ErrInvalidCredentials
 	}
 
-	// Generate tokens
-	accessToken, refreshToken, err := s.tokenService.GenerateTokenPair(
-		user.ID,
-		user.Email,
-		user.Username,
-		user.IsAdmin,
-	)
+	// Only tell whether the account is active once the password is known
+	if !user.IsActive {
+		s.guard.Failed(ctx, "login", user.ID.String(), req.Email, req.IPAddress)
+		return nil, ErrInactiveUser
+	}
+
+	// The sign-in is completed by VerifyTwoFactorLogin. Failures aren't
+	// cleared until then, so codes can't be guessed by signing in again.
+	if user.TwoFactorEnabled {
+		s.guard.Challenged(ctx, "login", user.ID.String(), req.IPAddress)
+		return s.challenge(&user)
+	}
+
+	s.guard.Succeeded(ctx, "login", user.ID.String(), req.Email, req.IPAddress)
+
+	// Start a sign-in session for the device
+	return s.issueTokens(&user, uuid.New(), time.Now(), req.DeviceInfo)
+}
+
+// unknownUserHash returns a password hash to verify against when the email
+// isn't registered
+func (s *Service) unknownUserHash() string {
+	s.dummyHashOnce.Do(func() {
+		s.dummyHash, _ = s.passwordHasher.HashPassword(uuid.NewString())
+	})
+	return s.dummyHash
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token.
+// Each refresh token can be used once; presenting one that was already
+// exchanged means it leaked, so every token of its session is revoked.
+func (s *Service) RefreshToken(ctx context.Context, req RefreshRequest) (*AuthResponse, error) {
+	var token models.RefreshToken
+	if err := s.db.WithContext(ctx).Where("token_hash = ?", hashToken(req.RefreshToken)).
+		First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, fmt.Errorf("failed to find refresh token: %w", err)
+	}
+
+	if token.RotatedAt != nil && token.RevokedAt == nil {
+		return nil, s.reused(ctx, &token)
+	}
+	if !token.IsUsable() {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Only one request can rotate the token; a concurrent one is reuse
+	now := time.Now()
+	result := s.db.WithContext(ctx).Model(&models.RefreshToken{}).
+		Where("id = ? AND rotated_at IS NULL AND revoked_at IS NULL", token.ID).
+		Update("rotated_at", now)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, s.reused(ctx, &token)
+	}
+
+	user, err := s.GetUser(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, ErrInactiveUser
+	}
+
+	device := req.DeviceInfo
+	if device.DeviceName == "" {
+		device.DeviceName = token.DeviceName
+	}
+	return s.issueTokens(user, token.FamilyID, token.SignedInAt, device)
+}
+
+// reused revokes the session of a refresh token that was presented again
+func (s *Service) reused(ctx context.Context, token *models.RefreshToken) error {
+	if err := s.revokeFamily(ctx, token.FamilyID, models.RevokedReuse); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// Logout ends the session the access token was issued for, revoking the
+// access token itself and the session's refresh tokens
+func (s *Service) Logout(ctx context.Context, claims *Claims) error {
+	if claims.SessionID != uuid.Nil {
+		if err := s.revokeFamily(ctx, claims.SessionID, models.RevokedLogout); err != nil {
+			return err
+		}
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	if err := s.revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return fmt.Errorf("failed to revoke access token: %w", err)
+	}
+	return nil
+}
+
+// ListSessions returns the user's signed-in devices, most recently used first.
+// Each session is represented by its current refresh token.
+func (s *Service) ListSessions(ctx context.Context, userID uuid.UUID) ([]models.RefreshToken, error) {
+	var tokens []models.RefreshToken
+	if err := s.db.WithContext(ctx).
+		Where("user_id = ? AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&tokens).Error; err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	return tokens, nil
+}
+
+// RevokeSession signs one of the user's devices out
+func (s *Service) RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	var count int64
+	if err := s.db.WithContext(ctx).Model(&models.RefreshToken{}).
+		Where("user_id = ? AND family_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, sessionID, time.Now()).
+		Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to find session: %w", err)
+	}
+	if count == 0 {
+		return ErrSessionNotFound
+	}
+	return s.revokeFamily(ctx, sessionID, models.RevokedByUser)
+}
+
+// revokeFamily revokes every refresh token of a session along with the access
+// tokens issued with them that have not expired yet
+func (s *Service) revokeFamily(ctx context.Context, familyID uuid.UUID, reason string) error {
+	now := time.Now()
+
+	var tokens []models.RefreshToken
+	if err := s.db.WithContext(ctx).
+		Where("family_id = ? AND access_token_id <> '' AND access_expires_at > ?", familyID, now).
+		Find(&tokens).Error; err != nil {
+		return fmt.Errorf("failed to find session tokens: %w", err)
+	}
+
+	if err := s.db.WithContext(ctx).Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Updates(map[string]interface{}{
+			"revoked_at":     now,
+			"revoked_reason": reason,
+		}).Error; err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	for _, token := range tokens {
+		if err := s.revocations.Revoke(ctx, token.AccessTokenID, token.AccessExpiresAt); err != nil {
+			return fmt.Errorf("failed to revoke access token: %w", err)
+		}
+	}
+	return nil
+}
+
+// issueTokens issues an access token and a new refresh token in the session
+// familyID, recording the device it was issued to
+func (s *Service) issueTokens(user *models.User, familyID uuid.UUID, signedInAt time.Time, device DeviceInfo) (*AuthResponse, error) {
+	accessToken, claims, err := s.tokenService.issueAccessToken(user.ID, user.Email, user.Username, user.IsAdmin, familyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate tokens: %w", err)
+	}
+
+	refreshToken, err := newRefreshToken()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate tokens: %w", err)
 	}
 
+	now := time.Now()
+	token := models.RefreshToken{
+		UserID:          user.ID,
+		FamilyID:        familyID,
+		TokenHash:       hashToken(refreshToken),
+		DeviceName:      device.DeviceName,
+		IPAddress:       device.IPAddress,
+		UserAgent:       device.UserAgent,
+		SignedInAt:      signedInAt,
+		LastUsedAt:      now,
+		ExpiresAt:       now.Add(s.tokenService.refreshTokenDuration),
+		AccessTokenID:   claims.ID,
+		AccessExpiresAt: claims.ExpiresAt.Time,
+	}
+	if err := s.db.Create(&token).Error; err != nil {
+		return nil, fmt.Errorf("failed to save refresh token: %w", err)
+	}
+
 	return &AuthResponse{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
-		User:         &user,
+		User:         user,
 	}, nil
 }
 
-// RefreshToken refreshes an access token using a refresh token
-func (s *Service) RefreshToken(refreshToken string) (string, error) {
-	return s.tokenService.RefreshAccessToken(refreshToken)
+// newRefreshToken generates an opaque refresh token
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash refresh tokens and recovery codes are stored and
+// looked up by
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// isRevoked checks the revocation list for a token of the given type. If the
+// list is unavailable the token is accepted, and the failure is logged and
+// counted so an outage does not go unnoticed.
+func (s *Service) isRevoked(ctx context.Context, tokenType, jti string) bool {
+	revoked, err := s.revocations.IsRevoked(ctx, jti)
+	if err != nil {
+		metrics.RevocationCheckFailures.WithLabelValues(tokenType).Inc()
+		s.log.Warn("failed to check token revocation, accepting token", "token_type", tokenType, "error", err)
+		return false
+	}
+	return revoked
+}
+
+// VerifyAccessToken verifies an access token and checks it has not been
+// revoked. If the revocation list is unavailable the token is accepted.
+func (s *Service) VerifyAccessToken(ctx context.Context, token string) (*Claims, error) {
+	claims, err := s.tokenService.VerifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenType != "access" {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.ID != "" && s.isRevoked(ctx, "access", claims.ID) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
 }
 
 // VerifyToken verifies a JWT token and returns claims
@@ -167,8 +431,10 @@ func (s *Service) GetUser(userID uuid.UUID) (*models.User, error) {
 	return &user, nil
 }
 
-// UpdatePassword updates a user's password
-func (s *Service) UpdatePassword(userID uuid.UUID, oldPassword, newPassword string) error {
+// UpdatePassword updates a user's password from the session sessionID. Every
+// other session is signed out, since it may have been opened with the old
+// password.
+func (s *Service) UpdatePassword(ctx context.Context, userID, sessionID uuid.UUID, oldPassword, newPassword string) error {
 	user, err := s.GetUser(userID)
 	if err != nil {
 		return err
@@ -191,5 +457,20 @@ func (s *Service) UpdatePassword(userID uuid.UUID, oldPassword, newPassword stri
 	}
 
 	// Update password
-	return s.db.Model(&user).Update("password_hash", newHash).Error
+	if err := s.db.WithContext(ctx).Model(&user).Update("password_hash", newHash).Error; err != nil {
+		return err
+	}
+
+	var families []uuid.UUID
+	if err := s.db.WithContext(ctx).Model(&models.RefreshToken{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, sessionID).
+		Distinct().Pluck("family_id", &families).Error; err != nil {
+		return fmt.Errorf("failed to find sessions: %w", err)
+	}
+	for _, familyID := range families {
+		if err := s.revokeFamily(ctx, familyID, models.RevokedPasswordChange); err != nil {
+			return err
+		}
+	}
+	return nil
 }
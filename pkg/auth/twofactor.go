@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTwoFactorUnavailable = errors.New("two-factor authentication is not available")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotSetUp    = errors.New("two-factor authentication has not been set up")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	ErrInvalidMFAToken      = errors.New("invalid or expired MFA token")
+)
+
+const (
+	totpIssuer        = "Aureo VPN"
+	recoveryCodeCount = 10
+)
+
+// TwoFactorSetup is the secret to add to an authenticator app
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// TwoFactorLoginRequest completes a sign-in that needs a two-factor code
+type TwoFactorLoginRequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"` // TOTP or recovery code
+	DeviceInfo
+}
+
+// SetupTwoFactor generates a new TOTP secret for the user. Two-factor
+// authentication is enabled once a code from it is confirmed with
+// EnableTwoFactor.
+func (s *Service) SetupTwoFactor(ctx context.Context, userID uuid.UUID) (*TwoFactorSetup, error) {
+	if s.encryption == nil {
+		return nil, ErrTwoFactorUnavailable
+	}
+
+	user, err := s.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TwoFactorEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	encrypted, err := s.encryption.EncryptAES([]byte(secret))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+
+	if err := s.db.WithContext(ctx).Model(user).Updates(map[string]interface{}{
+		"two_factor_secret":    encrypted,
+		"two_factor_last_step": 0,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to save secret: %w", err)
+	}
+
+	return &TwoFactorSetup{
+		Secret: secret,
+		URI:    totpURI(totpIssuer, user.Email, secret),
+	}, nil
+}
+
+// EnableTwoFactor enables two-factor authentication once the user proves
+// their authenticator app works, and returns new recovery codes. The codes
+// are only stored hashed, so this is the only time they can be shown.
+func (s *Service) EnableTwoFactor(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	user, err := s.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TwoFactorEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TwoFactorSecret == "" {
+		return nil, ErrTwoFactorNotSetUp
+	}
+
+	secret, err := s.twoFactorSecret(user)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND two_factor_enabled = ?", user.ID, false).
+			Updates(map[string]interface{}{
+				"two_factor_enabled":   true,
+				"two_factor_last_step": step,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTwoFactorEnabled
+		}
+		return replaceRecoveryCodes(tx, user.ID, codes)
+	})
+	if err != nil {
+		if errors.Is(err, ErrTwoFactorEnabled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+
+	return codes, nil
+}
+
+// DisableTwoFactor turns two-factor authentication off after checking the
+// user's password, removing the secret and recovery codes
+func (s *Service) DisableTwoFactor(ctx context.Context, userID uuid.UUID, password string) error {
+	user, err := s.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if !user.TwoFactorEnabled {
+		return ErrTwoFactorNotEnabled
+	}
+
+	valid, err := s.passwordHasher.VerifyPassword(password, user.PasswordHash)
+	if err != nil {
+		return fmt.Errorf("failed to verify password: %w", err)
+	}
+	if !valid {
+		return ErrInvalidCredentials
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"two_factor_enabled":   false,
+			"two_factor_secret":    "",
+			"two_factor_last_step": 0,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+		return nil
+	})
+}
+
+// VerifyTwoFactorLogin completes a sign-in started by Login with the MFA token
+// it returned and a TOTP or recovery code. The MFA token can be used once, and
+// failed codes are limited like failed passwords.
+func (s *Service) VerifyTwoFactorLogin(ctx context.Context, req TwoFactorLoginRequest) (*AuthResponse, error) {
+	claims, err := s.tokenService.VerifyToken(req.MFAToken)
+	if err != nil || claims.TokenType != "mfa" {
+		return nil, ErrInvalidMFAToken
+	}
+	if s.isRevoked(ctx, "mfa", claims.ID) {
+		return nil, ErrInvalidMFAToken
+	}
+
+	user, err := s.GetUser(claims.UserID)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	if !user.IsActive {
+		return nil, ErrInactiveUser
+	}
+	if !user.TwoFactorEnabled {
+		return nil, ErrInvalidMFAToken
+	}
+
+	// Wrong codes count against the account like wrong passwords
+	if err := s.guard.Check(ctx, "login_mfa", user.Email, req.IPAddress); err != nil {
+		return nil, err
+	}
+	if err := s.checkTwoFactorCode(ctx, user, req.Code); err != nil {
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			s.guard.Failed(ctx, "login_mfa", user.ID.String(), user.Email, req.IPAddress)
+		}
+		return nil, err
+	}
+	s.guard.Succeeded(ctx, "login_mfa", user.ID.String(), user.Email, req.IPAddress)
+
+	if err := s.revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return nil, fmt.Errorf("failed to revoke MFA token: %w", err)
+	}
+
+	// Start a sign-in session for the device
+	return s.issueTokens(user, uuid.New(), time.Now(), req.DeviceInfo)
+}
+
+// challenge returns the response to a login that still needs a two-factor code
+func (s *Service) challenge(user *models.User) (*AuthResponse, error) {
+	token, _, err := s.tokenService.issueChallengeToken(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate MFA token: %w", err)
+	}
+	return &AuthResponse{
+		MFARequired: true,
+		MFAToken:    token,
+	}, nil
+}
+
+// checkTwoFactorCode accepts a TOTP code that has not been used yet or an
+// unused recovery code, which is then used up
+func (s *Service) checkTwoFactorCode(ctx context.Context, user *models.User, code string) error {
+	secret, err := s.twoFactorSecret(user)
+	if err != nil && !errors.Is(err, ErrTwoFactorUnavailable) {
+		return err
+	}
+
+	if secret != "" {
+		if step, ok := validateTOTP(secret, code, time.Now()); ok {
+			// Each code can be used once, and none older than the last one
+			result := s.db.WithContext(ctx).Model(&models.User{}).
+				Where("id = ? AND two_factor_last_step < ?", user.ID, step).
+				Update("two_factor_last_step", step)
+			if result.Error != nil {
+				return fmt.Errorf("failed to record two-factor code: %w", result.Error)
+			}
+			if result.RowsAffected == 0 {
+				return ErrInvalidTwoFactorCode
+			}
+			return nil
+		}
+	}
+
+	result := s.db.WithContext(ctx).Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return fmt.Errorf("failed to use recovery code: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// twoFactorSecret decrypts the user's TOTP secret
+func (s *Service) twoFactorSecret(user *models.User) (string, error) {
+	if s.encryption == nil {
+		return "", ErrTwoFactorUnavailable
+	}
+	secret, err := s.encryption.DecryptAES(user.TwoFactorSecret)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt two-factor secret: %w", err)
+	}
+	return string(secret), nil
+}
+
+// replaceRecoveryCodes replaces the user's recovery codes with codes
+func replaceRecoveryCodes(tx *gorm.DB, userID uuid.UUID, codes []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+
+	records := make([]models.RecoveryCode, len(codes))
+	for i, code := range codes {
+		records[i] = models.RecoveryCode{
+			UserID:   userID,
+			CodeHash: hashRecoveryCode(code),
+		}
+	}
+	return tx.Create(&records).Error
+}
+
+// generateRecoveryCodes returns random codes formatted as xxxxx-xxxxx
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored by, ignoring
+// case and formatting
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
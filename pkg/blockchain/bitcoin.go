@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"net/http"
 	"regexp"
@@ -62,6 +63,12 @@ func NewBitcoinClient(rpcURL, rpcUser, rpcPass string, log *logger.Logger) (*Bit
 
 // call makes a JSON-RPC call to the Bitcoin node
 func (bc *BitcoinClient) call(method string, params []interface{}) (json.RawMessage, error) {
+	return bc.callWallet("", method, params)
+}
+
+// callWallet makes a JSON-RPC call to one of the node's wallets, or to its
+// default wallet when wallet is empty
+func (bc *BitcoinClient) callWallet(wallet, method string, params []interface{}) (json.RawMessage, error) {
 	// Build request
 	reqBody := bitcoinRPCRequest{
 		JSONRPC: "1.0",
@@ -75,8 +82,13 @@ func (bc *BitcoinClient) call(method string, params []interface{}) (json.RawMess
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
+	endpoint := bc.rpcURL
+	if wallet != "" {
+		endpoint = walletURL(bc.rpcURL, wallet)
+	}
+
 	// Create HTTP request
-	req, err := http.NewRequest("POST", bc.rpcURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -111,18 +123,20 @@ func (bc *BitcoinClient) call(method string, params []interface{}) (json.RawMess
 	return rpcResp.Result, nil
 }
 
-// SendTransaction sends BTC to an address
-func (bc *BitcoinClient) SendTransaction(ctx context.Context, toAddress string, amountUSD float64) (*Transaction, error) {
+// SendTransaction sends btcAmount BTC to an address
+func (bc *BitcoinClient) SendTransaction(ctx context.Context, toAddress string, btcAmount float64) (*Transaction, error) {
 	// Validate address
 	valid, err := bc.ValidateAddress(toAddress)
 	if err != nil || !valid {
 		return nil, fmt.Errorf("invalid bitcoin address: %s", toAddress)
 	}
 
-	// Get current BTC price in USD (simplified - in production, use a price oracle)
-	// For now, assume 1 BTC = $40,000 USD
-	btcPriceUSD := 40000.0
-	btcAmount := amountUSD / btcPriceUSD
+	if btcAmount <= 0 {
+		return nil, fmt.Errorf("invalid bitcoin amount: %v", btcAmount)
+	}
+
+	// Amounts are sent in whole satoshis
+	btcAmount = math.Round(btcAmount*1e8) / 1e8
 
 	// Send transaction using sendtoaddress RPC method
 	// This requires the wallet to be unlocked
@@ -142,7 +156,6 @@ func (bc *BitcoinClient) SendTransaction(ctx context.Context, toAddress string,
 		"tx_hash", txHash,
 		"to", toAddress,
 		"amount_btc", btcAmount,
-		"amount_usd", amountUSD,
 	)
 
 	// Estimate fee (approximate)
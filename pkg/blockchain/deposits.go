@@ -0,0 +1,260 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Deposit is the total received by an address
+type Deposit struct {
+	Address  string
+	Amount   *big.Float // In coin units (BTC, LTC, ETH)
+	TxHashes []string   // Transactions that paid the address, when the chain reports them
+}
+
+// watchWallet is the node wallet deposit addresses are imported into.
+// Descriptor wallets holding private keys cannot watch addresses they have
+// no keys for, so deposits are tracked in a separate watch-only wallet.
+const watchWallet = "aureo-payments"
+
+// walletCall makes a JSON-RPC call to a named bitcoind wallet
+type walletCall func(wallet, method string, params []interface{}) (json.RawMessage, error)
+
+// walletURL returns the RPC endpoint of a node wallet. A wallet already named
+// in rpcURL, such as the one payouts are sent from, is replaced.
+func walletURL(rpcURL, wallet string) string {
+	endpoint := strings.TrimSuffix(rpcURL, "/")
+	if u, err := url.Parse(endpoint); err == nil {
+		if i := strings.Index(u.Path, "/wallet/"); i >= 0 {
+			u.Path, u.RawPath = u.Path[:i], ""
+			endpoint = u.String()
+		}
+	}
+	return endpoint + "/wallet/" + url.PathEscape(wallet)
+}
+
+// loadWatchWallet loads the watch-only wallet, creating it on first use.
+// It is created to load on startup, so it survives node restarts.
+func loadWatchWallet(call walletCall) error {
+	_, err := call("", "loadwallet", []interface{}{watchWallet})
+	switch {
+	case err == nil:
+		return nil
+	case strings.Contains(err.Error(), "rpc error -35:"): // RPC_WALLET_ALREADY_LOADED
+		return nil
+	case !strings.Contains(err.Error(), "rpc error -18:"): // RPC_WALLET_NOT_FOUND
+		return fmt.Errorf("failed to load wallet %s: %w", watchWallet, err)
+	}
+
+	// Without private keys, blank, no passphrase, no address reuse
+	// avoidance, descriptors, load on startup
+	params := []interface{}{watchWallet, true, true, "", false, true, true}
+	if _, err := call("", "createwallet", params); err != nil {
+		return fmt.Errorf("failed to create wallet %s: %w", watchWallet, err)
+	}
+	return nil
+}
+
+// watchAddress imports an address into the watch-only wallet as an addr()
+// descriptor, rescanning blocks from since so deposits made before the import
+// are found. Importing an address twice is harmless.
+func watchAddress(call walletCall, address string, since time.Time) error {
+	if err := loadWatchWallet(call); err != nil {
+		return err
+	}
+
+	// Descriptors are imported with their checksum
+	result, err := call("", "getdescriptorinfo", []interface{}{"addr(" + address + ")"})
+	if err != nil {
+		return fmt.Errorf("failed to get descriptor: %w", err)
+	}
+	var info struct {
+		Descriptor string `json:"descriptor"`
+	}
+	if err := json.Unmarshal(result, &info); err != nil {
+		return fmt.Errorf("failed to parse descriptor: %w", err)
+	}
+
+	request := map[string]interface{}{
+		"desc":      info.Descriptor,
+		"timestamp": since.Unix(),
+		"label":     watchWallet,
+	}
+	result, err = call(watchWallet, "importdescriptors", []interface{}{[]interface{}{request}})
+	if err != nil {
+		return fmt.Errorf("failed to import descriptor: %w", err)
+	}
+	var imported []struct {
+		Success bool `json:"success"`
+		Error   *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(result, &imported); err != nil {
+		return fmt.Errorf("failed to parse import result: %w", err)
+	}
+	if len(imported) != 1 || !imported[0].Success {
+		if len(imported) == 1 && imported[0].Error != nil {
+			return fmt.Errorf("failed to import descriptor: %s", imported[0].Error.Message)
+		}
+		return fmt.Errorf("failed to import descriptor %s", info.Descriptor)
+	}
+	return nil
+}
+
+// receivedByAddress sums what the watch-only wallet has received on an
+// address with at least minConf confirmations
+func receivedByAddress(call walletCall, address string, minConf int64) (*Deposit, error) {
+	params := []interface{}{minConf, true, true, address}
+	result, err := call(watchWallet, "listreceivedbyaddress", params)
+	if err != nil && strings.Contains(err.Error(), "rpc error -18:") {
+		// The wallet was unloaded, e.g. by a node restarted without it
+		if err := loadWatchWallet(call); err != nil {
+			return nil, err
+		}
+		result, err = call(watchWallet, "listreceivedbyaddress", params)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list received transactions: %w", err)
+	}
+
+	var received []struct {
+		Address string   `json:"address"`
+		Amount  float64  `json:"amount"`
+		TxIDs   []string `json:"txids"`
+	}
+	if err := json.Unmarshal(result, &received); err != nil {
+		return nil, fmt.Errorf("failed to parse received transactions: %w", err)
+	}
+
+	deposit := &Deposit{Address: address, Amount: new(big.Float)}
+	for _, entry := range received {
+		if entry.Address != address {
+			continue
+		}
+		deposit.Amount.Add(deposit.Amount, big.NewFloat(entry.Amount))
+		deposit.TxHashes = append(deposit.TxHashes, entry.TxIDs...)
+	}
+	return deposit, nil
+}
+
+// WatchAddress imports an address into the node's watch-only payments wallet,
+// so payments to it made since the given time are tracked
+func (bc *BitcoinClient) WatchAddress(ctx context.Context, address string, since time.Time) error {
+	if err := watchAddress(bc.callWallet, address, since); err != nil {
+		return fmt.Errorf("failed to watch bitcoin address: %w", err)
+	}
+	return nil
+}
+
+// ReceivedByAddress returns what a watched address has received with at
+// least minConf confirmations
+func (bc *BitcoinClient) ReceivedByAddress(ctx context.Context, address string, minConf int64) (*Deposit, error) {
+	return receivedByAddress(bc.callWallet, address, minConf)
+}
+
+// WatchAddress imports an address into the node's watch-only payments wallet,
+// so payments to it made since the given time are tracked
+func (lc *LitecoinClient) WatchAddress(ctx context.Context, address string, since time.Time) error {
+	if err := watchAddress(lc.callWallet, address, since); err != nil {
+		return fmt.Errorf("failed to watch litecoin address: %w", err)
+	}
+	return nil
+}
+
+// ReceivedByAddress returns what a watched address has received with at
+// least minConf confirmations
+func (lc *LitecoinClient) ReceivedByAddress(ctx context.Context, address string, minConf int64) (*Deposit, error) {
+	return receivedByAddress(lc.callWallet, address, minConf)
+}
+
+// ReceivedByAddress returns the balance of a deposit address as of the block
+// minConf-1 blocks below the chain head. Deposit addresses are never spent
+// from while they are watched, so their balance is what they received.
+func (ec *EthereumClient) ReceivedByAddress(ctx context.Context, address string, minConf int64) (*Deposit, error) {
+	if !common.IsHexAddress(address) {
+		return nil, fmt.Errorf("invalid ethereum address: %s", address)
+	}
+	account := common.HexToAddress(address)
+
+	var balance *big.Int
+	var err error
+	if minConf <= 0 {
+		balance, err = ec.client.PendingBalanceAt(ctx, account)
+	} else {
+		var head uint64
+		head, err = ec.client.BlockNumber(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block number: %w", err)
+		}
+		if uint64(minConf) > head+1 {
+			return &Deposit{Address: address, Amount: new(big.Float)}, nil
+		}
+		balance, err = ec.client.BalanceAt(ctx, account, new(big.Int).SetUint64(head+1-uint64(minConf)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance: %w", err)
+	}
+
+	amount := new(big.Float).Quo(new(big.Float).SetInt(balance), big.NewFloat(1e18))
+	return &Deposit{Address: address, Amount: amount}, nil
+}
+
+// WatchAddress registers a deposit address to be watched for payments made
+// since the given time. Bitcoin and Litecoin nodes must import it; Ethereum
+// balances can be read directly.
+func (s *Service) WatchAddress(ctx context.Context, walletType, address string, since time.Time) error {
+	switch walletType {
+	case "ethereum":
+		return nil
+
+	case "bitcoin":
+		if s.bitcoin == nil {
+			return fmt.Errorf("bitcoin client not configured")
+		}
+		return s.bitcoin.WatchAddress(ctx, address, since)
+
+	case "litecoin":
+		if s.litecoin == nil {
+			return fmt.Errorf("litecoin client not configured")
+		}
+		return s.litecoin.WatchAddress(ctx, address, since)
+
+	default:
+		return fmt.Errorf("unsupported wallet type: %s", walletType)
+	}
+}
+
+// ReceivedByAddress returns what a deposit address has received with at
+// least minConf confirmations
+func (s *Service) ReceivedByAddress(ctx context.Context, walletType, address string, minConf int64) (*Deposit, error) {
+	switch walletType {
+	case "ethereum":
+		if s.ethereum == nil {
+			return nil, fmt.Errorf("ethereum client not configured")
+		}
+		return s.ethereum.ReceivedByAddress(ctx, address, minConf)
+
+	case "bitcoin":
+		if s.bitcoin == nil {
+			return nil, fmt.Errorf("bitcoin client not configured")
+		}
+		return s.bitcoin.ReceivedByAddress(ctx, address, minConf)
+
+	case "litecoin":
+		if s.litecoin == nil {
+			return nil, fmt.Errorf("litecoin client not configured")
+		}
+		return s.litecoin.ReceivedByAddress(ctx, address, minConf)
+
+	default:
+		return nil, fmt.Errorf("unsupported wallet type: %s", walletType)
+	}
+}
@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"math/big"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/nikola43/aureo-vpn/pkg/logger"
@@ -62,46 +62,11 @@ func NewEthereumClient(rpcURL, privateKeyHex string, chainID int64, log *logger.
 	}, nil
 }
 
-// SendTransaction sends ETH to an address
-func (ec *EthereumClient) SendTransaction(ctx context.Context, toAddress string, amountUSD float64) (*Transaction, error) {
-	// Validate address
-	if !common.IsHexAddress(toAddress) {
-		return nil, fmt.Errorf("invalid ethereum address: %s", toAddress)
-	}
-	to := common.HexToAddress(toAddress)
-
-	// Get current ETH price in USD (simplified - in production, use a price oracle)
-	// For now, assume 1 ETH = $2000 USD
-	ethPriceUSD := 2000.0
-	ethAmount := amountUSD / ethPriceUSD
-
-	// Convert to Wei (1 ETH = 10^18 Wei)
-	amountWei := new(big.Float).Mul(big.NewFloat(ethAmount), big.NewFloat(1e18))
-	amount := new(big.Int)
-	amountWei.Int(amount)
-
-	// Get nonce
-	nonce, err := ec.client.PendingNonceAt(ctx, ec.address)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get nonce: %w", err)
-	}
-
-	// Get gas price
-	gasPrice, err := ec.client.SuggestGasPrice(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get gas price: %w", err)
-	}
-
-	// Estimate gas limit
-	gasLimit := uint64(21000) // Standard ETH transfer
-
-	// Create transaction
-	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
-
-	// Sign transaction
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(ec.chainID), ec.privateKey)
+// SendTransaction sends ethAmount ETH to an address
+func (ec *EthereumClient) SendTransaction(ctx context.Context, toAddress string, ethAmount float64) (*Transaction, error) {
+	signedTx, err := ec.signTx(ctx, toAddress, ethAmount)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign transaction: %w", err)
+		return nil, err
 	}
 
 	// Send transaction
@@ -112,8 +77,8 @@ func (ec *EthereumClient) SendTransaction(ctx context.Context, toAddress string,
 
 	// Calculate fee
 	fee := new(big.Float).Mul(
-		new(big.Float).SetInt(gasPrice),
-		new(big.Float).SetInt(big.NewInt(int64(gasLimit))),
+		new(big.Float).SetInt(signedTx.GasPrice()),
+		new(big.Float).SetInt(new(big.Int).SetUint64(signedTx.Gas())),
 	)
 	feeETH := new(big.Float).Quo(fee, big.NewFloat(1e18))
 
@@ -121,8 +86,7 @@ func (ec *EthereumClient) SendTransaction(ctx context.Context, toAddress string,
 		"tx_hash", signedTx.Hash().Hex(),
 		"to", toAddress,
 		"amount_eth", ethAmount,
-		"amount_usd", amountUSD,
-		"nonce", nonce,
+		"nonce", signedTx.Nonce(),
 	)
 
 	return &Transaction{
@@ -136,6 +100,20 @@ func (ec *EthereumClient) SendTransaction(ctx context.Context, toAddress string,
 	}, nil
 }
 
+// toWei converts an ETH amount to Wei. The amount is parsed from its
+// shortest decimal form so it is not skewed by binary rounding.
+func toWei(ethAmount float64) (*big.Int, error) {
+	if ethAmount <= 0 {
+		return nil, fmt.Errorf("invalid ethereum amount: %v", ethAmount)
+	}
+	eth, ok := new(big.Rat).SetString(strconv.FormatFloat(ethAmount, 'f', -1, 64))
+	if !ok {
+		return nil, fmt.Errorf("invalid ethereum amount: %v", ethAmount)
+	}
+	wei := new(big.Rat).Mul(eth, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)))
+	return new(big.Int).Quo(wei.Num(), wei.Denom()), nil
+}
+
 // GetTransactionStatus gets the status of a transaction
 func (ec *EthereumClient) GetTransactionStatus(ctx context.Context, txHash string) (*Transaction, error) {
 	hash := common.HexToHash(txHash)
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"net/http"
 	"regexp"
@@ -62,6 +63,12 @@ func NewLitecoinClient(rpcURL, rpcUser, rpcPass string, log *logger.Logger) (*Li
 
 // call makes a JSON-RPC call to the Litecoin node
 func (lc *LitecoinClient) call(method string, params []interface{}) (json.RawMessage, error) {
+	return lc.callWallet("", method, params)
+}
+
+// callWallet makes a JSON-RPC call to one of the node's wallets, or to its
+// default wallet when wallet is empty
+func (lc *LitecoinClient) callWallet(wallet, method string, params []interface{}) (json.RawMessage, error) {
 	// Build request
 	reqBody := litecoinRPCRequest{
 		JSONRPC: "1.0",
@@ -75,8 +82,13 @@ func (lc *LitecoinClient) call(method string, params []interface{}) (json.RawMes
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
+	endpoint := lc.rpcURL
+	if wallet != "" {
+		endpoint = walletURL(lc.rpcURL, wallet)
+	}
+
 	// Create HTTP request
-	req, err := http.NewRequest("POST", lc.rpcURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -111,18 +123,20 @@ func (lc *LitecoinClient) call(method string, params []interface{}) (json.RawMes
 	return rpcResp.Result, nil
 }
 
-// SendTransaction sends LTC to an address
-func (lc *LitecoinClient) SendTransaction(ctx context.Context, toAddress string, amountUSD float64) (*Transaction, error) {
+// SendTransaction sends ltcAmount LTC to an address
+func (lc *LitecoinClient) SendTransaction(ctx context.Context, toAddress string, ltcAmount float64) (*Transaction, error) {
 	// Validate address
 	valid, err := lc.ValidateAddress(toAddress)
 	if err != nil || !valid {
 		return nil, fmt.Errorf("invalid litecoin address: %s", toAddress)
 	}
 
-	// Get current LTC price in USD (simplified - in production, use a price oracle)
-	// For now, assume 1 LTC = $80 USD
-	ltcPriceUSD := 80.0
-	ltcAmount := amountUSD / ltcPriceUSD
+	if ltcAmount <= 0 {
+		return nil, fmt.Errorf("invalid litecoin amount: %v", ltcAmount)
+	}
+
+	// Amounts are sent in whole satoshis
+	ltcAmount = math.Round(ltcAmount*1e8) / 1e8
 
 	// Send transaction using sendtoaddress RPC method
 	params := []interface{}{toAddress, ltcAmount}
@@ -141,7 +155,6 @@ func (lc *LitecoinClient) SendTransaction(ctx context.Context, toAddress string,
 		"tx_hash", txHash,
 		"to", toAddress,
 		"amount_ltc", ltcAmount,
-		"amount_usd", amountUSD,
 	)
 
 	// Estimate fee (approximate)
@@ -99,12 +99,13 @@ func NewService(cfg Config, log *logger.Logger) (*Service, error) {
 	return service, nil
 }
 
-// SendTransaction sends a cryptocurrency transaction
-func (s *Service) SendTransaction(ctx context.Context, walletType, toAddress string, amountUSD float64) (*Transaction, error) {
+// SendTransaction sends amount, in units of the wallet type's coin, to
+// toAddress. Callers price the amount; the service holds no exchange rates.
+func (s *Service) SendTransaction(ctx context.Context, walletType, toAddress string, amount float64) (*Transaction, error) {
 	s.log.Info("initiating blockchain transaction",
 		"wallet_type", walletType,
 		"to_address", toAddress,
-		"amount_usd", amountUSD,
+		"amount", amount,
 	)
 
 	switch walletType {
@@ -112,19 +113,19 @@ func (s *Service) SendTransaction(ctx context.Context, walletType, toAddress str
 		if s.ethereum == nil {
 			return nil, fmt.Errorf("ethereum client not configured")
 		}
-		return s.ethereum.SendTransaction(ctx, toAddress, amountUSD)
+		return s.ethereum.SendTransaction(ctx, toAddress, amount)
 
 	case "bitcoin":
 		if s.bitcoin == nil {
 			return nil, fmt.Errorf("bitcoin client not configured")
 		}
-		return s.bitcoin.SendTransaction(ctx, toAddress, amountUSD)
+		return s.bitcoin.SendTransaction(ctx, toAddress, amount)
 
 	case "litecoin":
 		if s.litecoin == nil {
 			return nil, fmt.Errorf("litecoin client not configured")
 		}
-		return s.litecoin.SendTransaction(ctx, toAddress, amountUSD)
+		return s.litecoin.SendTransaction(ctx, toAddress, amount)
 
 	default:
 		return nil, fmt.Errorf("unsupported wallet type: %s", walletType)
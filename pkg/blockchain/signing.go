@@ -0,0 +1,247 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// SignedTransaction is a signed transaction that may not have been broadcast
+// yet. Broadcasting it again cannot pay twice: every copy has the same hash
+// and spends the same nonce or inputs, so at most one is ever mined.
+type SignedTransaction struct {
+	TxHash string
+	Raw    string // Hex encoded
+}
+
+// alreadyBroadcast reports whether a broadcast was rejected because the node
+// already has the transaction in its mempool or chain
+func alreadyBroadcast(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "already known") || // geth
+		strings.Contains(msg, "known transaction") ||
+		strings.Contains(msg, "txn-already") || // bitcoind mempool
+		strings.Contains(msg, "rpc error -27:") // bitcoind RPC_VERIFY_ALREADY_IN_CHAIN
+}
+
+// signTx builds and signs a transfer of ethAmount ETH at the next pending
+// nonce
+func (ec *EthereumClient) signTx(ctx context.Context, toAddress string, ethAmount float64) (*types.Transaction, error) {
+	if !common.IsHexAddress(toAddress) {
+		return nil, fmt.Errorf("invalid ethereum address: %s", toAddress)
+	}
+	to := common.HexToAddress(toAddress)
+
+	// Convert to Wei (1 ETH = 10^18 Wei)
+	amount, err := toWei(ethAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := ec.client.PendingNonceAt(ctx, ec.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nonce: %w", err)
+	}
+
+	gasPrice, err := ec.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gas price: %w", err)
+	}
+
+	gasLimit := uint64(21000) // Standard ETH transfer
+
+	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(ec.chainID), ec.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	return signedTx, nil
+}
+
+// SignTransaction signs a transfer of ethAmount ETH without broadcasting it
+func (ec *EthereumClient) SignTransaction(ctx context.Context, toAddress string, ethAmount float64) (*SignedTransaction, error) {
+	tx, err := ec.signTx(ctx, toAddress, ethAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode transaction: %w", err)
+	}
+	return &SignedTransaction{TxHash: tx.Hash().Hex(), Raw: hexutil.Encode(raw)}, nil
+}
+
+// BroadcastTransaction broadcasts a signed transaction. A transaction the
+// node already knows is not an error.
+func (ec *EthereumClient) BroadcastTransaction(ctx context.Context, raw string) error {
+	data, err := hexutil.Decode(raw)
+	if err != nil {
+		return fmt.Errorf("invalid signed transaction: %w", err)
+	}
+	var tx types.Transaction
+	if err := tx.UnmarshalBinary(data); err != nil {
+		return fmt.Errorf("invalid signed transaction: %w", err)
+	}
+
+	if err := ec.client.SendTransaction(ctx, &tx); err != nil && !alreadyBroadcast(err) {
+		return fmt.Errorf("failed to send transaction: %w", err)
+	}
+	return nil
+}
+
+// signRawTransaction funds a payment of amount to toAddress from a
+// bitcoind-compatible wallet and signs it. The inputs it spends are locked,
+// so other payments do not spend them before it is broadcast.
+func signRawTransaction(call func(string, []interface{}) (json.RawMessage, error), toAddress string, amount float64) (*SignedTransaction, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid amount: %v", amount)
+	}
+	// Amounts are sent in whole satoshis
+	amount = math.Round(amount*1e8) / 1e8
+
+	result, err := call("createrawtransaction", []interface{}{[]interface{}{}, map[string]float64{toAddress: amount}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	var created string
+	if err := json.Unmarshal(result, &created); err != nil {
+		return nil, fmt.Errorf("failed to parse transaction: %w", err)
+	}
+
+	result, err = call("fundrawtransaction", []interface{}{created, map[string]interface{}{"lockUnspents": true}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fund transaction: %w", err)
+	}
+	var funded struct {
+		Hex string `json:"hex"`
+	}
+	if err := json.Unmarshal(result, &funded); err != nil {
+		return nil, fmt.Errorf("failed to parse funded transaction: %w", err)
+	}
+
+	result, err = call("signrawtransactionwithwallet", []interface{}{funded.Hex})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	var signed struct {
+		Hex      string `json:"hex"`
+		Complete bool   `json:"complete"`
+	}
+	if err := json.Unmarshal(result, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse signed transaction: %w", err)
+	}
+	if !signed.Complete {
+		return nil, fmt.Errorf("wallet could not sign every input")
+	}
+
+	result, err = call("decoderawtransaction", []interface{}{signed.Hex})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode transaction: %w", err)
+	}
+	var decoded struct {
+		TxID string `json:"txid"`
+	}
+	if err := json.Unmarshal(result, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to parse decoded transaction: %w", err)
+	}
+
+	return &SignedTransaction{TxHash: decoded.TxID, Raw: signed.Hex}, nil
+}
+
+// broadcastRawTransaction broadcasts a signed transaction through a
+// bitcoind-compatible node. A transaction the node already knows is not an
+// error.
+func broadcastRawTransaction(call func(string, []interface{}) (json.RawMessage, error), raw string) error {
+	if _, err := call("sendrawtransaction", []interface{}{raw}); err != nil && !alreadyBroadcast(err) {
+		return fmt.Errorf("failed to broadcast transaction: %w", err)
+	}
+	return nil
+}
+
+// SignTransaction signs a payment of btcAmount BTC without broadcasting it
+func (bc *BitcoinClient) SignTransaction(ctx context.Context, toAddress string, btcAmount float64) (*SignedTransaction, error) {
+	if valid, err := bc.ValidateAddress(toAddress); err != nil || !valid {
+		return nil, fmt.Errorf("invalid bitcoin address: %s", toAddress)
+	}
+	return signRawTransaction(bc.call, toAddress, btcAmount)
+}
+
+// BroadcastTransaction broadcasts a signed transaction
+func (bc *BitcoinClient) BroadcastTransaction(ctx context.Context, raw string) error {
+	return broadcastRawTransaction(bc.call, raw)
+}
+
+// SignTransaction signs a payment of ltcAmount LTC without broadcasting it
+func (lc *LitecoinClient) SignTransaction(ctx context.Context, toAddress string, ltcAmount float64) (*SignedTransaction, error) {
+	if valid, err := lc.ValidateAddress(toAddress); err != nil || !valid {
+		return nil, fmt.Errorf("invalid litecoin address: %s", toAddress)
+	}
+	return signRawTransaction(lc.call, toAddress, ltcAmount)
+}
+
+// BroadcastTransaction broadcasts a signed transaction
+func (lc *LitecoinClient) BroadcastTransaction(ctx context.Context, raw string) error {
+	return broadcastRawTransaction(lc.call, raw)
+}
+
+// SignTransaction signs a payment of amount, in units of the wallet type's
+// coin, to toAddress without broadcasting it. Persisting the result before
+// broadcasting lets a payment be retried without paying twice.
+func (s *Service) SignTransaction(ctx context.Context, walletType, toAddress string, amount float64) (*SignedTransaction, error) {
+	switch walletType {
+	case "ethereum":
+		if s.ethereum == nil {
+			return nil, fmt.Errorf("ethereum client not configured")
+		}
+		return s.ethereum.SignTransaction(ctx, toAddress, amount)
+
+	case "bitcoin":
+		if s.bitcoin == nil {
+			return nil, fmt.Errorf("bitcoin client not configured")
+		}
+		return s.bitcoin.SignTransaction(ctx, toAddress, amount)
+
+	case "litecoin":
+		if s.litecoin == nil {
+			return nil, fmt.Errorf("litecoin client not configured")
+		}
+		return s.litecoin.SignTransaction(ctx, toAddress, amount)
+
+	default:
+		return nil, fmt.Errorf("unsupported wallet type: %s", walletType)
+	}
+}
+
+// BroadcastTransaction broadcasts a transaction returned by SignTransaction.
+// It may be called again with the same transaction.
+func (s *Service) BroadcastTransaction(ctx context.Context, walletType, raw string) error {
+	switch walletType {
+	case "ethereum":
+		if s.ethereum == nil {
+			return fmt.Errorf("ethereum client not configured")
+		}
+		return s.ethereum.BroadcastTransaction(ctx, raw)
+
+	case "bitcoin":
+		if s.bitcoin == nil {
+			return fmt.Errorf("bitcoin client not configured")
+		}
+		return s.bitcoin.BroadcastTransaction(ctx, raw)
+
+	case "litecoin":
+		if s.litecoin == nil {
+			return fmt.Errorf("litecoin client not configured")
+		}
+		return s.litecoin.BroadcastTransaction(ctx, raw)
+
+	default:
+		return fmt.Errorf("unsupported wallet type: %s", walletType)
+	}
+}
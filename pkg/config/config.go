@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
 	"os"
 	"strconv"
@@ -33,6 +34,21 @@ type Config struct {
 
 	// VPN configuration
 	VPN VPNConfig
+
+	// Operator payout configuration
+	Payouts PayoutConfig
+
+	// Exchange rate configuration
+	Pricing PricingConfig
+
+	// Subscription payment configuration
+	Payments PaymentConfig
+
+	// Blockchain RPC configuration for payouts and payment confirmation
+	Blockchain BlockchainConfig
+
+	// Data cap enforcement configuration
+	Quota QuotaConfig
 }
 
 // ServerConfig holds HTTP server configuration
@@ -98,13 +114,15 @@ type LoggingConfig struct {
 
 // SecurityConfig holds security configuration
 type SecurityConfig struct {
-	CORS               CORSConfig
-	RateLimit          RateLimitConfig
-	AllowedOrigins     []string
-	TrustedProxies     []string
-	PasswordMinLength  int
-	MaxLoginAttempts   int
-	LockoutDuration    time.Duration
+	CORS                  CORSConfig
+	RateLimit             RateLimitConfig
+	AllowedOrigins        []string
+	TrustedProxies        []string
+	PasswordMinLength     int
+	MaxLoginAttempts      int // Failed logins before an account is locked
+	MaxLoginAttemptsPerIP int // Failed logins before an IP address is locked
+	LockoutDuration       time.Duration
+	EncryptionKey         string // Base64 encoded 32-byte key for secrets stored in the database
 }
 
 // CORSConfig holds CORS configuration
@@ -136,12 +154,94 @@ type VPNConfig struct {
 	NodeID                string
 	DefaultProtocol       string
 	SessionTimeout        time.Duration
-	MaxSessionsPerUser    int
-	DataTransferLimitGB   float64
 	EnableKillSwitch      bool
 	EnableDNSProtection   bool
 	EnableMultiHop        bool
 	EnableObfuscation     bool
+	NodeAPIPrivateKey     string // Gateway key for the node API; nodes trust its public key
+	NodeAPITimeout        time.Duration
+	DeviceLimitPolicy     string        // At a plan's device limit: reject the new session or evict_oldest
+	JoinTokenTTL          time.Duration // How long a node join token can be redeemed
+}
+
+// PayoutConfig holds operator payout worker configuration
+type PayoutConfig struct {
+	Enabled        bool
+	Interval       time.Duration // How often operators with a payable balance are paid out
+	MinAmountUSD   float64
+	PollInterval   time.Duration // How often due jobs are picked up and transactions polled
+	MaxAttempts    int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	LeaseDuration  time.Duration
+	Confirmations  map[string]int64 // Required confirmations by wallet type
+}
+
+// PricingConfig holds exchange rate provider configuration
+type PricingConfig struct {
+	Sources        []string      // coingecko, file
+	RatesFile      string        // JSON rates file used by the file source
+	CoinGeckoURL   string
+	RequestTimeout time.Duration
+	CacheTTL       time.Duration // How long a rate is reused before fetching again
+	MaxAge         time.Duration // Rates older than this are never used
+	MinSources     int           // Sources that must agree before a median is used
+}
+
+// PaymentConfig holds subscription payment configuration
+type PaymentConfig struct {
+	// Account-level extended public keys deposit addresses are derived from,
+	// by symbol. Spending keys are never given to the server.
+	XPubs map[string]string
+
+	WatchInterval         time.Duration // How often open payments are checked on-chain
+	UnderpaymentTolerance float64       // Fraction a payment may fall short by and still confirm
+	LateGracePeriod       time.Duration // How long after expiry funds are still watched for, to refund
+}
+
+// BlockchainConfig holds the RPC endpoints payouts are sent and payments are
+// confirmed through. Chains without an RPC URL are not used.
+type BlockchainConfig struct {
+	EthereumRPCURL     string
+	EthereumPrivateKey string // Hot wallet operator payouts are sent from
+	EthereumChainID    int64
+
+	BitcoinRPCURL      string
+	BitcoinRPCUser     string
+	BitcoinRPCPassword string
+
+	LitecoinRPCURL      string
+	LitecoinRPCUser     string
+	LitecoinRPCPassword string
+}
+
+// Enabled reports whether any chain is configured
+func (c BlockchainConfig) Enabled() bool {
+	return c.EthereumRPCURL != "" || c.BitcoinRPCURL != "" || c.LitecoinRPCURL != ""
+}
+
+// Supports reports whether the chain of a payment symbol (BTC, LTC or ETH)
+// is configured
+func (c BlockchainConfig) Supports(symbol string) bool {
+	switch symbol {
+	case "BTC":
+		return c.BitcoinRPCURL != ""
+	case "LTC":
+		return c.LitecoinRPCURL != ""
+	case "ETH":
+		return c.EthereumRPCURL != ""
+	default:
+		return false
+	}
+}
+
+// QuotaConfig holds data cap enforcement configuration
+type QuotaConfig struct {
+	Enabled         bool
+	CheckInterval   time.Duration // How often usage is compared against plan caps
+	Action          string        // What happens at the cap: disconnect or throttle
+	ThrottleKbps    int           // Rate peers are limited to when throttled
+	WarningPercents []int         // Usage thresholds users are warned at, below 100
 }
 
 // Load loads configuration from environment variables
@@ -214,11 +314,13 @@ func Load() (*Config, error) {
 				MaxRequests: getEnvAsInt("RATE_LIMIT_MAX_REQUESTS", 100),
 				WindowSize:  getEnvAsDuration("RATE_LIMIT_WINDOW", time.Minute),
 			},
-			AllowedOrigins:    getEnvAsSlice("ALLOWED_ORIGINS", []string{}),
-			TrustedProxies:    getEnvAsSlice("TRUSTED_PROXIES", []string{}),
-			PasswordMinLength: getEnvAsInt("PASSWORD_MIN_LENGTH", 8),
-			MaxLoginAttempts:  getEnvAsInt("MAX_LOGIN_ATTEMPTS", 5),
-			LockoutDuration:   getEnvAsDuration("LOCKOUT_DURATION", 15*time.Minute),
+			AllowedOrigins:        getEnvAsSlice("ALLOWED_ORIGINS", []string{}),
+			TrustedProxies:        getEnvAsSlice("TRUSTED_PROXIES", []string{}),
+			PasswordMinLength:     getEnvAsInt("PASSWORD_MIN_LENGTH", 8),
+			MaxLoginAttempts:      getEnvAsInt("MAX_LOGIN_ATTEMPTS", 5),
+			MaxLoginAttemptsPerIP: getEnvAsInt("MAX_LOGIN_ATTEMPTS_PER_IP", 20),
+			LockoutDuration:       getEnvAsDuration("LOCKOUT_DURATION", 15*time.Minute),
+			EncryptionKey:         getEnv("ENCRYPTION_KEY", ""),
 		},
 
 		Metrics: MetricsConfig{
@@ -231,12 +333,71 @@ func Load() (*Config, error) {
 			NodeID:              getEnv("NODE_ID", ""),
 			DefaultProtocol:     getEnv("DEFAULT_PROTOCOL", "wireguard"),
 			SessionTimeout:      getEnvAsDuration("SESSION_TIMEOUT", 24*time.Hour),
-			MaxSessionsPerUser:  getEnvAsInt("MAX_SESSIONS_PER_USER", 5),
-			DataTransferLimitGB: getEnvAsFloat("DATA_TRANSFER_LIMIT_GB", 0), // 0 = unlimited
 			EnableKillSwitch:    getEnvAsBool("ENABLE_KILL_SWITCH", true),
 			EnableDNSProtection: getEnvAsBool("ENABLE_DNS_PROTECTION", true),
 			EnableMultiHop:      getEnvAsBool("ENABLE_MULTIHOP", true),
 			EnableObfuscation:   getEnvAsBool("ENABLE_OBFUSCATION", true),
+			NodeAPIPrivateKey:   getEnv("NODE_API_PRIVATE_KEY", ""),
+			NodeAPITimeout:      getEnvAsDuration("NODE_API_TIMEOUT", 10*time.Second),
+			DeviceLimitPolicy:   getEnv("DEVICE_LIMIT_POLICY", "reject"),
+			JoinTokenTTL:        getEnvAsDuration("JOIN_TOKEN_TTL", 24*time.Hour),
+		},
+
+		Payouts: PayoutConfig{
+			Enabled:        getEnvAsBool("PAYOUTS_ENABLED", true),
+			Interval:       getEnvAsDuration("PAYOUT_INTERVAL", 24*time.Hour),
+			MinAmountUSD:   getEnvAsFloat("PAYOUT_MIN_AMOUNT_USD", 10),
+			PollInterval:   getEnvAsDuration("PAYOUT_POLL_INTERVAL", 30*time.Second),
+			MaxAttempts:    getEnvAsInt("PAYOUT_MAX_ATTEMPTS", 5),
+			RetryBaseDelay: getEnvAsDuration("PAYOUT_RETRY_BASE_DELAY", time.Minute),
+			RetryMaxDelay:  getEnvAsDuration("PAYOUT_RETRY_MAX_DELAY", time.Hour),
+			LeaseDuration:  getEnvAsDuration("PAYOUT_LEASE_DURATION", 5*time.Minute),
+			Confirmations: map[string]int64{
+				"ethereum": int64(getEnvAsInt("PAYOUT_CONFIRMATIONS_ETHEREUM", 12)),
+				"bitcoin":  int64(getEnvAsInt("PAYOUT_CONFIRMATIONS_BITCOIN", 3)),
+				"litecoin": int64(getEnvAsInt("PAYOUT_CONFIRMATIONS_LITECOIN", 6)),
+			},
+		},
+
+		Pricing: PricingConfig{
+			Sources:        getEnvAsSlice("PRICING_SOURCES", []string{"coingecko"}),
+			RatesFile:      getEnv("PRICING_RATES_FILE", ""),
+			CoinGeckoURL:   getEnv("PRICING_COINGECKO_URL", ""),
+			RequestTimeout: getEnvAsDuration("PRICING_REQUEST_TIMEOUT", 10*time.Second),
+			CacheTTL:       getEnvAsDuration("PRICING_CACHE_TTL", time.Minute),
+			MaxAge:         getEnvAsDuration("PRICING_MAX_AGE", 15*time.Minute),
+			MinSources:     getEnvAsInt("PRICING_MIN_SOURCES", 1),
+		},
+
+		Payments: PaymentConfig{
+			XPubs: map[string]string{
+				"BTC": getEnv("PAYMENT_XPUB_BTC", ""),
+				"LTC": getEnv("PAYMENT_XPUB_LTC", ""),
+				"ETH": getEnv("PAYMENT_XPUB_ETH", ""),
+			},
+			WatchInterval:         getEnvAsDuration("PAYMENT_WATCH_INTERVAL", time.Minute),
+			UnderpaymentTolerance: getEnvAsFloat("PAYMENT_UNDERPAYMENT_TOLERANCE", 0.005),
+			LateGracePeriod:       getEnvAsDuration("PAYMENT_LATE_GRACE_PERIOD", 7*24*time.Hour),
+		},
+
+		Blockchain: BlockchainConfig{
+			EthereumRPCURL:      getEnv("ETHEREUM_RPC_URL", ""),
+			EthereumPrivateKey:  getEnv("ETHEREUM_PRIVATE_KEY", ""),
+			EthereumChainID:     int64(getEnvAsInt("ETHEREUM_CHAIN_ID", 1)),
+			BitcoinRPCURL:       getEnv("BITCOIN_RPC_URL", ""),
+			BitcoinRPCUser:      getEnv("BITCOIN_RPC_USER", ""),
+			BitcoinRPCPassword:  getEnv("BITCOIN_RPC_PASSWORD", ""),
+			LitecoinRPCURL:      getEnv("LITECOIN_RPC_URL", ""),
+			LitecoinRPCUser:     getEnv("LITECOIN_RPC_USER", ""),
+			LitecoinRPCPassword: getEnv("LITECOIN_RPC_PASSWORD", ""),
+		},
+
+		Quota: QuotaConfig{
+			Enabled:         getEnvAsBool("QUOTA_ENABLED", true),
+			CheckInterval:   getEnvAsDuration("QUOTA_CHECK_INTERVAL", 30*time.Second),
+			Action:          getEnv("QUOTA_ACTION", "disconnect"),
+			ThrottleKbps:    getEnvAsInt("QUOTA_THROTTLE_KBPS", 256),
+			WarningPercents: getEnvAsIntSlice("QUOTA_WARNING_PERCENTS", []int{80, 90}),
 		},
 	}
 
@@ -267,6 +428,25 @@ func (c *Config) Validate() error {
 		if len(c.Security.CORS.AllowedOrigins) == 0 {
 			return fmt.Errorf("CORS_ALLOWED_ORIGINS must be set in production")
 		}
+		if c.Security.EncryptionKey == "" {
+			return fmt.Errorf("ENCRYPTION_KEY is required in production")
+		}
+		// Payments to an xpub are only confirmed through its chain's RPC
+		for symbol, xpub := range c.Payments.XPubs {
+			if xpub != "" && !c.Blockchain.Supports(symbol) {
+				return fmt.Errorf("PAYMENT_XPUB_%s requires an RPC URL for its chain in production", symbol)
+			}
+		}
+	}
+
+	if c.Blockchain.EthereumRPCURL != "" && c.Blockchain.EthereumPrivateKey == "" {
+		return fmt.Errorf("ETHEREUM_PRIVATE_KEY is required with ETHEREUM_RPC_URL")
+	}
+
+	if c.Security.EncryptionKey != "" {
+		if _, err := c.Security.EncryptionKeyBytes(); err != nil {
+			return err
+		}
 	}
 
 	// Validate database configuration
@@ -277,6 +457,14 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("DB_NAME is required")
 	}
 
+	if c.VPN.DeviceLimitPolicy != "reject" && c.VPN.DeviceLimitPolicy != "evict_oldest" {
+		return fmt.Errorf("DEVICE_LIMIT_POLICY must be reject or evict_oldest")
+	}
+
+	if c.Quota.Action != "disconnect" && c.Quota.Action != "throttle" {
+		return fmt.Errorf("QUOTA_ACTION must be disconnect or throttle")
+	}
+
 	return nil
 }
 
@@ -345,6 +533,22 @@ func getEnvAsSlice(key string, defaultValue []string) []string {
 	return strings.Split(valueStr, ",")
 }
 
+func getEnvAsIntSlice(key string, defaultValue []int) []int {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	var values []int
+	for _, part := range strings.Split(valueStr, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return defaultValue
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
 // IsDevelopment returns true if running in development mode
 func (c *Config) IsDevelopment() bool {
 	return c.Logging.Environment == "development"
@@ -367,3 +571,12 @@ func (c *DatabaseConfig) DSN() string {
 func (c *RedisConfig) Addr() string {
 	return fmt.Sprintf("%s:%d", c.Host, c.Port)
 }
+
+// EncryptionKeyBytes decodes the encryption key
+func (c *SecurityConfig) EncryptionKeyBytes() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(c.EncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+	}
+	return key, nil
+}
@@ -0,0 +1,279 @@
+package controlapi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers carrying request and response authentication
+const (
+	HeaderNode      = "X-Aureo-Node"
+	HeaderTimestamp = "X-Aureo-Timestamp"
+	HeaderNonce     = "X-Aureo-Nonce"
+	HeaderSignature = "X-Aureo-Signature"
+)
+
+// MaxClockSkew is how far a request timestamp may drift from the control
+// server's clock
+const MaxClockSkew = 30 * time.Second
+
+// GenerateKey returns a new Ed25519 key, the private key as a base64 seed
+// and the public key base64 encoded
+func GenerateKey() (privateKey, publicKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(priv.Seed()), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// parsePrivateKey decodes a base64 Ed25519 seed
+func parsePrivateKey(privateKey string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// parsePublicKey decodes a base64 Ed25519 public key
+func parsePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+// Certificate binds a node's identity key to its node ID. It is signed by
+// the control server when the node enrolls.
+type Certificate struct {
+	NodeID      uuid.UUID `json:"node_id"`
+	IdentityKey string    `json:"identity_key"` // The node's Ed25519 public key
+	Issuer      string    `json:"issuer"`       // The control server's Ed25519 public key
+	IssuedAt    time.Time `json:"issued_at"`
+	Signature   string    `json:"signature"`
+}
+
+// signedParts returns what the certificate signature covers
+func (c *Certificate) signedParts() []string {
+	return []string{"certificate", c.NodeID.String(), c.IdentityKey, c.Issuer, strconv.FormatInt(c.IssuedAt.Unix(), 10)}
+}
+
+// Verify checks the certificate was signed by issuer
+func (c *Certificate) Verify(issuer string) error {
+	if c.Issuer != issuer {
+		return fmt.Errorf("certificate issued by an unknown control server")
+	}
+	pub, err := parsePublicKey(issuer)
+	if err != nil {
+		return err
+	}
+	if !verifySignature(pub, c.Signature, c.signedParts()...) {
+		return fmt.Errorf("invalid certificate signature")
+	}
+	return nil
+}
+
+// Authority is the control server's signing key. It issues node certificates
+// and signs API responses, which nodes verify against the issuer of their
+// certificate.
+type Authority struct {
+	key       ed25519.PrivateKey
+	publicKey string
+}
+
+// NewAuthority creates an authority from a base64 Ed25519 seed
+func NewAuthority(privateKey string) (*Authority, error) {
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{
+		key:       key,
+		publicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}, nil
+}
+
+// PublicKey returns the key nodes can be pinned to
+func (a *Authority) PublicKey() string {
+	return a.publicKey
+}
+
+// Issue signs a certificate for a node's identity key
+func (a *Authority) Issue(nodeID uuid.UUID, identityKey string) *Certificate {
+	cert := &Certificate{
+		NodeID:      nodeID,
+		IdentityKey: identityKey,
+		Issuer:      a.publicKey,
+		IssuedAt:    time.Now().UTC().Truncate(time.Second),
+	}
+	cert.Signature = sign(a.key, cert.signedParts()...)
+	return cert
+}
+
+// signResponse signs a response. It is bound to the request nonce so a
+// response cannot be replayed for another request.
+func (a *Authority) signResponse(nonce string, status int, body []byte) string {
+	return sign(a.key, "response", nonce, strconv.Itoa(status), string(body))
+}
+
+// Identity is a node's enrolled identity: its private key and the
+// certificate the control server issued for it
+type Identity struct {
+	PrivateKey  string      `json:"private_key"`
+	Certificate Certificate `json:"certificate"`
+
+	key ed25519.PrivateKey
+}
+
+// NodeID returns the ID of the node the identity belongs to
+func (i *Identity) NodeID() uuid.UUID {
+	return i.Certificate.NodeID
+}
+
+// init decodes the private key and checks it matches the certificate
+func (i *Identity) init() error {
+	key, err := parsePrivateKey(i.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)) != i.Certificate.IdentityKey {
+		return fmt.Errorf("private key does not match the certificate")
+	}
+	if err := i.Certificate.Verify(i.Certificate.Issuer); err != nil {
+		return err
+	}
+	i.key = key
+	return nil
+}
+
+// LoadIdentity reads an identity saved with Save. It returns an error
+// satisfying os.IsNotExist if the node hasn't enrolled yet.
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var identity Identity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("invalid identity file: %w", err)
+	}
+	if err := identity.init(); err != nil {
+		return nil, fmt.Errorf("invalid identity file: %w", err)
+	}
+	return &identity, nil
+}
+
+// Save writes the identity to path, readable only by the node
+func (i *Identity) Save(path string) error {
+	data, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// signRequest signs a request with the node's key
+func signRequest(key ed25519.PrivateKey, method, uri, timestamp, nonce string, body []byte) string {
+	return sign(key, "request", method, uri, timestamp, nonce, string(body))
+}
+
+// verifyRequest checks a request signature against the node's public key
+func verifyRequest(pub ed25519.PublicKey, signature, method, uri, timestamp, nonce string, body []byte) bool {
+	return verifySignature(pub, signature, "request", method, uri, timestamp, nonce, string(body))
+}
+
+func sign(key ed25519.PrivateKey, parts ...string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, message(parts)))
+}
+
+func verifySignature(pub ed25519.PublicKey, signature string, parts ...string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, message(parts), sig)
+}
+
+// message joins the signed parts, length-prefixing every part so boundaries
+// cannot be shifted
+func message(parts []string) []byte {
+	var msg []byte
+	for _, part := range parts {
+		msg = append(msg, strconv.Itoa(len(part))...)
+		msg = append(msg, ':')
+		msg = append(msg, part...)
+	}
+	return msg
+}
+
+// newNonce returns a random request nonce
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// checkTimestamp validates a request timestamp against the allowed skew
+func checkTimestamp(header http.Header) error {
+	ts, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return fmt.Errorf("timestamp outside allowed window")
+	}
+
+	return nil
+}
+
+// nonceCache remembers recently seen nonces to reject replayed requests
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+// add records a nonce, returning false if it was already used
+func (c *nonceCache) add(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for n, expires := range c.seen {
+		if now.After(expires) {
+			delete(c.seen, n)
+		}
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+
+	// A nonce only needs remembering while its timestamp is still accepted
+	c.seen[nonce] = now.Add(2 * MaxClockSkew)
+	return true
+}
@@ -0,0 +1,277 @@
+package controlapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+)
+
+// Client calls the control API from an enrolled node
+type Client struct {
+	baseURL    string
+	identity   *Identity
+	issuer     ed25519.PublicKey
+	httpClient *http.Client
+}
+
+// NewClient creates a control API client authenticated with the node's
+// identity. baseURL is the control server's address, e.g.
+// https://control.example.com:8090.
+func NewClient(baseURL string, identity *Identity, timeout time.Duration) (*Client, error) {
+	if identity.key == nil {
+		if err := identity.init(); err != nil {
+			return nil, fmt.Errorf("invalid identity: %w", err)
+		}
+	}
+	issuer, err := parsePublicKey(identity.Certificate.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate issuer: %w", err)
+	}
+
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		identity:   identity,
+		issuer:     issuer,
+		httpClient: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Enroll generates a new identity key and exchanges a join token for its
+// certificate. If controlPublicKey is set, the control server must sign with
+// that key; otherwise the key it answers with is trusted from then on.
+func Enroll(ctx context.Context, baseURL, token, controlPublicKey string, timeout time.Duration) (*Identity, error) {
+	privateKey, publicKey, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	key, _ := parsePrivateKey(privateKey)
+
+	body, err := json.Marshal(EnrollRequest{Token: token, IdentityKey: publicKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+	resp, err := send(ctx, httpClient, strings.TrimRight(baseURL, "/"), key, "", http.MethodPost, "/v1/enroll", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var enrolled EnrollResponse
+	if resp.status == http.StatusOK {
+		if err := json.Unmarshal(resp.body, &enrolled); err != nil {
+			return nil, fmt.Errorf("failed to decode enrollment response: %w", err)
+		}
+	}
+
+	issuer := controlPublicKey
+	if issuer == "" {
+		issuer = enrolled.Certificate.Issuer
+	}
+	pub, err := parsePublicKey(issuer)
+	if err != nil {
+		if resp.status != http.StatusOK {
+			return nil, resp.err()
+		}
+		return nil, fmt.Errorf("invalid control server key: %w", err)
+	}
+	if err := resp.verify(pub); err != nil {
+		return nil, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, resp.err()
+	}
+
+	identity := &Identity{PrivateKey: privateKey, Certificate: enrolled.Certificate}
+	if identity.Certificate.IdentityKey != publicKey {
+		return nil, fmt.Errorf("certificate issued for another key")
+	}
+	if err := identity.Certificate.Verify(issuer); err != nil {
+		return nil, err
+	}
+	identity.key = key
+
+	return identity, nil
+}
+
+// Node returns the node's record
+func (c *Client) Node(ctx context.Context) (*models.VPNNode, error) {
+	var node models.VPNNode
+	if err := c.do(ctx, http.MethodGet, "/v1/node", nil, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// NodeID returns the ID of the node the client acts for
+func (c *Client) NodeID() uuid.UUID {
+	return c.identity.NodeID()
+}
+
+// Register announces the node's WireGuard public key and node API port
+func (c *Client) Register(ctx context.Context, req RegisterRequest) error {
+	return c.do(ctx, http.MethodPut, "/v1/node", req, nil)
+}
+
+// Heartbeat marks the node online
+func (c *Client) Heartbeat(ctx context.Context, hb Heartbeat) error {
+	return c.do(ctx, http.MethodPost, "/v1/heartbeat", hb, nil)
+}
+
+// Sessions returns the node's active sessions
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	var resp SessionsResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/sessions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}
+
+// PeerSession returns the active session using publicKey on the node, or
+// ErrSessionNotFound if there is none
+func (c *Client) PeerSession(ctx context.Context, publicKey string) (*Session, error) {
+	var resp SessionsResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/sessions?public_key="+url.QueryEscape(publicKey), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Sessions) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	return &resp.Sessions[0], nil
+}
+
+// Keepalives records the latest handshakes of the node's sessions
+func (c *Client) Keepalives(ctx context.Context, keepalives []Keepalive) error {
+	return c.do(ctx, http.MethodPost, "/v1/sessions/keepalive", KeepaliveRequest{Keepalives: keepalives}, nil)
+}
+
+// EndSession ends a session on the node. It returns ErrSessionNotFound if
+// the session already ended.
+func (c *Client) EndSession(ctx context.Context, sessionID uuid.UUID, status string) error {
+	return c.do(ctx, http.MethodPost, "/v1/sessions/"+sessionID.String()+"/end", EndSessionRequest{Status: status}, nil)
+}
+
+// LimitSession throttles the session using publicKey to rateKbps, 0
+// restoring its plan's speed, and returns it with the resulting limit
+func (c *Client) LimitSession(ctx context.Context, publicKey string, rateKbps int) (*Session, error) {
+	var session Session
+	if err := c.do(ctx, http.MethodPut, "/v1/sessions/limit", LimitSessionRequest{PublicKey: publicKey, RateKbps: rateKbps}, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ReportTraffic records the traffic carried since the last report
+func (c *Client) ReportTraffic(ctx context.Context, report TrafficReport) error {
+	return c.do(ctx, http.MethodPost, "/v1/traffic", report, nil)
+}
+
+// do sends a signed request to the control server and verifies the signed
+// response
+func (c *Client) do(ctx context.Context, method, uri string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	resp, err := send(ctx, c.httpClient, c.baseURL, c.identity.key, c.identity.NodeID().String(), method, uri, body)
+	if err != nil {
+		return err
+	}
+	if err := resp.verify(c.issuer); err != nil {
+		return err
+	}
+	if resp.status >= http.StatusBadRequest {
+		return resp.err()
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(resp.body, out); err != nil {
+			return fmt.Errorf("failed to decode control server response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// response is an unverified control API response
+type response struct {
+	nonce     string
+	status    int
+	body      []byte
+	signature string
+}
+
+// send signs and sends a request with key on behalf of nodeID
+func send(ctx context.Context, httpClient *http.Client, baseURL string, key ed25519.PrivateKey, nodeID, method, uri string, body []byte) (*response, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if nodeID != "" {
+		req.Header.Set(HeaderNode, nodeID)
+	}
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, signRequest(key, method, req.URL.RequestURI(), timestamp, nonce, body))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("control server unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read control server response: %w", err)
+	}
+
+	return &response{
+		nonce:     nonce,
+		status:    resp.StatusCode,
+		body:      respBody,
+		signature: resp.Header.Get(HeaderSignature),
+	}, nil
+}
+
+// verify checks the response was signed by the control server
+func (r *response) verify(issuer ed25519.PublicKey) error {
+	if !verifySignature(issuer, r.signature, "response", r.nonce, strconv.Itoa(r.status), string(r.body)) {
+		return fmt.Errorf("control server returned an unauthenticated response")
+	}
+	return nil
+}
+
+// err returns the error reported in a failed response
+func (r *response) err() error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(r.body, &e)
+	if r.status == http.StatusNotFound && e.Error == ErrSessionNotFound.Error() {
+		return ErrSessionNotFound
+	}
+	return fmt.Errorf("control server rejected request (%d): %s", r.status, e.Error)
+}
@@ -0,0 +1,509 @@
+package controlapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/enrollment"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+	"github.com/nikola43/aureo-vpn/pkg/telemetry"
+)
+
+// DefaultPort is the port the control API listens on when none is configured
+const DefaultPort = 8090
+
+// maxBodySize limits request bodies accepted by the control API
+const maxBodySize = 256 * 1024
+
+// HeartbeatVersion is the heartbeat format nodes send. Version 1 carried only
+// the peer count; version 2 adds host telemetry. A heartbeat without a
+// version is version 1.
+const HeartbeatVersion = 2
+
+// Protocols a node can serve clients with
+const (
+	ProtocolWireGuard = "wireguard"
+	ProtocolOpenVPN   = "openvpn"
+)
+
+// ErrSessionNotFound is returned for sessions that are not active on the
+// node asking about them
+var ErrSessionNotFound = errors.New("no active session on this node")
+
+// Backend holds the node records the control API serves. Nodes have no
+// database access: everything they report or need to know goes through it.
+type Backend interface {
+	// Enroll redeems a join token, recording identityKey as the identity of
+	// the node it was issued to. It returns enrollment.ErrInvalidToken for
+	// tokens that can't be used.
+	Enroll(ctx context.Context, token, identityKey string) (uuid.UUID, error)
+
+	// IdentityKey returns the identity key enrolled for an active node, or
+	// an empty string if it has none
+	IdentityKey(ctx context.Context, nodeID uuid.UUID) (string, error)
+
+	// Node returns a node's record
+	Node(ctx context.Context, nodeID uuid.UUID) (*models.VPNNode, error)
+
+	// Register records the key and API port a node started with
+	Register(ctx context.Context, nodeID uuid.UUID, req RegisterRequest) error
+
+	// Heartbeat marks a node online
+	Heartbeat(ctx context.Context, nodeID uuid.UUID, hb Heartbeat) error
+
+	// Sessions returns a node's active sessions, or only the one using
+	// publicKey if it is set
+	Sessions(ctx context.Context, nodeID uuid.UUID, publicKey string) ([]Session, error)
+
+	// Keepalives records the latest handshakes of a node's sessions
+	Keepalives(ctx context.Context, nodeID uuid.UUID, keepalives []Keepalive) error
+
+	// EndSession ends an active session on a node. It returns
+	// ErrSessionNotFound if the session is not active there.
+	EndSession(ctx context.Context, nodeID, sessionID uuid.UUID, status string) error
+
+	// LimitSession throttles the active session using publicKey to rateKbps,
+	// 0 restoring its plan's speed, and returns it with the resulting limit.
+	// It returns ErrSessionNotFound if there is no such session on the node.
+	LimitSession(ctx context.Context, nodeID uuid.UUID, publicKey string, rateKbps int) (*Session, error)
+
+	// ReportTraffic records the traffic a node has carried since its last
+	// report
+	ReportTraffic(ctx context.Context, nodeID uuid.UUID, report TrafficReport) error
+}
+
+// EnrollRequest exchanges a join token for a node certificate. The request
+// must be signed with the private key of IdentityKey.
+type EnrollRequest struct {
+	Token       string `json:"token"`
+	IdentityKey string `json:"identity_key"`
+}
+
+// EnrollResponse carries the certificate issued to an enrolled node
+type EnrollResponse struct {
+	Certificate Certificate `json:"certificate"`
+}
+
+// RegisterRequest announces how a node can be reached once it has started
+type RegisterRequest struct {
+	PublicKey string   `json:"public_key"`          // WireGuard public key; the private key never leaves the node
+	APIPort   int      `json:"api_port,omitempty"`  // Node API port, 0 if the API is disabled
+	Protocols []string `json:"protocols,omitempty"` // Protocols the node serves; nodes that do not report them serve only WireGuard
+}
+
+// Heartbeat reports that a node is up and how loaded it is
+type Heartbeat struct {
+	Version     int               `json:"version"`
+	Connections int               `json:"connections"`         // Peers on the WireGuard interface
+	Telemetry   *telemetry.Sample `json:"telemetry,omitempty"` // Nil if the host could not be sampled
+}
+
+// Session is an active session as a node needs to know it
+type Session struct {
+	ID            uuid.UUID `json:"id"`
+	UserID        uuid.UUID `json:"user_id"`
+	Protocol      string    `json:"protocol"`
+	PublicKey     string    `json:"public_key"`
+	TunnelIP      string    `json:"tunnel_ip"`
+	LastKeepalive time.Time `json:"last_keepalive"`
+
+	// RateKbps is the peer's bandwidth limit: its plan's speed, or less if
+	// the session was throttled. 0 means unlimited.
+	RateKbps int `json:"rate_kbps"`
+}
+
+// SessionsResponse lists a node's active sessions
+type SessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// Keepalive is the latest WireGuard handshake of a session's peer
+type Keepalive struct {
+	SessionID uuid.UUID `json:"session_id"`
+	At        time.Time `json:"at"`
+}
+
+// KeepaliveRequest reports the sessions whose peers handshook since the last
+// report
+type KeepaliveRequest struct {
+	Keepalives []Keepalive `json:"keepalives"`
+}
+
+// EndSessionRequest ends a session the node disconnected, e.g. when idle
+type EndSessionRequest struct {
+	Status string `json:"status"` // disconnected or terminated
+}
+
+// LimitSessionRequest throttles a session's peer below its plan's speed
+type LimitSessionRequest struct {
+	PublicKey string `json:"public_key"`
+	RateKbps  int    `json:"rate_kbps"` // 0 restores the plan's speed
+}
+
+// SessionTraffic is the traffic of a session's peer since the last report
+type SessionTraffic struct {
+	SessionID     uuid.UUID `json:"session_id"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// TrafficReport is the traffic a node carried since its last report
+type TrafficReport struct {
+	BandwidthMbps float64          `json:"bandwidth_mbps"` // Current throughput of the interface
+	Bytes         int64            `json:"bytes"`          // All traffic, including peers without a session
+	Sessions      []SessionTraffic `json:"sessions,omitempty"`
+}
+
+// Server exposes the control plane to nodes. Apart from enrollment, every
+// request must be signed with the identity key the node enrolled, and every
+// response is signed by the control server.
+type Server struct {
+	backend    Backend
+	authority  *Authority
+	nonces     *nonceCache
+	httpServer *http.Server
+}
+
+// NewServer creates a control API server signing with authority
+func NewServer(backend Backend, authority *Authority) *Server {
+	s := &Server{
+		backend:   backend,
+		authority: authority,
+		nonces:    newNonceCache(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/enroll", s.handleEnroll)
+	mux.HandleFunc("GET /v1/node", s.authenticate(s.handleGetNode))
+	mux.HandleFunc("PUT /v1/node", s.authenticate(s.handleRegister))
+	mux.HandleFunc("POST /v1/heartbeat", s.authenticate(s.handleHeartbeat))
+	mux.HandleFunc("GET /v1/sessions", s.authenticate(s.handleListSessions))
+	mux.HandleFunc("POST /v1/sessions/keepalive", s.authenticate(s.handleKeepalive))
+	mux.HandleFunc("PUT /v1/sessions/limit", s.authenticate(s.handleLimitSession))
+	mux.HandleFunc("POST /v1/sessions/{id}/end", s.authenticate(s.handleEndSession))
+	mux.HandleFunc("POST /v1/traffic", s.authenticate(s.handleTraffic))
+
+	s.httpServer = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// ListenAndServe serves the control API on addr until Shutdown is called
+func (s *Server) ListenAndServe(addr string) error {
+	s.httpServer.Addr = addr
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler serving the control API
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// authenticatedHandler handles a request signed by an enrolled node
+type authenticatedHandler func(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{})
+
+// verifyRequest checks the timestamp, nonce and signature of a request
+// against a node's public key and returns its body
+func (s *Server) verifyRequest(r *http.Request, pub ed25519.PublicKey) ([]byte, int, string) {
+	if err := checkTimestamp(r.Header); err != nil {
+		return nil, http.StatusUnauthorized, err.Error()
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, http.StatusBadRequest, "failed to read body"
+	}
+
+	nonce := r.Header.Get(HeaderNonce)
+	if nonce == "" || !verifyRequest(pub, r.Header.Get(HeaderSignature), r.Method, r.URL.RequestURI(), r.Header.Get(HeaderTimestamp), nonce, body) {
+		return nil, http.StatusUnauthorized, "invalid signature"
+	}
+
+	if !s.nonces.add(nonce) {
+		return nil, http.StatusUnauthorized, "replayed request"
+	}
+
+	return body, 0, ""
+}
+
+// authenticate verifies the request is signed by the node it claims to come
+// from and signs the response
+func (s *Server) authenticate(next authenticatedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nonce := r.Header.Get(HeaderNonce)
+
+		nodeID, err := uuid.Parse(r.Header.Get(HeaderNode))
+		if err != nil {
+			s.respond(w, nonce, http.StatusUnauthorized, errorBody("unknown node"))
+			return
+		}
+
+		identityKey, err := s.backend.IdentityKey(r.Context(), nodeID)
+		if err != nil {
+			log.Printf("Failed to load identity of node %s: %v", nodeID, err)
+			s.respond(w, nonce, http.StatusInternalServerError, errorBody("internal error"))
+			return
+		}
+		pub, err := parsePublicKey(identityKey)
+		if err != nil {
+			// Not enrolled, deactivated or deleted
+			s.respond(w, nonce, http.StatusUnauthorized, errorBody("unknown node"))
+			return
+		}
+
+		body, status, msg := s.verifyRequest(r, pub)
+		if status != 0 {
+			s.respond(w, nonce, status, errorBody(msg))
+			return
+		}
+
+		status, resp := next(r, nodeID, body)
+		s.respond(w, nonce, status, resp)
+	}
+}
+
+// respond writes a JSON response signed by the control server
+func (s *Server) respond(w http.ResponseWriter, nonce string, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode control API response: %v", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":"internal error"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(HeaderSignature, s.authority.signResponse(nonce, status, body))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// handleEnroll redeems a join token. The request is signed with the new
+// identity key, proving the node holds its private key.
+func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	nonce := r.Header.Get(HeaderNonce)
+
+	// The body is signed with the key it carries, so peek at it first
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		s.respond(w, nonce, http.StatusBadRequest, errorBody("failed to read body"))
+		return
+	}
+	var req EnrollRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.Token == "" {
+		s.respond(w, nonce, http.StatusBadRequest, errorBody("invalid request body"))
+		return
+	}
+	pub, err := parsePublicKey(req.IdentityKey)
+	if err != nil {
+		s.respond(w, nonce, http.StatusBadRequest, errorBody("invalid identity key"))
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if _, status, msg := s.verifyRequest(r, pub); status != 0 {
+		s.respond(w, nonce, status, errorBody(msg))
+		return
+	}
+
+	nodeID, err := s.backend.Enroll(r.Context(), req.Token, req.IdentityKey)
+	if err != nil {
+		if errors.Is(err, enrollment.ErrInvalidToken) {
+			s.respond(w, nonce, http.StatusForbidden, errorBody(err.Error()))
+			return
+		}
+		log.Printf("Failed to enroll node: %v", err)
+		s.respond(w, nonce, http.StatusInternalServerError, errorBody("internal error"))
+		return
+	}
+
+	log.Printf("Node %s enrolled", nodeID)
+	s.respond(w, nonce, http.StatusOK, EnrollResponse{Certificate: *s.authority.Issue(nodeID, req.IdentityKey)})
+}
+
+func (s *Server) handleGetNode(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{}) {
+	node, err := s.backend.Node(r.Context(), nodeID)
+	if err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+	return http.StatusOK, node
+}
+
+func (s *Server) handleRegister(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{}) {
+	var req RegisterRequest
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
+		return http.StatusBadRequest, errorBody("invalid request body")
+	}
+
+	if err := wireguard.ValidatePublicKey(req.PublicKey); err != nil {
+		return http.StatusBadRequest, errorBody(fmt.Sprintf("invalid public key: %v", err))
+	}
+
+	if req.APIPort < 0 || req.APIPort > 65535 {
+		return http.StatusBadRequest, errorBody("invalid api_port")
+	}
+
+	if err := s.backend.Register(r.Context(), nodeID, req); err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, req
+}
+
+func (s *Server) handleHeartbeat(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{}) {
+	var hb Heartbeat
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&hb); err != nil {
+		return http.StatusBadRequest, errorBody("invalid request body")
+	}
+
+	if hb.Version == 0 {
+		hb.Version = 1
+	}
+	if hb.Version > HeartbeatVersion {
+		// Control servers are upgraded before their nodes
+		return http.StatusBadRequest, errorBody(fmt.Sprintf("heartbeat version %d is not supported, this control server supports up to %d", hb.Version, HeartbeatVersion))
+	}
+	if hb.Version < 2 {
+		hb.Telemetry = nil
+	}
+
+	if hb.Connections < 0 {
+		return http.StatusBadRequest, errorBody("connections must not be negative")
+	}
+
+	if t := hb.Telemetry; t != nil {
+		if !isPercent(t.CPUPercent) || !isPercent(t.MemoryPercent) {
+			return http.StatusBadRequest, errorBody("telemetry percentages must be between 0 and 100")
+		}
+		if t.UptimeSeconds < 0 || t.Load1 < 0 || t.Load5 < 0 || t.Load15 < 0 || t.RxMbps < 0 || t.TxMbps < 0 ||
+			t.ConntrackCount < 0 || t.ConntrackMax < 0 || t.Peers < 0 || t.ActivePeers < 0 {
+			return http.StatusBadRequest, errorBody("telemetry must not be negative")
+		}
+	}
+
+	if err := s.backend.Heartbeat(r.Context(), nodeID, hb); err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, hb
+}
+
+func (s *Server) handleListSessions(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{}) {
+	sessions, err := s.backend.Sessions(r.Context(), nodeID, r.URL.Query().Get("public_key"))
+	if err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, SessionsResponse{Sessions: sessions}
+}
+
+func (s *Server) handleKeepalive(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{}) {
+	var req KeepaliveRequest
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
+		return http.StatusBadRequest, errorBody("invalid request body")
+	}
+
+	if err := s.backend.Keepalives(r.Context(), nodeID, req.Keepalives); err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, map[string]int{"recorded": len(req.Keepalives)}
+}
+
+func (s *Server) handleLimitSession(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{}) {
+	var req LimitSessionRequest
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
+		return http.StatusBadRequest, errorBody("invalid request body")
+	}
+
+	if req.RateKbps < 0 {
+		return http.StatusBadRequest, errorBody("rate_kbps must not be negative")
+	}
+
+	session, err := s.backend.LimitSession(r.Context(), nodeID, req.PublicKey, req.RateKbps)
+	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return http.StatusNotFound, errorBody(err.Error())
+		}
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, session
+}
+
+func (s *Server) handleEndSession(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{}) {
+	sessionID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		return http.StatusBadRequest, errorBody("invalid session ID")
+	}
+
+	var req EndSessionRequest
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
+		return http.StatusBadRequest, errorBody("invalid request body")
+	}
+
+	if req.Status != "disconnected" && req.Status != "terminated" {
+		return http.StatusBadRequest, errorBody("status must be disconnected or terminated")
+	}
+
+	if err := s.backend.EndSession(r.Context(), nodeID, sessionID, req.Status); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return http.StatusNotFound, errorBody(err.Error())
+		}
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, req
+}
+
+func (s *Server) handleTraffic(r *http.Request, nodeID uuid.UUID, body []byte) (int, interface{}) {
+	var report TrafficReport
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&report); err != nil {
+		return http.StatusBadRequest, errorBody("invalid request body")
+	}
+
+	if report.Bytes < 0 || report.BandwidthMbps < 0 {
+		return http.StatusBadRequest, errorBody("traffic must not be negative")
+	}
+	for _, t := range report.Sessions {
+		if t.BytesSent < 0 || t.BytesReceived < 0 {
+			return http.StatusBadRequest, errorBody("traffic must not be negative")
+		}
+	}
+
+	if err := s.backend.ReportTraffic(r.Context(), nodeID, report); err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, map[string]int{"sessions": len(report.Sessions)}
+}
+
+// isPercent reports whether v is a valid percentage
+func isPercent(v float64) bool {
+	return v >= 0 && v <= 100
+}
+
+func errorBody(msg string) map[string]string {
+	return map[string]string{"error": msg}
+}
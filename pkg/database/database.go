@@ -111,12 +111,17 @@ func AutoMigrate() error {
 		// 1. Independent tables (no foreign keys)
 		&models.User{},
 		&models.NodeReward{},
+		&models.Plan{},
 
-		// 2. NodeOperator (depends on User)
+		// 2. NodeOperator and auth records (depend on User)
 		&models.NodeOperator{},
+		&models.RefreshToken{},
+		&models.RecoveryCode{},
 
-		// 3. VPNNode (depends on NodeOperator)
+		// 3. VPNNode (depends on NodeOperator), its join tokens and drains
 		&models.VPNNode{},
+		&models.NodeJoinToken{},
+		&models.NodeDrain{},
 
 		// 4. Session and Config (depend on User and VPNNode)
 		&models.Session{},
@@ -124,12 +129,29 @@ func AutoMigrate() error {
 
 		// 5. Operator earnings and metrics (depend on above tables)
 		&models.OperatorEarning{},
+		&models.ExchangeRateSnapshot{},
 		&models.OperatorPayout{},
+		&models.PayoutJob{},
 		&models.NodePerformanceMetric{},
+
+		// 6. Ledger (append-only journal of operator money)
+		&models.JournalEntry{},
+		&models.LedgerPosting{},
+
+		// 7. Subscription payments
+		&models.AddressDerivation{},
+		&models.Payment{},
 	); err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	// Rate snapshots used to be unique without their rate
+	if DB.Migrator().HasIndex(&models.ExchangeRateSnapshot{}, "idx_rate_snapshot") {
+		if err := DB.Migrator().DropIndex(&models.ExchangeRateSnapshot{}, "idx_rate_snapshot"); err != nil {
+			return fmt.Errorf("failed to drop rate snapshot index: %w", err)
+		}
+	}
+
 	log.Println("Database migrations completed successfully")
 	return nil
 }
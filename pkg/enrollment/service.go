@@ -0,0 +1,193 @@
+package enrollment
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid, used or expired join token")
+	ErrTokenNotFound = errors.New("join token not found")
+	ErrNodeNotFound  = errors.New("node not found")
+)
+
+// DefaultTokenTTL is how long a join token can be redeemed when no lifetime
+// is configured
+const DefaultTokenTTL = 24 * time.Hour
+
+// tokenPrefix makes join tokens recognizable, e.g. in leaked configs
+const tokenPrefix = "ajt_"
+
+// Service issues the one-time join tokens nodes enroll with and redeems them
+// for the node's identity
+type Service struct {
+	db       *gorm.DB
+	log      *logger.Logger
+	tokenTTL time.Duration
+}
+
+// NewService creates an enrollment service whose tokens expire after tokenTTL
+func NewService(log *logger.Logger, tokenTTL time.Duration) *Service {
+	if tokenTTL <= 0 {
+		tokenTTL = DefaultTokenTTL
+	}
+	return &Service{
+		db:       database.GetDB(),
+		log:      log,
+		tokenTTL: tokenTTL,
+	}
+}
+
+// IssueToken creates a join token for a node, revoking any earlier unused
+// ones. The token is only stored hashed, so this is the only time it can be
+// shown. issuedBy is the user requesting it, if any.
+func (s *Service) IssueToken(ctx context.Context, nodeID uuid.UUID, issuedBy *uuid.UUID) (string, *models.NodeJoinToken, error) {
+	var node models.VPNNode
+	if err := s.db.WithContext(ctx).Select("id").First(&node, nodeID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil, ErrNodeNotFound
+		}
+		return "", nil, fmt.Errorf("failed to load node: %w", err)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate join token: %w", err)
+	}
+
+	record := &models.NodeJoinToken{
+		NodeID:    nodeID,
+		IssuedBy:  issuedBy,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(s.tokenTTL),
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.NodeJoinToken{}).
+			Where("node_id = ? AND used_at IS NULL AND revoked_at IS NULL", nodeID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(record).Error
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to save join token: %w", err)
+	}
+
+	s.log.Info("node join token issued",
+		"node_id", nodeID,
+		"token_id", record.ID,
+		"expires_at", record.ExpiresAt,
+	)
+
+	return token, record, nil
+}
+
+// ListTokens returns the join tokens issued for a node, newest first
+func (s *Service) ListTokens(ctx context.Context, nodeID uuid.UUID) ([]models.NodeJoinToken, error) {
+	var tokens []models.NodeJoinToken
+	err := s.db.WithContext(ctx).
+		Where("node_id = ?", nodeID).
+		Order("created_at DESC").
+		Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokeToken stops an unused join token from being redeemed
+func (s *Service) RevokeToken(ctx context.Context, tokenID uuid.UUID) error {
+	result := s.db.WithContext(ctx).Model(&models.NodeJoinToken{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", tokenID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke join token: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrTokenNotFound
+	}
+
+	s.log.Info("node join token revoked", "token_id", tokenID)
+	return nil
+}
+
+// Redeem uses up a join token and records identityKey as the identity of
+// the node it was issued to, replacing any earlier identity. Tokens can only
+// be redeemed once, so a second node presenting the same token is refused.
+func (s *Service) Redeem(ctx context.Context, token, identityKey string) (*models.VPNNode, error) {
+	var node models.VPNNode
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var record models.NodeJoinToken
+		if err := tx.Where("token_hash = ?", hashToken(token)).First(&record).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidToken
+			}
+			return err
+		}
+		if !record.IsUsable() {
+			return ErrInvalidToken
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.NodeJoinToken{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", record.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidToken
+		}
+
+		if err := tx.First(&node, record.NodeID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidToken
+			}
+			return err
+		}
+		if !node.IsActive {
+			return ErrInvalidToken
+		}
+
+		node.IdentityKey = identityKey
+		node.EnrolledAt = &now
+		return tx.Model(&node).Updates(map[string]interface{}{
+			"identity_key": identityKey,
+			"enrolled_at":  now,
+		}).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to redeem join token: %w", err)
+	}
+
+	s.log.Info("node enrolled", "node_id", node.ID, "name", node.Name)
+	return &node, nil
+}
+
+// newToken returns a random join token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash a join token is stored by
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,181 @@
+package hdwallet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"golang.org/x/crypto/ripemd160" //nolint:staticcheck // required by Bitcoin's HASH160
+)
+
+// HardenedOffset is the first hardened child index. Hardened children can
+// only be derived from private keys.
+const HardenedOffset = 0x80000000
+
+var (
+	// ErrPrivateKey is returned when an extended private key is given where
+	// only public keys are accepted
+	ErrPrivateKey = errors.New("extended private keys are not accepted")
+
+	// ErrHardenedChild is returned when a hardened child is requested from a
+	// public key
+	ErrHardenedChild = errors.New("cannot derive a hardened child from a public key")
+
+	// ErrInvalidChild is returned for the rare indexes that do not produce a
+	// valid key; the next index should be used instead
+	ErrInvalidChild = errors.New("index does not produce a valid child key")
+)
+
+// Extended public key versions
+var (
+	versionXPub = [4]byte{0x04, 0x88, 0xb2, 0x1e} // BIP44 mainnet
+	versionYPub = [4]byte{0x04, 0x9d, 0x7c, 0xb2} // BIP49 mainnet
+	versionZPub = [4]byte{0x04, 0xb2, 0x47, 0x46} // BIP84 mainnet
+	versionTPub = [4]byte{0x04, 0x35, 0x87, 0xcf} // BIP44 testnet
+	versionUPub = [4]byte{0x04, 0x4a, 0x52, 0x62} // BIP49 testnet
+	versionVPub = [4]byte{0x04, 0x5f, 0x1c, 0xff} // BIP84 testnet
+	versionLtub = [4]byte{0x01, 0x9d, 0xa4, 0x62} // Litecoin BIP44 mainnet
+	versionMtub = [4]byte{0x01, 0xb2, 0x6e, 0xf6} // Litecoin BIP84 mainnet
+)
+
+var publicVersions = map[[4]byte]bool{
+	versionXPub: false, versionYPub: false, versionZPub: false,
+	versionLtub: false, versionMtub: false,
+	versionTPub: true, versionUPub: true, versionVPub: true,
+}
+
+// serializedKeyLength is the length of a BIP32 serialized extended key
+const serializedKeyLength = 78
+
+// ExtendedKey is a BIP32 extended public key
+type ExtendedKey struct {
+	version           [4]byte
+	depth             uint8
+	parentFingerprint [4]byte
+	childNumber       uint32
+	chainCode         []byte
+	publicKey         []byte // Compressed SEC1 encoding
+}
+
+// ParseExtendedKey decodes a base58check encoded extended public key such
+// as an xpub, zpub or Ltub
+func ParseExtendedKey(encoded string) (*ExtendedKey, error) {
+	payload, err := base58CheckDecode(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended key: %w", err)
+	}
+	if len(payload) != serializedKeyLength {
+		return nil, fmt.Errorf("invalid extended key: length is %d bytes", len(payload))
+	}
+
+	key := &ExtendedKey{
+		depth:       payload[4],
+		childNumber: binary.BigEndian.Uint32(payload[9:13]),
+		chainCode:   append([]byte(nil), payload[13:45]...),
+		publicKey:   append([]byte(nil), payload[45:78]...),
+	}
+	copy(key.version[:], payload[0:4])
+	copy(key.parentFingerprint[:], payload[5:9])
+
+	if key.publicKey[0] == 0x00 {
+		return nil, ErrPrivateKey
+	}
+	if _, ok := publicVersions[key.version]; !ok {
+		return nil, fmt.Errorf("invalid extended key: unknown version %x", key.version)
+	}
+	if _, err := secp256k1.ParsePubKey(key.publicKey); err != nil {
+		return nil, fmt.Errorf("invalid extended key: %w", err)
+	}
+
+	return key, nil
+}
+
+// String returns the base58check encoding of the key
+func (k *ExtendedKey) String() string {
+	payload := make([]byte, 0, serializedKeyLength)
+	payload = append(payload, k.version[:]...)
+	payload = append(payload, k.depth)
+	payload = append(payload, k.parentFingerprint[:]...)
+	payload = binary.BigEndian.AppendUint32(payload, k.childNumber)
+	payload = append(payload, k.chainCode...)
+	payload = append(payload, k.publicKey...)
+	return base58CheckEncode(payload)
+}
+
+// PublicKey returns the compressed public key
+func (k *ExtendedKey) PublicKey() []byte {
+	return append([]byte(nil), k.publicKey...)
+}
+
+// Depth returns how many derivations the key is from the master key
+func (k *ExtendedKey) Depth() uint8 {
+	return k.depth
+}
+
+// IsTestnet reports whether the key's version marks it as a testnet key
+func (k *ExtendedKey) IsTestnet() bool {
+	return publicVersions[k.version]
+}
+
+// Fingerprint returns the first four bytes of the key's HASH160
+func (k *ExtendedKey) Fingerprint() [4]byte {
+	var fingerprint [4]byte
+	copy(fingerprint[:], hash160(k.publicKey))
+	return fingerprint
+}
+
+// Child derives the non-hardened child at index (BIP32 CKDpub)
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	if index >= HardenedOffset {
+		return nil, ErrHardenedChild
+	}
+
+	data := make([]byte, 0, 37)
+	data = append(data, k.publicKey...)
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	var tweak secp256k1.ModNScalar
+	if overflow := tweak.SetByteSlice(sum[:32]); overflow {
+		return nil, ErrInvalidChild
+	}
+
+	parent, err := secp256k1.ParsePubKey(k.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// child = tweak*G + parent
+	var tweakPoint, parentPoint, childPoint secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&tweak, &tweakPoint)
+	parent.AsJacobian(&parentPoint)
+	secp256k1.AddNonConst(&tweakPoint, &parentPoint, &childPoint)
+	if (childPoint.X.IsZero() && childPoint.Y.IsZero()) || childPoint.Z.IsZero() {
+		return nil, ErrInvalidChild
+	}
+	childPoint.ToAffine()
+
+	return &ExtendedKey{
+		version:           k.version,
+		depth:             k.depth + 1,
+		parentFingerprint: k.Fingerprint(),
+		childNumber:       index,
+		chainCode:         sum[32:],
+		publicKey:         secp256k1.NewPublicKey(&childPoint.X, &childPoint.Y).SerializeCompressed(),
+	}, nil
+}
+
+// hash160 returns RIPEMD160(SHA256(data))
+func hash160(data []byte) []byte {
+	sha := sha256.Sum256(data)
+	ripemd := ripemd160.New()
+	ripemd.Write(sha[:])
+	return ripemd.Sum(nil)
+}
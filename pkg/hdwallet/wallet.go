@@ -0,0 +1,127 @@
+package hdwallet
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Supported coins, by ticker symbol
+const (
+	BTC = "BTC"
+	LTC = "LTC"
+	ETH = "ETH"
+)
+
+// externalChain is the BIP44 change level used for receiving addresses
+const externalChain = 0
+
+// Wallet derives deposit addresses from a BIP44 account-level extended
+// public key (m/44'/coin'/account' or the BIP84 equivalent). The matching
+// private keys stay offline, so the server can receive but never spend.
+type Wallet struct {
+	coin     string
+	account  *ExtendedKey
+	external *ExtendedKey
+}
+
+// NewWallet creates a wallet for coin from an account-level extended public key
+func NewWallet(coin, xpub string) (*Wallet, error) {
+	coin = strings.ToUpper(coin)
+	switch coin {
+	case BTC, LTC, ETH:
+	default:
+		return nil, fmt.Errorf("unsupported coin for HD derivation: %s", coin)
+	}
+
+	account, err := ParseExtendedKey(strings.TrimSpace(xpub))
+	if err != nil {
+		return nil, err
+	}
+
+	external, err := account.Child(externalChain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive external chain: %w", err)
+	}
+
+	return &Wallet{coin: coin, account: account, external: external}, nil
+}
+
+// Coin returns the wallet's ticker symbol
+func (w *Wallet) Coin() string {
+	return w.coin
+}
+
+// ID identifies the account key, so derivation indexes persisted for one
+// key are never reused for another
+func (w *Wallet) ID() string {
+	fingerprint := w.account.Fingerprint()
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// Address returns the receiving address at index, derived at
+// <account>/0/<index>
+func (w *Wallet) Address(index uint32) (string, error) {
+	child, err := w.external.Child(index)
+	if err != nil {
+		return "", err
+	}
+	return AddressFromPublicKey(w.coin, child.PublicKey(), w.account.IsTestnet())
+}
+
+// DerivationPath returns the path of the address at index relative to the
+// account key
+func (w *Wallet) DerivationPath(index uint32) string {
+	return fmt.Sprintf("%d/%d", externalChain, index)
+}
+
+// AddressFromPublicKey encodes a compressed public key as a coin address:
+// native segwit (P2WPKH) for BTC and LTC, EIP-55 checksummed for ETH
+func AddressFromPublicKey(coin string, publicKey []byte, testnet bool) (string, error) {
+	switch strings.ToUpper(coin) {
+	case BTC:
+		hrp := "bc"
+		if testnet {
+			hrp = "tb"
+		}
+		return segwitAddress(hrp, hash160(publicKey)), nil
+
+	case LTC:
+		hrp := "ltc"
+		if testnet {
+			hrp = "tltc"
+		}
+		return segwitAddress(hrp, hash160(publicKey)), nil
+
+	case ETH:
+		key, err := secp256k1.ParsePubKey(publicKey)
+		if err != nil {
+			return "", fmt.Errorf("invalid public key: %w", err)
+		}
+		// Keccak256 of the uncompressed key without its 0x04 prefix
+		hash := crypto.Keccak256(key.SerializeUncompressed()[1:])
+		return common.BytesToAddress(hash[12:]).Hex(), nil
+	}
+
+	return "", fmt.Errorf("unsupported coin for HD derivation: %s", coin)
+}
+
+// LoadWallets creates a wallet for every coin with a non-empty xpub
+func LoadWallets(xpubs map[string]string) (map[string]*Wallet, error) {
+	wallets := make(map[string]*Wallet, len(xpubs))
+	for coin, xpub := range xpubs {
+		if strings.TrimSpace(xpub) == "" {
+			continue
+		}
+		wallet, err := NewWallet(coin, xpub)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s xpub: %w", coin, err)
+		}
+		wallets[wallet.Coin()] = wallet
+	}
+	return wallets, nil
+}
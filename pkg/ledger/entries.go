@@ -0,0 +1,76 @@
+package ledger
+
+import (
+	"fmt"
+
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// PostEarning records an operator earning: the platform expenses the reward
+// and owes it to the operator. Zero-amount earnings are not posted.
+func PostEarning(tx *gorm.DB, earning *models.OperatorEarning) error {
+	amount := FromUSD(earning.AmountUSD)
+	if amount == 0 {
+		return nil
+	}
+
+	nodeID := earning.NodeID
+	return Post(tx, Entry{
+		Kind:        KindEarning,
+		Reference:   earning.ID,
+		OperatorID:  earning.OperatorID,
+		NodeID:      &nodeID,
+		Description: fmt.Sprintf("Earning for session %s", earning.SessionID),
+		Postings: []Posting{
+			{Account: PlatformExpense, Amount: amount},
+			{Account: OperatorPayable, Amount: -amount},
+		},
+	})
+}
+
+// PostPayoutInitiated moves the payout amount from the operator's payable
+// balance into clearing, so it cannot be paid out twice
+func PostPayoutInitiated(tx *gorm.DB, payout *models.OperatorPayout) error {
+	amount := FromUSD(payout.AmountUSD)
+	return Post(tx, Entry{
+		Kind:        KindPayoutInitiated,
+		Reference:   payout.ID,
+		OperatorID:  payout.OperatorID,
+		Description: fmt.Sprintf("Payout to %s", payout.WalletAddress),
+		Postings: []Posting{
+			{Account: OperatorPayable, Amount: amount},
+			{Account: PayoutClearing, Amount: -amount},
+		},
+	})
+}
+
+// PostPayoutCompleted settles a payout once its transaction has confirmed
+func PostPayoutCompleted(tx *gorm.DB, payout *models.OperatorPayout) error {
+	amount := FromUSD(payout.AmountUSD)
+	return Post(tx, Entry{
+		Kind:        KindPayoutCompleted,
+		Reference:   payout.ID,
+		OperatorID:  payout.OperatorID,
+		Description: fmt.Sprintf("Payout settled in %s", payout.TransactionHash),
+		Postings: []Posting{
+			{Account: PayoutClearing, Amount: amount},
+			{Account: PlatformTreasury, Amount: -amount},
+		},
+	})
+}
+
+// PostPayoutFailed returns a failed payout's amount to the operator's payable balance
+func PostPayoutFailed(tx *gorm.DB, payout *models.OperatorPayout) error {
+	amount := FromUSD(payout.AmountUSD)
+	return Post(tx, Entry{
+		Kind:        KindPayoutFailed,
+		Reference:   payout.ID,
+		OperatorID:  payout.OperatorID,
+		Description: "Payout failed: " + payout.FailureReason,
+		Postings: []Posting{
+			{Account: PayoutClearing, Amount: amount},
+			{Account: OperatorPayable, Amount: -amount},
+		},
+	})
+}
@@ -0,0 +1,233 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// Micros is an amount of USD in millionths of a dollar
+type Micros int64
+
+// MicrosPerUSD is the number of micro-units in one US dollar
+const MicrosPerUSD = 1_000_000
+
+// FromUSD converts a dollar amount to micro-units, rounding to the nearest unit
+func FromUSD(usd float64) Micros {
+	return Micros(math.Round(usd * MicrosPerUSD))
+}
+
+// USD returns the amount in dollars
+func (m Micros) USD() float64 {
+	return float64(m) / MicrosPerUSD
+}
+
+// String formats the amount as dollars with six decimals
+func (m Micros) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+	return fmt.Sprintf("%s%d.%06d", sign, m/MicrosPerUSD, m%MicrosPerUSD)
+}
+
+// Account names. Every operator has its own sub-account in each of them.
+const (
+	// OperatorPayable is what the platform owes the operator (liability)
+	OperatorPayable = "operator_payable"
+	// PlatformExpense accumulates the rewards earned by operators
+	PlatformExpense = "platform_expense"
+	// PayoutClearing holds payouts that have been initiated but not settled
+	PayoutClearing = "payout_clearing"
+	// PlatformTreasury is the wallet payouts are sent from (asset)
+	PlatformTreasury = "platform_treasury"
+)
+
+// Entry kinds
+const (
+	KindEarning         = "earning"
+	KindPayoutInitiated = "payout_initiated"
+	KindPayoutCompleted = "payout_completed"
+	KindPayoutFailed    = "payout_failed"
+)
+
+var (
+	// ErrUnbalanced is returned when an entry's postings do not sum to zero
+	ErrUnbalanced = errors.New("ledger entry is unbalanced")
+
+	// ErrAlreadyPosted is returned when an event has already been posted
+	ErrAlreadyPosted = errors.New("ledger entry already posted")
+)
+
+// Posting is a single debit (positive) or credit (negative) to an account
+type Posting struct {
+	Account string
+	Amount  Micros
+}
+
+// Entry describes a business event to be posted to the ledger
+type Entry struct {
+	Kind        string
+	Reference   uuid.UUID
+	OperatorID  uuid.UUID
+	NodeID      *uuid.UUID
+	Description string
+	Postings    []Posting
+}
+
+// Post appends an entry and its postings. tx should be the transaction that
+// records the business event itself, so the ledger never diverges from it.
+func Post(tx *gorm.DB, entry Entry) error {
+	if len(entry.Postings) < 2 {
+		return fmt.Errorf("%w: at least two postings are required", ErrUnbalanced)
+	}
+
+	var sum Micros
+	for _, posting := range entry.Postings {
+		sum += posting.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("%w: postings sum to %s", ErrUnbalanced, sum)
+	}
+
+	var count int64
+	if err := tx.Model(&models.JournalEntry{}).
+		Where("kind = ? AND reference = ?", entry.Kind, entry.Reference).
+		Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check ledger entry: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s %s", ErrAlreadyPosted, entry.Kind, entry.Reference)
+	}
+
+	journalEntry := models.JournalEntry{
+		Kind:        entry.Kind,
+		Reference:   entry.Reference,
+		OperatorID:  entry.OperatorID,
+		NodeID:      entry.NodeID,
+		Description: entry.Description,
+	}
+	for _, posting := range entry.Postings {
+		journalEntry.Postings = append(journalEntry.Postings, models.LedgerPosting{
+			Account:    posting.Account,
+			OperatorID: entry.OperatorID,
+			Amount:     int64(posting.Amount),
+		})
+	}
+
+	if err := tx.Create(&journalEntry).Error; err != nil {
+		return fmt.Errorf("failed to post ledger entry: %w", err)
+	}
+	return nil
+}
+
+// Balance returns the balance of an operator's sub-account. Liability
+// accounts such as OperatorPayable have credit (negative) balances.
+func Balance(db *gorm.DB, account string, operatorID uuid.UUID) (Micros, error) {
+	var balance int64
+	err := db.Model(&models.LedgerPosting{}).
+		Where("account = ? AND operator_id = ?", account, operatorID).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&balance).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to load %s balance: %w", account, err)
+	}
+	return Micros(balance), nil
+}
+
+// OperatorBalances summarizes an operator's position in the ledger
+type OperatorBalances struct {
+	Earned   Micros `json:"earned"`    // Rewards earned over the operator's lifetime
+	Payable  Micros `json:"payable"`   // Earned and not yet included in a payout
+	InFlight Micros `json:"in_flight"` // Included in payouts that have not settled
+	Paid     Micros `json:"paid"`      // Sent to the operator's wallet
+}
+
+// GetOperatorBalances derives an operator's balances from the ledger
+func GetOperatorBalances(db *gorm.DB, operatorID uuid.UUID) (*OperatorBalances, error) {
+	var rows []struct {
+		Account string
+		Total   int64
+	}
+	err := db.Model(&models.LedgerPosting{}).
+		Select("account, COALESCE(SUM(amount), 0) AS total").
+		Where("operator_id = ?", operatorID).
+		Group("account").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load operator balances: %w", err)
+	}
+
+	balances := &OperatorBalances{}
+	for _, row := range rows {
+		switch row.Account {
+		case PlatformExpense:
+			balances.Earned = Micros(row.Total)
+		case OperatorPayable:
+			balances.Payable = -Micros(row.Total)
+		case PayoutClearing:
+			balances.InFlight = -Micros(row.Total)
+		case PlatformTreasury:
+			balances.Paid = -Micros(row.Total)
+		}
+	}
+	return balances, nil
+}
+
+// EarnedSince returns the rewards an operator earned since the given time
+func EarnedSince(db *gorm.DB, operatorID uuid.UUID, since time.Time) (Micros, error) {
+	var total int64
+	err := db.Model(&models.LedgerPosting{}).
+		Where("account = ? AND operator_id = ? AND created_at >= ?", PlatformExpense, operatorID, since).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&total).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to load earnings: %w", err)
+	}
+	return Micros(total), nil
+}
+
+// NodeEarned returns the rewards earned by sessions on a node
+func NodeEarned(db *gorm.DB, nodeID uuid.UUID) (Micros, error) {
+	var total int64
+	err := db.Model(&models.LedgerPosting{}).
+		Joins("JOIN journal_entries ON journal_entries.id = ledger_postings.entry_id").
+		Where("journal_entries.node_id = ? AND ledger_postings.account = ?", nodeID, PlatformExpense).
+		Select("COALESCE(SUM(ledger_postings.amount), 0)").
+		Scan(&total).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to load node earnings: %w", err)
+	}
+	return Micros(total), nil
+}
+
+// RefreshOperator copies the operator's ledger balances into the cached
+// TotalEarned and PendingPayout columns shown by the API
+func RefreshOperator(tx *gorm.DB, operatorID uuid.UUID) error {
+	balances, err := GetOperatorBalances(tx, operatorID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&models.NodeOperator{}).Where("id = ?", operatorID).Updates(map[string]interface{}{
+		"total_earned":   balances.Earned.USD(),
+		"pending_payout": balances.Payable.USD(),
+	}).Error
+}
+
+// RefreshNode copies the node's ledger earnings into its cached TotalEarnedUSD
+func RefreshNode(tx *gorm.DB, nodeID uuid.UUID) error {
+	earned, err := NodeEarned(tx, nodeID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&models.VPNNode{}).Where("id = ?", nodeID).
+		UpdateColumn("total_earned_usd", earned.USD()).Error
+}
@@ -0,0 +1,147 @@
+package ledger
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// Drift is a disagreement between the ledger and the records it mirrors
+type Drift struct {
+	Kind      string    `json:"kind"` // unbalanced_entry, earning, payout, operator_balance, node_balance
+	Reference uuid.UUID `json:"reference"`
+	Message   string    `json:"message"`
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Reference, d.Message)
+}
+
+// entryKey identifies a posted event
+type entryKey struct {
+	kind      string
+	reference uuid.UUID
+}
+
+// Reconcile checks that every entry balances, that earnings and payouts have
+// exactly the entries their state requires, and that the cached balance
+// columns on operators and nodes match the ledger
+func Reconcile(db *gorm.DB) ([]Drift, error) {
+	var drifts []Drift
+
+	var unbalanced []struct {
+		EntryID uuid.UUID
+		Total   int64
+	}
+	if err := db.Model(&models.LedgerPosting{}).
+		Select("entry_id, SUM(amount) AS total").
+		Group("entry_id").
+		Having("SUM(amount) <> 0").
+		Scan(&unbalanced).Error; err != nil {
+		return nil, fmt.Errorf("failed to check entry balances: %w", err)
+	}
+	for _, entry := range unbalanced {
+		drifts = append(drifts, Drift{"unbalanced_entry", entry.EntryID, fmt.Sprintf("postings sum to %s", Micros(entry.Total))})
+	}
+
+	// Amount moved by each posted event
+	var posted []struct {
+		Kind      string
+		Reference uuid.UUID
+		Amount    int64
+	}
+	if err := db.Model(&models.LedgerPosting{}).
+		Joins("JOIN journal_entries ON journal_entries.id = ledger_postings.entry_id").
+		Select("journal_entries.kind, journal_entries.reference, SUM(CASE WHEN ledger_postings.amount > 0 THEN ledger_postings.amount ELSE 0 END) AS amount").
+		Group("journal_entries.kind, journal_entries.reference").
+		Scan(&posted).Error; err != nil {
+		return nil, fmt.Errorf("failed to load ledger entries: %w", err)
+	}
+	entries := make(map[entryKey]Micros, len(posted))
+	for _, entry := range posted {
+		entries[entryKey{entry.Kind, entry.Reference}] = Micros(entry.Amount)
+	}
+
+	var earnings []models.OperatorEarning
+	if err := db.Select("id", "amount_usd").Find(&earnings).Error; err != nil {
+		return nil, fmt.Errorf("failed to load earnings: %w", err)
+	}
+	earningIDs := make(map[uuid.UUID]bool, len(earnings))
+	for _, earning := range earnings {
+		earningIDs[earning.ID] = true
+		drifts = append(drifts, checkEntry(entries, KindEarning, earning.ID, FromUSD(earning.AmountUSD), "earning")...)
+	}
+	for key := range entries {
+		if key.kind == KindEarning && !earningIDs[key.reference] {
+			drifts = append(drifts, Drift{"earning", key.reference, "ledger entry references a missing earning"})
+		}
+	}
+
+	var payouts []models.OperatorPayout
+	if err := db.Select("id", "amount_usd", "status").Find(&payouts).Error; err != nil {
+		return nil, fmt.Errorf("failed to load payouts: %w", err)
+	}
+	for _, payout := range payouts {
+		amount := FromUSD(payout.AmountUSD)
+		var settled, failed Micros
+		switch payout.Status {
+		case "completed":
+			settled = amount
+		case "failed":
+			failed = amount
+		}
+		drifts = append(drifts, checkEntry(entries, KindPayoutInitiated, payout.ID, amount, "payout")...)
+		drifts = append(drifts, checkEntry(entries, KindPayoutCompleted, payout.ID, settled, "payout")...)
+		drifts = append(drifts, checkEntry(entries, KindPayoutFailed, payout.ID, failed, "payout")...)
+	}
+
+	var operators []models.NodeOperator
+	if err := db.Select("id", "total_earned", "pending_payout").Find(&operators).Error; err != nil {
+		return nil, fmt.Errorf("failed to load operators: %w", err)
+	}
+	for _, operator := range operators {
+		balances, err := GetOperatorBalances(db, operator.ID)
+		if err != nil {
+			return nil, err
+		}
+		if cached := FromUSD(operator.TotalEarned); cached != balances.Earned {
+			drifts = append(drifts, Drift{"operator_balance", operator.ID, fmt.Sprintf("total_earned is %s, ledger has %s", cached, balances.Earned)})
+		}
+		if cached := FromUSD(operator.PendingPayout); cached != balances.Payable {
+			drifts = append(drifts, Drift{"operator_balance", operator.ID, fmt.Sprintf("pending_payout is %s, ledger has %s", cached, balances.Payable)})
+		}
+	}
+
+	var nodes []models.VPNNode
+	if err := db.Select("id", "total_earned_usd").Where("operator_id IS NOT NULL").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to load nodes: %w", err)
+	}
+	for _, node := range nodes {
+		earned, err := NodeEarned(db, node.ID)
+		if err != nil {
+			return nil, err
+		}
+		if cached := FromUSD(node.TotalEarnedUSD); cached != earned {
+			drifts = append(drifts, Drift{"node_balance", node.ID, fmt.Sprintf("total_earned_usd is %s, ledger has %s", cached, earned)})
+		}
+	}
+
+	return drifts, nil
+}
+
+// checkEntry reports a drift unless the event was posted with the expected
+// amount. An expected amount of zero means the event must not be posted.
+func checkEntry(entries map[entryKey]Micros, kind string, reference uuid.UUID, expected Micros, driftKind string) []Drift {
+	amount, ok := entries[entryKey{kind, reference}]
+	switch {
+	case expected == 0 && ok:
+		return []Drift{{driftKind, reference, fmt.Sprintf("unexpected %s entry", kind)}}
+	case expected != 0 && !ok:
+		return []Drift{{driftKind, reference, fmt.Sprintf("missing %s entry for %s", kind, expected)}}
+	case ok && amount != expected:
+		return []Drift{{driftKind, reference, fmt.Sprintf("%s entry is %s, expected %s", kind, amount, expected)}}
+	}
+	return nil
+}
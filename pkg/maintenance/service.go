@@ -0,0 +1,296 @@
+// Package maintenance drains VPN nodes of their sessions so they can be
+// taken out of service
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/database"
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNodeNotFound    = errors.New("node not found")
+	ErrAlreadyDraining = errors.New("node is already draining or in maintenance")
+	ErrNotDraining     = errors.New("node is not draining or in maintenance")
+)
+
+// DefaultDrainTimeout is how long clients get to leave a draining node when
+// no deadline is given
+const DefaultDrainTimeout = 30 * time.Minute
+
+// Service puts nodes into maintenance after draining their sessions
+type Service struct {
+	db       *gorm.DB
+	log      *logger.Logger
+	sessions *session.Service
+}
+
+// DrainStatus is the drain progress of a node
+type DrainStatus struct {
+	NodeID         uuid.UUID         `json:"node_id"`
+	NodeStatus     string            `json:"node_status"`
+	State          string            `json:"state"` // draining, completed, cancelled, or none if never drained
+	ActiveSessions int64             `json:"active_sessions"`
+	Drain          *models.NodeDrain `json:"drain,omitempty"` // Latest drain
+}
+
+// MigrateHint tells a client its node is draining and where to reconnect
+type MigrateHint struct {
+	Reason   string     `json:"reason"`
+	Deadline time.Time  `json:"deadline"`          // The session is ended at this time
+	NodeID   *uuid.UUID `json:"node_id,omitempty"` // Suggested node to reconnect to
+}
+
+// NewService creates a maintenance service. sessions ends the sessions left
+// at the deadline and suggests nodes to migrate to; it is only needed by
+// ProcessDrains and MigrateHint.
+func NewService(log *logger.Logger, sessions *session.Service) *Service {
+	return &Service{
+		db:       database.GetDB(),
+		log:      log,
+		sessions: sessions,
+	}
+}
+
+// Drain stops a node from receiving new sessions. Its clients are asked to
+// migrate, and the node goes into maintenance when they have left or after
+// timeout. requestedBy is the user draining the node, if any.
+func (s *Service) Drain(ctx context.Context, nodeID uuid.UUID, timeout time.Duration, reason string, requestedBy *uuid.UUID) (*models.NodeDrain, error) {
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+
+	if err := s.db.WithContext(ctx).Select("id").First(&models.VPNNode{}, nodeID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, fmt.Errorf("failed to load node: %w", err)
+	}
+
+	drain := &models.NodeDrain{
+		NodeID:      nodeID,
+		RequestedBy: requestedBy,
+		Reason:      reason,
+		Deadline:    time.Now().Add(timeout),
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.VPNNode{}).
+			Where("id = ? AND status NOT IN ?", nodeID, []string{"draining", "maintenance"}).
+			Update("status", "draining")
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAlreadyDraining
+		}
+
+		var active int64
+		if err := tx.Model(&models.Session{}).Where("node_id = ? AND status = ?", nodeID, "active").
+			Count(&active).Error; err != nil {
+			return err
+		}
+		drain.SessionsAtStart = int(active)
+
+		return tx.Create(drain).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrAlreadyDraining) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to drain node: %w", err)
+	}
+
+	s.log.Info("node draining",
+		"node_id", nodeID,
+		"drain_id", drain.ID,
+		"sessions", drain.SessionsAtStart,
+		"deadline", drain.Deadline,
+	)
+
+	return drain, nil
+}
+
+// Resume returns a draining or maintenance node to service. The node is
+// offline until its next heartbeat.
+func (s *Service) Resume(ctx context.Context, nodeID uuid.UUID) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.VPNNode{}).
+			Where("id = ? AND status IN ?", nodeID, []string{"draining", "maintenance"}).
+			Update("status", "offline")
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotDraining
+		}
+
+		return tx.Model(&models.NodeDrain{}).
+			Where("node_id = ? AND completed_at IS NULL AND cancelled_at IS NULL", nodeID).
+			Update("cancelled_at", time.Now()).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotDraining) {
+			return err
+		}
+		return fmt.Errorf("failed to resume node: %w", err)
+	}
+
+	s.log.Info("node returned to service", "node_id", nodeID)
+	return nil
+}
+
+// Status returns the drain progress of a node
+func (s *Service) Status(ctx context.Context, nodeID uuid.UUID) (*DrainStatus, error) {
+	var node models.VPNNode
+	if err := s.db.WithContext(ctx).Select("id", "status").First(&node, nodeID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, fmt.Errorf("failed to load node: %w", err)
+	}
+
+	status := &DrainStatus{NodeID: nodeID, NodeStatus: node.Status, State: "none"}
+
+	var drain models.NodeDrain
+	err := s.db.WithContext(ctx).Where("node_id = ?", nodeID).Order("created_at DESC").First(&drain).Error
+	switch {
+	case err == nil:
+		status.Drain = &drain
+		status.State = drain.State()
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, fmt.Errorf("failed to load drain: %w", err)
+	}
+
+	if err := s.db.WithContext(ctx).Model(&models.Session{}).Where("node_id = ? AND status = ?", nodeID, "active").
+		Count(&status.ActiveSessions).Error; err != nil {
+		return nil, fmt.Errorf("failed to count sessions: %w", err)
+	}
+
+	return status, nil
+}
+
+// ProcessDrains puts draining nodes into maintenance once their sessions
+// have left, ending the sessions still connected at the deadline. It returns
+// the number of drains completed.
+func (s *Service) ProcessDrains(ctx context.Context) (int, error) {
+	var drains []models.NodeDrain
+	if err := s.db.WithContext(ctx).Where("completed_at IS NULL AND cancelled_at IS NULL").
+		Find(&drains).Error; err != nil {
+		return 0, fmt.Errorf("failed to load drains: %w", err)
+	}
+
+	completed := 0
+	for i := range drains {
+		done, err := s.processDrain(ctx, &drains[i])
+		if err != nil {
+			s.log.Error("failed to process node drain", "drain_id", drains[i].ID, "node_id", drains[i].NodeID, "error", err)
+			continue
+		}
+		if done {
+			completed++
+		}
+	}
+	return completed, nil
+}
+
+// processDrain completes a drain if the node has no sessions left or its
+// deadline passed
+func (s *Service) processDrain(ctx context.Context, drain *models.NodeDrain) (bool, error) {
+	var sessions []models.Session
+	if err := s.db.WithContext(ctx).Preload("Node").Where("node_id = ? AND status = ?", drain.NodeID, "active").
+		Find(&sessions).Error; err != nil {
+		return false, fmt.Errorf("failed to load sessions: %w", err)
+	}
+	if len(sessions) > 0 && time.Now().Before(drain.Deadline) {
+		return false, nil
+	}
+
+	// Ending the sessions settles their earnings, and the node removes their
+	// peers on its next peer sync
+	ended := 0
+	for i := range sessions {
+		if err := s.sessions.End(ctx, &sessions[i], "terminated"); err != nil {
+			if apperrors.Is(err, session.ErrSessionNotActive) {
+				continue
+			}
+			return false, fmt.Errorf("failed to end session %s: %w", sessions[i].ID, err)
+		}
+		ended++
+	}
+
+	now := time.Now()
+	resumed := false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(drain).Where("completed_at IS NULL AND cancelled_at IS NULL").
+			Updates(map[string]interface{}{
+				"completed_at":   now,
+				"sessions_ended": ended,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			resumed = true
+			return nil
+		}
+
+		return tx.Model(&models.VPNNode{}).Where("id = ? AND status = ?", drain.NodeID, "draining").
+			Update("status", "maintenance").Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to complete drain: %w", err)
+	}
+	if resumed {
+		return false, nil
+	}
+
+	s.log.Info("node drained into maintenance",
+		"node_id", drain.NodeID,
+		"drain_id", drain.ID,
+		"sessions_ended", ended,
+	)
+
+	return true, nil
+}
+
+// MigrateHint returns the hint for a client of a draining node to reconnect
+// elsewhere, or nil if the session's node is not draining
+func (s *Service) MigrateHint(ctx context.Context, sess *models.Session) (*MigrateHint, error) {
+	var drain models.NodeDrain
+	err := s.db.WithContext(ctx).
+		Where("node_id = ? AND completed_at IS NULL AND cancelled_at IS NULL", sess.NodeID).
+		First(&drain).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load drain: %w", err)
+	}
+
+	hint := &MigrateHint{Reason: "node_maintenance", Deadline: drain.Deadline}
+
+	// Prefer a node in the same country
+	country := ""
+	if sess.Node != nil {
+		country = sess.Node.CountryCode
+	}
+	node, err := s.sessions.SelectNode(sess.Protocol, country)
+	if err != nil && country != "" {
+		node, err = s.sessions.SelectNode(sess.Protocol, "")
+	}
+	if err == nil {
+		hint.NodeID = &node.ID
+	}
+
+	return hint, nil
+}
@@ -117,6 +117,48 @@ var (
 		},
 	)
 
+	// Data cap metrics
+	QuotaWarnings = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aureo_vpn_quota_warnings_total",
+			Help: "Total number of data cap warnings sent to users",
+		},
+		[]string{"plan", "percent"},
+	)
+
+	QuotaEnforcements = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aureo_vpn_quota_enforcements_total",
+			Help: "Total number of sessions throttled or disconnected at their data cap",
+		},
+		[]string{"action"},
+	)
+
+	// Bandwidth shaping metrics
+	ShapedPeers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "aureo_vpn_shaped_peers",
+			Help: "Number of peers with a bandwidth limit on a node",
+		},
+		[]string{"node"},
+	)
+
+	ShapedRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "aureo_vpn_shaped_rate_kbps",
+			Help: "Sum of the bandwidth limits of the shaped peers on a node in kbit/s",
+		},
+		[]string{"node"},
+	)
+
+	ShapingErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aureo_vpn_shaping_errors_total",
+			Help: "Total number of failed bandwidth limit changes",
+		},
+		[]string{"node", "operation"},
+	)
+
 	// Authentication metrics
 	LoginAttempts = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -126,6 +168,14 @@ var (
 		[]string{"status"},
 	)
 
+	LoginLockouts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aureo_vpn_login_lockouts_total",
+			Help: "Total number of accounts and IP addresses locked after failed logins",
+		},
+		[]string{"scope"},
+	)
+
 	TokenGenerations = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "aureo_vpn_token_generations_total",
@@ -134,6 +184,14 @@ var (
 		[]string{"type"},
 	)
 
+	RevocationCheckFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aureo_vpn_token_revocation_check_failures_total",
+			Help: "Total number of tokens accepted because the revocation list could not be checked",
+		},
+		[]string{"type"},
+	)
+
 	// Database metrics
 	DatabaseQueries = promauto.NewCounterVec(
 		prometheus.CounterOpts{
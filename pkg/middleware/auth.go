@@ -7,8 +7,9 @@ import (
 	"github.com/nikola43/aureo-vpn/pkg/auth"
 )
 
-// AuthMiddleware creates a middleware for JWT authentication
-func AuthMiddleware(tokenService *auth.TokenService) fiber.Handler {
+// AuthMiddleware creates a middleware for JWT authentication. Access tokens
+// that were revoked by signing out are rejected.
+func AuthMiddleware(authService *auth.Service) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Get authorization header
 		authHeader := c.Get("Authorization")
@@ -29,7 +30,7 @@ func AuthMiddleware(tokenService *auth.TokenService) fiber.Handler {
 		token := parts[1]
 
 		// Verify token
-		claims, err := tokenService.VerifyToken(token)
+		claims, err := authService.VerifyAccessToken(c.UserContext(), token)
 		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "invalid or expired token",
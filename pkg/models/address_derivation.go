@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// AddressDerivation tracks the next unused derivation index of an HD wallet,
+// so every payment gets its own deposit address
+type AddressDerivation struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Coin      string `gorm:"type:varchar(10);not null;uniqueIndex:idx_address_derivation_wallet" json:"coin"`      // BTC, LTC, ETH
+	WalletID  string `gorm:"type:varchar(64);not null;uniqueIndex:idx_address_derivation_wallet" json:"wallet_id"` // Fingerprint of the account xpub
+	NextIndex uint32 `gorm:"not null;default:0" json:"next_index"`
+}
+
+// BeforeCreate hook
+func (d *AddressDerivation) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
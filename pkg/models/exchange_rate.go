@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ExchangeRateSnapshot is an exchange rate that was used to price a payout
+// or an invoice
+type ExchangeRateSnapshot struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Symbol    string    `gorm:"type:varchar(10);not null;uniqueIndex:idx_rate_snapshot_rate" json:"symbol"` // BTC, ETH, LTC, XMR
+	Source    string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_rate_snapshot_rate" json:"source"`
+	FetchedAt time.Time `gorm:"not null;uniqueIndex:idx_rate_snapshot_rate" json:"fetched_at"`
+	RateUSD   float64   `gorm:"type:decimal(20,8);not null;uniqueIndex:idx_rate_snapshot_rate" json:"rate_usd"` // USD per crypto unit
+}
+
+// BeforeCreate hook
+func (s *ExchangeRateSnapshot) BeforeCreate(tx *gorm.DB) error {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// JournalEntry is an append-only ledger record of one business event, such
+// as an earning or a payout state change. Its postings always sum to zero.
+type JournalEntry struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	// Kind and Reference identify the event, so it can only be posted once
+	Kind      string    `gorm:"type:varchar(50);not null;uniqueIndex:idx_journal_kind_reference" json:"kind"` // earning, payout_initiated, payout_completed, payout_failed
+	Reference uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_journal_kind_reference" json:"reference"`   // OperatorEarning or OperatorPayout ID
+
+	OperatorID  uuid.UUID  `gorm:"type:uuid;not null;index" json:"operator_id"`
+	NodeID      *uuid.UUID `gorm:"type:uuid;index" json:"node_id,omitempty"`
+	Description string     `gorm:"type:text" json:"description,omitempty"`
+
+	Postings []LedgerPosting `gorm:"foreignKey:EntryID" json:"postings,omitempty"`
+}
+
+// LedgerPosting moves an amount in or out of one account. Debits are
+// positive and credits negative, in micro-units of USD.
+type LedgerPosting struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	EntryID    uuid.UUID `gorm:"type:uuid;not null;index" json:"entry_id"`
+	Account    string    `gorm:"type:varchar(50);not null;index:idx_posting_account_operator" json:"account"` // operator_payable, platform_expense, payout_clearing, platform_treasury
+	OperatorID uuid.UUID `gorm:"type:uuid;not null;index:idx_posting_account_operator" json:"operator_id"`
+	Amount     int64     `gorm:"not null" json:"amount"`
+}
+
+// BeforeCreate hook
+func (e *JournalEntry) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook
+func (p *LedgerPosting) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// NodeDrain takes a node out of service. A draining node gets no new
+// sessions; once its sessions have left, or at the deadline, the remaining
+// ones are ended and the node goes into maintenance.
+type NodeDrain struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	NodeID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"node_id"`
+	Node        *VPNNode   `gorm:"foreignKey:NodeID" json:"-"`
+	RequestedBy *uuid.UUID `gorm:"type:uuid" json:"requested_by,omitempty"` // User who requested the drain
+	Reason      string     `json:"reason,omitempty"`
+
+	Deadline        time.Time `gorm:"not null" json:"deadline"`
+	SessionsAtStart int       `gorm:"default:0" json:"sessions_at_start"`
+	SessionsEnded   int       `gorm:"default:0" json:"sessions_ended"` // Sessions still connected at the deadline
+
+	CompletedAt *time.Time `json:"completed_at,omitempty"` // The node went into maintenance
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"` // The node returned to service
+}
+
+// BeforeCreate hook to set UUID
+func (d *NodeDrain) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
+
+// State returns draining, completed or cancelled
+func (d *NodeDrain) State() string {
+	switch {
+	case d.CancelledAt != nil:
+		return "cancelled"
+	case d.CompletedAt != nil:
+		return "completed"
+	default:
+		return "draining"
+	}
+}
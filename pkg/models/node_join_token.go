@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// NodeJoinToken is a hashed single-use token a node exchanges for its
+// identity certificate when it enrolls with the control server
+type NodeJoinToken struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	NodeID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"node_id"`
+	Node     *VPNNode   `gorm:"foreignKey:NodeID" json:"-"`
+	IssuedBy *uuid.UUID `gorm:"type:uuid" json:"issued_by,omitempty"` // User who requested the token
+
+	TokenHash string    `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"` // SHA-256 of the token
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// BeforeCreate hook to set UUID
+func (t *NodeJoinToken) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
+}
+
+// IsUsable reports whether the token can still be redeemed
+func (t *NodeJoinToken) IsUsable() bool {
+	return t.UsedAt == nil && t.RevokedAt == nil && time.Now().Before(t.ExpiresAt)
+}
@@ -28,6 +28,7 @@ type NodeOperator struct {
 	VerifiedAt       *time.Time `json:"verified_at,omitempty"`
 
 	// Earnings & Statistics
+	// Cached from the ledger, which is the source of truth
 	TotalEarned      float64 `gorm:"type:decimal(20,8);default:0" json:"total_earned"`      // Total earned in USD
 	PendingPayout    float64 `gorm:"type:decimal(20,8);default:0" json:"pending_payout"`    // Pending payout in USD
 	LastPayoutAt     *time.Time `json:"last_payout_at,omitempty"`
@@ -76,9 +77,15 @@ type OperatorEarning struct {
 	NodeID     uuid.UUID      `gorm:"type:uuid;not null;index" json:"node_id"`
 	Node       *VPNNode       `gorm:"foreignKey:NodeID" json:"node,omitempty"`
 
-	SessionID  uuid.UUID      `gorm:"type:uuid;not null;index" json:"session_id"`
+	SessionID  uuid.UUID      `gorm:"type:uuid;not null;index;uniqueIndex:idx_earning_session_period" json:"session_id"`
 	Session    *Session       `gorm:"foreignKey:SessionID" json:"session,omitempty"`
 
+	// Session period covered by this earning. Each period ends where the
+	// previous one did, so a session is never paid twice for the same traffic.
+	PeriodStart      time.Time `json:"period_start"`
+	PeriodEnd        time.Time `gorm:"uniqueIndex:idx_earning_session_period" json:"period_end"`
+	BytesThrough     int64     `gorm:"default:0" json:"bytes_through"` // Session bytes counted up to PeriodEnd
+
 	// Earning details
 	BandwidthGB      float64 `gorm:"type:decimal(20,4);not null" json:"bandwidth_gb"`
 	DurationMinutes  int     `gorm:"not null" json:"duration_minutes"`
@@ -91,7 +98,31 @@ type OperatorEarning struct {
 
 	// Quality metrics (affects future rates)
 	ConnectionQuality float64 `gorm:"type:decimal(5,2)" json:"connection_quality"` // 0-100
-	UserRating       int      `gorm:"type:int;check:user_rating >= 1 AND user_rating <= 5" json:"user_rating,omitempty"`
+	UserRating       *int     `gorm:"type:int;check:user_rating >= 1 AND user_rating <= 5" json:"user_rating,omitempty"`
+}
+
+// BeforeCreate hook
+func (op *NodeOperator) BeforeCreate(tx *gorm.DB) error {
+	if op.ID == uuid.Nil {
+		op.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook
+func (p *OperatorPayout) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook
+func (e *OperatorEarning) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
 }
 
 // OperatorPayout tracks payout transactions
@@ -108,6 +139,7 @@ type OperatorPayout struct {
 	CryptoAmount     float64 `gorm:"type:decimal(30,18);not null" json:"crypto_amount"`
 	CryptoCurrency   string  `gorm:"type:varchar(50);not null" json:"crypto_currency"` // ETH, BTC, LTC
 	ExchangeRate     float64 `gorm:"type:decimal(20,8);not null" json:"exchange_rate"` // USD per crypto unit
+	RateSnapshotID   *uuid.UUID `gorm:"type:uuid" json:"rate_snapshot_id,omitempty"`      // ExchangeRateSnapshot the amount was priced at
 
 	// Transaction details
 	WalletAddress    string  `gorm:"type:varchar(255);not null" json:"wallet_address"`
@@ -147,7 +179,8 @@ type NodeReward struct {
 	IsActive         bool    `gorm:"default:true" json:"is_active"`
 }
 
-// NodePerformanceMetric tracks node performance over time
+// NodePerformanceMetric tracks node performance over time. A sample is
+// recorded from the host telemetry of every node heartbeat.
 type NodePerformanceMetric struct {
 	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()" json:"id"`
 	CreatedAt time.Time `json:"created_at"`
@@ -166,6 +199,22 @@ type NodePerformanceMetric struct {
 	BandwidthGB      float64 `gorm:"type:decimal(20,4);default:0" json:"bandwidth_gb"`
 	AverageLatencyMs int     `gorm:"default:0" json:"average_latency_ms"`
 
+	// Host telemetry reported with the heartbeat
+	SampledAt        time.Time `gorm:"index" json:"sampled_at"`
+	HeartbeatVersion int       `gorm:"default:0" json:"heartbeat_version"`
+	CPUUsage         float64   `gorm:"default:0" json:"cpu_usage"`    // Percent
+	MemoryUsage      float64   `gorm:"default:0" json:"memory_usage"` // Percent
+	LoadAverage1     float64   `gorm:"default:0" json:"load_average_1"`
+	LoadAverage5     float64   `gorm:"default:0" json:"load_average_5"`
+	LoadAverage15    float64   `gorm:"default:0" json:"load_average_15"`
+	RxMbps           float64   `gorm:"default:0" json:"rx_mbps"` // Public interface throughput
+	TxMbps           float64   `gorm:"default:0" json:"tx_mbps"`
+	ConntrackCount   int64     `gorm:"default:0" json:"conntrack_count"`
+	ConntrackMax     int64     `gorm:"default:0" json:"conntrack_max"`
+	Peers            int       `gorm:"default:0" json:"peers"`
+	ActivePeers      int       `gorm:"default:0" json:"active_peers"` // Peers with a recent handshake
+	LoadScore        float64   `gorm:"default:0" json:"load_score"`
+
 	// Quality scores
 	AvailabilityScore float64 `gorm:"type:decimal(5,2)" json:"availability_score"` // 0-100
 	PerformanceScore  float64 `gorm:"type:decimal(5,2)" json:"performance_score"`  // 0-100
@@ -194,15 +243,9 @@ func CalculateEarnings(bandwidthGB float64, durationMinutes int, ratePerGB float
 	return baseEarnings * qualityMultiplier * durationBonus
 }
 
-// UpdateOperatorStats updates operator statistics
+// UpdateStats recomputes operator node statistics. Money columns are
+// maintained by the ledger package and are not touched here.
 func (op *NodeOperator) UpdateStats(db *gorm.DB) error {
-	// Calculate total earnings
-	var totalEarned float64
-	db.Model(&OperatorEarning{}).
-		Where("operator_id = ? AND status = ?", op.ID, "confirmed").
-		Select("COALESCE(SUM(amount_usd), 0)").
-		Scan(&totalEarned)
-
 	// Calculate total bandwidth from all operator nodes (in KB)
 	var totalBandwidthKB int64
 	db.Model(&VPNNode{}).
@@ -210,24 +253,6 @@ func (op *NodeOperator) UpdateStats(db *gorm.DB) error {
 		Select("COALESCE(SUM(total_bandwidth_kb), 0)").
 		Scan(&totalBandwidthKB)
 
-	// Calculate pending payout based on bandwidth
-	// Rate: $0.10 per GB ($0.0001 per KB)
-	// Formula: (totalBandwidthKB / 1024 / 1024) * $0.10
-	ratePerKB := 0.0001 / 1024.0 / 1024.0 * 0.10 // $0.10 per GB
-	pendingPayout := float64(totalBandwidthKB) * ratePerKB
-
-	// Subtract already paid amounts
-	var totalPaid float64
-	db.Model(&OperatorEarning{}).
-		Where("operator_id = ? AND status = ?", op.ID, "confirmed").
-		Select("COALESCE(SUM(amount_usd), 0)").
-		Scan(&totalPaid)
-
-	pendingPayout = pendingPayout - totalPaid
-	if pendingPayout < 0 {
-		pendingPayout = 0
-	}
-
 	// Count active nodes
 	var activeNodes int64
 	db.Model(&VPNNode{}).
@@ -243,11 +268,9 @@ func (op *NodeOperator) UpdateStats(db *gorm.DB) error {
 
 	// Update operator record
 	return db.Model(op).Updates(map[string]interface{}{
-		"total_earned":       totalEarned,
-		"pending_payout":     pendingPayout,
 		"active_nodes_count": activeNodes,
 		"average_uptime":     avgUptime,
-		"total_bandwidth_kb": totalBandwidthKB,
+		"total_bandwidth_gb": float64(totalBandwidthKB) / (1024 * 1024),
 	}).Error
 }
 
@@ -299,8 +322,9 @@ func (op *NodeOperator) GetEligibleTier(db *gorm.DB) (*NodeReward, error) {
 	if err != nil {
 		// Return default tier
 		return &NodeReward{
-			TierName:      "bronze",
-			BaseRatePerGB: 0.01, // $0.01 per GB
+			TierName:        "bronze",
+			BaseRatePerGB:   0.01, // $0.01 per GB
+			BonusMultiplier: 1.0,
 		}, nil
 	}
 
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Payment states
+const (
+	PaymentPending   = "pending"   // Waiting for a deposit
+	PaymentDetected  = "detected"  // Deposit seen, waiting for confirmations
+	PaymentConfirmed = "confirmed" // Paid in full and confirmed; subscription activated
+	PaymentExpired   = "expired"   // Nothing was paid before the payment expired
+	PaymentUnderpaid = "underpaid" // Less than the amount due was paid before expiry
+	PaymentLate      = "late"      // Funds arrived after the payment expired and are due for refund
+	PaymentRefunded  = "refunded"  // Funds were returned to the payer
+)
+
+// paymentTransitions lists the states each state may move to
+var paymentTransitions = map[string][]string{
+	PaymentPending:   {PaymentDetected, PaymentExpired},
+	PaymentDetected:  {PaymentConfirmed, PaymentUnderpaid, PaymentExpired},
+	PaymentConfirmed: {PaymentRefunded},
+	PaymentExpired:   {PaymentLate},
+	PaymentUnderpaid: {PaymentRefunded},
+	PaymentLate:      {PaymentRefunded},
+}
+
+// Payment is a cryptocurrency payment for a subscription
+type Payment struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	UserID uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	User   *User     `gorm:"foreignKey:UserID" json:"-"`
+
+	// What is being paid for
+	SubscriptionTier string  `gorm:"type:varchar(50);not null" json:"subscription_tier"`
+	Duration         int     `gorm:"not null" json:"duration"`                  // Months
+	Amount           float64 `gorm:"type:decimal(20,8);not null" json:"amount"` // USD
+
+	// How it is paid
+	Cryptocurrency  string     `gorm:"type:varchar(10);not null" json:"cryptocurrency"` // BTC, ETH, LTC
+	AmountCrypto    float64    `gorm:"type:decimal(30,18);not null" json:"amount_crypto"`
+	AmountReceived  float64    `gorm:"type:decimal(30,18);default:0" json:"amount_received"`
+	ExchangeRate    float64    `gorm:"type:decimal(20,8);not null" json:"exchange_rate"` // USD per crypto unit
+	RateSnapshotID  *uuid.UUID `gorm:"type:uuid" json:"rate_snapshot_id,omitempty"`      // ExchangeRateSnapshot the amount was quoted at
+	Address         string     `gorm:"type:varchar(255);not null;uniqueIndex" json:"address"`
+	DerivationIndex *uint32    `json:"derivation_index,omitempty"` // HD wallet index the address was derived at
+	TxHash          string     `gorm:"type:varchar(255)" json:"tx_hash,omitempty"`
+	Confirmations   int        `json:"confirmations"`
+	RequiredConf    int        `gorm:"not null" json:"required_confirmations"`
+
+	// State, with the time each state was entered
+	Status      string     `gorm:"type:varchar(20);not null;default:'pending';index" json:"status"`
+	ExpiresAt   time.Time  `gorm:"not null" json:"expires_at"`
+	DetectedAt  *time.Time `json:"detected_at,omitempty"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	ExpiredAt   *time.Time `json:"expired_at,omitempty"`
+	UnderpaidAt *time.Time `json:"underpaid_at,omitempty"`
+	LateAt      *time.Time `json:"late_at,omitempty"`
+	RefundedAt  *time.Time `json:"refunded_at,omitempty"`
+}
+
+// BeforeCreate hook
+func (p *Payment) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	if p.Status == "" {
+		p.Status = PaymentPending
+	}
+	return nil
+}
+
+// CanTransitionTo reports whether the payment may move to status
+func (p *Payment) CanTransitionTo(status string) bool {
+	for _, next := range paymentTransitions[p.Status] {
+		if next == status {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOpen reports whether the payment is still waiting for funds
+func (p *Payment) IsOpen() bool {
+	return p.Status == PaymentPending || p.Status == PaymentDetected
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Payout job states
+const (
+	PayoutJobQueued    = "queued"    // Waiting to send the transaction
+	PayoutJobSending   = "sending"   // Signed transaction is being broadcast
+	PayoutJobSubmitted = "submitted" // Sent; waiting for confirmations
+	PayoutJobCompleted = "completed"
+	PayoutJobFailed    = "failed"
+	PayoutJobReview    = "review" // The transaction may have been sent; needs manual reconciliation
+)
+
+// PayoutJob is the durable work item that sends an OperatorPayout on-chain
+// and tracks it until it is confirmed. There is exactly one job per payout,
+// so the payout ID doubles as the idempotency key.
+type PayoutJob struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	PayoutID uuid.UUID       `gorm:"type:uuid;not null;uniqueIndex" json:"payout_id"`
+	Payout   *OperatorPayout `gorm:"foreignKey:PayoutID" json:"payout,omitempty"`
+
+	State     string    `gorm:"type:varchar(20);not null;index:idx_payout_job_due" json:"state"`
+	NextRunAt time.Time `gorm:"not null;index:idx_payout_job_due" json:"next_run_at"`
+	Attempts  int       `gorm:"default:0" json:"attempts"` // Send attempts
+	LastError string    `gorm:"type:text" json:"last_error,omitempty"`
+
+	// Lease held by the worker currently processing the job
+	LeaseOwner     string     `gorm:"type:varchar(100)" json:"lease_owner,omitempty"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+
+	// On-chain tracking. The transaction is signed and stored before it is
+	// first broadcast, and only that transaction is ever broadcast again.
+	TransactionHash   string `gorm:"type:varchar(255)" json:"transaction_hash,omitempty"`
+	SignedTransaction string `gorm:"type:text" json:"-"`
+	Confirmations     int64  `gorm:"default:0" json:"confirmations"`
+}
+
+// BeforeCreate hook
+func (j *PayoutJob) BeforeCreate(tx *gorm.DB) error {
+	if j.ID == uuid.Nil {
+		j.ID = uuid.New()
+	}
+	return nil
+}
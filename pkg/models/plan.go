@@ -0,0 +1,58 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// FreePlan is the plan of users without an active paid subscription
+const FreePlan = "free"
+
+// Plan is a subscription plan and the features it entitles users to
+type Plan struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Name        string  `gorm:"type:varchar(50);uniqueIndex;not null" json:"name"` // Matches User.SubscriptionTier
+	DisplayName string  `gorm:"type:varchar(100)" json:"display_name"`
+	PriceUSD    float64 `gorm:"type:decimal(10,2);not null" json:"price_usd"` // Per month; 0 for the free plan
+
+	// Limits (0 = unlimited)
+	DeviceLimit    int     `gorm:"not null" json:"device_limit"`                        // Concurrent sessions
+	BandwidthCapGB float64 `gorm:"type:decimal(12,2);not null" json:"bandwidth_cap_gb"` // Per billing cycle
+	SpeedLimitMbps int     `gorm:"not null;default:0" json:"speed_limit_mbps"`          // Per session, each direction
+
+	// Features
+	AllowedProtocols  string `gorm:"not null" json:"allowed_protocols"` // comma-separated
+	AllowsMultiHop    bool   `json:"allows_multihop"`
+	AllowsObfuscation bool   `json:"allows_obfuscation"`
+
+	IsActive bool `gorm:"default:true" json:"is_active"`
+}
+
+// BeforeCreate hook to set UUID
+func (p *Plan) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
+// AllowsProtocol reports whether sessions may use protocol
+func (p *Plan) AllowsProtocol(protocol string) bool {
+	for _, allowed := range strings.Split(p.AllowedProtocols, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// SpeedLimitKbps returns the per-session rate limit in kbit/s, 0 if unlimited
+func (p *Plan) SpeedLimitKbps() int {
+	return p.SpeedLimitMbps * 1000
+}
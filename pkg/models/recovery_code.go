@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RecoveryCode is a hashed single-use code that signs a user in when they
+// can't use their authenticator app
+type RecoveryCode struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	UserID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	User     *User      `gorm:"foreignKey:UserID" json:"-"`
+	CodeHash string     `gorm:"type:varchar(64);not null;index" json:"-"` // SHA-256 of the code
+	UsedAt   *time.Time `json:"used_at,omitempty"`
+}
+
+// BeforeCreate hook to set UUID
+func (r *RecoveryCode) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Reasons a refresh token was revoked
+const (
+	RevokedLogout = "logout"  // The user signed out on the device
+	RevokedByUser = "revoked" // The user signed the device out from another one
+	RevokedReuse  = "reuse"   // A rotated token was presented again, so the family may be stolen
+
+	RevokedPasswordChange = "password_change" // The password was changed from another session
+)
+
+// RefreshToken is a hashed refresh token. Every sign-in starts a family of
+// tokens; each refresh rotates the current token for a new one in the same
+// family, so a family is one signed-in device.
+type RefreshToken struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	UserID   uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	User     *User     `gorm:"foreignKey:UserID" json:"-"`
+	FamilyID uuid.UUID `gorm:"type:uuid;not null;index" json:"family_id"`
+
+	TokenHash string `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"` // SHA-256 of the token
+
+	// The device, as of the last use
+	DeviceName string    `gorm:"type:varchar(100)" json:"device_name"`
+	IPAddress  string    `gorm:"type:varchar(45)" json:"ip_address"`
+	UserAgent  string    `gorm:"type:varchar(255)" json:"user_agent"`
+	SignedInAt time.Time `gorm:"not null" json:"signed_in_at"` // When the family was started
+	LastUsedAt time.Time `gorm:"not null" json:"last_used_at"`
+	ExpiresAt  time.Time `gorm:"not null;index" json:"expires_at"`
+
+	// The access token issued with this refresh token, revoked with the family
+	AccessTokenID   string    `gorm:"type:varchar(36)" json:"-"`
+	AccessExpiresAt time.Time `json:"-"`
+
+	RotatedAt     *time.Time `json:"rotated_at,omitempty"` // Exchanged for the next token in the family
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason string     `gorm:"type:varchar(20)" json:"revoked_reason,omitempty"`
+}
+
+// BeforeCreate hook to set UUID
+func (r *RefreshToken) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+// IsUsable reports whether the token can still be exchanged
+func (r *RefreshToken) IsUsable() bool {
+	return r.RotatedAt == nil && r.RevokedAt == nil && time.Now().Before(r.ExpiresAt)
+}
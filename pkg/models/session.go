@@ -19,7 +19,7 @@ type Session struct {
 	TunnelIP      string    `gorm:"not null" json:"tunnel_ip"`
 	PublicKey     string    `json:"public_key"`     // For WireGuard
 	PrivateKey    string    `json:"-"`              // Encrypted, never exposed
-	Status        string    `gorm:"default:'active'" json:"status"` // active, disconnected, terminated
+	Status        string    `gorm:"default:'active'" json:"status"` // active, disconnected, terminated, evicted
 	ConnectedAt   time.Time `gorm:"not null" json:"connected_at"`
 	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
 
@@ -28,6 +28,9 @@ type Session struct {
 	BytesReceived int64   `gorm:"default:0" json:"bytes_received"`
 	DataUsedGB    float64 `gorm:"default:0" json:"data_used_gb"`
 
+	// Rate limit applied to the peer on its node, in kbps (0 = unlimited)
+	RateLimitKbps int `gorm:"default:0" json:"rate_limit_kbps"`
+
 	// Connection quality
 	Latency       int `json:"latency"`        // milliseconds
 	PacketLoss    float64 `json:"packet_loss"` // percentage
@@ -25,9 +25,16 @@ type User struct {
 	DataTransferredGB float64 `gorm:"default:0" json:"data_transferred_gb"`
 	ConnectionCount   int64   `gorm:"default:0" json:"connection_count"`
 
+	// Usage in the current billing cycle, checked against the plan's cap
+	CycleDataGB        float64    `gorm:"default:0" json:"cycle_data_gb"`
+	CycleStartedAt     time.Time  `json:"cycle_started_at"`
+	QuotaWarnedPercent int        `gorm:"default:0" json:"-"` // Highest warning sent this cycle
+	QuotaExceededAt    *time.Time `json:"quota_exceeded_at,omitempty"`
+
 	// Security
-	TwoFactorEnabled bool   `gorm:"default:false" json:"two_factor_enabled"`
-	TwoFactorSecret  string `json:"-"`
+	TwoFactorEnabled  bool   `gorm:"default:false" json:"two_factor_enabled"`
+	TwoFactorSecret   string `json:"-"`                  // Encrypted TOTP secret
+	TwoFactorLastStep int64  `gorm:"default:0" json:"-"` // Time step of the last code used, so codes can't be replayed
 
 	// Timestamps
 	CreatedAt time.Time      `json:"created_at"`
@@ -35,20 +35,28 @@ type VPNNode struct {
 	LoadScore          float64 `gorm:"default:0;index" json:"load_score"`   // 0-100, lower is better
 
 	// Status and health
-	Status         string    `gorm:"default:'offline'" json:"status"` // online, offline, maintenance
+	Status         string    `gorm:"default:'offline'" json:"status"` // online, degraded, offline, draining, maintenance
 	IsActive       bool      `gorm:"default:true" json:"is_active"`
 	LastHeartbeat  time.Time `json:"last_heartbeat"`
 	LastHealthCheck time.Time `json:"last_health_check"`
-	Latency        int       `json:"latency"` // in milliseconds
+	Latency        int       `json:"latency"` // Probe round trip from the control server, in milliseconds
+	ProbeFailures  int       `gorm:"default:0" json:"probe_failures"` // Consecutive failed health probes
+	LastProbeError string    `json:"last_probe_error,omitempty"`
 
 	// Supported protocols
 	SupportsWireGuard bool   `gorm:"default:true" json:"supports_wireguard"`
-	SupportsOpenVPN   bool   `gorm:"default:true" json:"supports_openvpn"`
+	SupportsOpenVPN   bool   `gorm:"default:false" json:"supports_openvpn"` // Set when the node reports serving OpenVPN
 	WireGuardPort     int    `gorm:"default:51820" json:"wireguard_port"`
 	OpenVPNPort       int    `gorm:"default:1194" json:"openvpn_port"`
+	APIPort           int    `gorm:"default:8081" json:"api_port"` // Node API used for peer provisioning, 0 if disabled
 	PublicKey         string `json:"public_key"` // WireGuard public key
 	PrivateKeyEncrypted string `json:"-"` // WireGuard private key (encrypted in production)
 
+	// Node identity, set when the node enrolls with a join token. Requests
+	// from the node to the control server are signed with this key.
+	IdentityKey string     `gorm:"type:varchar(64)" json:"identity_key,omitempty"` // Ed25519 public key
+	EnrolledAt  *time.Time `json:"enrolled_at,omitempty"`
+
 	// Features
 	SupportsMultiHop   bool `gorm:"default:false" json:"supports_multihop"`
 	SupportsObfuscation bool `gorm:"default:false" json:"supports_obfuscation"`
@@ -64,7 +72,7 @@ type VPNNode struct {
 	IsOperatorOwned  bool       `gorm:"default:false" json:"is_operator_owned"`
 	UptimePercentage float64    `gorm:"type:decimal(5,2);default:0" json:"uptime_percentage"`
 
-	// Earnings (for operator nodes)
+	// Earnings (for operator nodes), cached from the ledger
 	TotalEarnedUSD   float64    `gorm:"type:decimal(20,8);default:0" json:"total_earned_usd,omitempty"`
 
 	// Timestamps
@@ -86,7 +94,10 @@ func (n *VPNNode) BeforeCreate(tx *gorm.DB) error {
 
 // CalculateLoadScore calculates the load score based on connections, CPU, and memory
 func (n *VPNNode) CalculateLoadScore() float64 {
-	connectionLoad := float64(n.CurrentConnections) / float64(n.MaxConnections) * 100
+	connectionLoad := 0.0
+	if n.MaxConnections > 0 {
+		connectionLoad = float64(n.CurrentConnections) / float64(n.MaxConnections) * 100
+	}
 	cpuLoad := n.CPUUsage
 	memoryLoad := n.MemoryUsage
 
@@ -0,0 +1,142 @@
+package nodeapi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Headers carrying request and response authentication
+const (
+	HeaderKey       = "X-Aureo-Key"
+	HeaderTimestamp = "X-Aureo-Timestamp"
+	HeaderNonce     = "X-Aureo-Nonce"
+	HeaderSignature = "X-Aureo-Signature"
+)
+
+// MaxClockSkew is how far a request timestamp may drift from the node's clock
+const MaxClockSkew = 30 * time.Second
+
+// keyLabel domain-separates the node API key from other uses of the shared secret
+const keyLabel = "aureo-vpn node api v1"
+
+// Authenticator signs and verifies messages exchanged between the API gateway
+// and a node. Both sides derive the same key through X25519 of their own
+// private key and the other side's public key, so a valid signature proves the
+// sender holds one of the two private keys.
+type Authenticator struct {
+	key []byte
+}
+
+// NewAuthenticator derives the shared signing key from a local private key and
+// a remote public key, both base64 encoded WireGuard-style keys
+func NewAuthenticator(privateKey, peerPublicKey string) (*Authenticator, error) {
+	priv, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(priv) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid private key")
+	}
+
+	pub, err := base64.StdEncoding.DecodeString(peerPublicKey)
+	if err != nil || len(pub) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid peer public key")
+	}
+
+	shared, err := curve25519.X25519(priv, pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive shared key: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(keyLabel))
+	mac.Write(shared)
+
+	return &Authenticator{key: mac.Sum(nil)}, nil
+}
+
+// signRequest computes the signature of a request
+func (a *Authenticator) signRequest(method, uri, timestamp, nonce string, body []byte) string {
+	return a.sign("request", method, uri, timestamp, nonce, string(body))
+}
+
+// signResponse computes the signature of a response. It is bound to the
+// request nonce so a response cannot be replayed for another request.
+func (a *Authenticator) signResponse(nonce string, status int, body []byte) string {
+	return a.sign("response", nonce, strconv.Itoa(status), string(body))
+}
+
+func (a *Authenticator) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, a.key)
+	for _, part := range parts {
+		// Length-prefix every part so boundaries cannot be shifted
+		fmt.Fprintf(mac, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify compares a signature in constant time
+func verify(expected, actual string) bool {
+	return hmac.Equal([]byte(expected), []byte(actual))
+}
+
+// newNonce returns a random request nonce
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkTimestamp validates a request timestamp against the allowed skew
+func checkTimestamp(header http.Header) error {
+	ts, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return fmt.Errorf("timestamp outside allowed window")
+	}
+
+	return nil
+}
+
+// nonceCache remembers recently seen nonces to reject replayed requests
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+// add records a nonce, returning false if it was already used
+func (c *nonceCache) add(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for n, expires := range c.seen {
+		if now.After(expires) {
+			delete(c.seen, n)
+		}
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+
+	// A nonce only needs remembering while its timestamp is still accepted
+	c.seen[nonce] = now.Add(2 * MaxClockSkew)
+	return true
+}
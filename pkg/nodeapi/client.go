@@ -0,0 +1,166 @@
+package nodeapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+)
+
+// Client calls the node API of any node from the API gateway, or probes node
+// health from the control server. It implements session.PeerController.
+type Client struct {
+	privateKey string
+	publicKey  string
+	httpClient *http.Client
+}
+
+// NewClient creates a node API client authenticated with the gateway's private key
+func NewClient(privateKey string, timeout time.Duration) (*Client, error) {
+	publicKey, err := wireguard.DerivePublicKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node API private key: %w", err)
+	}
+
+	return &Client{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		httpClient: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// PublicKey returns the key nodes must be configured with to accept this client
+func (c *Client) PublicKey() string {
+	return c.publicKey
+}
+
+// AddPeer adds a peer to the node's WireGuard interface
+func (c *Client) AddPeer(ctx context.Context, node *models.VPNNode, peer wireguard.PeerConfig) error {
+	req := AddPeerRequest{
+		PublicKey:           peer.PublicKey,
+		PresharedKey:        peer.PresharedKey,
+		AllowedIPs:          peer.AllowedIPs,
+		PersistentKeepalive: peer.PersistentKeepalive,
+	}
+	return c.do(ctx, node, http.MethodPost, "/v1/peers", req, nil)
+}
+
+// RemovePeer removes a peer from the node's WireGuard interface
+func (c *Client) RemovePeer(ctx context.Context, node *models.VPNNode, publicKey string) error {
+	uri := "/v1/peers?" + url.Values{"public_key": {publicKey}}.Encode()
+	return c.do(ctx, node, http.MethodDelete, uri, nil, nil)
+}
+
+// LimitPeer rate limits a peer on the node's WireGuard interface. A rate of 0
+// removes the limit.
+func (c *Client) LimitPeer(ctx context.Context, node *models.VPNNode, publicKey string, rateKbps int) error {
+	req := LimitPeerRequest{PublicKey: publicKey, RateKbps: rateKbps}
+	return c.do(ctx, node, http.MethodPut, "/v1/peers/limit", req, nil)
+}
+
+// ListPeers returns the peers configured on the node
+func (c *Client) ListPeers(ctx context.Context, node *models.VPNNode) ([]Peer, error) {
+	var resp ListPeersResponse
+	if err := c.do(ctx, node, http.MethodGet, "/v1/peers", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Peers, nil
+}
+
+// Health checks that the node's WireGuard interface is up
+func (c *Client) Health(ctx context.Context, node *models.VPNNode) (*Health, error) {
+	var health Health
+	if err := c.do(ctx, node, http.MethodGet, "/v1/health", nil, &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// do sends a signed request to the node and verifies the signed response
+func (c *Client) do(ctx context.Context, node *models.VPNNode, method, uri string, in, out interface{}) error {
+	if node.PublicKey == "" {
+		return fmt.Errorf("node %s has no public key", node.Name)
+	}
+	if node.APIPort == 0 {
+		return fmt.Errorf("node %s has the node API disabled", node.Name)
+	}
+
+	auth, err := NewAuthenticator(c.privateKey, node.PublicKey)
+	if err != nil {
+		return fmt.Errorf("node %s: %w", node.Name, err)
+	}
+
+	var body []byte
+	if in != nil {
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	endpoint := "http://" + Address(node.PublicIP, node.APIPort) + uri
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderKey, c.publicKey)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, auth.signRequest(method, req.URL.RequestURI(), timestamp, nonce, body))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("node %s unreachable: %w", node.Name, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read response from node %s: %w", node.Name, err)
+	}
+
+	if !verify(auth.signResponse(nonce, resp.StatusCode, respBody), resp.Header.Get(HeaderSignature)) {
+		return fmt.Errorf("node %s returned an unauthenticated response", node.Name)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(respBody, &e)
+		return fmt.Errorf("node %s rejected request (%d): %s", node.Name, resp.StatusCode, e.Error)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to decode response from node %s: %w", node.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Address returns the node API address for a host, using DefaultPort when
+// no port is set
+func Address(host string, port int) string {
+	if port == 0 {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,288 @@
+package nodeapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+)
+
+// DefaultPort is the port the node API listens on when none is configured
+const DefaultPort = 8081
+
+// maxBodySize limits request bodies accepted by the node API
+const maxBodySize = 64 * 1024
+
+// PeerManager applies peer changes to the node's WireGuard interface
+type PeerManager interface {
+	AddPeer(peer wireguard.PeerConfig) error
+	RemovePeer(publicKey string) error
+	GetInterfaceStats() (*wireguard.InterfaceStats, error)
+}
+
+// RateLimiter limits the bandwidth of individual peers. Nodes whose
+// PeerManager does not implement it reject rate limit requests.
+type RateLimiter interface {
+	SetPeerRateLimit(publicKey string, rateKbps int) error
+}
+
+// Peer represents a WireGuard peer configured on a node
+type Peer struct {
+	PublicKey           string    `json:"public_key"`
+	Endpoint            string    `json:"endpoint,omitempty"`
+	AllowedIPs          []string  `json:"allowed_ips"`
+	LatestHandshake     time.Time `json:"latest_handshake"`
+	BytesReceived       int64     `json:"bytes_received"`
+	BytesSent           int64     `json:"bytes_sent"`
+	PersistentKeepalive int       `json:"persistent_keepalive"`
+}
+
+// AddPeerRequest represents a request to add a peer
+type AddPeerRequest struct {
+	PublicKey           string   `json:"public_key"`
+	PresharedKey        string   `json:"preshared_key,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive"`
+}
+
+// LimitPeerRequest represents a request to rate limit a peer. A rate of 0
+// removes the limit, leaving the peer at its plan's speed.
+type LimitPeerRequest struct {
+	PublicKey string `json:"public_key"`
+	RateKbps  int    `json:"rate_kbps"`
+}
+
+// ListPeersResponse represents the peers configured on a node
+type ListPeersResponse struct {
+	Peers []Peer `json:"peers"`
+}
+
+// Health reports the state of a node's WireGuard interface
+type Health struct {
+	Interface string `json:"interface"`
+	Peers     int    `json:"peers"`
+}
+
+// Server exposes peer provisioning and health on a node to the API gateway
+// and control server
+type Server struct {
+	peers            PeerManager
+	auth             *Authenticator
+	gatewayPublicKey string
+	nonces           *nonceCache
+	httpServer       *http.Server
+}
+
+// NewServer creates a node API server authenticated with the node's private
+// key and the API gateway's public key
+func NewServer(peers PeerManager, nodePrivateKey, gatewayPublicKey string) (*Server, error) {
+	auth, err := NewAuthenticator(nodePrivateKey, gatewayPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		peers:            peers,
+		auth:             auth,
+		gatewayPublicKey: gatewayPublicKey,
+		nonces:           newNonceCache(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/peers", s.authenticate(s.handleListPeers))
+	mux.HandleFunc("POST /v1/peers", s.authenticate(s.handleAddPeer))
+	mux.HandleFunc("DELETE /v1/peers", s.authenticate(s.handleRemovePeer))
+	mux.HandleFunc("PUT /v1/peers/limit", s.authenticate(s.handleLimitPeer))
+	mux.HandleFunc("GET /v1/health", s.authenticate(s.handleHealth))
+
+	s.httpServer = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	return s, nil
+}
+
+// ListenAndServe serves the node API on addr until Shutdown is called
+func (s *Server) ListenAndServe(addr string) error {
+	s.httpServer.Addr = addr
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler serving the node API
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// authenticatedHandler handles a request whose signature has been verified
+type authenticatedHandler func(w http.ResponseWriter, r *http.Request, body []byte) (int, interface{})
+
+// authenticate verifies the request signature and signs the response
+func (s *Server) authenticate(next authenticatedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nonce := r.Header.Get(HeaderNonce)
+
+		if r.Header.Get(HeaderKey) != s.gatewayPublicKey {
+			s.respond(w, nonce, http.StatusUnauthorized, errorBody("unknown caller"))
+			return
+		}
+
+		if err := checkTimestamp(r.Header); err != nil {
+			s.respond(w, nonce, http.StatusUnauthorized, errorBody(err.Error()))
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		if err != nil {
+			s.respond(w, nonce, http.StatusBadRequest, errorBody("failed to read body"))
+			return
+		}
+
+		expected := s.auth.signRequest(r.Method, r.URL.RequestURI(), r.Header.Get(HeaderTimestamp), nonce, body)
+		if nonce == "" || !verify(expected, r.Header.Get(HeaderSignature)) {
+			s.respond(w, nonce, http.StatusUnauthorized, errorBody("invalid signature"))
+			return
+		}
+
+		if !s.nonces.add(nonce) {
+			s.respond(w, nonce, http.StatusUnauthorized, errorBody("replayed request"))
+			return
+		}
+
+		status, resp := next(w, r, body)
+		s.respond(w, nonce, status, resp)
+	}
+}
+
+// respond writes a signed JSON response
+func (s *Server) respond(w http.ResponseWriter, nonce string, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode node API response: %v", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":"internal error"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(HeaderSignature, s.auth.signResponse(nonce, status, body))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (s *Server) handleListPeers(w http.ResponseWriter, r *http.Request, body []byte) (int, interface{}) {
+	stats, err := s.peers.GetInterfaceStats()
+	if err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	resp := ListPeersResponse{Peers: make([]Peer, 0, len(stats.Peers))}
+	for _, p := range stats.Peers {
+		resp.Peers = append(resp.Peers, Peer{
+			PublicKey:           p.PublicKey,
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          p.AllowedIPs,
+			LatestHandshake:     p.LatestHandshake,
+			BytesReceived:       p.BytesReceived,
+			BytesSent:           p.BytesSent,
+			PersistentKeepalive: p.PersistentKeepalive,
+		})
+	}
+
+	return http.StatusOK, resp
+}
+
+func (s *Server) handleAddPeer(w http.ResponseWriter, r *http.Request, body []byte) (int, interface{}) {
+	var req AddPeerRequest
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
+		return http.StatusBadRequest, errorBody("invalid request body")
+	}
+
+	if err := wireguard.ValidatePublicKey(req.PublicKey); err != nil {
+		return http.StatusBadRequest, errorBody(fmt.Sprintf("invalid public key: %v", err))
+	}
+
+	if len(req.AllowedIPs) == 0 {
+		return http.StatusBadRequest, errorBody("allowed_ips is required")
+	}
+
+	peer := wireguard.PeerConfig{
+		PublicKey:           req.PublicKey,
+		PresharedKey:        req.PresharedKey,
+		AllowedIPs:          req.AllowedIPs,
+		PersistentKeepalive: req.PersistentKeepalive,
+	}
+
+	if err := s.peers.AddPeer(peer); err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusCreated, map[string]string{"public_key": req.PublicKey}
+}
+
+func (s *Server) handleRemovePeer(w http.ResponseWriter, r *http.Request, body []byte) (int, interface{}) {
+	publicKey := r.URL.Query().Get("public_key")
+	if err := wireguard.ValidatePublicKey(publicKey); err != nil {
+		return http.StatusBadRequest, errorBody(fmt.Sprintf("invalid public key: %v", err))
+	}
+
+	if err := s.peers.RemovePeer(publicKey); err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, map[string]string{"public_key": publicKey}
+}
+
+func (s *Server) handleLimitPeer(w http.ResponseWriter, r *http.Request, body []byte) (int, interface{}) {
+	limiter, ok := s.peers.(RateLimiter)
+	if !ok {
+		return http.StatusNotImplemented, errorBody("rate limiting is not supported on this node")
+	}
+
+	var req LimitPeerRequest
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
+		return http.StatusBadRequest, errorBody("invalid request body")
+	}
+
+	if err := wireguard.ValidatePublicKey(req.PublicKey); err != nil {
+		return http.StatusBadRequest, errorBody(fmt.Sprintf("invalid public key: %v", err))
+	}
+
+	if req.RateKbps < 0 {
+		return http.StatusBadRequest, errorBody("rate_kbps must not be negative")
+	}
+
+	if err := limiter.SetPeerRateLimit(req.PublicKey, req.RateKbps); err != nil {
+		return http.StatusInternalServerError, errorBody(err.Error())
+	}
+
+	return http.StatusOK, req
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request, body []byte) (int, interface{}) {
+	stats, err := s.peers.GetInterfaceStats()
+	if err != nil {
+		return http.StatusServiceUnavailable, errorBody(fmt.Sprintf("wireguard interface unavailable: %v", err))
+	}
+
+	return http.StatusOK, Health{Interface: stats.InterfaceName, Peers: len(stats.Peers)}
+}
+
+func errorBody(msg string) map[string]string {
+	return map[string]string{"error": msg}
+}
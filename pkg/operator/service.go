@@ -2,15 +2,19 @@ package operator
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/enrollment"
 	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/ledger"
 	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/maintenance"
 	"github.com/nikola43/aureo-vpn/pkg/models"
-	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
 	"github.com/nikola43/aureo-vpn/pkg/rewards"
 	"gorm.io/gorm"
 )
@@ -20,14 +24,19 @@ type Service struct {
 	db            *gorm.DB
 	log           *logger.Logger
 	rewardService *rewards.RewardService
+	enrollments   *enrollment.Service
+	drains        *maintenance.Service
 }
 
-// NewService creates a new operator service
-func NewService(log *logger.Logger, rewardService *rewards.RewardService) *Service {
+// NewService creates a new operator service. New nodes get join tokens from
+// enrollments, and operators take their nodes out of service with drains.
+func NewService(log *logger.Logger, rewardService *rewards.RewardService, enrollments *enrollment.Service, drains *maintenance.Service) *Service {
 	return &Service{
 		db:            database.GetDB(),
 		log:           log,
 		rewardService: rewardService,
+		enrollments:   enrollments,
+		drains:        drains,
 	}
 }
 
@@ -101,7 +110,9 @@ func (s *Service) RegisterOperator(ctx context.Context, userID uuid.UUID, req Re
 	return operator, nil
 }
 
-// CreateNode creates a new VPN node for an operator
+// CreateNode creates a new VPN node for an operator and returns the one-time
+// join token the node enrolls with. The node generates its own keys, so no
+// private key ever leaves it.
 func (s *Service) CreateNode(ctx context.Context, operatorID uuid.UUID, req NodeCreateRequest) (*models.VPNNode, string, error) {
 	// Get operator
 	var operator models.NodeOperator
@@ -120,12 +131,6 @@ func (s *Service) CreateNode(ctx context.Context, operatorID uuid.UUID, req Node
 		return nil, "", apperrors.ErrQuotaExceeded.WithInternal(fmt.Errorf("maximum nodes limit reached"))
 	}
 
-	// Generate WireGuard keypair
-	keyPair, err := wireguard.GenerateKeyPair()
-	if err != nil {
-		return nil, "", apperrors.ErrInternal.WithInternal(fmt.Errorf("failed to generate WireGuard keypair: %w", err))
-	}
-
 	// Create node
 	node := &models.VPNNode{
 		Name:                req.Name,
@@ -138,11 +143,9 @@ func (s *Service) CreateNode(ctx context.Context, operatorID uuid.UUID, req Node
 		Longitude:           req.Longitude,
 		WireGuardPort:       req.WireGuardPort,
 		OpenVPNPort:         req.OpenVPNPort,
-		PublicKey:           keyPair.PublicKey,
 		Status:              "offline", // Will be online when node connects
 		IsActive:            true,
 		SupportsWireGuard:   true,
-		SupportsOpenVPN:     true,
 		MaxConnections:      1000,
 		OperatorID:          &operatorID,
 		IsOperatorOwned:     true,
@@ -163,7 +166,101 @@ func (s *Service) CreateNode(ctx context.Context, operatorID uuid.UUID, req Node
 		"location", fmt.Sprintf("%s, %s", node.City, node.Country),
 	)
 
-	return node, keyPair.PrivateKey, nil
+	token, _, err := s.enrollments.IssueToken(ctx, node.ID, &operator.UserID)
+	if err != nil {
+		return nil, "", apperrors.ErrInternal.WithInternal(err)
+	}
+
+	return node, token, nil
+}
+
+// IssueJoinToken issues a new join token for one of the operator's nodes,
+// e.g. when the first one expired or the node has to enroll again. Earlier
+// unused tokens stop working.
+func (s *Service) IssueJoinToken(ctx context.Context, operatorID, nodeID uuid.UUID) (string, *models.NodeJoinToken, error) {
+	operator, err := s.ownedNode(operatorID, nodeID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, record, err := s.enrollments.IssueToken(ctx, nodeID, &operator.UserID)
+	if err != nil {
+		return "", nil, apperrors.ErrInternal.WithInternal(err)
+	}
+	return token, record, nil
+}
+
+// DrainNode stops one of the operator's nodes from receiving new sessions
+// and puts it into maintenance once its clients have left or after timeout
+func (s *Service) DrainNode(ctx context.Context, operatorID, nodeID uuid.UUID, timeout time.Duration, reason string) (*models.NodeDrain, error) {
+	operator, err := s.ownedNode(operatorID, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	drain, err := s.drains.Drain(ctx, nodeID, timeout, reason, &operator.UserID)
+	if err != nil {
+		return nil, drainError(err)
+	}
+	return drain, nil
+}
+
+// NodeDrainStatus returns the drain progress of one of the operator's nodes
+func (s *Service) NodeDrainStatus(ctx context.Context, operatorID, nodeID uuid.UUID) (*maintenance.DrainStatus, error) {
+	if _, err := s.ownedNode(operatorID, nodeID); err != nil {
+		return nil, err
+	}
+
+	status, err := s.drains.Status(ctx, nodeID)
+	if err != nil {
+		return nil, drainError(err)
+	}
+	return status, nil
+}
+
+// ResumeNode returns one of the operator's draining or maintenance nodes to
+// service
+func (s *Service) ResumeNode(ctx context.Context, operatorID, nodeID uuid.UUID) error {
+	if _, err := s.ownedNode(operatorID, nodeID); err != nil {
+		return err
+	}
+
+	if err := s.drains.Resume(ctx, nodeID); err != nil {
+		return drainError(err)
+	}
+	return nil
+}
+
+// ownedNode returns the operator if it owns the node
+func (s *Service) ownedNode(operatorID, nodeID uuid.UUID) (*models.NodeOperator, error) {
+	var operator models.NodeOperator
+	if err := s.db.First(&operator, operatorID).Error; err != nil {
+		return nil, apperrors.ErrNotFound.WithInternal(err)
+	}
+
+	var count int64
+	if err := s.db.Model(&models.VPNNode{}).
+		Where("id = ? AND operator_id = ?", nodeID, operatorID).
+		Count(&count).Error; err != nil {
+		return nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+	if count == 0 {
+		return nil, apperrors.ErrNotFound.WithInternal(fmt.Errorf("node %s not owned by operator", nodeID))
+	}
+
+	return &operator, nil
+}
+
+// drainError maps maintenance errors to application errors
+func drainError(err error) error {
+	switch {
+	case errors.Is(err, maintenance.ErrNodeNotFound):
+		return apperrors.ErrNotFound.WithInternal(err)
+	case errors.Is(err, maintenance.ErrAlreadyDraining), errors.Is(err, maintenance.ErrNotDraining):
+		return apperrors.New(apperrors.ErrCodeConflict, err.Error(), http.StatusConflict).WithInternal(err)
+	default:
+		return apperrors.ErrInternal.WithInternal(err)
+	}
 }
 
 // GetOperatorStats retrieves comprehensive statistics for an operator
@@ -197,10 +294,15 @@ func (s *Service) RequestPayout(ctx context.Context, operatorID uuid.UUID) error
 		return apperrors.ErrNotFound.WithInternal(err)
 	}
 
+	payable, err := ledger.Balance(s.db, ledger.OperatorPayable, operator.ID)
+	if err != nil {
+		return apperrors.ErrDatabase.WithInternal(err)
+	}
+
 	minPayout := 10.0 // Minimum $10 for payout
-	if operator.PendingPayout < minPayout {
+	if pending := -payable; pending < ledger.FromUSD(minPayout) {
 		return apperrors.ErrBadRequest.WithInternal(
-			fmt.Errorf("minimum payout amount is $%.2f, current: $%.2f", minPayout, operator.PendingPayout))
+			fmt.Errorf("minimum payout amount is $%.2f, current: $%s", minPayout, pending))
 	}
 
 	// Process payout
@@ -1,52 +1,62 @@
 package payment
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/hdwallet"
 	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"github.com/nikola43/aureo-vpn/pkg/pricing"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // CryptoPaymentProcessor handles cryptocurrency payments
 type CryptoPaymentProcessor struct {
 	db              *gorm.DB
-	btcAddressPool  []string
-	ethAddressPool  []string
-	ltcAddressPool  []string
-	xmrAddressPool  []string
+	wallets         map[string]*hdwallet.Wallet // Deposit wallets by symbol
 	confirmations   map[string]int
+	rates           pricing.RateProvider
+	plans           *plans.Service
 }
 
-// Payment represents a cryptocurrency payment
-type Payment struct {
-	ID              uuid.UUID `gorm:"type:uuid;primary_key"`
-	UserID          uuid.UUID `gorm:"type:uuid"`
-	Cryptocurrency  string    // BTC, ETH, LTC, XMR
-	Amount          float64
-	AmountCrypto    float64
-	Address         string // Payment address
-	TxHash          string // Transaction hash
-	Status          string // pending, confirmed, failed, expired
-	Confirmations   int
-	RequiredConf    int
-	SubscriptionTier string
-	Duration        int // months
-	ExpiresAt       time.Time
-	CreatedAt       time.Time
-	UpdatedAt       time.Time
-}
+var (
+	// ErrUnsupportedCurrency is returned for currencies without a deposit wallet
+	ErrUnsupportedCurrency = apperrors.New(apperrors.ErrCodeBadRequest, "Unsupported cryptocurrency", http.StatusBadRequest)
+
+	// ErrInvalidPlan is returned for unknown tiers or durations
+	ErrInvalidPlan = apperrors.New(apperrors.ErrCodeBadRequest, "Invalid subscription tier or duration", http.StatusBadRequest)
+
+	// ErrRatesUnavailable is returned when no usable exchange rate is available
+	ErrRatesUnavailable = apperrors.New("RATES_UNAVAILABLE", "Exchange rates are temporarily unavailable", http.StatusServiceUnavailable)
+
+	// ErrPaymentNotFound is returned when a payment does not exist or belongs to another user
+	ErrPaymentNotFound = apperrors.New(apperrors.ErrCodeNotFound, "Payment not found", http.StatusNotFound)
+)
+
+// maxDuration is the longest subscription that can be bought at once, in months
+const maxDuration = 24
 
-// NewCryptoPaymentProcessor creates a new crypto payment processor
-func NewCryptoPaymentProcessor() *CryptoPaymentProcessor {
+// NewCryptoPaymentProcessor creates a new crypto payment processor. Payments
+// can only be made in currencies that have a deposit wallet, for plans with a
+// price.
+func NewCryptoPaymentProcessor(rates pricing.RateProvider, wallets map[string]*hdwallet.Wallet, plans *plans.Service) *CryptoPaymentProcessor {
 	return &CryptoPaymentProcessor{
-		db: database.GetDB(),
+		db:      database.GetDB(),
+		rates:   rates,
+		wallets: wallets,
+		plans:   plans,
 		confirmations: map[string]int{
 			"BTC": 3,
 			"ETH": 12,
@@ -57,92 +67,92 @@ func NewCryptoPaymentProcessor() *CryptoPaymentProcessor {
 }
 
 // CreatePayment creates a new cryptocurrency payment
-func (p *CryptoPaymentProcessor) CreatePayment(userID uuid.UUID, crypto, tier string, duration int) (*Payment, error) {
-	// Calculate amount based on tier and duration
-	amount := p.calculateAmount(tier, duration)
+func (p *CryptoPaymentProcessor) CreatePayment(ctx context.Context, userID uuid.UUID, crypto, tier string, duration int) (*models.Payment, error) {
+	crypto = pricing.Symbol(crypto)
+	wallet, ok := p.wallets[crypto]
+	if !ok {
+		return nil, ErrUnsupportedCurrency.WithInternal(fmt.Errorf("no deposit wallet for %s", crypto))
+	}
 
-	// Get current crypto rate
-	cryptoAmount, err := p.convertToCrypto(amount, crypto)
+	if duration < 1 || duration > maxDuration {
+		return nil, ErrInvalidPlan
+	}
+	plan, err := p.plans.Get(ctx, tier)
 	if err != nil {
+		if errors.Is(err, plans.ErrPlanNotFound) {
+			return nil, ErrInvalidPlan.WithInternal(err)
+		}
 		return nil, err
 	}
+	if plan.PriceUSD <= 0 {
+		return nil, ErrInvalidPlan.WithInternal(fmt.Errorf("plan %s is free", plan.Name))
+	}
 
-	// Generate payment address
-	address, err := p.generatePaymentAddress(crypto)
+	// Calculate amount based on the plan's price and duration
+	amount := p.calculateAmount(plan.PriceUSD, duration)
+
+	// Get current crypto rate
+	rate, err := p.rates.GetRate(ctx, crypto)
 	if err != nil {
-		return nil, err
+		return nil, ErrRatesUnavailable.WithInternal(err)
 	}
+	cryptoAmount := rate.Convert(amount)
 
-	payment := &Payment{
-		ID:               uuid.New(),
+	payment := &models.Payment{
 		UserID:           userID,
 		Cryptocurrency:   crypto,
 		Amount:           amount,
 		AmountCrypto:     cryptoAmount,
-		Address:          address,
-		Status:           "pending",
-		Confirmations:    0,
+		ExchangeRate:     rate.USD,
+		Status:           models.PaymentPending,
 		RequiredConf:     p.confirmations[crypto],
 		SubscriptionTier: tier,
 		Duration:         duration,
 		ExpiresAt:        time.Now().Add(24 * time.Hour), // Payment expires in 24h
-		CreatedAt:        time.Now(),
 	}
 
-	// Save to database
-	if err := p.db.Table("payments").Create(payment).Error; err != nil {
-		return nil, fmt.Errorf("failed to create payment: %w", err)
+	// Save to database along with the rate it was quoted at. The address
+	// index is only consumed if the payment is saved.
+	err = p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		address, index, err := p.generatePaymentAddress(tx, wallet)
+		if err != nil {
+			return err
+		}
+		payment.Address = address
+		payment.DerivationIndex = &index
+
+		snapshot, err := pricing.RecordSnapshot(tx, rate)
+		if err != nil {
+			return err
+		}
+		payment.RateSnapshotID = &snapshot.ID
+
+		return tx.Create(payment).Error
+	})
+	if err != nil {
+		return nil, apperrors.ErrDatabase.WithInternal(fmt.Errorf("failed to create payment: %w", err))
 	}
 
 	log.Printf("Created payment: %s - %s %f %s", payment.ID, tier, cryptoAmount, crypto)
 	return payment, nil
 }
 
-// CheckPayment checks the status of a payment
-func (p *CryptoPaymentProcessor) CheckPayment(paymentID uuid.UUID) (*Payment, error) {
-	var payment Payment
-	if err := p.db.Table("payments").First(&payment, paymentID).Error; err != nil {
-		return nil, err
-	}
-
-	// If payment is pending, check blockchain
-	if payment.Status == "pending" {
-		confirmed, confirmations, txHash, err := p.checkBlockchain(payment.Address, payment.Cryptocurrency, payment.AmountCrypto)
-		if err != nil {
-			log.Printf("Failed to check blockchain: %v", err)
-			return &payment, nil
-		}
-
-		// Update confirmations
-		payment.Confirmations = confirmations
-		payment.TxHash = txHash
-
-		// If confirmed, update status
-		if confirmed {
-			payment.Status = "confirmed"
-			p.activateSubscription(payment.UserID, payment.SubscriptionTier, payment.Duration)
+// GetPayment returns one of the user's payments. Its status is kept up to
+// date by the Watcher as deposits arrive and confirm.
+func (p *CryptoPaymentProcessor) GetPayment(ctx context.Context, userID, paymentID uuid.UUID) (*models.Payment, error) {
+	var payment models.Payment
+	err := p.db.WithContext(ctx).Where("id = ? AND user_id = ?", paymentID, userID).First(&payment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPaymentNotFound.WithInternal(err)
 		}
-
-		// Save updated payment
-		p.db.Table("payments").Save(&payment)
+		return nil, apperrors.ErrDatabase.WithInternal(err)
 	}
-
 	return &payment, nil
 }
 
 // calculateAmount calculates the USD amount for a subscription
-func (p *CryptoPaymentProcessor) calculateAmount(tier string, duration int) float64 {
-	basePrices := map[string]float64{
-		"basic":   9.99,
-		"premium": 12.99,
-		"ultimate": 15.99,
-	}
-
-	basePrice := basePrices[tier]
-	if basePrice == 0 {
-		basePrice = 9.99
-	}
-
+func (p *CryptoPaymentProcessor) calculateAmount(basePrice float64, duration int) float64 {
 	// Apply discounts for longer subscriptions
 	discount := 1.0
 	switch duration {
@@ -157,74 +167,54 @@ func (p *CryptoPaymentProcessor) calculateAmount(tier string, duration int) floa
 	return basePrice * float64(duration) * discount
 }
 
-// convertToCrypto converts USD to cryptocurrency amount
-func (p *CryptoPaymentProcessor) convertToCrypto(usdAmount float64, crypto string) (float64, error) {
-	// In production, fetch real-time rates from exchange API
-	// For now, use approximate rates
-	rates := map[string]float64{
-		"BTC": 45000.0,
-		"ETH": 3000.0,
-		"LTC": 100.0,
-		"XMR": 150.0,
+// generatePaymentAddress derives the wallet's next unused deposit address.
+// The derivation index row is locked until tx commits, so concurrent
+// payments never share an address.
+func (p *CryptoPaymentProcessor) generatePaymentAddress(tx *gorm.DB, wallet *hdwallet.Wallet) (string, uint32, error) {
+	derivation := models.AddressDerivation{Coin: wallet.Coin(), WalletID: wallet.ID()}
+	if err := tx.Where(&derivation).FirstOrCreate(&derivation).Error; err != nil {
+		return "", 0, fmt.Errorf("failed to load derivation index: %w", err)
 	}
-
-	rate, ok := rates[crypto]
-	if !ok {
-		return 0, fmt.Errorf("unsupported cryptocurrency: %s", crypto)
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&derivation, derivation.ID).Error; err != nil {
+		return "", 0, fmt.Errorf("failed to lock derivation index: %w", err)
 	}
 
-	return usdAmount / rate, nil
-}
-
-// generatePaymentAddress generates a unique payment address
-func (p *CryptoPaymentProcessor) generatePaymentAddress(crypto string) (string, error) {
-	// In production, generate real addresses using HD wallets
-	// For now, generate mock addresses
-
-	prefix := map[string]string{
-		"BTC": "bc1",
-		"ETH": "0x",
-		"LTC": "ltc1",
-		"XMR": "4",
+	// A few indexes in 2^127 do not produce a valid key and are skipped
+	index := derivation.NextIndex
+	address, err := wallet.Address(index)
+	for errors.Is(err, hdwallet.ErrInvalidChild) {
+		index++
+		address, err = wallet.Address(index)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to derive address: %w", err)
 	}
 
-	// Generate unique address
-	hash := sha256.Sum256([]byte(uuid.New().String() + time.Now().String()))
-	address := prefix[crypto] + hex.EncodeToString(hash[:])[:32]
-
-	return address, nil
-}
-
-// checkBlockchain checks if payment is received on blockchain
-func (p *CryptoPaymentProcessor) checkBlockchain(address, crypto string, expectedAmount float64) (bool, int, string, error) {
-	// In production, integrate with blockchain APIs:
-	// - Bitcoin: BlockCypher, Blockchain.info
-	// - Ethereum: Etherscan, Infura
-	// - Litecoin: BlockCypher
-	// - Monero: Monero RPC
-
-	// Mock implementation for demonstration
-	// Return: confirmed, confirmations, txHash, error
-
-	// Simulate checking (in production, make actual API calls)
-	log.Printf("Checking blockchain for %s on %s address", crypto, address)
+	if err := tx.Model(&derivation).Update("next_index", index+1).Error; err != nil {
+		return "", 0, fmt.Errorf("failed to update derivation index: %w", err)
+	}
 
-	// For demonstration, return pending
-	return false, 0, "", nil
+	return address, index, nil
 }
 
-// activateSubscription activates a user's subscription
-func (p *CryptoPaymentProcessor) activateSubscription(userID uuid.UUID, tier string, duration int) error {
+// activateSubscription activates a user's subscription. Time left on an
+// active subscription is kept.
+func activateSubscription(tx *gorm.DB, userID uuid.UUID, tier string, duration int) error {
 	var user models.User
-	if err := p.db.First(&user, userID).Error; err != nil {
+	if err := tx.First(&user, userID).Error; err != nil {
 		return err
 	}
 
-	// Update subscription
-	user.SubscriptionTier = tier
-	user.SubscriptionExpiry = time.Now().AddDate(0, duration, 0)
+	start := time.Now()
+	if user.SubscriptionExpiry.After(start) {
+		start = user.SubscriptionExpiry
+	}
 
-	if err := p.db.Save(&user).Error; err != nil {
+	// Update subscription
+	if err := tx.Model(&user).Updates(map[string]interface{}{
+		"subscription_tier":   tier,
+		"subscription_expiry": start.AddDate(0, duration, 0),
+	}).Error; err != nil {
 		return err
 	}
 
@@ -233,16 +223,16 @@ func (p *CryptoPaymentProcessor) activateSubscription(userID uuid.UUID, tier str
 }
 
 // GetPaymentHistory returns payment history for a user
-func (p *CryptoPaymentProcessor) GetPaymentHistory(userID uuid.UUID) ([]Payment, error) {
-	var payments []Payment
-	if err := p.db.Table("payments").Where("user_id = ?", userID).Order("created_at DESC").Find(&payments).Error; err != nil {
-		return nil, err
+func (p *CryptoPaymentProcessor) GetPaymentHistory(ctx context.Context, userID uuid.UUID) ([]models.Payment, error) {
+	var payments []models.Payment
+	if err := p.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at DESC").Find(&payments).Error; err != nil {
+		return nil, apperrors.ErrDatabase.WithInternal(err)
 	}
 	return payments, nil
 }
 
 // GenerateInvoice generates an invoice for a payment
-func (p *CryptoPaymentProcessor) GenerateInvoice(payment *Payment) string {
+func (p *CryptoPaymentProcessor) GenerateInvoice(payment *models.Payment) string {
 	return fmt.Sprintf(`
 INVOICE
 =======
@@ -250,6 +240,7 @@ Payment ID: %s
 Subscription: %s (%d months)
 Amount: $%.2f USD
 Pay: %.8f %s
+Rate: 1 %s = $%.2f USD
 Address: %s
 Expires: %s
 Status: %s
@@ -263,6 +254,8 @@ Payment will be confirmed after %d blockchain confirmations.
 		payment.Amount,
 		payment.AmountCrypto,
 		payment.Cryptocurrency,
+		payment.Cryptocurrency,
+		payment.ExchangeRate,
 		payment.Address,
 		payment.ExpiresAt.Format(time.RFC3339),
 		payment.Status,
@@ -272,7 +265,7 @@ Payment will be confirmed after %d blockchain confirmations.
 
 // GetSupportedCryptocurrencies returns list of supported cryptocurrencies
 func (p *CryptoPaymentProcessor) GetSupportedCryptocurrencies() []CryptoCurrency {
-	return []CryptoCurrency{
+	currencies := []CryptoCurrency{
 		{
 			Symbol:      "BTC",
 			Name:        "Bitcoin",
@@ -298,14 +291,23 @@ func (p *CryptoPaymentProcessor) GetSupportedCryptocurrencies() []CryptoCurrency
 			Confirmations: 10,
 		},
 	}
+
+	// Only currencies with a deposit wallet can be paid in
+	supported := make([]CryptoCurrency, 0, len(currencies))
+	for _, currency := range currencies {
+		if _, ok := p.wallets[currency.Symbol]; ok {
+			supported = append(supported, currency)
+		}
+	}
+	return supported
 }
 
 // CryptoCurrency represents a supported cryptocurrency
 type CryptoCurrency struct {
-	Symbol        string
-	Name          string
-	Network       string
-	Confirmations int
+	Symbol        string `json:"symbol"`
+	Name          string `json:"name"`
+	Network       string `json:"network"`
+	Confirmations int    `json:"confirmations"`
 }
 
 // VerifyPaymentSignature verifies webhook payment signature
@@ -316,22 +318,23 @@ func (p *CryptoPaymentProcessor) VerifyPaymentSignature(payload, signature, secr
 	return hmac.Equal([]byte(signature), []byte(expectedSignature))
 }
 
-// RefundPayment processes a refund (for failed payments)
-func (p *CryptoPaymentProcessor) RefundPayment(paymentID uuid.UUID) error {
-	var payment Payment
-	if err := p.db.Table("payments").First(&payment, paymentID).Error; err != nil {
-		return err
+// RefundPayment records that a confirmed, underpaid or late payment's funds
+// were returned to the payer. The refund itself is sent from the offline wallet.
+func (p *CryptoPaymentProcessor) RefundPayment(ctx context.Context, paymentID uuid.UUID) error {
+	var payment models.Payment
+	if err := p.db.WithContext(ctx).First(&payment, paymentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPaymentNotFound.WithInternal(err)
+		}
+		return apperrors.ErrDatabase.WithInternal(err)
 	}
 
-	// Mark as refunded
-	payment.Status = "refunded"
-	payment.UpdatedAt = time.Now()
-
-	return p.db.Table("payments").Save(&payment).Error
+	_, err := transition(p.db.WithContext(ctx), &payment, models.PaymentRefunded, nil)
+	return err
 }
 
 // GetPaymentQRCode generates a QR code for payment
-func (p *CryptoPaymentProcessor) GetPaymentQRCode(payment *Payment) (string, error) {
+func (p *CryptoPaymentProcessor) GetPaymentQRCode(payment *models.Payment) (string, error) {
 	// Generate payment URI for QR code
 	uri := fmt.Sprintf("%s:%s?amount=%.8f&label=Aureo+VPN+Subscription",
 		payment.Cryptocurrency,
@@ -0,0 +1,47 @@
+package payment
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidTransition is returned when a payment cannot move to the
+// requested state from its current one
+var ErrInvalidTransition = apperrors.New(apperrors.ErrCodeConflict, "Invalid payment status transition", http.StatusConflict)
+
+// transition moves a payment to status, recording when it happened along
+// with any other column updates. It returns false without error if the
+// payment was moved by someone else in the meantime.
+func transition(tx *gorm.DB, payment *models.Payment, status string, updates map[string]interface{}) (bool, error) {
+	if !payment.CanTransitionTo(status) {
+		return false, ErrInvalidTransition.WithInternal(fmt.Errorf("payment %s cannot move from %s to %s", payment.ID, payment.Status, status))
+	}
+
+	now := time.Now()
+	columns := map[string]interface{}{
+		"status":       status,
+		status + "_at": now,
+		"updated_at":   now,
+	}
+	for column, value := range updates {
+		columns[column] = value
+	}
+
+	result := tx.Model(&models.Payment{}).
+		Where("id = ? AND status = ?", payment.ID, payment.Status).
+		Updates(columns)
+	if result.Error != nil {
+		return false, apperrors.ErrDatabase.WithInternal(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	payment.Status = status
+	return true, nil
+}
@@ -0,0 +1,282 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/blockchain"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// DepositScanner reports deposits to watched addresses. blockchain.Service
+// implements it.
+type DepositScanner interface {
+	WatchAddress(ctx context.Context, walletType, address string, since time.Time) error
+	ReceivedByAddress(ctx context.Context, walletType, address string, minConf int64) (*blockchain.Deposit, error)
+}
+
+// walletTypes maps payment currencies to blockchain wallet types
+var walletTypes = map[string]string{
+	"BTC": "bitcoin",
+	"LTC": "litecoin",
+	"ETH": "ethereum",
+}
+
+// lateStatuses are the states of expired payments whose addresses are still
+// scanned during the grace period
+var lateStatuses = []string{models.PaymentExpired, models.PaymentUnderpaid, models.PaymentLate}
+
+// Watcher scans the chain for deposits to open payments' addresses and
+// confirms, expires or flags them as underpaid. Addresses of expired payments
+// are scanned for a grace period after, so funds sent late can be refunded.
+type Watcher struct {
+	db        *gorm.DB
+	chain     DepositScanner
+	interval  time.Duration
+	tolerance float64       // Fraction of the amount a payment may fall short by
+	grace     time.Duration // How long after expiry payments are still scanned
+
+	mu      sync.Mutex
+	watched map[string]bool
+}
+
+// NewWatcher creates a payment watcher. Payments that are short by no more
+// than tolerance (e.g. 0.005 for 0.5%) are accepted, to absorb rounding by
+// wallets. Funds arriving up to grace after a payment expired are flagged
+// for refund.
+func NewWatcher(processor *CryptoPaymentProcessor, chain DepositScanner, interval time.Duration, tolerance float64, grace time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &Watcher{
+		db:        processor.db,
+		chain:     chain,
+		interval:  interval,
+		tolerance: tolerance,
+		grace:     grace,
+		watched:   make(map[string]bool),
+	}
+}
+
+// Run scans open payments every interval until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	log.Printf("Payment watcher started (interval: %s)", w.interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Payment watcher stopped")
+			return
+		case <-ticker.C:
+			if err := w.RunOnce(ctx); err != nil {
+				log.Printf("Failed to scan payments: %v", err)
+			}
+		}
+	}
+}
+
+// RunOnce scans every open payment, and every payment still in its grace
+// period, once
+func (w *Watcher) RunOnce(ctx context.Context) error {
+	var payments []models.Payment
+	if err := w.db.WithContext(ctx).
+		Where("status IN ?", []string{models.PaymentPending, models.PaymentDetected}).
+		Or("status IN ? AND expires_at > ?", lateStatuses, time.Now().Add(-w.grace)).
+		Find(&payments).Error; err != nil {
+		return fmt.Errorf("failed to load open payments: %w", err)
+	}
+
+	for i := range payments {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := w.scan(ctx, &payments[i]); err != nil {
+			log.Printf("Failed to scan payment %s: %v", payments[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// scan checks one payment's address and advances its status
+func (w *Watcher) scan(ctx context.Context, payment *models.Payment) error {
+	walletType, ok := walletTypes[payment.Cryptocurrency]
+	if !ok {
+		return fmt.Errorf("unsupported cryptocurrency: %s", payment.Cryptocurrency)
+	}
+
+	if err := w.watch(ctx, walletType, payment.Address, payment.CreatedAt); err != nil {
+		return err
+	}
+
+	seen, err := w.chain.ReceivedByAddress(ctx, walletType, payment.Address, 0)
+	if err != nil {
+		return err
+	}
+	confirmed, err := w.chain.ReceivedByAddress(ctx, walletType, payment.Address, int64(payment.RequiredConf))
+	if err != nil {
+		return err
+	}
+
+	seenAmount, _ := seen.Amount.Float64()
+	confirmedAmount, _ := confirmed.Amount.Float64()
+	txHash := payment.TxHash
+	if len(seen.TxHashes) > 0 {
+		txHash = seen.TxHashes[0]
+	}
+
+	if !payment.IsOpen() {
+		return w.flagLate(payment, confirmedAmount, txHash)
+	}
+
+	minimum := payment.AmountCrypto * (1 - w.tolerance)
+
+	switch {
+	case confirmedAmount >= minimum:
+		return w.confirm(payment, confirmedAmount, txHash)
+
+	case time.Now().After(payment.ExpiresAt) && seenAmount == confirmedAmount:
+		// Nothing is still confirming, so nothing more is coming
+		status := models.PaymentExpired
+		if confirmedAmount > 0 {
+			status = models.PaymentUnderpaid
+		}
+		return w.settle(payment, status, confirmedAmount, txHash)
+
+	case seenAmount > 0:
+		return w.settle(payment, models.PaymentDetected, seenAmount, txHash)
+	}
+
+	return nil
+}
+
+// watch registers an address with the chain once per process
+func (w *Watcher) watch(ctx context.Context, walletType, address string, since time.Time) error {
+	w.mu.Lock()
+	watched := w.watched[address]
+	w.mu.Unlock()
+	if watched {
+		return nil
+	}
+
+	if err := w.chain.WatchAddress(ctx, walletType, address, since); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.watched[address] = true
+	w.mu.Unlock()
+	return nil
+}
+
+// confirm marks the payment confirmed and activates its subscription in one
+// transaction. The status guard ensures the subscription is activated once.
+func (w *Watcher) confirm(payment *models.Payment, received float64, txHash string) error {
+	err := w.db.Transaction(func(tx *gorm.DB) error {
+		ok, err := advance(tx, payment, models.PaymentConfirmed, map[string]interface{}{
+			"amount_received": received,
+			"confirmations":   payment.RequiredConf,
+			"tx_hash":         txHash,
+		})
+		if err != nil || !ok {
+			return err // !ok: already settled by another watcher
+		}
+
+		return activateSubscription(tx, payment.UserID, payment.SubscriptionTier, payment.Duration)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to confirm payment: %w", err)
+	}
+	if payment.Status != models.PaymentConfirmed {
+		return nil
+	}
+
+	if received > payment.AmountCrypto {
+		log.Printf("Payment %s overpaid: received %.8f %s, expected %.8f", payment.ID, received, payment.Cryptocurrency, payment.AmountCrypto)
+	}
+	log.Printf("Confirmed payment %s: %.8f %s", payment.ID, received, payment.Cryptocurrency)
+	return nil
+}
+
+// settle records a deposit that is still confirming, or a final failure
+func (w *Watcher) settle(payment *models.Payment, status string, received float64, txHash string) error {
+	if payment.Status == status && payment.AmountReceived == received {
+		return nil
+	}
+
+	updates := map[string]interface{}{
+		"amount_received": received,
+		"tx_hash":         txHash,
+	}
+
+	var err error
+	if payment.Status == status {
+		// More was received while still detected; not a state change
+		updates["updated_at"] = time.Now()
+		err = w.db.Model(&models.Payment{}).
+			Where("id = ? AND status = ?", payment.ID, status).
+			Updates(updates).Error
+	} else {
+		err = w.db.Transaction(func(tx *gorm.DB) error {
+			_, err := advance(tx, payment, status, updates)
+			return err
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update payment: %w", err)
+	}
+
+	if status != models.PaymentDetected {
+		log.Printf("Payment %s %s: received %.8f of %.8f %s", payment.ID, status, received, payment.AmountCrypto, payment.Cryptocurrency)
+	}
+	return nil
+}
+
+// flagLate records funds confirmed on an expired payment's address after it
+// expired. Expired payments move to late; underpaid and late ones track the
+// growing amount to refund.
+func (w *Watcher) flagLate(payment *models.Payment, received float64, txHash string) error {
+	if received <= payment.AmountReceived {
+		return nil
+	}
+
+	updates := map[string]interface{}{
+		"amount_received": received,
+		"tx_hash":         txHash,
+	}
+
+	var err error
+	if payment.Status == models.PaymentExpired {
+		_, err = transition(w.db, payment, models.PaymentLate, updates)
+	} else {
+		updates["updated_at"] = time.Now()
+		err = w.db.Model(&models.Payment{}).
+			Where("id = ? AND status = ?", payment.ID, payment.Status).
+			Updates(updates).Error
+	}
+	if err != nil {
+		return fmt.Errorf("failed to flag late payment: %w", err)
+	}
+
+	log.Printf("Payment %s received %.8f %s after expiring, due for refund", payment.ID, received-payment.AmountReceived, payment.Cryptocurrency)
+	return nil
+}
+
+// advance moves an open payment to status. Pending payments pass through
+// detected first, so a deposit that confirms between two scans still gets a
+// detection time.
+func advance(tx *gorm.DB, payment *models.Payment, status string, updates map[string]interface{}) (bool, error) {
+	if payment.Status == models.PaymentPending && !payment.CanTransitionTo(status) {
+		ok, err := transition(tx, payment, models.PaymentDetected, nil)
+		if err != nil || !ok {
+			return ok, err
+		}
+	}
+	return transition(tx, payment, status, updates)
+}
@@ -0,0 +1,252 @@
+package plans
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/database"
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// Features that are only available on some plans
+const (
+	FeatureProtocol    = "protocol"
+	FeatureDevices     = "devices"
+	FeatureBandwidth   = "bandwidth"
+	FeatureMultiHop    = "multihop"
+	FeatureObfuscation = "obfuscation"
+)
+
+// ErrCodeNotEntitled is the AppError code for features outside the user's plan
+const ErrCodeNotEntitled = "NOT_ENTITLED"
+
+// ErrPlanNotFound is returned for unknown or retired plans
+var ErrPlanNotFound = apperrors.New(apperrors.ErrCodeNotFound, "Plan not found", http.StatusNotFound)
+
+// DefaultPlans are created on first start. Existing plans are left as they
+// are, so prices and limits can be changed in the database.
+var DefaultPlans = []models.Plan{
+	{
+		Name:             models.FreePlan,
+		DisplayName:      "Free",
+		PriceUSD:         0,
+		DeviceLimit:      1,
+		BandwidthCapGB:   10,
+		SpeedLimitMbps:   20,
+		AllowedProtocols: "wireguard",
+	},
+	{
+		Name:             "basic",
+		DisplayName:      "Basic",
+		PriceUSD:         9.99,
+		DeviceLimit:      1,
+		SpeedLimitMbps:   100,
+		AllowedProtocols: "wireguard,openvpn",
+	},
+	{
+		Name:              "premium",
+		DisplayName:       "Premium",
+		PriceUSD:          12.99,
+		DeviceLimit:       6,
+		SpeedLimitMbps:    500,
+		AllowedProtocols:  "wireguard,openvpn",
+		AllowsObfuscation: true,
+	},
+	{
+		Name:              "ultimate",
+		DisplayName:       "Ultimate",
+		PriceUSD:          15.99,
+		DeviceLimit:       0,
+		AllowedProtocols:  "wireguard,openvpn",
+		AllowsMultiHop:    true,
+		AllowsObfuscation: true,
+	},
+}
+
+// Service looks up subscription plans and checks what users are entitled to
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new plan service
+func NewService() *Service {
+	return &Service{
+		db: database.GetDB(),
+	}
+}
+
+// InitializePlans creates the default plans that don't exist yet
+func (s *Service) InitializePlans(ctx context.Context) error {
+	for _, plan := range DefaultPlans {
+		var existing models.Plan
+		err := s.db.WithContext(ctx).Where("name = ?", plan.Name).First(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := s.db.WithContext(ctx).Create(&plan).Error; err != nil {
+				return fmt.Errorf("failed to create plan %s: %w", plan.Name, err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("failed to load plan %s: %w", plan.Name, err)
+		}
+	}
+	return nil
+}
+
+// List returns the active plans, cheapest first
+func (s *Service) List(ctx context.Context) ([]models.Plan, error) {
+	var plans []models.Plan
+	if err := s.db.WithContext(ctx).Where("is_active = ?", true).Order("price_usd ASC").Find(&plans).Error; err != nil {
+		return nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+	return plans, nil
+}
+
+// Get returns an active plan by name
+func (s *Service) Get(ctx context.Context, name string) (*models.Plan, error) {
+	var plan models.Plan
+	err := s.db.WithContext(ctx).Where("name = ? AND is_active = ?", name, true).First(&plan).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPlanNotFound.WithInternal(fmt.Errorf("plan %q", name))
+		}
+		return nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+	return &plan, nil
+}
+
+// ForUser returns the user and the plan they are currently entitled to.
+// Users whose subscription has expired, or whose plan was retired, fall back
+// to the free plan.
+func (s *Service) ForUser(ctx context.Context, userID uuid.UUID) (*models.User, *models.Plan, error) {
+	var user models.User
+	if err := s.db.WithContext(ctx).First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, apperrors.ErrUserNotFound.WithInternal(err)
+		}
+		return nil, nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+
+	name := planName(&user)
+	plan, err := s.Get(ctx, name)
+	if errors.Is(err, ErrPlanNotFound) && name != models.FreePlan {
+		plan, err = s.Get(ctx, models.FreePlan)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, plan, nil
+}
+
+// ForUsers returns the plan each of the users is currently entitled to, by
+// user ID, resolved as in ForUser. Unknown users are left out.
+func (s *Service) ForUsers(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]*models.Plan, error) {
+	result := make(map[uuid.UUID]*models.Plan, len(userIDs))
+	if len(userIDs) == 0 {
+		return result, nil
+	}
+
+	var users []models.User
+	if err := s.db.WithContext(ctx).Select("id", "subscription_tier", "subscription_expiry").
+		Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		return nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+
+	active, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*models.Plan, len(active))
+	for i := range active {
+		byName[active[i].Name] = &active[i]
+	}
+
+	for i := range users {
+		plan, ok := byName[planName(&users[i])]
+		if !ok {
+			plan, ok = byName[models.FreePlan]
+		}
+		if !ok {
+			return nil, ErrPlanNotFound.WithInternal(fmt.Errorf("plan %q", models.FreePlan))
+		}
+		result[users[i].ID] = plan
+	}
+	return result, nil
+}
+
+// planName returns the name of the plan the user is subscribed to, or the
+// free plan if they have no subscription or it has expired
+func planName(user *models.User) string {
+	name := user.SubscriptionTier
+	if name == "" || (name != models.FreePlan && user.SubscriptionExpiry.Before(time.Now())) {
+		return models.FreePlan
+	}
+	return name
+}
+
+// CheckSession verifies the user's plan allows a new session with protocol:
+// the protocol is included and the bandwidth cap is not used up. The plan is
+// returned so the caller can enforce its device limit while holding the
+// user's lock.
+func (s *Service) CheckSession(ctx context.Context, userID uuid.UUID, protocol string, obfuscated bool) (*models.Plan, error) {
+	user, plan, err := s.ForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !plan.AllowsProtocol(protocol) {
+		return nil, NotEntitled(plan, FeatureProtocol, fmt.Sprintf("The %s protocol is not included in your plan", protocol))
+	}
+
+	if obfuscated && !plan.AllowsObfuscation {
+		return nil, NotEntitled(plan, FeatureObfuscation, "Obfuscation is not included in your plan")
+	}
+
+	if plan.BandwidthCapGB > 0 && user.CycleDataGB >= plan.BandwidthCapGB {
+		return nil, NotEntitled(plan, FeatureBandwidth, "Your plan's data transfer limit has been reached")
+	}
+
+	return plan, nil
+}
+
+// DeviceLimitReached builds the error returned when the user already has as
+// many sessions as plan allows
+func DeviceLimitReached(plan *models.Plan) *apperrors.AppError {
+	return NotEntitled(plan, FeatureDevices, fmt.Sprintf("Your plan's limit of %d connected devices has been reached", plan.DeviceLimit))
+}
+
+// Require verifies the user's plan includes feature (FeatureMultiHop or
+// FeatureObfuscation)
+func (s *Service) Require(ctx context.Context, userID uuid.UUID, feature string) error {
+	_, plan, err := s.ForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	switch feature {
+	case FeatureMultiHop:
+		if !plan.AllowsMultiHop {
+			return NotEntitled(plan, feature, "Multi-hop is not included in your plan")
+		}
+	case FeatureObfuscation:
+		if !plan.AllowsObfuscation {
+			return NotEntitled(plan, feature, "Obfuscation is not included in your plan")
+		}
+	default:
+		return apperrors.ErrInternal.WithInternal(fmt.Errorf("unknown plan feature: %s", feature))
+	}
+	return nil
+}
+
+// NotEntitled builds the error returned when feature is not in plan. The plan
+// and feature are included as details so clients can offer an upgrade.
+func NotEntitled(plan *models.Plan, feature, message string) *apperrors.AppError {
+	return apperrors.New(ErrCodeNotEntitled, message, http.StatusForbidden).WithDetails(map[string]interface{}{
+		"plan":    plan.Name,
+		"feature": feature,
+	})
+}
@@ -0,0 +1,64 @@
+package pricing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CachingProvider caches rates from another provider. Cached rates are
+// served for ttl; after that the provider is asked again, and if it fails
+// the cached rate keeps being served until it is older than maxAge.
+type CachingProvider struct {
+	provider RateProvider
+	ttl      time.Duration
+	maxAge   time.Duration
+
+	mu    sync.Mutex
+	rates map[string]*Rate
+}
+
+// NewCachingProvider wraps provider with a cache. Rates older than maxAge
+// are never returned, whether cached or freshly fetched.
+func NewCachingProvider(provider RateProvider, ttl, maxAge time.Duration) *CachingProvider {
+	if maxAge < ttl {
+		maxAge = ttl
+	}
+	return &CachingProvider{
+		provider: provider,
+		ttl:      ttl,
+		maxAge:   maxAge,
+		rates:    make(map[string]*Rate),
+	}
+}
+
+// GetRate returns a cached rate or fetches a new one
+func (p *CachingProvider) GetRate(ctx context.Context, symbol string) (*Rate, error) {
+	symbol = Symbol(symbol)
+
+	p.mu.Lock()
+	cached := p.rates[symbol]
+	p.mu.Unlock()
+
+	if cached != nil && cached.Age() < p.ttl {
+		return cached, nil
+	}
+
+	rate, err := p.provider.GetRate(ctx, symbol)
+	if err == nil && rate.Age() > p.maxAge {
+		err = fmt.Errorf("%w: %s rate from %s is %s old", ErrStaleRate, symbol, rate.Source, rate.Age().Round(time.Second))
+	}
+	if err != nil {
+		if cached != nil && cached.Age() <= p.maxAge {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.rates[symbol] = rate
+	p.mu.Unlock()
+
+	return rate, nil
+}
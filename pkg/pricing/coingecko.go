@@ -0,0 +1,89 @@
+package pricing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultCoinGeckoURL is the public CoinGecko API
+const DefaultCoinGeckoURL = "https://api.coingecko.com/api/v3"
+
+// coinGeckoIDs maps ticker symbols to CoinGecko coin IDs
+var coinGeckoIDs = map[string]string{
+	"BTC": "bitcoin",
+	"ETH": "ethereum",
+	"LTC": "litecoin",
+	"XMR": "monero",
+}
+
+// CoinGeckoProvider fetches rates from the CoinGecko simple price API
+type CoinGeckoProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewCoinGeckoProvider creates a CoinGecko provider. An empty baseURL uses
+// the public API.
+func NewCoinGeckoProvider(baseURL string, timeout time.Duration) *CoinGeckoProvider {
+	if baseURL == "" {
+		baseURL = DefaultCoinGeckoURL
+	}
+	return &CoinGeckoProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// GetRate fetches the current USD price of symbol
+func (p *CoinGeckoProvider) GetRate(ctx context.Context, symbol string) (*Rate, error) {
+	symbol = Symbol(symbol)
+	id, ok := coinGeckoIDs[symbol]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSymbol, symbol)
+	}
+
+	query := url.Values{
+		"ids":                     {id},
+		"vs_currencies":           {"usd"},
+		"include_last_updated_at": {"true"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/simple/price?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s rate: %w", symbol, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s rate: coingecko returned %s", symbol, resp.Status)
+	}
+
+	var prices map[string]struct {
+		USD           float64 `json:"usd"`
+		LastUpdatedAt int64   `json:"last_updated_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&prices); err != nil {
+		return nil, fmt.Errorf("failed to decode %s rate: %w", symbol, err)
+	}
+
+	price, ok := prices[id]
+	if !ok || price.USD <= 0 {
+		return nil, fmt.Errorf("%w: coingecko has no price for %s", ErrUnsupportedSymbol, symbol)
+	}
+
+	fetchedAt := time.Now()
+	if price.LastUpdatedAt > 0 {
+		fetchedAt = time.Unix(price.LastUpdatedAt, 0)
+	}
+
+	return &Rate{Symbol: symbol, USD: price.USD, Source: "coingecko", FetchedAt: fetchedAt}, nil
+}
@@ -0,0 +1,92 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MedianProvider queries several providers and returns the median of their
+// rates, so a single bad source cannot move the price
+type MedianProvider struct {
+	providers  []RateProvider
+	minSources int
+	maxAge     time.Duration
+}
+
+// NewMedianProvider aggregates providers. At least minSources of them must
+// return a rate no older than maxAge.
+func NewMedianProvider(minSources int, maxAge time.Duration, providers ...RateProvider) *MedianProvider {
+	if minSources < 1 {
+		minSources = 1
+	}
+	return &MedianProvider{
+		providers:  providers,
+		minSources: minSources,
+		maxAge:     maxAge,
+	}
+}
+
+// GetRate returns the median rate reported by the providers
+func (p *MedianProvider) GetRate(ctx context.Context, symbol string) (*Rate, error) {
+	symbol = Symbol(symbol)
+
+	type result struct {
+		rate *Rate
+		err  error
+	}
+	results := make(chan result, len(p.providers))
+	for _, provider := range p.providers {
+		go func(provider RateProvider) {
+			rate, err := provider.GetRate(ctx, symbol)
+			results <- result{rate, err}
+		}(provider)
+	}
+
+	var rates []*Rate
+	var errs []error
+	for range p.providers {
+		res := <-results
+		switch {
+		case res.err != nil:
+			errs = append(errs, res.err)
+		case p.maxAge > 0 && res.rate.Age() > p.maxAge:
+			errs = append(errs, fmt.Errorf("%w: %s rate from %s", ErrStaleRate, symbol, res.rate.Source))
+		default:
+			rates = append(rates, res.rate)
+		}
+	}
+
+	if len(rates) < p.minSources {
+		return nil, fmt.Errorf("only %d of %d required sources returned a %s rate: %w",
+			len(rates), p.minSources, symbol, errors.Join(errs...))
+	}
+
+	sort.Slice(rates, func(i, j int) bool { return rates[i].USD < rates[j].USD })
+
+	median := rates[len(rates)/2].USD
+	if len(rates)%2 == 0 {
+		median = (rates[len(rates)/2-1].USD + median) / 2
+	}
+
+	// The aggregate is as old as the oldest rate it was computed from
+	sources := make([]string, 0, len(rates))
+	fetchedAt := rates[0].FetchedAt
+	for _, rate := range rates {
+		sources = append(sources, rate.Source)
+		if rate.FetchedAt.Before(fetchedAt) {
+			fetchedAt = rate.FetchedAt
+		}
+	}
+	sort.Strings(sources)
+
+	return &Rate{
+		Symbol:    symbol,
+		USD:       median,
+		Source:    "median(" + strings.Join(sources, ",") + ")",
+		FetchedAt: fetchedAt,
+	}, nil
+}
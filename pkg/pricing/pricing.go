@@ -0,0 +1,113 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/config"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrUnsupportedSymbol is returned when a provider has no rate for a symbol
+	ErrUnsupportedSymbol = errors.New("unsupported cryptocurrency")
+
+	// ErrStaleRate is returned when the only rate available is too old to use
+	ErrStaleRate = errors.New("exchange rate is stale")
+)
+
+// Rate is the USD price of one unit of a cryptocurrency
+type Rate struct {
+	Symbol    string    // BTC, ETH, LTC, XMR
+	USD       float64   // USD per unit
+	Source    string    // Provider the price came from
+	FetchedAt time.Time // When the provider observed the price
+}
+
+// Age returns how old the rate is
+func (r *Rate) Age() time.Duration {
+	return time.Since(r.FetchedAt)
+}
+
+// Convert returns the amount of the cryptocurrency worth amountUSD
+func (r *Rate) Convert(amountUSD float64) float64 {
+	return amountUSD / r.USD
+}
+
+// RateProvider returns current exchange rates
+type RateProvider interface {
+	GetRate(ctx context.Context, symbol string) (*Rate, error)
+}
+
+// symbols maps the wallet types used by operators to ticker symbols
+var symbols = map[string]string{
+	"bitcoin":  "BTC",
+	"ethereum": "ETH",
+	"litecoin": "LTC",
+	"monero":   "XMR",
+}
+
+// snapshotScale rounds snapshot rates to the 8 decimals they are stored with
+const snapshotScale = 1e8
+
+// Symbol normalizes a ticker symbol or wallet type such as "ethereum" to
+// its upper-case ticker symbol
+func Symbol(currency string) string {
+	currency = strings.ToLower(strings.TrimSpace(currency))
+	if symbol, ok := symbols[currency]; ok {
+		return symbol
+	}
+	return strings.ToUpper(currency)
+}
+
+// RecordSnapshot stores the rate so payouts and invoices can reference the
+// exact price they were quoted at. A rate that was already recorded is
+// reused. The rate is part of the key: a median can change while its oldest
+// source, and so its fetch time, stays the same.
+func RecordSnapshot(tx *gorm.DB, rate *Rate) (*models.ExchangeRateSnapshot, error) {
+	snapshot := models.ExchangeRateSnapshot{
+		Symbol:    rate.Symbol,
+		Source:    rate.Source,
+		FetchedAt: rate.FetchedAt.UTC(),
+		RateUSD:   math.Round(rate.USD*snapshotScale) / snapshotScale,
+	}
+	err := tx.Where(&snapshot).FirstOrCreate(&snapshot).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to record exchange rate: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// NewProvider builds the provider described by cfg: every configured source
+// is queried, the median of their rates is used, and results are cached
+func NewProvider(cfg config.PricingConfig) (RateProvider, error) {
+	var sources []RateProvider
+	for _, source := range cfg.Sources {
+		switch strings.ToLower(strings.TrimSpace(source)) {
+		case "coingecko":
+			sources = append(sources, NewCoinGeckoProvider(cfg.CoinGeckoURL, cfg.RequestTimeout))
+		case "file":
+			if cfg.RatesFile == "" {
+				return nil, fmt.Errorf("PRICING_RATES_FILE is required for the file source")
+			}
+			sources = append(sources, NewFileProvider(cfg.RatesFile))
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown pricing source: %s", source)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no pricing sources configured")
+	}
+	if cfg.MinSources > len(sources) {
+		return nil, fmt.Errorf("PRICING_MIN_SOURCES is %d but only %d sources are configured", cfg.MinSources, len(sources))
+	}
+
+	median := NewMedianProvider(cfg.MinSources, cfg.MaxAge, sources...)
+	return NewCachingProvider(median, cfg.CacheTTL, cfg.MaxAge), nil
+}
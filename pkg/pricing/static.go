@@ -0,0 +1,86 @@
+package pricing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// StaticProvider serves a fixed set of rates. It is meant for tests and
+// development; rates it returns are always reported as fresh.
+type StaticProvider struct {
+	source string
+	rates  map[string]float64
+}
+
+// NewStaticProvider creates a provider for the given USD rates, keyed by
+// ticker symbol or wallet type
+func NewStaticProvider(source string, rates map[string]float64) *StaticProvider {
+	normalized := make(map[string]float64, len(rates))
+	for currency, usd := range rates {
+		normalized[Symbol(currency)] = usd
+	}
+	return &StaticProvider{source: source, rates: normalized}
+}
+
+// GetRate returns the configured rate for symbol
+func (p *StaticProvider) GetRate(ctx context.Context, symbol string) (*Rate, error) {
+	symbol = Symbol(symbol)
+	usd, ok := p.rates[symbol]
+	if !ok || usd <= 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSymbol, symbol)
+	}
+	return &Rate{Symbol: symbol, USD: usd, Source: p.source, FetchedAt: time.Now()}, nil
+}
+
+// FileProvider serves rates from a JSON file such as
+//
+//	{"updated_at": "2025-01-01T00:00:00Z", "rates": {"BTC": 45000, "ETH": 3000}}
+//
+// The file is read on every call, so it can be updated in place. Rates are
+// as old as updated_at, or the file's modification time when it is omitted.
+type FileProvider struct {
+	path string
+}
+
+// rateFile is the format read by FileProvider
+type rateFile struct {
+	UpdatedAt *time.Time         `json:"updated_at"`
+	Rates     map[string]float64 `json:"rates"`
+}
+
+// NewFileProvider creates a provider backed by the JSON file at path
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+// GetRate reads the rate for symbol from the file
+func (p *FileProvider) GetRate(ctx context.Context, symbol string) (*Rate, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rates file: %w", err)
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rates file: %w", err)
+	}
+
+	var file rateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse rates file: %w", err)
+	}
+
+	fetchedAt := info.ModTime()
+	if file.UpdatedAt != nil {
+		fetchedAt = *file.UpdatedAt
+	}
+
+	rate, err := NewStaticProvider("file:"+p.path, file.Rates).GetRate(ctx, symbol)
+	if err != nil {
+		return nil, err
+	}
+	rate.FetchedAt = fetchedAt
+	return rate, nil
+}
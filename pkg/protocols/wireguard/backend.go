@@ -0,0 +1,31 @@
+package wireguard
+
+// Backend configures a WireGuard interface and its peers
+type Backend interface {
+	// SetupInterface creates and configures the interface
+	SetupInterface(config ServerConfig) error
+
+	// AddPeer adds or updates a single peer
+	AddPeer(peer PeerConfig) error
+
+	// RemovePeer removes a single peer
+	RemovePeer(publicKey string) error
+
+	// UpdatePeers adds and removes several peers in one operation
+	UpdatePeers(add []PeerConfig, remove []string) error
+
+	// GetInterfaceStats returns the interface's peers and their counters
+	GetInterfaceStats() (*InterfaceStats, error)
+
+	// Teardown removes the interface
+	Teardown(config ServerConfig) error
+}
+
+// NewBackend returns a netlink backend when the kernel supports it, falling
+// back to the exec backend that drives the ip and wg tools
+func NewBackend(interfaceName string) Backend {
+	if backend, err := NewNetlinkManager(interfaceName); err == nil {
+		return backend
+	}
+	return NewManager(interfaceName)
+}
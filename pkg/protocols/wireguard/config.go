@@ -149,9 +149,12 @@ func AllocateClientIP(networkCIDR string, usedIPs []string) (string, error) {
 		return "", fmt.Errorf("invalid CIDR: %w", err)
 	}
 
-	// Create a map of used IPs for quick lookup
+	// Create a map of used IPs for quick lookup (entries may carry a prefix length)
 	used := make(map[string]bool)
 	for _, ip := range usedIPs {
+		if i := strings.IndexByte(ip, '/'); i >= 0 {
+			ip = ip[:i]
+		}
 		used[ip] = true
 	}
 
@@ -0,0 +1,193 @@
+package wireguard
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeBackend is an in-memory Backend for tests. It keeps peers in a map and
+// lets tests simulate handshakes and traffic instead of touching the OS.
+type FakeBackend struct {
+	mu            sync.Mutex
+	interfaceName string
+	config        *ServerConfig
+	setups        int
+	peers         map[string]*PeerStats
+	err           error
+}
+
+// NewFakeBackend creates an in-memory backend
+func NewFakeBackend(interfaceName string) *FakeBackend {
+	return &FakeBackend{
+		interfaceName: interfaceName,
+		peers:         make(map[string]*PeerStats),
+	}
+}
+
+// SetError makes every subsequent call fail with err until cleared with nil
+func (f *FakeBackend) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// SetupInterface records the interface configuration. Like the real
+// backends it reuses an interface that is already up, keeping its peers.
+func (f *FakeBackend) SetupInterface(config ServerConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.setups++
+	f.config = &config
+	for _, peer := range config.Peers {
+		f.addPeer(peer)
+	}
+	return nil
+}
+
+// AddPeer adds a peer or updates an existing one, keeping its counters
+func (f *FakeBackend) AddPeer(peer PeerConfig) error {
+	return f.UpdatePeers([]PeerConfig{peer}, nil)
+}
+
+// RemovePeer removes a peer. Removing an unknown peer is not an error, matching wg.
+func (f *FakeBackend) RemovePeer(publicKey string) error {
+	return f.UpdatePeers(nil, []string{publicKey})
+}
+
+// UpdatePeers adds and removes peers atomically
+func (f *FakeBackend) UpdatePeers(add []PeerConfig, remove []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	for _, peer := range add {
+		if err := ValidatePublicKey(peer.PublicKey); err != nil {
+			return fmt.Errorf("invalid public key %s: %w", peer.PublicKey, err)
+		}
+	}
+
+	for _, peer := range add {
+		f.addPeer(peer)
+	}
+	for _, publicKey := range remove {
+		delete(f.peers, publicKey)
+	}
+	return nil
+}
+
+func (f *FakeBackend) addPeer(peer PeerConfig) {
+	stats, ok := f.peers[peer.PublicKey]
+	if !ok {
+		stats = &PeerStats{PublicKey: peer.PublicKey}
+		f.peers[peer.PublicKey] = stats
+	}
+	stats.AllowedIPs = append([]string(nil), peer.AllowedIPs...)
+	stats.PersistentKeepalive = peer.PersistentKeepalive
+}
+
+// GetInterfaceStats returns a snapshot of all peers, ordered by public key
+func (f *FakeBackend) GetInterfaceStats() (*InterfaceStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	stats := &InterfaceStats{
+		InterfaceName: f.interfaceName,
+		Peers:         make([]PeerStats, 0, len(f.peers)),
+	}
+	for _, peer := range f.peers {
+		p := *peer
+		p.AllowedIPs = append([]string(nil), peer.AllowedIPs...)
+		stats.Peers = append(stats.Peers, p)
+	}
+	sort.Slice(stats.Peers, func(i, j int) bool {
+		return stats.Peers[i].PublicKey < stats.Peers[j].PublicKey
+	})
+
+	return stats, nil
+}
+
+// Teardown removes the interface and all its peers
+func (f *FakeBackend) Teardown(config ServerConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.config = nil
+	f.peers = make(map[string]*PeerStats)
+	return nil
+}
+
+// Setups returns how often the interface has been set up
+func (f *FakeBackend) Setups() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.setups
+}
+
+// Peer returns the current state of a peer
+func (f *FakeBackend) Peer(publicKey string) (PeerStats, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	peer, ok := f.peers[publicKey]
+	if !ok {
+		return PeerStats{}, false
+	}
+	return *peer, true
+}
+
+// Handshake simulates a completed handshake with a peer from endpoint
+func (f *FakeBackend) Handshake(publicKey, endpoint string, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	peer, ok := f.peers[publicKey]
+	if !ok {
+		return fmt.Errorf("peer %s not found", publicKey)
+	}
+	peer.Endpoint = endpoint
+	peer.LatestHandshake = at
+	return nil
+}
+
+// Transfer simulates traffic by advancing a peer's byte counters
+func (f *FakeBackend) Transfer(publicKey string, received, sent int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	peer, ok := f.peers[publicKey]
+	if !ok {
+		return fmt.Errorf("peer %s not found", publicKey)
+	}
+	peer.BytesReceived += received
+	peer.BytesSent += sent
+	return nil
+}
+
+// ResetCounters zeroes every peer's byte counters, as recreating the interface would
+func (f *FakeBackend) ResetCounters() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, peer := range f.peers {
+		peer.BytesReceived = 0
+		peer.BytesSent = 0
+	}
+}
@@ -7,7 +7,8 @@ import (
 	"time"
 )
 
-// Manager handles WireGuard interface operations
+// Manager handles WireGuard interface operations by running the ip and wg
+// tools. It is the fallback Backend where netlink is unavailable.
 type Manager struct {
 	interfaceName string
 }
@@ -19,12 +20,16 @@ func NewManager(interfaceName string) *Manager {
 	}
 }
 
-// SetupInterface creates and configures a WireGuard interface
+// SetupInterface creates and configures a WireGuard interface. An interface
+// left up by a previous run is reused with its peers.
 func (m *Manager) SetupInterface(config ServerConfig) error {
-	// Create WireGuard interface
-	cmd := exec.Command("ip", "link", "add", "dev", m.interfaceName, "type", "wireguard")
+	// Create WireGuard interface unless it exists
+	cmd := exec.Command("ip", "link", "show", "dev", m.interfaceName)
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create interface: %w", err)
+		cmd = exec.Command("ip", "link", "add", "dev", m.interfaceName, "type", "wireguard")
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to create interface: %w", err)
+		}
 	}
 
 	// Set private key
@@ -40,8 +45,8 @@ func (m *Manager) SetupInterface(config ServerConfig) error {
 		return fmt.Errorf("failed to set listen port: %w", err)
 	}
 
-	// Set IP address
-	cmd = exec.Command("ip", "address", "add", config.Address, "dev", m.interfaceName)
+	// Set IP address, keeping it if it is already set
+	cmd = exec.Command("ip", "address", "replace", config.Address, "dev", m.interfaceName)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to set IP address: %w", err)
 	}
@@ -54,7 +59,7 @@ func (m *Manager) SetupInterface(config ServerConfig) error {
 
 	// Execute PostUp commands
 	for _, postUpCmd := range config.PostUp {
-		cmd = exec.Command("sh", "-c", postUpCmd)
+		cmd = exec.Command("sh", "-c", idempotentCommand(postUpCmd))
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("failed to execute PostUp command %s: %w", postUpCmd, err)
 		}
@@ -100,6 +105,43 @@ func (m *Manager) RemovePeer(publicKey string) error {
 	return nil
 }
 
+// UpdatePeers adds and removes peers with a single wg invocation
+func (m *Manager) UpdatePeers(add []PeerConfig, remove []string) error {
+	args := []string{"set", m.interfaceName}
+
+	for _, peer := range add {
+		// Preshared keys are passed on stdin, which only works once per invocation
+		if peer.PresharedKey != "" {
+			if err := m.AddPeer(peer); err != nil {
+				return err
+			}
+			continue
+		}
+
+		args = append(args, "peer", peer.PublicKey)
+		if len(peer.AllowedIPs) > 0 {
+			args = append(args, "allowed-ips", strings.Join(peer.AllowedIPs, ","))
+		}
+		if peer.PersistentKeepalive > 0 {
+			args = append(args, "persistent-keepalive", fmt.Sprintf("%d", peer.PersistentKeepalive))
+		}
+	}
+
+	for _, publicKey := range remove {
+		args = append(args, "peer", publicKey, "remove")
+	}
+
+	if len(args) == 2 {
+		return nil
+	}
+
+	if err := exec.Command("wg", args...).Run(); err != nil {
+		return fmt.Errorf("failed to update peers: %w", err)
+	}
+
+	return nil
+}
+
 // GetInterfaceStats retrieves statistics for the WireGuard interface
 func (m *Manager) GetInterfaceStats() (*InterfaceStats, error) {
 	cmd := exec.Command("wg", "show", m.interfaceName, "dump")
@@ -119,9 +161,11 @@ func (m *Manager) GetInterfaceStats() (*InterfaceStats, error) {
 			continue // Skip header and empty lines
 		}
 
-		fields := strings.Fields(line)
-		if len(fields) < 8 {
-			continue
+		// Peer lines have exactly 8 tab-separated fields; anything else means
+		// the dump format changed and the counters cannot be trusted
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("unexpected wg dump line with %d fields", len(fields))
 		}
 
 		peer := PeerStats{
@@ -134,14 +178,18 @@ func (m *Manager) GetInterfaceStats() (*InterfaceStats, error) {
 			PersistentKeepalive: parseInt(fields[7]),
 		}
 
+		if peer.Endpoint == "(none)" {
+			peer.Endpoint = ""
+		}
+
 		stats.Peers = append(stats.Peers, peer)
 	}
 
 	return stats, nil
 }
 
-// TeardownInterface removes the WireGuard interface
-func (m *Manager) TeardownInterface(config ServerConfig) error {
+// Teardown removes the WireGuard interface
+func (m *Manager) Teardown(config ServerConfig) error {
 	// Execute PostDown commands
 	for _, postDownCmd := range config.PostDown {
 		cmd := exec.Command("sh", "-c", postDownCmd)
@@ -194,3 +242,21 @@ func parseInt(s string) int {
 	fmt.Sscanf(s, "%d", &val)
 	return val
 }
+
+// idempotentCommand turns an iptables rule append into a check followed by
+// the append, so running PostUp again for an interface that is already set
+// up does not add the rule twice. Other commands are returned unchanged.
+func idempotentCommand(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || (fields[0] != "iptables" && fields[0] != "ip6tables") {
+		return command
+	}
+	for i, field := range fields {
+		if field == "-A" {
+			check := append([]string(nil), fields...)
+			check[i] = "-C"
+			return strings.Join(check, " ") + " 2>/dev/null || " + command
+		}
+	}
+	return command
+}
@@ -0,0 +1,239 @@
+//go:build linux
+
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// NetlinkManager configures a WireGuard interface through netlink instead of
+// forking the ip and wg tools
+type NetlinkManager struct {
+	interfaceName string
+	client        *wgctrl.Client
+}
+
+// NewNetlinkManager creates a netlink-backed WireGuard manager
+func NewNetlinkManager(interfaceName string) (Backend, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wgctrl client: %w", err)
+	}
+
+	return &NetlinkManager{
+		interfaceName: interfaceName,
+		client:        client,
+	}, nil
+}
+
+// SetupInterface creates and configures a WireGuard interface. An interface
+// left up by a previous run is reused with its peers.
+func (m *NetlinkManager) SetupInterface(config ServerConfig) error {
+	var link netlink.Link
+	existing, err := netlink.LinkByName(m.interfaceName)
+	switch {
+	case err == nil && existing.Type() == "wireguard":
+		link = existing
+	case err == nil:
+		return fmt.Errorf("interface %s exists but is a %s link", m.interfaceName, existing.Type())
+	default:
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("failed to look up interface: %w", err)
+		}
+		link = &netlink.GenericLink{
+			LinkAttrs: netlink.LinkAttrs{Name: m.interfaceName},
+			LinkType:  "wireguard",
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return fmt.Errorf("failed to create interface: %w", err)
+		}
+	}
+
+	privateKey, err := wgtypes.ParseKey(config.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	listenPort := config.ListenPort
+	if err := m.client.ConfigureDevice(m.interfaceName, wgtypes.Config{
+		PrivateKey: &privateKey,
+		ListenPort: &listenPort,
+	}); err != nil {
+		return fmt.Errorf("failed to configure device: %w", err)
+	}
+
+	addr, err := netlink.ParseAddr(config.Address)
+	if err != nil {
+		return fmt.Errorf("failed to parse IP address: %w", err)
+	}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("failed to set IP address: %w", err)
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring interface up: %w", err)
+	}
+
+	// Execute PostUp commands
+	for _, postUpCmd := range config.PostUp {
+		cmd := exec.Command("sh", "-c", idempotentCommand(postUpCmd))
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to execute PostUp command %s: %w", postUpCmd, err)
+		}
+	}
+
+	return nil
+}
+
+// AddPeer adds a peer to the WireGuard interface
+func (m *NetlinkManager) AddPeer(peer PeerConfig) error {
+	if err := m.UpdatePeers([]PeerConfig{peer}, nil); err != nil {
+		return fmt.Errorf("failed to add peer: %w", err)
+	}
+	return nil
+}
+
+// RemovePeer removes a peer from the WireGuard interface
+func (m *NetlinkManager) RemovePeer(publicKey string) error {
+	if err := m.UpdatePeers(nil, []string{publicKey}); err != nil {
+		return fmt.Errorf("failed to remove peer: %w", err)
+	}
+	return nil
+}
+
+// UpdatePeers adds and removes peers in a single netlink request
+func (m *NetlinkManager) UpdatePeers(add []PeerConfig, remove []string) error {
+	peers := make([]wgtypes.PeerConfig, 0, len(add)+len(remove))
+
+	for _, peer := range add {
+		cfg, err := toPeerConfig(peer)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, cfg)
+	}
+
+	for _, publicKey := range remove {
+		key, err := wgtypes.ParseKey(publicKey)
+		if err != nil {
+			return fmt.Errorf("invalid public key %s: %w", publicKey, err)
+		}
+		peers = append(peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+	}
+
+	if len(peers) == 0 {
+		return nil
+	}
+
+	return m.client.ConfigureDevice(m.interfaceName, wgtypes.Config{Peers: peers})
+}
+
+// GetInterfaceStats retrieves statistics for the WireGuard interface
+func (m *NetlinkManager) GetInterfaceStats() (*InterfaceStats, error) {
+	device, err := m.client.Device(m.interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface stats: %w", err)
+	}
+
+	stats := &InterfaceStats{
+		InterfaceName: m.interfaceName,
+		Peers:         make([]PeerStats, 0, len(device.Peers)),
+	}
+
+	for _, p := range device.Peers {
+		peer := PeerStats{
+			PublicKey:           p.PublicKey.String(),
+			AllowedIPs:          make([]string, 0, len(p.AllowedIPs)),
+			BytesReceived:       p.ReceiveBytes,
+			BytesSent:           p.TransmitBytes,
+			PersistentKeepalive: int(p.PersistentKeepaliveInterval / time.Second),
+		}
+
+		if p.Endpoint != nil {
+			peer.Endpoint = p.Endpoint.String()
+		}
+
+		// The kernel reports the zero Unix time for peers that never completed a handshake
+		if p.LastHandshakeTime.Unix() > 0 {
+			peer.LatestHandshake = p.LastHandshakeTime
+		}
+
+		for _, ipNet := range p.AllowedIPs {
+			peer.AllowedIPs = append(peer.AllowedIPs, ipNet.String())
+		}
+
+		stats.Peers = append(stats.Peers, peer)
+	}
+
+	return stats, nil
+}
+
+// Teardown removes the WireGuard interface
+func (m *NetlinkManager) Teardown(config ServerConfig) error {
+	// Execute PostDown commands
+	for _, postDownCmd := range config.PostDown {
+		cmd := exec.Command("sh", "-c", postDownCmd)
+		_ = cmd.Run() // Ignore errors for PostDown commands
+	}
+
+	link, err := netlink.LinkByName(m.interfaceName)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to find interface: %w", err)
+	}
+
+	if err := netlink.LinkDel(link); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete interface: %w", err)
+	}
+
+	return nil
+}
+
+// toPeerConfig converts a PeerConfig to its wgctrl representation
+func toPeerConfig(peer PeerConfig) (wgtypes.PeerConfig, error) {
+	key, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("invalid public key %s: %w", peer.PublicKey, err)
+	}
+
+	cfg := wgtypes.PeerConfig{
+		PublicKey:         key,
+		ReplaceAllowedIPs: true,
+	}
+
+	if peer.PresharedKey != "" {
+		psk, err := wgtypes.ParseKey(peer.PresharedKey)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("invalid preshared key: %w", err)
+		}
+		cfg.PresharedKey = &psk
+	}
+
+	if peer.PersistentKeepalive > 0 {
+		interval := time.Duration(peer.PersistentKeepalive) * time.Second
+		cfg.PersistentKeepaliveInterval = &interval
+	}
+
+	for _, allowedIP := range peer.AllowedIPs {
+		_, ipNet, err := net.ParseCIDR(allowedIP)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("invalid allowed IP %s: %w", allowedIP, err)
+		}
+		cfg.AllowedIPs = append(cfg.AllowedIPs, *ipNet)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package wireguard
+
+import "fmt"
+
+// NewNetlinkManager is only available on Linux
+func NewNetlinkManager(interfaceName string) (Backend, error) {
+	return nil, fmt.Errorf("netlink WireGuard backend is not supported on this platform")
+}
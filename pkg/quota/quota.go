@@ -0,0 +1,347 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/config"
+	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/metrics"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+	"gorm.io/gorm"
+)
+
+// Actions taken on a user's sessions once their plan's data cap is reached
+const (
+	ActionDisconnect = "disconnect"
+	ActionThrottle   = "throttle"
+)
+
+// PeerLimiter rate limits a peer on its node. nodeapi.Client implements it.
+type PeerLimiter interface {
+	LimitPeer(ctx context.Context, node *models.VPNNode, publicKey string, rateKbps int) error
+}
+
+// SessionEnder ends a session and removes its peer. session.Service
+// implements it.
+type SessionEnder interface {
+	End(ctx context.Context, session *models.Session, status string) error
+}
+
+// Usage is a user's data usage in the current billing cycle
+type Usage struct {
+	Plan           string     `json:"plan"`
+	CapGB          float64    `json:"cap_gb"` // 0 = unlimited
+	UsedGB         float64    `json:"used_gb"`
+	Percent        float64    `json:"percent"`
+	WarnedPercent  int        `json:"warned_percent,omitempty"`
+	CycleStartedAt time.Time  `json:"cycle_started_at"`
+	CycleEndsAt    time.Time  `json:"cycle_ends_at"`
+	ExceededAt     *time.Time `json:"exceeded_at,omitempty"`
+}
+
+// Service enforces plan data caps. Nodes add each session's traffic to its
+// user's billing cycle total as it happens; the service compares the totals
+// against the caps, warns users as they approach theirs and throttles or
+// disconnects their sessions on every node once it is reached. Usage resets
+// monthly from the start of each user's cycle.
+type Service struct {
+	db       *gorm.DB
+	log      *logger.Logger
+	plans    *plans.Service
+	sessions SessionEnder
+	limiter  PeerLimiter
+	cfg      config.QuotaConfig
+}
+
+// NewService creates a quota service. limiter may be nil, in which case
+// throttled users are disconnected instead.
+func NewService(log *logger.Logger, plans *plans.Service, sessions SessionEnder, limiter PeerLimiter, cfg config.QuotaConfig) *Service {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = 30 * time.Second
+	}
+	if cfg.Action == "" {
+		cfg.Action = ActionDisconnect
+	}
+	if cfg.ThrottleKbps <= 0 {
+		cfg.ThrottleKbps = 256
+	}
+
+	// Only thresholds below the cap, lowest first
+	var percents []int
+	for _, percent := range cfg.WarningPercents {
+		if percent > 0 && percent < 100 {
+			percents = append(percents, percent)
+		}
+	}
+	sort.Ints(percents)
+	cfg.WarningPercents = percents
+
+	return &Service{
+		db:       database.GetDB(),
+		log:      log,
+		plans:    plans,
+		sessions: sessions,
+		limiter:  limiter,
+		cfg:      cfg,
+	}
+}
+
+// Run checks usage every check interval until ctx is cancelled
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	s.log.Info("quota enforcement started", "interval", s.cfg.CheckInterval, "action", s.cfg.Action)
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Info("quota enforcement stopped")
+			return
+		case <-ticker.C:
+			if err := s.RunOnce(ctx); err != nil {
+				s.log.Error("failed to enforce data caps", "error", err)
+			}
+		}
+	}
+}
+
+// RunOnce starts new billing cycles that are due, then checks every user
+// with an active session against their cap
+func (s *Service) RunOnce(ctx context.Context) error {
+	now := time.Now()
+	if err := s.resetCycles(ctx, now); err != nil {
+		return err
+	}
+
+	var userIDs []uuid.UUID
+	if err := s.db.WithContext(ctx).Model(&models.Session{}).
+		Where("status = ?", "active").
+		Distinct().Pluck("user_id", &userIDs).Error; err != nil {
+		return fmt.Errorf("failed to load connected users: %w", err)
+	}
+
+	for _, userID := range userIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := s.check(ctx, userID); err != nil {
+			s.log.Error("failed to check data cap", "user_id", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+// Usage returns the user's usage in the current billing cycle
+func (s *Service) Usage(ctx context.Context, userID uuid.UUID) (*Usage, error) {
+	user, plan, err := s.plans.ForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &Usage{
+		Plan:           plan.Name,
+		CapGB:          plan.BandwidthCapGB,
+		UsedGB:         user.CycleDataGB,
+		WarnedPercent:  user.QuotaWarnedPercent,
+		CycleStartedAt: user.CycleStartedAt,
+		CycleEndsAt:    cycleEnd(user.CycleStartedAt),
+		ExceededAt:     user.QuotaExceededAt,
+	}
+	if plan.BandwidthCapGB > 0 {
+		usage.Percent = user.CycleDataGB / plan.BandwidthCapGB * 100
+	}
+	return usage, nil
+}
+
+// cycleEnd returns when the billing cycle starting at start ends
+func cycleEnd(start time.Time) time.Time {
+	return start.AddDate(0, 1, 0)
+}
+
+// resetCycles starts a new billing cycle for users whose cycle has ended,
+// lifting any throttling from the previous one
+func (s *Service) resetCycles(ctx context.Context, now time.Time) error {
+	var users []models.User
+	if err := s.db.WithContext(ctx).
+		Where("cycle_started_at <= ?", now.AddDate(0, -1, 0)).
+		Find(&users).Error; err != nil {
+		return fmt.Errorf("failed to load users due a new cycle: %w", err)
+	}
+
+	for _, user := range users {
+		var updates map[string]interface{}
+		if user.CycleStartedAt.IsZero() {
+			// First cycle: keep what was counted before it was tracked
+			updates = map[string]interface{}{"cycle_started_at": now}
+		} else {
+			start := user.CycleStartedAt
+			for !cycleEnd(start).After(now) {
+				start = cycleEnd(start)
+			}
+			updates = map[string]interface{}{
+				"cycle_started_at":     start,
+				"cycle_data_gb":        0,
+				"quota_warned_percent": 0,
+				"quota_exceeded_at":    nil,
+			}
+		}
+
+		// Guarded by the old start so concurrent runs reset a cycle once
+		result := s.db.WithContext(ctx).Model(&models.User{}).
+			Where("id = ? AND cycle_started_at = ?", user.ID, user.CycleStartedAt).
+			Updates(updates)
+		if result.Error != nil {
+			return fmt.Errorf("failed to start new cycle for user %s: %w", user.ID, result.Error)
+		}
+		if result.RowsAffected == 0 || user.QuotaExceededAt == nil {
+			continue
+		}
+
+		s.log.Info("data cap reset", "user_id", user.ID, "used_gb", user.CycleDataGB)
+		s.lift(ctx, user.ID)
+	}
+	return nil
+}
+
+// check warns the user at each threshold they cross and enforces the cap
+// once it is reached
+func (s *Service) check(ctx context.Context, userID uuid.UUID) error {
+	user, plan, err := s.plans.ForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	percent := 0.0
+	if plan.BandwidthCapGB > 0 {
+		percent = user.CycleDataGB / plan.BandwidthCapGB * 100
+	}
+
+	// Upgraded to a larger or unlimited plan since the cap was hit
+	if percent < 100 {
+		if user.QuotaExceededAt != nil {
+			result := s.db.WithContext(ctx).Model(&models.User{}).
+				Where("id = ? AND quota_exceeded_at IS NOT NULL", user.ID).
+				Update("quota_exceeded_at", nil)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				s.lift(ctx, user.ID)
+			}
+		}
+		return s.warn(ctx, user, plan, percent)
+	}
+
+	if user.QuotaExceededAt == nil {
+		now := time.Now()
+		result := s.db.WithContext(ctx).Model(&models.User{}).
+			Where("id = ? AND quota_exceeded_at IS NULL", user.ID).
+			Updates(map[string]interface{}{"quota_exceeded_at": now, "quota_warned_percent": 100})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			s.log.Warn("data cap reached", "user_id", user.ID, "plan", plan.Name, "used_gb", user.CycleDataGB, "cap_gb", plan.BandwidthCapGB)
+			metrics.QuotaWarnings.WithLabelValues(plan.Name, "100").Inc()
+		}
+	}
+
+	return s.enforce(ctx, user.ID)
+}
+
+// warn records the highest threshold the user has crossed, once per cycle
+func (s *Service) warn(ctx context.Context, user *models.User, plan *models.Plan, percent float64) error {
+	threshold := 0
+	for _, t := range s.cfg.WarningPercents {
+		if percent >= float64(t) {
+			threshold = t
+		}
+	}
+	if threshold <= user.QuotaWarnedPercent {
+		return nil
+	}
+
+	result := s.db.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND quota_warned_percent < ?", user.ID, threshold).
+		Update("quota_warned_percent", threshold)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		s.log.Warn("data cap warning", "user_id", user.ID, "plan", plan.Name, "percent", threshold, "used_gb", user.CycleDataGB, "cap_gb", plan.BandwidthCapGB)
+		metrics.QuotaWarnings.WithLabelValues(plan.Name, strconv.Itoa(threshold)).Inc()
+	}
+	return nil
+}
+
+// enforce throttles or disconnects every active session of a user over their
+// cap. Peers that cannot be throttled are disconnected.
+func (s *Service) enforce(ctx context.Context, userID uuid.UUID) error {
+	var sessions []models.Session
+	if err := s.db.WithContext(ctx).Preload("Node").
+		Where("user_id = ? AND status = ?", userID, "active").
+		Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	for i := range sessions {
+		sess := &sessions[i]
+
+		if s.cfg.Action == ActionThrottle && s.limiter != nil && sess.Node != nil {
+			if sess.RateLimitKbps == s.cfg.ThrottleKbps {
+				continue
+			}
+			err := s.limiter.LimitPeer(ctx, sess.Node, sess.PublicKey, s.cfg.ThrottleKbps)
+			if err == nil {
+				s.db.WithContext(ctx).Model(sess).UpdateColumn("rate_limit_kbps", s.cfg.ThrottleKbps)
+				metrics.QuotaEnforcements.WithLabelValues(ActionThrottle).Inc()
+				s.log.Info("session throttled at data cap", "session_id", sess.ID, "user_id", userID, "rate_kbps", s.cfg.ThrottleKbps)
+				continue
+			}
+			s.log.Warn("failed to throttle peer, disconnecting", "session_id", sess.ID, "node_id", sess.NodeID, "error", err)
+		}
+
+		err := s.sessions.End(ctx, sess, "terminated")
+		if err != nil && !errors.Is(err, session.ErrSessionNotActive) {
+			s.log.Error("failed to disconnect session at data cap", "session_id", sess.ID, "error", err)
+			continue
+		}
+		if err == nil {
+			metrics.QuotaEnforcements.WithLabelValues(ActionDisconnect).Inc()
+			s.log.Info("session disconnected at data cap", "session_id", sess.ID, "user_id", userID)
+		}
+	}
+	return nil
+}
+
+// lift removes throttling from a user's active sessions
+func (s *Service) lift(ctx context.Context, userID uuid.UUID) {
+	var sessions []models.Session
+	if err := s.db.WithContext(ctx).Preload("Node").
+		Where("user_id = ? AND status = ? AND rate_limit_kbps > 0", userID, "active").
+		Find(&sessions).Error; err != nil {
+		s.log.Error("failed to load throttled sessions", "user_id", userID, "error", err)
+		return
+	}
+
+	for i := range sessions {
+		sess := &sessions[i]
+		if s.limiter != nil && sess.Node != nil {
+			if err := s.limiter.LimitPeer(ctx, sess.Node, sess.PublicKey, 0); err != nil {
+				s.log.Warn("failed to lift peer throttling", "session_id", sess.ID, "error", err)
+				continue
+			}
+		}
+		s.db.WithContext(ctx).Model(sess).UpdateColumn("rate_limit_kbps", 0)
+	}
+}
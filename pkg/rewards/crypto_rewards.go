@@ -2,30 +2,35 @@ package rewards
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/nikola43/aureo-vpn/pkg/blockchain"
 	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/ledger"
 	"github.com/nikola43/aureo-vpn/pkg/logger"
 	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/pricing"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // RewardService handles crypto rewards for node operators
 type RewardService struct {
-	db         *gorm.DB
-	log        *logger.Logger
-	blockchain *blockchain.Service
+	db    *gorm.DB
+	log   *logger.Logger
+	rates pricing.RateProvider
 }
 
-// NewRewardService creates a new reward service
-func NewRewardService(log *logger.Logger, blockchainService *blockchain.Service) *RewardService {
+// NewRewardService creates a new reward service. Payouts it creates are sent
+// by a PayoutWorker. rates may be nil for services that only record
+// earnings; creating payouts then fails.
+func NewRewardService(log *logger.Logger, rates pricing.RateProvider) *RewardService {
 	return &RewardService{
-		db:         database.GetDB(),
-		log:        log,
-		blockchain: blockchainService,
+		db:    database.GetDB(),
+		log:   log,
+		rates: rates,
 	}
 }
 
@@ -88,74 +93,198 @@ func (rs *RewardService) InitializeRewardTiers() error {
 	return nil
 }
 
-// RecordEarning records an earning event for a session
-func (rs *RewardService) RecordEarning(ctx context.Context, sessionID uuid.UUID, bandwidthGB float64, durationMinutes int) error {
-	// Get session details
-	var session models.Session
-	if err := rs.db.Preload("Node").First(&session, sessionID).Error; err != nil {
-		return fmt.Errorf("session not found: %w", err)
-	}
+// RecordEarning records the operator earning for a session's traffic since its
+// previous earning, up to periodEnd. Periods that are already covered are
+// skipped, so recording the same period twice is a no-op.
+func (rs *RewardService) RecordEarning(ctx context.Context, sessionID uuid.UUID, periodEnd time.Time) error {
+	var (
+		earning  *models.OperatorEarning
+		operator models.NodeOperator
+		tierName string
+	)
 
-	// Check if node is operator-owned
-	if session.Node.OperatorID == nil {
-		rs.log.Debug("session on company node, no earnings", "session_id", sessionID)
-		return nil // Company-owned nodes don't generate operator earnings
-	}
+	err := rs.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Lock the session so concurrent recorders agree on the previous period
+		var session models.Session
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, sessionID).Error; err != nil {
+			return fmt.Errorf("session not found: %w", err)
+		}
 
-	// Get operator
-	var operator models.NodeOperator
-	if err := rs.db.First(&operator, session.Node.OperatorID).Error; err != nil {
-		return fmt.Errorf("operator not found: %w", err)
-	}
+		var node models.VPNNode
+		if err := tx.First(&node, session.NodeID).Error; err != nil {
+			return fmt.Errorf("node not found: %w", err)
+		}
+		session.Node = &node
 
-	// Get eligible tier
-	tier, err := operator.GetEligibleTier(rs.db)
-	if err != nil {
-		return fmt.Errorf("failed to get tier: %w", err)
-	}
+		// Check if node is operator-owned
+		if node.OperatorID == nil {
+			rs.log.Debug("session on company node, no earnings", "session_id", sessionID)
+			return nil // Company-owned nodes don't generate operator earnings
+		}
 
-	// Calculate quality score based on session
-	qualityScore := calculateSessionQuality(&session)
+		// Traffic after the session ended belongs to no period
+		if session.DisconnectedAt != nil && periodEnd.After(*session.DisconnectedAt) {
+			periodEnd = *session.DisconnectedAt
+		}
 
-	// Calculate earnings
-	amountUSD := models.CalculateEarnings(
-		bandwidthGB,
-		durationMinutes,
-		tier.BaseRatePerGB*tier.BonusMultiplier,
-		qualityScore,
-	)
+		periodStart := session.ConnectedAt
+		var bytesFrom int64
+		var last models.OperatorEarning
+		err := tx.Where("session_id = ?", sessionID).Order("period_end DESC").First(&last).Error
+		switch {
+		case err == nil:
+			periodStart = last.PeriodEnd
+			bytesFrom = last.BytesThrough
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return fmt.Errorf("failed to load previous earning: %w", err)
+		}
 
-	// Create earning record
-	earning := models.OperatorEarning{
-		OperatorID:        *session.Node.OperatorID,
-		NodeID:            session.NodeID,
-		SessionID:         sessionID,
-		BandwidthGB:       bandwidthGB,
-		DurationMinutes:   durationMinutes,
-		RatePerGB:         tier.BaseRatePerGB * tier.BonusMultiplier,
-		AmountUSD:         amountUSD,
-		Status:            "pending",
-		ConnectionQuality: qualityScore,
-	}
+		if !periodEnd.After(periodStart) {
+			return nil // Already recorded
+		}
 
-	if err := rs.db.Create(&earning).Error; err != nil {
-		return fmt.Errorf("failed to record earning: %w", err)
+		bytesThrough := session.BytesSent + session.BytesReceived
+		bytes := bytesThrough - bytesFrom
+		if bytes < 0 {
+			bytes = 0
+		}
+
+		// Idle checkpoints are folded into the next period; the final period
+		// is always recorded so the session is known to be settled
+		if bytes == 0 && session.DisconnectedAt == nil {
+			return nil
+		}
+
+		// Get operator
+		if err := tx.First(&operator, node.OperatorID).Error; err != nil {
+			return fmt.Errorf("operator not found: %w", err)
+		}
+
+		// Get eligible tier
+		tier, err := operator.GetEligibleTier(tx)
+		if err != nil {
+			return fmt.Errorf("failed to get tier: %w", err)
+		}
+		tierName = tier.TierName
+
+		// Calculate quality score based on session
+		qualityScore := calculateSessionQuality(&session)
+
+		bandwidthGB := float64(bytes) / (1024 * 1024 * 1024)
+		durationMinutes := int(periodEnd.Sub(periodStart) / time.Minute)
+
+		// The duration bonus rewards the session's stability, not the period
+		// length. Amounts are kept to the ledger's micro-unit precision.
+		amountUSD := ledger.FromUSD(models.CalculateEarnings(
+			bandwidthGB,
+			int(periodEnd.Sub(session.ConnectedAt)/time.Minute),
+			tier.BaseRatePerGB*tier.BonusMultiplier,
+			qualityScore,
+		)).USD()
+
+		earning = &models.OperatorEarning{
+			OperatorID:        *node.OperatorID,
+			NodeID:            session.NodeID,
+			SessionID:         sessionID,
+			PeriodStart:       periodStart,
+			PeriodEnd:         periodEnd,
+			BytesThrough:      bytesThrough,
+			BandwidthGB:       bandwidthGB,
+			DurationMinutes:   durationMinutes,
+			RatePerGB:         tier.BaseRatePerGB * tier.BonusMultiplier,
+			AmountUSD:         amountUSD,
+			Status:            "pending",
+			ConnectionQuality: qualityScore,
+		}
+
+		if err := tx.Create(earning).Error; err != nil {
+			return fmt.Errorf("failed to record earning: %w", err)
+		}
+
+		if err := ledger.PostEarning(tx, earning); err != nil {
+			return err
+		}
+		if err := ledger.RefreshNode(tx, node.ID); err != nil {
+			return err
+		}
+		return ledger.RefreshOperator(tx, operator.ID)
+	})
+	if err != nil || earning == nil {
+		return err
 	}
 
 	rs.log.Info("earning recorded",
 		"operator_id", operator.ID,
 		"session_id", sessionID,
-		"amount_usd", amountUSD,
-		"tier", tier.TierName,
+		"amount_usd", earning.AmountUSD,
+		"bandwidth_gb", earning.BandwidthGB,
+		"tier", tierName,
 	)
 
-	// Update node total earnings
-	rs.db.Model(&session.Node).UpdateColumn("total_earned_usd",
-		gorm.Expr("total_earned_usd + ?", amountUSD))
+	return nil
+}
 
-	// Update operator stats
-	go operator.UpdateStats(rs.db)
+// RecordSessionEnd records the final earning for an ended session
+func (rs *RewardService) RecordSessionEnd(ctx context.Context, sessionID uuid.UUID) error {
+	var session models.Session
+	if err := rs.db.WithContext(ctx).Select("id", "disconnected_at").First(&session, sessionID).Error; err != nil {
+		return fmt.Errorf("session not found: %w", err)
+	}
+	if session.DisconnectedAt == nil {
+		return fmt.Errorf("session %s has not ended", sessionID)
+	}
+
+	return rs.RecordEarning(ctx, sessionID, *session.DisconnectedAt)
+}
 
+// CheckpointNode records earnings for a node's sessions. Active sessions are
+// settled up to the last multiple of interval, so long sessions accrue
+// earnings while they run. Sessions that ended within the last day without a
+// final earning, e.g. because recording failed at disconnect, are settled too.
+func (rs *RewardService) CheckpointNode(ctx context.Context, nodeID uuid.UUID, interval time.Duration) error {
+	var node models.VPNNode
+	if err := rs.db.WithContext(ctx).First(&node, nodeID).Error; err != nil {
+		return fmt.Errorf("node not found: %w", err)
+	}
+	if node.OperatorID == nil {
+		return nil
+	}
+
+	periodEnd := time.Now().Truncate(interval)
+
+	var active []uuid.UUID
+	if err := rs.db.WithContext(ctx).Model(&models.Session{}).
+		Where("node_id = ? AND status = ? AND connected_at < ?", nodeID, "active", periodEnd).
+		Pluck("id", &active).Error; err != nil {
+		return fmt.Errorf("failed to load active sessions: %w", err)
+	}
+
+	var ended []uuid.UUID
+	if err := rs.db.WithContext(ctx).Model(&models.Session{}).
+		Where("node_id = ? AND status <> ? AND disconnected_at > ?", nodeID, "active", time.Now().Add(-24*time.Hour)).
+		Where("NOT EXISTS (?)", rs.db.Model(&models.OperatorEarning{}).Select("1").
+			Where("operator_earnings.session_id = sessions.id AND operator_earnings.period_end = sessions.disconnected_at")).
+		Pluck("id", &ended).Error; err != nil {
+		return fmt.Errorf("failed to load ended sessions: %w", err)
+	}
+
+	var failed int
+	for _, sessionID := range active {
+		if err := rs.RecordEarning(ctx, sessionID, periodEnd); err != nil {
+			rs.log.Error("failed to checkpoint session earnings", "session_id", sessionID, "error", err)
+			failed++
+		}
+	}
+	for _, sessionID := range ended {
+		if err := rs.RecordSessionEnd(ctx, sessionID); err != nil {
+			rs.log.Error("failed to settle session earnings", "session_id", sessionID, "error", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to record earnings for %d sessions", failed)
+	}
 	return nil
 }
 
@@ -170,7 +299,8 @@ func (rs *RewardService) ConfirmEarnings(ctx context.Context, earningID uuid.UUI
 
 // ProcessPayouts processes pending payouts for operators
 func (rs *RewardService) ProcessPayouts(ctx context.Context, minPayoutAmount float64) error {
-	// Find operators with sufficient pending payouts
+	// Find candidate operators; the ledger balance is checked again when
+	// the payout is created
 	var operators []models.NodeOperator
 	err := rs.db.Where("pending_payout >= ? AND status = ?", minPayoutAmount, "active").
 		Find(&operators).Error
@@ -179,7 +309,7 @@ func (rs *RewardService) ProcessPayouts(ctx context.Context, minPayoutAmount flo
 	}
 
 	for _, operator := range operators {
-		if err := rs.createPayout(ctx, &operator); err != nil {
+		if err := rs.createPayout(ctx, &operator, ledger.FromUSD(minPayoutAmount)); err != nil {
 			rs.log.Error("failed to create payout",
 				"operator_id", operator.ID,
 				"error", err,
@@ -191,190 +321,141 @@ func (rs *RewardService) ProcessPayouts(ctx context.Context, minPayoutAmount flo
 	return nil
 }
 
-// createPayout creates a payout for an operator
-func (rs *RewardService) createPayout(ctx context.Context, operator *models.NodeOperator) error {
-	// Get crypto exchange rate
-	exchangeRate, cryptoAmount, err := rs.getCryptoConversion(operator.WalletType, operator.PendingPayout)
+// createPayout pays out an operator's whole payable ledger balance if it is
+// at least minAmount
+func (rs *RewardService) createPayout(ctx context.Context, operator *models.NodeOperator, minAmount ledger.Micros) error {
+	if rs.rates == nil {
+		return errors.New("exchange rates are not configured")
+	}
+
+	// Fetch the rate before locking anything, it may take a network call
+	rate, err := rs.rates.GetRate(ctx, operator.WalletType)
 	if err != nil {
 		return fmt.Errorf("failed to get exchange rate: %w", err)
 	}
 
-	// Create payout record
-	payout := models.OperatorPayout{
-		OperatorID:     operator.ID,
-		AmountUSD:      operator.PendingPayout,
-		CryptoAmount:   cryptoAmount,
-		CryptoCurrency: operator.WalletType,
-		ExchangeRate:   exchangeRate,
-		WalletAddress:  operator.WalletAddress,
-		Status:         "pending",
-		PayoutMethod:   "blockchain",
-	}
+	var payout models.OperatorPayout
+
+	err = rs.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Lock the operator so concurrent payouts see each other's entries
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(operator, operator.ID).Error; err != nil {
+			return fmt.Errorf("operator not found: %w", err)
+		}
+
+		payable, err := ledger.Balance(tx, ledger.OperatorPayable, operator.ID)
+		if err != nil {
+			return err
+		}
+		amount := -payable
+		if amount <= 0 || amount < minAmount {
+			return fmt.Errorf("payable balance %s is below the minimum payout of %s", amount, minAmount)
+		}
+
+		snapshot, err := pricing.RecordSnapshot(tx, rate)
+		if err != nil {
+			return err
+		}
 
-	if err := rs.db.Create(&payout).Error; err != nil {
+		// Create payout record
+		payout = models.OperatorPayout{
+			OperatorID:     operator.ID,
+			AmountUSD:      amount.USD(),
+			CryptoAmount:   rate.Convert(amount.USD()),
+			CryptoCurrency: operator.WalletType,
+			ExchangeRate:   rate.USD,
+			RateSnapshotID: &snapshot.ID,
+			WalletAddress:  operator.WalletAddress,
+			Status:         "pending",
+			PayoutMethod:   "blockchain",
+		}
+
+		if err := tx.Create(&payout).Error; err != nil {
+			return err
+		}
+
+		if err := ledger.PostPayoutInitiated(tx, &payout); err != nil {
+			return err
+		}
+
+		// The payout worker sends the transaction and tracks it on-chain
+		if err := tx.Create(&models.PayoutJob{
+			PayoutID:  payout.ID,
+			State:     models.PayoutJobQueued,
+			NextRunAt: time.Now(),
+		}).Error; err != nil {
+			return fmt.Errorf("failed to queue payout: %w", err)
+		}
+
+		return ledger.RefreshOperator(tx, operator.ID)
+	})
+	if err != nil {
 		return err
 	}
 
 	rs.log.Info("payout created",
 		"operator_id", operator.ID,
 		"amount_usd", payout.AmountUSD,
-		"crypto_amount", cryptoAmount,
+		"crypto_amount", payout.CryptoAmount,
 		"currency", operator.WalletType,
+		"rate_source", rate.Source,
 	)
 
-	// In production, this would trigger actual blockchain transaction
-	// For now, we'll mark it as processing
-	go rs.executeBlockchainTransaction(ctx, &payout)
-
 	return nil
 }
 
-// executeBlockchainTransaction executes the actual blockchain transaction
-func (rs *RewardService) executeBlockchainTransaction(ctx context.Context, payout *models.OperatorPayout) {
-	// Update status to processing
-	rs.db.Model(payout).Updates(map[string]interface{}{
-		"status":       "processing",
-		"processed_at": time.Now(),
+// completePayout marks a payout completed and settles it in the ledger. It
+// must run in the transaction that finishes the payout's job.
+func completePayout(tx *gorm.DB, payout *models.OperatorPayout, fee float64) error {
+	now := time.Now()
+	result := tx.Model(payout).Where("status <> ?", "completed").Updates(map[string]interface{}{
+		"status":          "completed",
+		"completed_at":    &now,
+		"transaction_fee": fee,
 	})
-
-	rs.log.Info("executing blockchain transaction",
-		"payout_id", payout.ID,
-		"wallet_type", payout.CryptoCurrency,
-		"amount_usd", payout.AmountUSD,
-		"wallet_address", payout.WalletAddress,
-	)
-
-	// Execute blockchain transaction
-	var tx *blockchain.Transaction
-	var err error
-
-	if rs.blockchain != nil {
-		// Use real blockchain service
-		tx, err = rs.blockchain.SendTransaction(ctx, payout.CryptoCurrency, payout.WalletAddress, payout.AmountUSD)
-		if err != nil {
-			rs.log.Error("blockchain transaction failed",
-				"payout_id", payout.ID,
-				"error", err,
-			)
-			rs.db.Model(payout).Updates(map[string]interface{}{
-				"status":         "failed",
-				"failure_reason": err.Error(),
-			})
-			return
-		}
-	} else {
-		// Fallback to mock transaction if blockchain service is not configured
-		rs.log.Warn("blockchain service not configured, using mock transaction", "payout_id", payout.ID)
-		time.Sleep(2 * time.Second)
-		tx = &blockchain.Transaction{
-			TxHash:         fmt.Sprintf("MOCK_%s", uuid.New().String()[:16]),
-			BlockchainType: payout.CryptoCurrency,
-			To:             payout.WalletAddress,
-			Status:         "pending",
-		}
+	if result.Error != nil {
+		return result.Error
 	}
-
-	// Update payout with transaction hash
-	rs.db.Model(payout).Updates(map[string]interface{}{
-		"transaction_hash": tx.TxHash,
-		"status":           "processing",
-	})
-
-	// Wait for transaction confirmation (simplified - in production, use webhooks or polling)
-	if rs.blockchain != nil {
-		// Poll for transaction status
-		maxAttempts := 30 // 5 minutes with 10-second intervals
-		for i := 0; i < maxAttempts; i++ {
-			time.Sleep(10 * time.Second)
-
-			status, err := rs.blockchain.GetTransactionStatus(ctx, payout.CryptoCurrency, tx.TxHash)
-			if err != nil {
-				rs.log.Warn("failed to check transaction status",
-					"payout_id", payout.ID,
-					"tx_hash", tx.TxHash,
-					"attempt", i+1,
-					"error", err,
-				)
-				continue
-			}
-
-			if status.Status == "confirmed" {
-				rs.log.Info("transaction confirmed",
-					"payout_id", payout.ID,
-					"tx_hash", tx.TxHash,
-					"confirmations", status.Confirmations,
-				)
-				break
-			} else if status.Status == "failed" {
-				err := fmt.Errorf("transaction failed: %s", status.ErrorMessage)
-				rs.log.Error("transaction failed on blockchain",
-					"payout_id", payout.ID,
-					"tx_hash", tx.TxHash,
-					"error", err,
-				)
-				rs.db.Model(payout).Updates(map[string]interface{}{
-					"status":         "failed",
-					"failure_reason": status.ErrorMessage,
-				})
-				return
-			}
-		}
+	if result.RowsAffected == 0 {
+		return nil // Already completed
 	}
 
-	// Mark payout as completed
-	now := time.Now()
-	err = rs.db.Model(payout).Updates(map[string]interface{}{
-		"status":       "completed",
-		"completed_at": &now,
-	}).Error
+	if err := ledger.PostPayoutCompleted(tx, payout); err != nil {
+		return err
+	}
 
-	if err != nil {
-		rs.log.Error("failed to update payout status", "payout_id", payout.ID, "error", err)
-		return
+	if err := tx.Model(&models.NodeOperator{}).Where("id = ?", payout.OperatorID).
+		UpdateColumn("last_payout_at", &now).Error; err != nil {
+		return err
 	}
 
-	// Update operator stats
-	var operator models.NodeOperator
-	if err := rs.db.First(&operator, payout.OperatorID).Error; err == nil {
-		rs.db.Model(&operator).Updates(map[string]interface{}{
-			"pending_payout": gorm.Expr("pending_payout - ?", payout.AmountUSD),
-			"last_payout_at": &now,
-		})
-
-		// Mark earnings as paid
-		rs.db.Model(&models.OperatorEarning{}).
-			Where("operator_id = ? AND status = ?", operator.ID, "confirmed").
-			Updates(map[string]interface{}{
-				"status":  "paid",
-				"paid_at": &now,
-			})
-	}
-
-	rs.log.Info("payout completed successfully",
-		"operator_id", payout.OperatorID,
-		"tx_hash", tx.TxHash,
-		"amount_usd", payout.AmountUSD,
-		"crypto_amount", payout.CryptoAmount,
-	)
+	// Mark the earnings included in the payout as paid
+	return tx.Model(&models.OperatorEarning{}).
+		Where("operator_id = ? AND status IN ? AND created_at <= ?", payout.OperatorID, []string{"pending", "confirmed"}, payout.CreatedAt).
+		Updates(map[string]interface{}{
+			"status":  "paid",
+			"paid_at": &now,
+		}).Error
 }
 
-// getCryptoConversion gets the current exchange rate and calculates crypto amount
-func (rs *RewardService) getCryptoConversion(cryptoType string, amountUSD float64) (rate float64, cryptoAmount float64, err error) {
-	// TODO: Integrate with real price API (CoinGecko, CoinMarketCap, etc.)
-	// For now, using mock rates
-	rates := map[string]float64{
-		"ethereum": 2000.0,  // 1 ETH = $2000
-		"bitcoin":  40000.0, // 1 BTC = $40000
-		"litecoin": 100.0,   // 1 LTC = $100
+// failPayout marks a payout failed and returns its amount to the operator's
+// payable balance. It must run in the transaction that finishes the payout's job.
+func failPayout(tx *gorm.DB, payout *models.OperatorPayout, reason string) error {
+	result := tx.Model(payout).Where("status NOT IN ?", []string{"completed", "failed"}).Updates(map[string]interface{}{
+		"status":         "failed",
+		"failure_reason": reason,
+	})
+	if result.Error != nil {
+		return result.Error
 	}
-
-	rate, ok := rates[cryptoType]
-	if !ok {
-		return 0, 0, fmt.Errorf("unsupported crypto type: %s", cryptoType)
+	if result.RowsAffected == 0 {
+		return nil // Already settled
 	}
 
-	cryptoAmount = amountUSD / rate
-	return rate, cryptoAmount, nil
+	payout.FailureReason = reason
+	if err := ledger.PostPayoutFailed(tx, payout); err != nil {
+		return err
+	}
+	return ledger.RefreshOperator(tx, payout.OperatorID)
 }
 
 // calculateSessionQuality calculates quality score for a session
@@ -390,7 +471,7 @@ func calculateSessionQuality(session *models.Session) float64 {
 	}
 
 	// Deduct for short sessions (prefer stability)
-	duration := time.Since(session.ConnectedAt)
+	duration := session.Duration()
 	if duration < 5*time.Minute {
 		score -= 20.0
 	}
@@ -468,27 +549,30 @@ func (rs *RewardService) GetOperatorStats(ctx context.Context, operatorID uuid.U
 		return nil, err
 	}
 
+	// Balances come from the ledger, not the cached operator columns
+	balances, err := ledger.GetOperatorBalances(rs.db, operatorID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get earnings breakdown
-	var earningsToday, earningsWeek, earningsMonth float64
 	now := time.Now()
 	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	weekAgo := today.AddDate(0, 0, -7)
 	monthAgo := today.AddDate(0, -1, 0)
 
-	rs.db.Model(&models.OperatorEarning{}).
-		Where("operator_id = ? AND created_at >= ?", operatorID, today).
-		Select("COALESCE(SUM(amount_usd), 0)").
-		Scan(&earningsToday)
-
-	rs.db.Model(&models.OperatorEarning{}).
-		Where("operator_id = ? AND created_at >= ?", operatorID, weekAgo).
-		Select("COALESCE(SUM(amount_usd), 0)").
-		Scan(&earningsWeek)
-
-	rs.db.Model(&models.OperatorEarning{}).
-		Where("operator_id = ? AND created_at >= ?", operatorID, monthAgo).
-		Select("COALESCE(SUM(amount_usd), 0)").
-		Scan(&earningsMonth)
+	earningsToday, err := ledger.EarnedSince(rs.db, operatorID, today)
+	if err != nil {
+		return nil, err
+	}
+	earningsWeek, err := ledger.EarnedSince(rs.db, operatorID, weekAgo)
+	if err != nil {
+		return nil, err
+	}
+	earningsMonth, err := ledger.EarnedSince(rs.db, operatorID, monthAgo)
+	if err != nil {
+		return nil, err
+	}
 
 	// Get current tier
 	tier, _ := operator.GetEligibleTier(rs.db)
@@ -506,11 +590,13 @@ func (rs *RewardService) GetOperatorStats(ctx context.Context, operatorID uuid.U
 
 	stats := map[string]interface{}{
 		"operator_id":       operator.ID,
-		"total_earned":      operator.TotalEarned,
-		"pending_payout":    operator.PendingPayout,
-		"earnings_today":    earningsToday,
-		"earnings_week":     earningsWeek,
-		"earnings_month":    earningsMonth,
+		"total_earned":      balances.Earned.USD(),
+		"pending_payout":    balances.Payable.USD(),
+		"payout_in_flight":  balances.InFlight.USD(),
+		"total_paid":        balances.Paid.USD(),
+		"earnings_today":    earningsToday.USD(),
+		"earnings_week":     earningsWeek.USD(),
+		"earnings_month":    earningsMonth.USD(),
 		"active_nodes":      operator.ActiveNodesCount,
 		"total_bandwidth":   operator.TotalBandwidthGB,
 		"reputation_score":  operator.ReputationScore,
@@ -0,0 +1,424 @@
+package rewards
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/blockchain"
+	"github.com/nikola43/aureo-vpn/pkg/config"
+	"github.com/nikola43/aureo-vpn/pkg/database"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// TransactionSender signs and broadcasts payout transactions, with amounts
+// in units of the wallet type's coin, and reports their status. Broadcasting
+// a signed transaction again must be harmless. blockchain.Service implements
+// it.
+type TransactionSender interface {
+	SignTransaction(ctx context.Context, walletType, toAddress string, amount float64) (*blockchain.SignedTransaction, error)
+	BroadcastTransaction(ctx context.Context, walletType, raw string) error
+	GetTransactionStatus(ctx context.Context, walletType, txHash string) (*blockchain.Transaction, error)
+}
+
+// PayoutWorker pays operators on a schedule and drives every queued payout
+// through sending and on-chain confirmation. Jobs live in the database and
+// are leased, so several workers can run and a restarted worker resumes
+// where the previous one stopped.
+type PayoutWorker struct {
+	db      *gorm.DB
+	log     *logger.Logger
+	rewards *RewardService
+	chain   TransactionSender
+	cfg     config.PayoutConfig
+	owner   string
+}
+
+// NewPayoutWorker creates a payout worker. Without a chain no transactions
+// can be sent or confirmed, so jobs stay where they are until a worker with
+// one picks them up.
+func NewPayoutWorker(log *logger.Logger, rewards *RewardService, chain TransactionSender, cfg config.PayoutConfig) *PayoutWorker {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 30 * time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.RetryBaseDelay <= 0 {
+		cfg.RetryBaseDelay = time.Minute
+	}
+	if cfg.RetryMaxDelay < cfg.RetryBaseDelay {
+		cfg.RetryMaxDelay = cfg.RetryBaseDelay
+	}
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = 5 * time.Minute
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &PayoutWorker{
+		db:      database.GetDB(),
+		log:     log,
+		rewards: rewards,
+		chain:   chain,
+		cfg:     cfg,
+		owner:   fmt.Sprintf("%s/%s", hostname, uuid.NewString()[:8]),
+	}
+}
+
+// Run creates payouts every Interval and processes due jobs every
+// PollInterval until ctx is cancelled
+func (w *PayoutWorker) Run(ctx context.Context) {
+	pollTicker := time.NewTicker(w.cfg.PollInterval)
+	defer pollTicker.Stop()
+
+	var payoutTick <-chan time.Time
+	if w.cfg.Interval > 0 {
+		payoutTicker := time.NewTicker(w.cfg.Interval)
+		defer payoutTicker.Stop()
+		payoutTick = payoutTicker.C
+	}
+
+	w.log.Info("payout worker started", "owner", w.owner, "interval", w.cfg.Interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.log.Info("payout worker stopped", "owner", w.owner)
+			return
+		case <-payoutTick:
+			if err := w.rewards.ProcessPayouts(ctx, w.cfg.MinAmountUSD); err != nil {
+				w.log.Error("failed to create payouts", "error", err)
+			}
+		case <-pollTicker.C:
+			if _, err := w.RunOnce(ctx); err != nil {
+				w.log.Error("failed to process payout jobs", "error", err)
+			}
+		}
+	}
+}
+
+// RunOnce processes every job that is currently due and returns how many
+// were processed. Jobs rescheduled during the pass wait for the next one.
+func (w *PayoutWorker) RunOnce(ctx context.Context) (int, error) {
+	if w.chain == nil {
+		w.log.Warn("blockchain service not configured, payouts stay queued")
+		return 0, nil
+	}
+
+	dueBy := time.Now()
+	processed := 0
+	for ctx.Err() == nil {
+		job, err := w.claim(ctx, dueBy)
+		if err != nil {
+			return processed, err
+		}
+		if job == nil {
+			return processed, nil
+		}
+
+		w.process(ctx, job)
+		processed++
+	}
+	return processed, ctx.Err()
+}
+
+// claim leases the next job due by dueBy. Interrupted sends are claimed as
+// soon as their lease expires so they can be flagged for review.
+func (w *PayoutWorker) claim(ctx context.Context, dueBy time.Time) (*models.PayoutJob, error) {
+	now := time.Now()
+
+	var job models.PayoutJob
+	err := w.db.WithContext(ctx).
+		Where("(state IN ? AND next_run_at <= ?) OR state = ?",
+			[]string{models.PayoutJobQueued, models.PayoutJobSubmitted}, dueBy, models.PayoutJobSending).
+		Where("lease_expires_at IS NULL OR lease_expires_at < ?", now).
+		Order("next_run_at").
+		First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payout jobs: %w", err)
+	}
+
+	// Take the lease only if no other worker took it in the meantime
+	leaseExpiresAt := now.Add(w.cfg.LeaseDuration)
+	result := w.db.WithContext(ctx).Model(&models.PayoutJob{}).
+		Where("id = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)", job.ID, now).
+		Updates(map[string]interface{}{
+			"lease_owner":      w.owner,
+			"lease_expires_at": leaseExpiresAt,
+		})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to lease payout job: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return w.claim(ctx, dueBy)
+	}
+
+	job.LeaseOwner = w.owner
+	job.LeaseExpiresAt = &leaseExpiresAt
+	return &job, nil
+}
+
+// process advances a leased job by one step
+func (w *PayoutWorker) process(ctx context.Context, job *models.PayoutJob) {
+	var payout models.OperatorPayout
+	if err := w.db.WithContext(ctx).First(&payout, job.PayoutID).Error; err != nil {
+		w.log.Error("payout not found for job", "job_id", job.ID, "payout_id", job.PayoutID, "error", err)
+		w.finish(job, map[string]interface{}{
+			"state":      models.PayoutJobFailed,
+			"last_error": "payout not found",
+		}, nil)
+		return
+	}
+
+	switch job.State {
+	case models.PayoutJobQueued:
+		w.send(ctx, job, &payout)
+	case models.PayoutJobSending:
+		if job.SignedTransaction != "" {
+			// The previous worker stopped while broadcasting; the stored
+			// transaction can safely be broadcast again
+			w.send(ctx, job, &payout)
+			return
+		}
+		// Jobs left sending by earlier versions have no stored transaction.
+		// It may have been broadcast, so sending again could pay twice.
+		w.log.Error("payout send was interrupted, manual review required",
+			"payout_id", payout.ID,
+			"attempts", job.Attempts,
+		)
+		w.finish(job, map[string]interface{}{
+			"state":      models.PayoutJobReview,
+			"last_error": "send interrupted; verify on-chain before retrying",
+		}, nil)
+	case models.PayoutJobSubmitted:
+		w.poll(ctx, job, &payout)
+	}
+}
+
+// send signs the payout transaction, unless an earlier attempt already did,
+// and broadcasts it. The signed transaction is stored before its first
+// broadcast and every retry broadcasts that same transaction, so a send that
+// fails after reaching the network cannot pay the operator twice.
+func (w *PayoutWorker) send(ctx context.Context, job *models.PayoutJob, payout *models.OperatorPayout) {
+	job.Attempts++
+
+	if job.SignedTransaction == "" {
+		// The crypto amount was priced at the payout's rate snapshot
+		signed, err := w.chain.SignTransaction(ctx, payout.CryptoCurrency, payout.WalletAddress, payout.CryptoAmount)
+		if err != nil {
+			// Nothing left the worker, so the payout can be retried or failed
+			w.log.Error("failed to sign payout transaction",
+				"payout_id", payout.ID,
+				"attempt", job.Attempts,
+				"error", err,
+			)
+			w.retry(job, payout, err, true)
+			return
+		}
+		job.SignedTransaction = signed.Raw
+		job.TransactionHash = signed.TxHash
+	}
+
+	// Store the transaction before broadcasting it, so a crash mid-send is
+	// detectable and resumable
+	result := w.db.Model(&models.PayoutJob{}).
+		Where("id = ? AND lease_owner = ?", job.ID, w.owner).
+		Updates(map[string]interface{}{
+			"state":              models.PayoutJobSending,
+			"attempts":           job.Attempts,
+			"signed_transaction": job.SignedTransaction,
+			"transaction_hash":   job.TransactionHash,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		w.log.Error("failed to start payout send", "payout_id", payout.ID, "error", result.Error)
+		return
+	}
+	w.db.Model(payout).Updates(map[string]interface{}{
+		"status":           "processing",
+		"processed_at":     time.Now(),
+		"transaction_hash": job.TransactionHash,
+	})
+
+	w.log.Info("broadcasting payout transaction",
+		"payout_id", payout.ID,
+		"wallet_type", payout.CryptoCurrency,
+		"amount_usd", payout.AmountUSD,
+		"crypto_amount", payout.CryptoAmount,
+		"wallet_address", payout.WalletAddress,
+		"tx_hash", job.TransactionHash,
+		"attempt", job.Attempts,
+	)
+
+	if err := w.chain.BroadcastTransaction(ctx, payout.CryptoCurrency, job.SignedTransaction); err != nil {
+		// The transaction may have reached the network anyway, so the
+		// payout is never failed from here
+		w.log.Error("failed to broadcast payout transaction",
+			"payout_id", payout.ID,
+			"tx_hash", job.TransactionHash,
+			"attempt", job.Attempts,
+			"error", err,
+		)
+		w.retry(job, payout, err, false)
+		return
+	}
+
+	w.finish(job, map[string]interface{}{
+		"state":       models.PayoutJobSubmitted,
+		"next_run_at": time.Now().Add(w.cfg.PollInterval),
+		"last_error":  "",
+	}, nil)
+}
+
+// retry schedules another send attempt after a failed one. Once the attempts
+// are used up the payout fails if nothing was signed yet; a signed
+// transaction may be on the network, so its job goes to review instead.
+func (w *PayoutWorker) retry(job *models.PayoutJob, payout *models.OperatorPayout, sendErr error, unsigned bool) {
+	if job.Attempts < w.cfg.MaxAttempts {
+		w.finish(job, map[string]interface{}{
+			"state":       models.PayoutJobQueued,
+			"attempts":    job.Attempts,
+			"next_run_at": time.Now().Add(w.backoff(job.Attempts)),
+			"last_error":  sendErr.Error(),
+		}, nil)
+		return
+	}
+
+	reason := fmt.Sprintf("giving up after %d attempts: %v", job.Attempts, sendErr)
+	if !unsigned {
+		w.log.Error("payout transaction could not be broadcast, manual review required",
+			"payout_id", payout.ID,
+			"tx_hash", job.TransactionHash,
+		)
+		w.finish(job, map[string]interface{}{
+			"state":      models.PayoutJobReview,
+			"attempts":   job.Attempts,
+			"last_error": reason + "; verify on-chain before retrying",
+		}, nil)
+		return
+	}
+
+	w.finish(job, map[string]interface{}{
+		"state":      models.PayoutJobFailed,
+		"attempts":   job.Attempts,
+		"last_error": reason,
+	}, func(tx *gorm.DB) error {
+		return failPayout(tx, payout, reason)
+	})
+}
+
+// poll checks a submitted transaction and settles the payout once it has
+// enough confirmations, at least one
+func (w *PayoutWorker) poll(ctx context.Context, job *models.PayoutJob, payout *models.OperatorPayout) {
+	required := w.cfg.Confirmations[payout.CryptoCurrency]
+	if required < 1 {
+		required = 1
+	}
+
+	status, err := w.chain.GetTransactionStatus(ctx, payout.CryptoCurrency, job.TransactionHash)
+	if err != nil {
+		w.log.Warn("failed to check transaction status",
+			"payout_id", payout.ID,
+			"tx_hash", job.TransactionHash,
+			"error", err,
+		)
+		w.finish(job, map[string]interface{}{
+			"next_run_at": time.Now().Add(w.cfg.PollInterval),
+			"last_error":  err.Error(),
+		}, nil)
+		return
+	}
+
+	switch {
+	case status.Status == "failed":
+		w.log.Error("transaction failed on blockchain",
+			"payout_id", payout.ID,
+			"tx_hash", job.TransactionHash,
+			"error", status.ErrorMessage,
+		)
+		reason := "transaction failed: " + status.ErrorMessage
+		w.finish(job, map[string]interface{}{
+			"state":      models.PayoutJobFailed,
+			"last_error": reason,
+		}, func(tx *gorm.DB) error {
+			return failPayout(tx, payout, reason)
+		})
+
+	case status.Status == "confirmed" && status.Confirmations >= required:
+		var fee float64
+		if status.Fee != nil {
+			fee, _ = status.Fee.Float64()
+		}
+
+		w.finish(job, map[string]interface{}{
+			"state":         models.PayoutJobCompleted,
+			"confirmations": status.Confirmations,
+		}, func(tx *gorm.DB) error {
+			return completePayout(tx, payout, fee)
+		})
+
+		w.log.Info("payout completed successfully",
+			"operator_id", payout.OperatorID,
+			"payout_id", payout.ID,
+			"tx_hash", job.TransactionHash,
+			"confirmations", status.Confirmations,
+			"amount_usd", payout.AmountUSD,
+			"crypto_amount", payout.CryptoAmount,
+		)
+
+	default:
+		// Still pending or waiting for more confirmations
+		w.finish(job, map[string]interface{}{
+			"confirmations": status.Confirmations,
+			"next_run_at":   time.Now().Add(w.cfg.PollInterval),
+		}, nil)
+	}
+}
+
+// finish applies updates to the job and releases its lease, together with
+// any payout changes in apply, in one transaction. Nothing is written if
+// the lease has been lost to another worker.
+func (w *PayoutWorker) finish(job *models.PayoutJob, updates map[string]interface{}, apply func(tx *gorm.DB) error) {
+	updates["lease_owner"] = ""
+	updates["lease_expires_at"] = nil
+
+	err := w.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.PayoutJob{}).
+			Where("id = ? AND lease_owner = ?", job.ID, w.owner).
+			Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("lease on payout job %s was lost", job.ID)
+		}
+
+		if apply != nil {
+			return apply(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		w.log.Error("failed to update payout job", "job_id", job.ID, "payout_id", job.PayoutID, "error", err)
+	}
+}
+
+// backoff returns the exponential delay before the given retry
+func (w *PayoutWorker) backoff(attempt int) time.Duration {
+	delay := w.cfg.RetryBaseDelay
+	for i := 1; i < attempt && delay < w.cfg.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.cfg.RetryMaxDelay {
+		delay = w.cfg.RetryMaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,552 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/database"
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Client configuration defaults handed out with every WireGuard session
+const (
+	DefaultDNS                 = "1.1.1.1,8.8.8.8"
+	DefaultMTU                 = 1420
+	DefaultPersistentKeepalive = 25
+)
+
+// DefaultClientAllowedIPs routes all IPv4 traffic through the tunnel. Split
+// routing (two /1 halves) is used instead of 0.0.0.0/0 to avoid clobbering
+// the default route on some systems.
+var DefaultClientAllowedIPs = []string{"0.0.0.0/1", "128.0.0.0/1"}
+
+// ErrSessionNotActive is returned when disconnecting a session that has already ended
+var ErrSessionNotActive = apperrors.New(apperrors.ErrCodeConflict, "Session is not active", http.StatusConflict)
+
+// Device limit policies: what happens when a user at their plan's device
+// limit creates another session
+const (
+	DeviceLimitReject      = "reject"       // The new session is refused
+	DeviceLimitEvictOldest = "evict_oldest" // The user's oldest session is ended
+)
+
+// ErrPublicKeyInUse is returned when another user's active session uses the same key
+var ErrPublicKeyInUse = apperrors.New(apperrors.ErrCodeConflict, "Public key is already in use", http.StatusConflict)
+
+// PeerController provisions WireGuard peers on the node that owns a session
+type PeerController interface {
+	AddPeer(ctx context.Context, node *models.VPNNode, peer wireguard.PeerConfig) error
+	RemovePeer(ctx context.Context, node *models.VPNNode, publicKey string) error
+}
+
+// EarningsRecorder settles operator earnings for a session once it has ended
+type EarningsRecorder interface {
+	RecordSessionEnd(ctx context.Context, sessionID uuid.UUID) error
+}
+
+// Entitlements checks that a user's plan allows a new session and returns
+// the plan, whose device limit is enforced by Create
+type Entitlements interface {
+	CheckSession(ctx context.Context, userID uuid.UUID, protocol string, obfuscated bool) (*models.Plan, error)
+}
+
+// Service manages the VPN session lifecycle: node selection, tunnel IP
+// allocation, persistence and peer provisioning. It is shared by the API
+// gateway and the VPN node so both follow exactly the same rules.
+type Service struct {
+	db           *gorm.DB
+	log          *logger.Logger
+	peers        PeerController
+	earnings     EarningsRecorder
+	plans        Entitlements
+	devicePolicy string
+}
+
+// NewService creates a new session service. peers may be nil, in which case
+// sessions are only persisted and the owning node picks them up on its next
+// peer sync. earnings may be nil when no operator earnings are recorded, and
+// plans may be nil when sessions are not subject to plan limits.
+// devicePolicy is DeviceLimitReject or DeviceLimitEvictOldest; empty rejects.
+func NewService(log *logger.Logger, peers PeerController, earnings EarningsRecorder, plans Entitlements, devicePolicy string) *Service {
+	if devicePolicy == "" {
+		devicePolicy = DeviceLimitReject
+	}
+	return &Service{
+		db:           database.GetDB(),
+		log:          log,
+		peers:        peers,
+		earnings:     earnings,
+		plans:        plans,
+		devicePolicy: devicePolicy,
+	}
+}
+
+// CreateRequest represents a session creation request
+type CreateRequest struct {
+	NodeID        *uuid.UUID `json:"node_id,omitempty"`
+	Protocol      string     `json:"protocol"`
+	Country       string     `json:"country,omitempty"`
+	PublicKey     string     `json:"public_key,omitempty"` // Client-generated key; a keypair is generated when empty
+	DeviceType    string     `json:"device_type,omitempty"`
+	OSType        string     `json:"os_type,omitempty"`
+	ClientVersion string     `json:"client_version,omitempty"`
+	Obfuscated    bool       `json:"obfuscated,omitempty"`
+	ClientIP      string     `json:"-"`
+}
+
+// ClientConfig holds everything a client needs to bring up its tunnel
+type ClientConfig struct {
+	ClientIP        string `json:"client_ip"`
+	DNS             string `json:"dns"`
+	ServerPublicKey string `json:"server_public_key"`
+	ServerEndpoint  string `json:"server_endpoint"`
+	AllowedIPs      string `json:"allowed_ips"`
+	MTU             int    `json:"mtu"`
+	ClientConfig    string `json:"client_config"` // Rendered wg-quick file
+}
+
+// CreateResult is returned after a session has been created
+type CreateResult struct {
+	Session *models.Session `json:"session"`
+	Node    *models.VPNNode `json:"node"`
+	Config  *ClientConfig   `json:"config"`
+	Evicted []EvictedDevice `json:"evicted,omitempty"` // Sessions ended to stay within the device limit
+}
+
+// EvictedDevice identifies a session that was ended to make room for a new
+// one, so the client can tell the user which device was signed out
+type EvictedDevice struct {
+	SessionID   uuid.UUID `json:"session_id"`
+	NodeID      uuid.UUID `json:"node_id"`
+	DeviceType  string    `json:"device_type,omitempty"`
+	OSType      string    `json:"os_type,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// SelectNode returns the least loaded online node supporting the protocol,
+// optionally restricted to a country code
+func (s *Service) SelectNode(protocol, country string) (*models.VPNNode, error) {
+	query := s.db.Where("is_active = ? AND status = ?", true, "online")
+
+	if country != "" {
+		query = query.Where("country_code = ?", country)
+	}
+
+	if protocol == "wireguard" {
+		query = query.Where("supports_wire_guard = ?", true)
+	} else if protocol == "openvpn" {
+		query = query.Where("supports_open_vpn = ?", true)
+	}
+
+	var node models.VPNNode
+	if err := query.Order("load_score ASC, latency ASC").First(&node).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.ErrNodeUnavailable.WithInternal(err)
+		}
+		return nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+
+	return &node, nil
+}
+
+// Create allocates a tunnel IP on the selected node, persists the session and
+// provisions the peer on the node
+func (s *Service) Create(ctx context.Context, userID uuid.UUID, req CreateRequest) (*CreateResult, error) {
+	if req.Protocol == "" {
+		req.Protocol = "wireguard"
+	}
+	if req.Protocol != "wireguard" {
+		return nil, apperrors.ErrBadRequest.WithInternal(fmt.Errorf("unsupported protocol: %s", req.Protocol))
+	}
+
+	var plan *models.Plan
+	if s.plans != nil {
+		var err error
+		if plan, err = s.plans.CheckSession(ctx, userID, req.Protocol, req.Obfuscated); err != nil {
+			return nil, err
+		}
+	}
+
+	// Use the client's key when provided, otherwise generate a keypair
+	var privateKey string
+	publicKey := req.PublicKey
+	if publicKey != "" {
+		if err := wireguard.ValidatePublicKey(publicKey); err != nil {
+			return nil, apperrors.ErrInvalidInput.WithInternal(err)
+		}
+		if err := s.releaseKey(ctx, userID, publicKey); err != nil {
+			return nil, err
+		}
+	} else {
+		keyPair, err := wireguard.GenerateKeyPair()
+		if err != nil {
+			return nil, apperrors.ErrInternal.WithInternal(fmt.Errorf("failed to generate keypair: %w", err))
+		}
+		publicKey = keyPair.PublicKey
+		privateKey = keyPair.PrivateKey
+	}
+
+	nodeID := req.NodeID
+	if nodeID == nil {
+		best, err := s.SelectNode(req.Protocol, req.Country)
+		if err != nil {
+			return nil, err
+		}
+		nodeID = &best.ID
+	}
+
+	var node models.VPNNode
+	session := &models.Session{
+		UserID:            userID,
+		NodeID:            *nodeID,
+		Protocol:          req.Protocol,
+		ClientIP:          req.ClientIP,
+		PublicKey:         publicKey,
+		PrivateKey:        privateKey, // Encrypted in production
+		Status:            "active",
+		ConnectedAt:       time.Now(),
+		LastKeepalive:     time.Now(),
+		KillSwitchEnabled: true,
+		DNSLeakProtection: true,
+		ClientVersion:     req.ClientVersion,
+		DeviceType:        req.DeviceType,
+		OSType:            req.OSType,
+	}
+
+	// Lock the user row so the device limit holds across concurrent requests on
+	// any node, then the node row so allocations on the same node are
+	// serialized. Locks are always taken in this order.
+	var evicted []models.Session
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if plan != nil && plan.DeviceLimit > 0 {
+			var err error
+			if evicted, err = s.enforceDeviceLimit(tx, userID, plan); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&node, *nodeID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apperrors.ErrNodeNotFound.WithInternal(err)
+			}
+			return apperrors.ErrDatabase.WithInternal(err)
+		}
+
+		if !node.IsActive || node.Status != "online" || !node.SupportsWireGuard || node.PublicKey == "" {
+			return apperrors.ErrNodeUnavailable.WithInternal(fmt.Errorf("node %s is not accepting sessions", node.ID))
+		}
+
+		if node.CurrentConnections >= node.MaxConnections {
+			return apperrors.ErrNodeAtCapacity
+		}
+
+		var usedIPs []string
+		if err := tx.Model(&models.Session{}).
+			Where("node_id = ? AND status = ?", node.ID, "active").
+			Pluck("tunnel_ip", &usedIPs).Error; err != nil {
+			return apperrors.ErrDatabase.WithInternal(err)
+		}
+
+		tunnelIP, err := wireguard.AllocateClientIP(node.InternalIP+"/24", usedIPs)
+		if err != nil {
+			return apperrors.ErrNodeAtCapacity.WithInternal(err)
+		}
+		session.TunnelIP = tunnelIP
+
+		if err := tx.Create(session).Error; err != nil {
+			return apperrors.ErrDatabase.WithInternal(err)
+		}
+
+		return tx.Model(&node).UpdateColumn("current_connections", gorm.Expr("current_connections + ?", 1)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CreateResult{Session: session, Node: &node}
+	for i := range evicted {
+		s.evicted(ctx, &evicted[i])
+		result.Evicted = append(result.Evicted, EvictedDevice{
+			SessionID:   evicted[i].ID,
+			NodeID:      evicted[i].NodeID,
+			DeviceType:  evicted[i].DeviceType,
+			OSType:      evicted[i].OSType,
+			ConnectedAt: evicted[i].ConnectedAt,
+		})
+	}
+
+	// Push the peer to the owning node
+	peer := wireguard.PeerConfig{
+		PublicKey:           publicKey,
+		AllowedIPs:          []string{HostAddress(session.TunnelIP)},
+		PersistentKeepalive: DefaultPersistentKeepalive,
+	}
+
+	if s.peers != nil {
+		if err := s.peers.AddPeer(ctx, &node, peer); err != nil {
+			s.rollback(session)
+			return nil, apperrors.ErrNodeUnavailable.WithInternal(fmt.Errorf("failed to add peer: %w", err))
+		}
+	}
+
+	config, err := BuildClientConfig(&node, session)
+	if err != nil {
+		s.End(ctx, session, "terminated")
+		return nil, apperrors.ErrInternal.WithInternal(err)
+	}
+
+	s.log.LogVPN("session_created", session.ID, userID, node.ID, session.Protocol)
+
+	result.Config = config
+	return result, nil
+}
+
+// enforceDeviceLimit locks the user and checks their active sessions against
+// the plan's device limit. Under DeviceLimitEvictOldest the oldest sessions
+// are ended to make room and returned; their peers are removed by evicted
+// once the transaction commits.
+func (s *Service) enforceDeviceLimit(tx *gorm.DB, userID uuid.UUID, plan *models.Plan) ([]models.Session, error) {
+	var user models.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.ErrUserNotFound.WithInternal(err)
+		}
+		return nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+
+	var active []models.Session
+	if err := tx.Where("user_id = ? AND status = ?", userID, "active").
+		Order("connected_at ASC").Find(&active).Error; err != nil {
+		return nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+
+	if len(active) < plan.DeviceLimit {
+		return nil, nil
+	}
+	if s.devicePolicy != DeviceLimitEvictOldest {
+		return nil, plans.DeviceLimitReached(plan)
+	}
+
+	now := time.Now()
+	var evicted []models.Session
+	for _, sess := range active[:len(active)-plan.DeviceLimit+1] {
+		result := tx.Model(&models.Session{}).
+			Where("id = ? AND status = ?", sess.ID, "active").
+			Updates(map[string]interface{}{
+				"status":          "evicted",
+				"disconnected_at": &now,
+			})
+		if result.Error != nil {
+			return nil, apperrors.ErrDatabase.WithInternal(result.Error)
+		}
+		// Sessions ended concurrently have already released their peer
+		if result.RowsAffected == 0 {
+			continue
+		}
+		sess.Status = "evicted"
+		sess.DisconnectedAt = &now
+		evicted = append(evicted, sess)
+	}
+	return evicted, nil
+}
+
+// evicted removes the peer of a session ended by the device limit and
+// releases what it held
+func (s *Service) evicted(ctx context.Context, session *models.Session) {
+	if err := s.removePeer(ctx, session); err != nil {
+		s.log.Warn("failed to remove evicted peer", "session_id", session.ID, "node_id", session.NodeID, "error", err)
+	}
+	s.ended(ctx, session)
+}
+
+// releaseKey ends the user's active sessions using publicKey, so a client
+// registering the same key again gets a fresh session instead of a duplicate peer
+func (s *Service) releaseKey(ctx context.Context, userID uuid.UUID, publicKey string) error {
+	var sessions []models.Session
+	if err := s.db.WithContext(ctx).
+		Where("public_key = ? AND status = ?", publicKey, "active").
+		Find(&sessions).Error; err != nil {
+		return apperrors.ErrDatabase.WithInternal(err)
+	}
+
+	for i := range sessions {
+		if sessions[i].UserID != userID {
+			return ErrPublicKeyInUse
+		}
+	}
+
+	for i := range sessions {
+		if err := s.End(ctx, &sessions[i], "disconnected"); err != nil && !apperrors.Is(err, ErrSessionNotActive) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollback removes a session whose peer could not be provisioned
+func (s *Service) rollback(session *models.Session) {
+	s.db.Unscoped().Delete(session)
+	s.db.Model(&models.VPNNode{}).Where("id = ? AND current_connections > 0", session.NodeID).
+		UpdateColumn("current_connections", gorm.Expr("current_connections - ?", 1))
+}
+
+// Get returns a session owned by the user
+func (s *Service) Get(ctx context.Context, userID, sessionID uuid.UUID) (*models.Session, error) {
+	var session models.Session
+	err := s.db.WithContext(ctx).
+		Where("id = ? AND user_id = ?", sessionID, userID).
+		Preload("Node").
+		First(&session).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.ErrSessionNotFound.WithInternal(err)
+		}
+		return nil, apperrors.ErrDatabase.WithInternal(err)
+	}
+	return &session, nil
+}
+
+// Disconnect tears down the session's peer and marks the session disconnected
+func (s *Service) Disconnect(ctx context.Context, userID, sessionID uuid.UUID) (*models.Session, error) {
+	session, err := s.Get(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return session, s.End(ctx, session, "disconnected")
+}
+
+// End removes the peer for an active session and records its end. status is
+// the terminal session status, e.g. disconnected or terminated.
+func (s *Service) End(ctx context.Context, session *models.Session, status string) error {
+	if session.Status != "active" {
+		return ErrSessionNotActive
+	}
+
+	if err := s.removePeer(ctx, session); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	result := s.db.WithContext(ctx).Model(&models.Session{}).
+		Where("id = ? AND status = ?", session.ID, "active").
+		Updates(map[string]interface{}{
+			"status":          status,
+			"disconnected_at": &now,
+		})
+	if result.Error != nil {
+		return apperrors.ErrDatabase.WithInternal(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		// Someone else ended the session concurrently
+		return ErrSessionNotActive
+	}
+
+	session.Status = status
+	session.DisconnectedAt = &now
+	s.ended(ctx, session)
+
+	return nil
+}
+
+// removePeer removes a session's peer from its node. Only a missing node is
+// an error: a peer that cannot be removed now is reaped by the node's peer sync.
+func (s *Service) removePeer(ctx context.Context, session *models.Session) error {
+	if s.peers == nil {
+		return nil
+	}
+
+	node := session.Node
+	if node == nil {
+		node = &models.VPNNode{}
+		if err := s.db.First(node, session.NodeID).Error; err != nil {
+			return apperrors.ErrNodeNotFound.WithInternal(err)
+		}
+	}
+
+	if err := s.peers.RemovePeer(ctx, node, session.PublicKey); err != nil {
+		s.log.Warn("failed to remove peer", "session_id", session.ID, "node_id", node.ID, "error", err)
+	}
+	return nil
+}
+
+// ended releases the node connection of a session that has just ended and
+// settles its earnings
+func (s *Service) ended(ctx context.Context, session *models.Session) {
+	s.db.Model(&models.VPNNode{}).Where("id = ? AND current_connections > 0", session.NodeID).
+		UpdateColumn("current_connections", gorm.Expr("current_connections - ?", 1))
+
+	s.log.LogVPN("session_"+session.Status, session.ID, session.UserID, session.NodeID, session.Protocol)
+
+	// Earnings that fail here are settled by the node's next earnings checkpoint
+	if s.earnings != nil {
+		if err := s.earnings.RecordSessionEnd(ctx, session.ID); err != nil {
+			s.log.Warn("failed to record session earnings", "session_id", session.ID, "error", err)
+		}
+	}
+}
+
+// BuildClientConfig renders the client-side WireGuard configuration for a session
+func BuildClientConfig(node *models.VPNNode, session *models.Session) (*ClientConfig, error) {
+	if node.PublicKey == "" {
+		return nil, fmt.Errorf("node %s has no public key", node.ID)
+	}
+
+	endpoint := net.JoinHostPort(node.PublicIP, fmt.Sprintf("%d", node.WireGuardPort))
+	clientIP := HostIP(session.TunnelIP)
+
+	config := &ClientConfig{
+		ClientIP:        clientIP,
+		DNS:             DefaultDNS,
+		ServerPublicKey: node.PublicKey,
+		ServerEndpoint:  endpoint,
+		AllowedIPs:      strings.Join(DefaultClientAllowedIPs, ", "),
+		MTU:             DefaultMTU,
+	}
+
+	// Only render a full config file when we hold the client's private key
+	if session.PrivateKey != "" {
+		rendered, err := wireguard.GenerateClientConfig(wireguard.Config{
+			PrivateKey:          session.PrivateKey,
+			Address:             []string{clientIP + "/32"},
+			DNS:                 strings.Split(DefaultDNS, ","),
+			MTU:                 DefaultMTU,
+			PeerPublicKey:       node.PublicKey,
+			PeerEndpoint:        endpoint,
+			AllowedIPs:          DefaultClientAllowedIPs,
+			PersistentKeepalive: DefaultPersistentKeepalive,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to render client config: %w", err)
+		}
+		config.ClientConfig = rendered
+	}
+
+	return config, nil
+}
+
+// HostIP strips the prefix length from a tunnel address ("10.8.0.2/24" -> "10.8.0.2")
+func HostIP(tunnelIP string) string {
+	if i := strings.IndexByte(tunnelIP, '/'); i >= 0 {
+		return tunnelIP[:i]
+	}
+	return tunnelIP
+}
+
+// HostAddress returns the single-host route for a tunnel address, used as the
+// peer's allowed IPs on the server ("10.8.0.2/24" -> "10.8.0.2/32")
+func HostAddress(tunnelIP string) string {
+	return HostIP(tunnelIP) + "/32"
+}
@@ -0,0 +1,74 @@
+package shaping
+
+import "sync"
+
+// FakeShaper is an in-memory Shaper for tests. It records the limit of each
+// tunnel IP instead of touching the OS.
+type FakeShaper struct {
+	mu     sync.Mutex
+	limits map[string]int
+	err    error
+}
+
+// NewFakeShaper creates an in-memory shaper
+func NewFakeShaper() *FakeShaper {
+	return &FakeShaper{limits: make(map[string]int)}
+}
+
+// SetError makes every subsequent call fail with err until cleared with nil
+func (f *FakeShaper) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Setup removes all limits
+func (f *FakeShaper) Setup() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+	f.limits = make(map[string]int)
+	return nil
+}
+
+// Limit records the peer's rate
+func (f *FakeShaper) Limit(tunnelIP string, rateKbps int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+	if _, err := classID(tunnelIP); err != nil {
+		return err
+	}
+	f.limits[host(tunnelIP)] = rateKbps
+	return nil
+}
+
+// Unlimit removes the peer's rate
+func (f *FakeShaper) Unlimit(tunnelIP string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+	delete(f.limits, host(tunnelIP))
+	return nil
+}
+
+// Limits returns a copy of the rates by tunnel IP, without prefix length
+func (f *FakeShaper) Limits() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	limits := make(map[string]int, len(f.limits))
+	for ip, rate := range f.limits {
+		limits[ip] = rate
+	}
+	return limits
+}
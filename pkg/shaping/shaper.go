@@ -0,0 +1,43 @@
+package shaping
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Shaper limits the bandwidth of individual peers on a VPN interface. Peers
+// are identified by their tunnel IP.
+type Shaper interface {
+	// Setup replaces any rules left on the interface with an empty set
+	Setup() error
+
+	// Limit sets the download and upload rate of the peer at tunnelIP,
+	// replacing its current limit
+	Limit(tunnelIP string, rateKbps int) error
+
+	// Unlimit removes the peer's limit. Removing an unknown limit is not an error.
+	Unlimit(tunnelIP string) error
+}
+
+// classID returns the traffic class minor number for a tunnel IP, taken from
+// the low 16 bits of the address. Tunnel IPs are allocated from a /24, so
+// these are unique on an interface.
+func classID(tunnelIP string) (uint16, error) {
+	ip := net.ParseIP(host(tunnelIP)).To4()
+	if ip == nil {
+		return 0, fmt.Errorf("invalid tunnel IP %q", tunnelIP)
+	}
+
+	id := uint16(ip[2])<<8 | uint16(ip[3])
+	if id == 0 || id == 0xffff {
+		return 0, fmt.Errorf("tunnel IP %s cannot be shaped", host(tunnelIP))
+	}
+	return id, nil
+}
+
+// host strips the prefix length from a tunnel address
+func host(tunnelIP string) string {
+	h, _, _ := strings.Cut(tunnelIP, "/")
+	return h
+}
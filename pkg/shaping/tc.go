@@ -0,0 +1,108 @@
+package shaping
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// minBurstBytes is the smallest policing burst, about ten full-size packets
+const minBurstBytes = 15000
+
+// TCShaper shapes peers with the tc tool. Traffic to a peer leaves the
+// interface through an HTB class with an fq_codel queue; traffic from a peer
+// is policed on ingress, since only egress can be queued.
+type TCShaper struct {
+	interfaceName string
+}
+
+// NewTCShaper creates a shaper for interfaceName
+func NewTCShaper(interfaceName string) *TCShaper {
+	return &TCShaper{interfaceName: interfaceName}
+}
+
+// Setup replaces the root and ingress qdiscs, removing all peer limits.
+// Unclassified traffic is not shaped.
+func (t *TCShaper) Setup() error {
+	// The qdiscs may not exist yet
+	t.tc("qdisc", "del", "dev", t.interfaceName, "root")
+	t.tc("qdisc", "del", "dev", t.interfaceName, "ingress")
+
+	if err := t.tc("qdisc", "add", "dev", t.interfaceName, "root", "handle", "1:", "htb"); err != nil {
+		return fmt.Errorf("failed to add root qdisc: %w", err)
+	}
+	if err := t.tc("qdisc", "add", "dev", t.interfaceName, "handle", "ffff:", "ingress"); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc: %w", err)
+	}
+	return nil
+}
+
+// Limit adds or replaces the peer's class, queue and filters
+func (t *TCShaper) Limit(tunnelIP string, rateKbps int) error {
+	if rateKbps <= 0 {
+		return fmt.Errorf("invalid rate %d kbps", rateKbps)
+	}
+	id, err := classID(tunnelIP)
+	if err != nil {
+		return err
+	}
+
+	addr := host(tunnelIP)
+	class := fmt.Sprintf("1:%x", id)
+	handle := fmt.Sprintf("0x%x", id)
+	rate := fmt.Sprintf("%dkbit", rateKbps)
+
+	// About 100ms of traffic at the limit
+	burst := rateKbps * 125 / 10
+	if burst < minBurstBytes {
+		burst = minBurstBytes
+	}
+
+	commands := [][]string{
+		{"class", "replace", "dev", t.interfaceName, "parent", "1:", "classid", class, "htb", "rate", rate, "ceil", rate},
+		{"qdisc", "replace", "dev", t.interfaceName, "parent", class, "handle", fmt.Sprintf("%x:", id), "fq_codel"},
+		{"filter", "replace", "dev", t.interfaceName, "parent", "1:", "protocol", "ip", "prio", "1",
+			"handle", handle, "flower", "dst_ip", addr, "classid", class},
+		{"filter", "replace", "dev", t.interfaceName, "parent", "ffff:", "protocol", "ip", "prio", "1",
+			"handle", handle, "flower", "src_ip", addr,
+			"action", "police", "rate", rate, "burst", strconv.Itoa(burst), "drop"},
+	}
+	for _, args := range commands {
+		if err := t.tc(args...); err != nil {
+			return fmt.Errorf("failed to limit %s: %w", addr, err)
+		}
+	}
+	return nil
+}
+
+// Unlimit removes the peer's filters and class. The class's queue is removed
+// with it.
+func (t *TCShaper) Unlimit(tunnelIP string) error {
+	id, err := classID(tunnelIP)
+	if err != nil {
+		return err
+	}
+
+	handle := fmt.Sprintf("0x%x", id)
+
+	// Deleting the filters first keeps the peer's traffic from being
+	// classified into a missing class
+	t.tc("filter", "del", "dev", t.interfaceName, "parent", "ffff:", "protocol", "ip", "prio", "1", "handle", handle, "flower")
+	t.tc("filter", "del", "dev", t.interfaceName, "parent", "1:", "protocol", "ip", "prio", "1", "handle", handle, "flower")
+
+	if err := t.tc("class", "del", "dev", t.interfaceName, "classid", fmt.Sprintf("1:%x", id)); err != nil &&
+		!strings.Contains(err.Error(), "No such file or directory") {
+		return fmt.Errorf("failed to unlimit %s: %w", tunnelIP, err)
+	}
+	return nil
+}
+
+// tc runs the tc tool, including its output in errors
+func (t *TCShaper) tc(args ...string) error {
+	output, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s: %w: %s", strings.Join(args[:2], " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+// Package telemetry samples the host metrics a VPN node reports with its
+// heartbeat from /proc
+package telemetry
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandshakeWindow is how recently a WireGuard peer must have handshaken to
+// count as active. Peers exchanging traffic handshake every two minutes.
+const HandshakeWindow = 3 * time.Minute
+
+// Sample is a snapshot of a node host's load
+type Sample struct {
+	UptimeSeconds int64 `json:"uptime_seconds"`
+
+	// CPU
+	CPUPercent float64 `json:"cpu_percent"` // Busy time of all CPUs since the previous sample
+	CPUCount   int     `json:"cpu_count"`
+	Load1      float64 `json:"load1"`
+	Load5      float64 `json:"load5"`
+	Load15     float64 `json:"load15"`
+
+	// Memory
+	MemoryPercent float64 `json:"memory_percent"` // Memory not available to new processes
+	MemoryTotalKB int64   `json:"memory_total_kb"`
+
+	// Network
+	RxMbps         float64 `json:"rx_mbps"` // Public interface throughput since the previous sample
+	TxMbps         float64 `json:"tx_mbps"`
+	ConntrackCount int64   `json:"conntrack_count"` // 0 when connection tracking is not loaded
+	ConntrackMax   int64   `json:"conntrack_max"`
+
+	// WireGuard, filled in by the node
+	Peers       int `json:"peers"`
+	ActivePeers int `json:"active_peers"` // Peers that handshook within HandshakeWindow
+}
+
+// Config configures a Collector
+type Config struct {
+	// ProcPath is where procfs is mounted, /proc when empty
+	ProcPath string
+
+	// Interface is the network interface whose throughput is reported. All
+	// interfaces except loopback are summed when empty.
+	Interface string
+}
+
+// Collector samples host metrics. Rates are computed against the previous
+// sample; the first sample averages them since boot.
+type Collector struct {
+	procPath  string
+	iface     string
+	mu        sync.Mutex
+	prevCPU   cpuTimes
+	prevNIC   nicCounters
+	prevAt    time.Time
+	hasSample bool
+}
+
+// cpuTimes are the aggregate CPU counters of /proc/stat, in clock ticks
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+// nicCounters are the byte counters of /proc/net/dev
+type nicCounters struct {
+	rx uint64
+	tx uint64
+}
+
+// NewCollector creates a collector reading the host's procfs
+func NewCollector(cfg Config) *Collector {
+	if cfg.ProcPath == "" {
+		cfg.ProcPath = "/proc"
+	}
+	return &Collector{procPath: cfg.ProcPath, iface: cfg.Interface}
+}
+
+// Sample reads the current host metrics. CPU, memory, load and uptime are
+// required; network figures are left at zero when unavailable.
+func (c *Collector) Sample() (*Sample, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	sample := &Sample{}
+
+	uptime, err := c.readUptime()
+	if err != nil {
+		return nil, err
+	}
+	sample.UptimeSeconds = int64(uptime)
+
+	cpu, cpuCount, err := c.readCPU()
+	if err != nil {
+		return nil, err
+	}
+	sample.CPUCount = cpuCount
+
+	if err := c.readLoad(sample); err != nil {
+		return nil, err
+	}
+	if err := c.readMemory(sample); err != nil {
+		return nil, err
+	}
+
+	nic, nicErr := c.readNIC()
+	sample.ConntrackCount, _ = c.readInt("sys/net/netfilter/nf_conntrack_count")
+	sample.ConntrackMax, _ = c.readInt("sys/net/netfilter/nf_conntrack_max")
+
+	// Without a previous sample, the counters started from zero at boot
+	prevCPU, prevNIC, prevAt := c.prevCPU, c.prevNIC, c.prevAt
+	if !c.hasSample {
+		prevCPU, prevNIC = cpuTimes{}, nicCounters{}
+		prevAt = now.Add(-time.Duration(uptime * float64(time.Second)))
+	}
+
+	if cpu.total > prevCPU.total && cpu.busy >= prevCPU.busy {
+		sample.CPUPercent = float64(cpu.busy-prevCPU.busy) / float64(cpu.total-prevCPU.total) * 100
+	}
+	if elapsed := now.Sub(prevAt).Seconds(); elapsed > 0 && nicErr == nil {
+		// Counters that went backwards were reset, e.g. by recreating the interface
+		if nic.rx >= prevNIC.rx {
+			sample.RxMbps = float64(nic.rx-prevNIC.rx) * 8 / elapsed / 1_000_000
+		}
+		if nic.tx >= prevNIC.tx {
+			sample.TxMbps = float64(nic.tx-prevNIC.tx) * 8 / elapsed / 1_000_000
+		}
+	}
+
+	c.prevCPU, c.prevAt = cpu, now
+	if nicErr == nil {
+		c.prevNIC = nic
+	}
+	c.hasSample = true
+
+	return sample, nil
+}
+
+// readUptime returns the seconds since boot
+func (c *Collector) readUptime() (float64, error) {
+	data, err := os.ReadFile(filepath.Join(c.procPath, "uptime"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read uptime: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid uptime")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readCPU returns the aggregate CPU counters and the number of CPUs
+func (c *Collector) readCPU() (cpuTimes, int, error) {
+	f, err := os.Open(filepath.Join(c.procPath, "stat"))
+	if err != nil {
+		return cpuTimes{}, 0, fmt.Errorf("failed to read CPU stats: %w", err)
+	}
+	defer f.Close()
+
+	var times cpuTimes
+	found := false
+	count := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			count++
+			continue
+		}
+
+		// user nice system idle iowait irq softirq steal; guest time is
+		// already included in user
+		if len(fields) < 5 {
+			return cpuTimes{}, 0, fmt.Errorf("invalid CPU stats")
+		}
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuTimes{}, 0, fmt.Errorf("invalid CPU stats: %w", err)
+			}
+			times.total += v
+			if i != 3 && i != 4 { // idle and iowait
+				times.busy += v
+			}
+		}
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return cpuTimes{}, 0, fmt.Errorf("failed to read CPU stats: %w", err)
+	}
+	if !found {
+		return cpuTimes{}, 0, fmt.Errorf("invalid CPU stats")
+	}
+
+	return times, count, nil
+}
+
+// readLoad reads the load averages
+func (c *Collector) readLoad(sample *Sample) error {
+	data, err := os.ReadFile(filepath.Join(c.procPath, "loadavg"))
+	if err != nil {
+		return fmt.Errorf("failed to read load average: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("invalid load average")
+	}
+
+	loads := make([]float64, 3)
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return fmt.Errorf("invalid load average: %w", err)
+		}
+	}
+	sample.Load1, sample.Load5, sample.Load15 = loads[0], loads[1], loads[2]
+	return nil
+}
+
+// readMemory reads memory usage. Page cache the kernel can reclaim counts
+// as available.
+func (c *Collector) readMemory(sample *Sample) error {
+	f, err := os.Open(filepath.Join(c.procPath, "meminfo"))
+	if err != nil {
+		return fmt.Errorf("failed to read memory stats: %w", err)
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			values[name] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read memory stats: %w", err)
+	}
+
+	total, available := values["MemTotal"], values["MemAvailable"]
+	if total <= 0 {
+		return fmt.Errorf("invalid memory stats")
+	}
+	if _, ok := values["MemAvailable"]; !ok {
+		// Kernels before 3.14
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+
+	sample.MemoryTotalKB = total
+	sample.MemoryPercent = float64(total-available) / float64(total) * 100
+	return nil
+}
+
+// readNIC returns the byte counters of the configured interface, or of all
+// interfaces but loopback
+func (c *Collector) readNIC() (nicCounters, error) {
+	f, err := os.Open(filepath.Join(c.procPath, "net/dev"))
+	if err != nil {
+		return nicCounters{}, err
+	}
+	defer f.Close()
+
+	var counters nicCounters
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue // Header
+		}
+		name = strings.TrimSpace(name)
+		if (c.iface != "" && name != c.iface) || (c.iface == "" && name == "lo") {
+			continue
+		}
+
+		// Receive bytes come first, transmit bytes are the 9th field
+		fields := strings.Fields(rest)
+		if len(fields) < 9 {
+			continue
+		}
+		rx, err1 := strconv.ParseUint(fields[0], 10, 64)
+		tx, err2 := strconv.ParseUint(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		counters.rx += rx
+		counters.tx += tx
+	}
+	return counters, scanner.Err()
+}
+
+// readInt reads a procfs file holding a single integer
+func (c *Collector) readInt(name string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(c.procPath, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
@@ -22,7 +22,7 @@ func TestCompleteVPNFlow(t *testing.T) {
 
 	t.Run("User Registration and Authentication", func(t *testing.T) {
 		tokenService := auth.NewTokenService("test-secret", 15*time.Minute, 7*24*time.Hour)
-		authService := auth.NewService(tokenService)
+		authService := auth.NewService(tokenService, nil, nil, nil)
 
 		// Register user
 		registerReq := auth.RegisterRequest{
@@ -253,7 +253,7 @@ func TestPerformance(t *testing.T) {
 
 	t.Run("Concurrent User Registration", func(t *testing.T) {
 		tokenService := auth.NewTokenService("test-secret", 15*time.Minute, 7*24*time.Hour)
-		authService := auth.NewService(tokenService)
+		authService := auth.NewService(tokenService, nil, nil, nil)
 
 		concurrency := 50
 		done := make(chan bool, concurrency)
@@ -0,0 +1,49 @@
+package unit
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/nikola43/aureo-vpn/pkg/database"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDB points the global database at a fresh SQLite file with the
+// given models migrated
+func setupTestDB(t *testing.T, testModels ...interface{}) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "unit.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+
+	// SQLite cannot parse the UUID column defaults used for Postgres. IDs
+	// are assigned by the BeforeCreate hooks anyway.
+	for _, model := range testModels {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatalf("Failed to parse model: %v", err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DefaultValue == "gen_random_uuid()" || field.DefaultValue == "uuid_generate_v4()" {
+				field.HasDefaultValue = false
+				field.DefaultValue = ""
+				field.DefaultValueInterface = nil
+			}
+		}
+	}
+
+	if err := db.AutoMigrate(testModels...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+
+	database.DB = db
+	t.Cleanup(func() { database.DB = nil })
+
+	return db
+}
@@ -0,0 +1,196 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/internal/control"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
+	"github.com/nikola43/aureo-vpn/pkg/enrollment"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// setupEnrollment creates a node waiting to enroll
+func setupEnrollment(t *testing.T) (*enrollment.Service, *gorm.DB, *models.VPNNode) {
+	t.Helper()
+
+	db := setupTestDB(t, &models.VPNNode{}, &models.NodeJoinToken{})
+	node := &models.VPNNode{
+		Name:        "test-node",
+		Hostname:    "node.example.com",
+		PublicIP:    "192.0.2.10",
+		Country:     "Testland",
+		CountryCode: "TL",
+		City:        "Test City",
+		IsActive:    true,
+	}
+	if err := db.Create(node).Error; err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	return enrollment.NewService(logger.Global(), time.Hour), db, node
+}
+
+// startControlAPI serves the control API with a new signing key
+func startControlAPI(t *testing.T) (string, *controlapi.Authority) {
+	t.Helper()
+
+	signingKey, _, err := controlapi.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	authority, err := controlapi.NewAuthority(signingKey)
+	if err != nil {
+		t.Fatalf("NewAuthority failed: %v", err)
+	}
+
+	server := controlapi.NewServer(control.NewServer(control.Config{Authority: authority}), authority)
+	ts := httptest.NewServer(server.Handler())
+	t.Cleanup(ts.Close)
+
+	return ts.URL, authority
+}
+
+func TestJoinTokenSingleUse(t *testing.T) {
+	service, db, node := setupEnrollment(t)
+	ctx := context.Background()
+
+	token, _, err := service.IssueToken(ctx, node.ID, nil)
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+
+	// Tokens are only stored hashed
+	var count int64
+	db.Model(&models.NodeJoinToken{}).Where("token_hash = ?", token).Count(&count)
+	if count != 0 {
+		t.Error("Join token should not be stored in plain text")
+	}
+
+	enrolled, err := service.Redeem(ctx, token, "identity-key")
+	if err != nil {
+		t.Fatalf("Redeem failed: %v", err)
+	}
+	if enrolled.ID != node.ID || enrolled.IdentityKey != "identity-key" || enrolled.EnrolledAt == nil {
+		t.Errorf("Expected the node to be enrolled with the identity key, got %+v", enrolled)
+	}
+
+	if _, err := service.Redeem(ctx, token, "another-key"); !errors.Is(err, enrollment.ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for a used token, got %v", err)
+	}
+}
+
+func TestJoinTokenRevocationAndExpiry(t *testing.T) {
+	service, db, node := setupEnrollment(t)
+	ctx := context.Background()
+
+	first, record, err := service.IssueToken(ctx, node.ID, nil)
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+
+	// A new token replaces the unused one
+	second, _, err := service.IssueToken(ctx, node.ID, nil)
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+	if _, err := service.Redeem(ctx, first, "identity-key"); !errors.Is(err, enrollment.ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for a replaced token, got %v", err)
+	}
+	if err := service.RevokeToken(ctx, record.ID); !errors.Is(err, enrollment.ErrTokenNotFound) {
+		t.Errorf("Expected ErrTokenNotFound for an already revoked token, got %v", err)
+	}
+
+	tokens, _ := service.ListTokens(ctx, node.ID)
+	if len(tokens) != 2 {
+		t.Fatalf("Expected 2 tokens, got %d", len(tokens))
+	}
+	if err := service.RevokeToken(ctx, tokens[0].ID); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+	if _, err := service.Redeem(ctx, second, "identity-key"); !errors.Is(err, enrollment.ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for a revoked token, got %v", err)
+	}
+
+	expired, record, _ := service.IssueToken(ctx, node.ID, nil)
+	db.Model(record).Update("expires_at", time.Now().Add(-time.Minute))
+	if _, err := service.Redeem(ctx, expired, "identity-key"); !errors.Is(err, enrollment.ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for an expired token, got %v", err)
+	}
+}
+
+func TestNodeEnrollment(t *testing.T) {
+	service, db, node := setupEnrollment(t)
+	controlURL, authority := startControlAPI(t)
+	ctx := context.Background()
+
+	token, _, err := service.IssueToken(ctx, node.ID, nil)
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+
+	// A node pinned to another control server refuses to enroll
+	_, otherKey, _ := controlapi.GenerateKey()
+	if _, err := controlapi.Enroll(ctx, controlURL, token, otherKey, 5*time.Second); err == nil {
+		t.Fatal("Expected enrollment against an unexpected control key to fail")
+	}
+
+	// The server used the token up even though the node refused its answer
+	token, _, _ = service.IssueToken(ctx, node.ID, nil)
+	identity, err := controlapi.Enroll(ctx, controlURL, token, authority.PublicKey(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	if identity.NodeID() != node.ID {
+		t.Errorf("Expected node %s, got %s", node.ID, identity.NodeID())
+	}
+
+	// The identity survives a restart
+	path := filepath.Join(t.TempDir(), "identity.json")
+	if err := identity.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	identity, err = controlapi.LoadIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadIdentity failed: %v", err)
+	}
+
+	client, err := controlapi.NewClient(controlURL, identity, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	info, err := client.Node(ctx)
+	if err != nil {
+		t.Fatalf("Node failed: %v", err)
+	}
+	if info.Name != node.Name {
+		t.Errorf("Expected node %s, got %s", node.Name, info.Name)
+	}
+
+	// Enrolling again with a new token replaces the identity
+	token, _, _ = service.IssueToken(ctx, node.ID, nil)
+	if _, err := controlapi.Enroll(ctx, controlURL, token, authority.PublicKey(), 5*time.Second); err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	if _, err := client.Node(ctx); err == nil {
+		t.Error("Expected the replaced identity to be refused")
+	}
+
+	// Deactivated nodes are refused
+	token, _, _ = service.IssueToken(ctx, node.ID, nil)
+	identity, err = controlapi.Enroll(ctx, controlURL, token, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	client, _ = controlapi.NewClient(controlURL, identity, 5*time.Second)
+	db.Model(node).Update("is_active", false)
+	if _, err := client.Node(ctx); err == nil {
+		t.Error("Expected a deactivated node to be refused")
+	}
+}
@@ -0,0 +1,96 @@
+package unit
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/nikola43/aureo-vpn/pkg/hdwallet"
+)
+
+// BIP32 test vector 1, chain m/0H and m/0H/1
+const (
+	bip32VectorM0H  = "xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw"
+	bip32VectorM0H1 = "xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ"
+)
+
+func TestExtendedKeyDerivation(t *testing.T) {
+	key, err := hdwallet.ParseExtendedKey(bip32VectorM0H)
+	if err != nil {
+		t.Fatalf("ParseExtendedKey failed: %v", err)
+	}
+	if key.String() != bip32VectorM0H {
+		t.Errorf("Expected the key to round-trip, got %s", key.String())
+	}
+
+	child, err := key.Child(1)
+	if err != nil {
+		t.Fatalf("Child failed: %v", err)
+	}
+	if child.String() != bip32VectorM0H1 {
+		t.Errorf("Expected m/0H/1 to be %s, got %s", bip32VectorM0H1, child.String())
+	}
+
+	if _, err := key.Child(hdwallet.HardenedOffset); !errors.Is(err, hdwallet.ErrHardenedChild) {
+		t.Errorf("Expected ErrHardenedChild, got %v", err)
+	}
+}
+
+func TestParseExtendedKeyRejectsPrivateKeys(t *testing.T) {
+	// BIP32 test vector 1, chain m
+	xprv := "xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi"
+	if _, err := hdwallet.ParseExtendedKey(xprv); !errors.Is(err, hdwallet.ErrPrivateKey) {
+		t.Errorf("Expected ErrPrivateKey, got %v", err)
+	}
+
+	if _, err := hdwallet.ParseExtendedKey(bip32VectorM0H[:len(bip32VectorM0H)-1] + "x"); err == nil {
+		t.Error("Expected a checksum error")
+	}
+}
+
+func TestAddressFromPublicKey(t *testing.T) {
+	// The public key of private key 1, the secp256k1 generator point
+	generator, _ := hex.DecodeString("0279BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798")
+
+	tests := []struct {
+		coin    string
+		testnet bool
+		want    string
+	}{
+		{hdwallet.BTC, false, "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}, // BIP173
+		{hdwallet.BTC, true, "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"},  // BIP173
+		{hdwallet.LTC, false, "ltc1qw508d6qejxtdg4y5r3zarvary0c5xw7kgmn4n9"},
+		{hdwallet.ETH, false, "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf"}, // EIP-55
+	}
+
+	for _, tt := range tests {
+		got, err := hdwallet.AddressFromPublicKey(tt.coin, generator, tt.testnet)
+		if err != nil {
+			t.Fatalf("AddressFromPublicKey(%s) failed: %v", tt.coin, err)
+		}
+		if got != tt.want {
+			t.Errorf("AddressFromPublicKey(%s, testnet=%v) = %s, want %s", tt.coin, tt.testnet, got, tt.want)
+		}
+	}
+}
+
+func TestWalletAddressesAreDeterministic(t *testing.T) {
+	wallet, err := hdwallet.NewWallet("eth", bip32VectorM0H)
+	if err != nil {
+		t.Fatalf("NewWallet failed: %v", err)
+	}
+
+	first, _ := wallet.Address(0)
+	again, _ := wallet.Address(0)
+	second, _ := wallet.Address(1)
+	if first != again {
+		t.Errorf("Expected the same address for the same index, got %s and %s", first, again)
+	}
+	if first == second {
+		t.Errorf("Expected different addresses for different indexes, got %s", first)
+	}
+
+	if _, err := hdwallet.NewWallet("XMR", bip32VectorM0H); err == nil {
+		t.Error("Expected an error for a coin without HD support")
+	}
+}
@@ -0,0 +1,142 @@
+package unit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/ledger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+func setupLedgerDB(t *testing.T) *gorm.DB {
+	return setupTestDB(t,
+		&models.User{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{},
+		&models.OperatorEarning{}, &models.OperatorPayout{},
+		&models.JournalEntry{}, &models.LedgerPosting{},
+	)
+}
+
+func TestMicros(t *testing.T) {
+	tests := []struct {
+		usd  float64
+		want ledger.Micros
+		str  string
+	}{
+		{0.1, 100000, "0.100000"},
+		{12.3456789, 12345679, "12.345679"},
+		{-0.0000004, 0, "0.000000"},
+		{-1.5, -1500000, "-1.500000"},
+	}
+
+	for _, tt := range tests {
+		got := ledger.FromUSD(tt.usd)
+		if got != tt.want {
+			t.Errorf("FromUSD(%v) = %d, want %d", tt.usd, got, tt.want)
+		}
+		if got.String() != tt.str {
+			t.Errorf("Micros(%d).String() = %q, want %q", got, got.String(), tt.str)
+		}
+	}
+}
+
+func TestPostRejectsUnbalancedEntries(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	err := ledger.Post(db, ledger.Entry{
+		Kind:       ledger.KindEarning,
+		Reference:  uuid.New(),
+		OperatorID: uuid.New(),
+		Postings: []ledger.Posting{
+			{Account: ledger.PlatformExpense, Amount: 100},
+			{Account: ledger.OperatorPayable, Amount: -99},
+		},
+	})
+	if !errors.Is(err, ledger.ErrUnbalanced) {
+		t.Errorf("Expected ErrUnbalanced, got %v", err)
+	}
+}
+
+func TestPayoutLifecycle(t *testing.T) {
+	db := setupLedgerDB(t)
+	operatorID := uuid.New()
+	nodeID := uuid.New()
+
+	for _, amount := range []float64{4.25, 0.75} {
+		earning := &models.OperatorEarning{OperatorID: operatorID, NodeID: nodeID, SessionID: uuid.New(), AmountUSD: amount}
+		if err := db.Create(earning).Error; err != nil {
+			t.Fatalf("Failed to create earning: %v", err)
+		}
+		if err := ledger.PostEarning(db, earning); err != nil {
+			t.Fatalf("PostEarning failed: %v", err)
+		}
+	}
+
+	first := &models.OperatorPayout{OperatorID: operatorID, AmountUSD: 5, WalletAddress: "0xabc", Status: "failed"}
+	db.Create(first)
+	if err := ledger.PostPayoutInitiated(db, first); err != nil {
+		t.Fatalf("PostPayoutInitiated failed: %v", err)
+	}
+	if err := ledger.PostPayoutInitiated(db, first); !errors.Is(err, ledger.ErrAlreadyPosted) {
+		t.Errorf("Expected ErrAlreadyPosted for a repeated entry, got %v", err)
+	}
+	if err := ledger.PostPayoutFailed(db, first); err != nil {
+		t.Fatalf("PostPayoutFailed failed: %v", err)
+	}
+
+	second := &models.OperatorPayout{OperatorID: operatorID, AmountUSD: 5, WalletAddress: "0xabc", Status: "completed"}
+	db.Create(second)
+	ledger.PostPayoutInitiated(db, second)
+	if err := ledger.PostPayoutCompleted(db, second); err != nil {
+		t.Fatalf("PostPayoutCompleted failed: %v", err)
+	}
+
+	balances, err := ledger.GetOperatorBalances(db, operatorID)
+	if err != nil {
+		t.Fatalf("GetOperatorBalances failed: %v", err)
+	}
+	want := ledger.OperatorBalances{Earned: 5000000, Payable: 0, InFlight: 0, Paid: 5000000}
+	if *balances != want {
+		t.Errorf("Expected balances %+v, got %+v", want, *balances)
+	}
+}
+
+func TestReconcileFlagsDrift(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	operator := &models.NodeOperator{UserID: uuid.New(), WalletAddress: "0xdef"}
+	db.Create(operator)
+
+	earning := &models.OperatorEarning{OperatorID: operator.ID, NodeID: uuid.New(), SessionID: uuid.New(), AmountUSD: 2}
+	db.Create(earning)
+	ledger.PostEarning(db, earning)
+	if err := ledger.RefreshOperator(db, operator.ID); err != nil {
+		t.Fatalf("RefreshOperator failed: %v", err)
+	}
+
+	drifts, err := ledger.Reconcile(db)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(drifts) != 0 {
+		t.Fatalf("Expected a consistent ledger, got %v", drifts)
+	}
+
+	// An earning written outside the ledger and a hand-edited balance
+	db.Create(&models.OperatorEarning{OperatorID: operator.ID, NodeID: uuid.New(), SessionID: uuid.New(), AmountUSD: 1})
+	db.Model(operator).UpdateColumn("pending_payout", 10)
+
+	drifts, err = ledger.Reconcile(db)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	kinds := make(map[string]int)
+	for _, drift := range drifts {
+		kinds[drift.Kind]++
+	}
+	if kinds["earning"] != 1 || kinds["operator_balance"] != 1 {
+		t.Errorf("Expected one earning and one operator balance drift, got %v", drifts)
+	}
+}
@@ -0,0 +1,122 @@
+package unit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/auth"
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+)
+
+// setupLockout registers test@example.com with a login guard using config
+func setupLockout(t *testing.T, config auth.LoginGuardConfig) *auth.Service {
+	t.Helper()
+
+	setupTestDB(t, &models.User{}, &models.RefreshToken{})
+	guard := auth.NewLoginGuard(auth.NewMemoryAttemptStore(), config, logger.Global())
+	service := auth.NewService(auth.NewTokenService("test-secret-key", 15*time.Minute, 7*24*time.Hour), nil, nil, guard)
+
+	if _, err := service.Register(auth.RegisterRequest{
+		Email:    "test@example.com",
+		Password: "correct-horse",
+		Username: "testuser",
+	}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	return service
+}
+
+// attemptLogin signs in and returns the error, if any
+func attemptLogin(service *auth.Service, email, password, ip string) error {
+	_, err := service.Login(auth.LoginRequest{
+		Email:      email,
+		Password:   password,
+		DeviceInfo: auth.DeviceInfo{IPAddress: ip},
+	})
+	return err
+}
+
+// assertLoginBlocked checks err refuses a login for at least minRetry seconds
+func assertLoginBlocked(t *testing.T, err error, minRetry int) {
+	t.Helper()
+
+	var appErr *apperrors.AppError
+	if !errors.As(err, &appErr) || appErr.Code != apperrors.ErrCodeRateLimit {
+		t.Fatalf("Expected the login to be blocked, got %v", err)
+	}
+	if retry, _ := appErr.Details["retry_after"].(int); retry < minRetry {
+		t.Errorf("Expected retry_after of at least %d, got %v", minRetry, appErr.Details["retry_after"])
+	}
+}
+
+func TestLoginLocksAccount(t *testing.T) {
+	service := setupLockout(t, auth.LoginGuardConfig{MaxAttempts: 2, LockoutDuration: time.Minute})
+
+	// The first failure isn't delayed
+	if err := attemptLogin(service, "test@example.com", "wrong", "192.0.2.1"); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials, got %v", err)
+	}
+	if err := attemptLogin(service, "test@example.com", "wrong", "192.0.2.2"); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// Even the right password is refused from any IP until the lock expires
+	assertLoginBlocked(t, attemptLogin(service, "test@example.com", "correct-horse", "192.0.2.3"), 59)
+}
+
+func TestLoginLockoutHidesUnknownEmails(t *testing.T) {
+	service := setupLockout(t, auth.LoginGuardConfig{MaxAttempts: 2, LockoutDuration: time.Minute})
+
+	// Unknown emails fail and lock exactly like registered ones
+	for i := 0; i < 2; i++ {
+		if err := attemptLogin(service, "nobody@example.com", "wrong", "192.0.2.1"); !errors.Is(err, auth.ErrInvalidCredentials) {
+			t.Fatalf("Expected ErrInvalidCredentials, got %v", err)
+		}
+	}
+	assertLoginBlocked(t, attemptLogin(service, "nobody@example.com", "wrong", "192.0.2.1"), 59)
+
+	// Other accounts are unaffected
+	if err := attemptLogin(service, "test@example.com", "correct-horse", "192.0.2.9"); err != nil {
+		t.Errorf("Expected another account to sign in, got %v", err)
+	}
+}
+
+func TestLoginDelaysRepeatedFailures(t *testing.T) {
+	service := setupLockout(t, auth.LoginGuardConfig{MaxAttempts: 5, LockoutDuration: time.Minute})
+
+	attemptLogin(service, "test@example.com", "wrong", "192.0.2.1")
+	if err := attemptLogin(service, "test@example.com", "wrong", "192.0.2.1"); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// The second failure delays the next attempt
+	assertLoginBlocked(t, attemptLogin(service, "test@example.com", "correct-horse", "192.0.2.1"), 1)
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := attemptLogin(service, "test@example.com", "correct-horse", "192.0.2.1"); err != nil {
+		t.Fatalf("Expected the login to succeed after the delay, got %v", err)
+	}
+
+	// A successful login clears the account's failures
+	attemptLogin(service, "test@example.com", "wrong", "192.0.2.1")
+	if err := attemptLogin(service, "test@example.com", "correct-horse", "192.0.2.1"); err != nil {
+		t.Errorf("Expected no delay after one failure, got %v", err)
+	}
+}
+
+func TestLoginLocksIPAddress(t *testing.T) {
+	service := setupLockout(t, auth.LoginGuardConfig{MaxAttemptsPerIP: 2, LockoutDuration: time.Minute})
+
+	// Guessing different accounts from one address
+	attemptLogin(service, "a@example.com", "wrong", "192.0.2.1")
+	attemptLogin(service, "b@example.com", "wrong", "192.0.2.1")
+
+	assertLoginBlocked(t, attemptLogin(service, "test@example.com", "correct-horse", "192.0.2.1"), 59)
+
+	if err := attemptLogin(service, "test@example.com", "correct-horse", "192.0.2.2"); err != nil {
+		t.Errorf("Expected other addresses to sign in, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/internal/control"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/maintenance"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+)
+
+func TestDrainNodeMigratesSessions(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.Plan{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{}, &models.NodeDrain{})
+	sessions := session.NewService(logger.Global(), nil, nil, newTestPlans(t), session.DeviceLimitReject)
+	service := maintenance.NewService(logger.Global(), sessions)
+	ctx := context.Background()
+
+	user := createPlanUser(t, db, "basic", time.Now().Add(time.Hour))
+	drained := createSessionNode(t, db, "10.8.0.1")
+	other := createSessionNode(t, db, "10.9.0.1")
+	db.Model(other).Update("load_score", 50)
+
+	result, err := sessions.Create(ctx, user.ID, session.CreateRequest{NodeID: &drained.ID})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	sess := result.Session
+
+	drain, err := service.Drain(ctx, drained.ID, time.Hour, "kernel upgrade", nil)
+	if err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if drain.SessionsAtStart != 1 || drain.State() != "draining" {
+		t.Errorf("Expected a draining drain of 1 session, got %s of %d", drain.State(), drain.SessionsAtStart)
+	}
+	if _, err := service.Drain(ctx, drained.ID, time.Hour, "", nil); !errors.Is(err, maintenance.ErrAlreadyDraining) {
+		t.Errorf("Expected ErrAlreadyDraining, got %v", err)
+	}
+
+	// New sessions go elsewhere
+	best, err := sessions.SelectNode("wireguard", "")
+	if err != nil || best.ID != other.ID {
+		t.Fatalf("Expected the other node to be selected, got %v", err)
+	}
+
+	// Connected clients are told where to reconnect
+	hint, err := service.MigrateHint(ctx, sess)
+	if err != nil {
+		t.Fatalf("MigrateHint failed: %v", err)
+	}
+	if hint == nil || hint.NodeID == nil || *hint.NodeID != other.ID || !hint.Deadline.Equal(drain.Deadline) {
+		t.Fatalf("Expected a hint to migrate to the other node by the deadline, got %+v", hint)
+	}
+
+	// Clients get until the deadline to leave
+	if completed, err := service.ProcessDrains(ctx); err != nil || completed != 0 {
+		t.Fatalf("Expected no drain to complete before the deadline, got %d: %v", completed, err)
+	}
+
+	db.Model(&models.NodeDrain{}).Where("id = ?", drain.ID).Update("deadline", time.Now().Add(-time.Minute))
+	if completed, err := service.ProcessDrains(ctx); err != nil || completed != 1 {
+		t.Fatalf("Expected the drain to complete at the deadline, got %d: %v", completed, err)
+	}
+
+	var ended models.Session
+	db.First(&ended, sess.ID)
+	if ended.Status != "terminated" {
+		t.Errorf("Expected the remaining session to be terminated, got %s", ended.Status)
+	}
+
+	status, err := service.Status(ctx, drained.ID)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.NodeStatus != "maintenance" || status.State != "completed" || status.ActiveSessions != 0 || status.Drain.SessionsEnded != 1 {
+		t.Errorf("Expected a completed drain with the node in maintenance, got %+v", status)
+	}
+
+	if hint, err := service.MigrateHint(ctx, sess); err != nil || hint != nil {
+		t.Errorf("Expected no hint after the drain completed, got %+v: %v", hint, err)
+	}
+}
+
+func TestDrainEmptyNodeCompletesEarly(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{}, &models.NodeDrain{})
+	service := maintenance.NewService(logger.Global(), session.NewService(logger.Global(), nil, nil, nil, ""))
+	ctx := context.Background()
+
+	node := createSessionNode(t, db, "10.8.0.1")
+
+	if _, err := service.Drain(ctx, node.ID, 0, "", nil); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if completed, err := service.ProcessDrains(ctx); err != nil || completed != 1 {
+		t.Fatalf("Expected a node without sessions to complete its drain, got %d: %v", completed, err)
+	}
+
+	// A node returned to service from maintenance keeps its completed drain
+	// and is offline until its next heartbeat
+	if err := service.Resume(ctx, node.ID); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	status, err := service.Status(ctx, node.ID)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.NodeStatus != "offline" || status.State != "completed" {
+		t.Errorf("Expected an offline node with a completed drain, got %q %q", status.NodeStatus, status.State)
+	}
+
+	if err := service.Resume(ctx, node.ID); !errors.Is(err, maintenance.ErrNotDraining) {
+		t.Errorf("Expected ErrNotDraining, got %v", err)
+	}
+	if _, err := service.Drain(ctx, uuid.New(), 0, "", nil); !errors.Is(err, maintenance.ErrNodeNotFound) {
+		t.Errorf("Expected ErrNodeNotFound, got %v", err)
+	}
+}
+
+func TestResumeCancelsDrain(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{}, &models.NodeDrain{})
+	service := maintenance.NewService(logger.Global(), session.NewService(logger.Global(), nil, nil, nil, ""))
+	ctx := context.Background()
+
+	node := createSessionNode(t, db, "10.8.0.1")
+	if _, err := service.Drain(ctx, node.ID, time.Hour, "", nil); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	// The control server keeps the node draining despite heartbeats and
+	// without probing it
+	server := control.NewServer(control.Config{})
+	if err := server.Heartbeat(ctx, node.ID, controlapi.Heartbeat{Version: controlapi.HeartbeatVersion}); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	db.Model(node).Update("last_heartbeat", time.Now().Add(-time.Hour))
+	server.CheckHealth()
+
+	var drained models.VPNNode
+	db.First(&drained, node.ID)
+	if drained.Status != "draining" {
+		t.Errorf("Expected the node to stay draining, got %q", drained.Status)
+	}
+
+	if err := service.Resume(ctx, node.ID); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	status, err := service.Status(ctx, node.ID)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.State != "cancelled" || status.Drain.CancelledAt == nil {
+		t.Errorf("Expected the drain to be cancelled, got %q", status.State)
+	}
+
+	// A cancelled drain does not put the node into maintenance
+	if completed, err := service.ProcessDrains(ctx); err != nil || completed != 0 {
+		t.Errorf("Expected no drain to complete, got %d: %v", completed, err)
+	}
+	if err := server.Heartbeat(ctx, node.ID, controlapi.Heartbeat{Version: controlapi.HeartbeatVersion}); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	db.First(&drained, node.ID)
+	if drained.Status != "online" {
+		t.Errorf("Expected the node to come back online with a heartbeat, got %q", drained.Status)
+	}
+}
+
+func TestDrainDuringHealthProbe(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{}, &models.NodeDrain{})
+	service := maintenance.NewService(logger.Global(), session.NewService(logger.Global(), nil, nil, nil, ""))
+	ctx := context.Background()
+
+	// The WireGuard probe of a silent port waits for an ICMP error
+	_, port := listenUDP(t)
+	node := createSessionNode(t, db, "10.8.0.1")
+	db.Model(node).Updates(map[string]interface{}{
+		"public_ip":         "127.0.0.1",
+		"wire_guard_port":   port,
+		"supports_open_vpn": false,
+		"last_heartbeat":    time.Now(),
+	})
+
+	server := control.NewServer(control.Config{ProbeTimeout: 2 * time.Second})
+	probed := make(chan struct{})
+	go func() {
+		server.CheckHealth()
+		close(probed)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := service.Drain(ctx, node.ID, time.Hour, "", nil); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	<-probed
+
+	var drained models.VPNNode
+	db.First(&drained, node.ID)
+	if drained.Status != "draining" {
+		t.Fatalf("Expected the probe not to undo the drain, got %q", drained.Status)
+	}
+
+	if completed, err := service.ProcessDrains(ctx); err != nil || completed != 1 {
+		t.Fatalf("Expected the drain to complete, got %d: %v", completed, err)
+	}
+	db.First(&drained, node.ID)
+	if drained.Status != "maintenance" {
+		t.Errorf("Expected the node to be in maintenance, got %q", drained.Status)
+	}
+}
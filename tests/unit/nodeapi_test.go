@@ -0,0 +1,126 @@
+package unit
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/nodeapi"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+)
+
+// memoryPeers is an in-memory nodeapi.PeerManager
+type memoryPeers struct {
+	mu    sync.Mutex
+	peers map[string]wireguard.PeerConfig
+}
+
+func (m *memoryPeers) AddPeer(peer wireguard.PeerConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peers[peer.PublicKey] = peer
+	return nil
+}
+
+func (m *memoryPeers) RemovePeer(publicKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.peers, publicKey)
+	return nil
+}
+
+func (m *memoryPeers) GetInterfaceStats() (*wireguard.InterfaceStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := &wireguard.InterfaceStats{InterfaceName: "wg0"}
+	for _, p := range m.peers {
+		stats.Peers = append(stats.Peers, wireguard.PeerStats{PublicKey: p.PublicKey, AllowedIPs: p.AllowedIPs})
+	}
+	return stats, nil
+}
+
+func startNodeAPI(t *testing.T, nodeKey, gatewayKey *wireguard.KeyPair, peers nodeapi.PeerManager) *models.VPNNode {
+	server, err := nodeapi.NewServer(peers, nodeKey.PrivateKey, gatewayKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to create node API server: %v", err)
+	}
+
+	ts := httptest.NewServer(server.Handler())
+	t.Cleanup(ts.Close)
+
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	apiPort, _ := strconv.Atoi(port)
+
+	return &models.VPNNode{Name: "test-node", PublicIP: host, APIPort: apiPort, PublicKey: nodeKey.PublicKey}
+}
+
+func TestNodeAPIPeerLifecycle(t *testing.T) {
+	nodeKey, _ := wireguard.GenerateKeyPair()
+	gatewayKey, _ := wireguard.GenerateKeyPair()
+	clientKey, _ := wireguard.GenerateKeyPair()
+
+	peers := &memoryPeers{peers: make(map[string]wireguard.PeerConfig)}
+	node := startNodeAPI(t, nodeKey, gatewayKey, peers)
+
+	client, err := nodeapi.NewClient(gatewayKey.PrivateKey, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	ctx := context.Background()
+	peer := wireguard.PeerConfig{
+		PublicKey:           clientKey.PublicKey,
+		AllowedIPs:          []string{"10.8.0.2/32"},
+		PersistentKeepalive: 25,
+	}
+
+	if err := client.AddPeer(ctx, node, peer); err != nil {
+		t.Fatalf("AddPeer failed: %v", err)
+	}
+
+	listed, err := client.ListPeers(ctx, node)
+	if err != nil {
+		t.Fatalf("ListPeers failed: %v", err)
+	}
+	if len(listed) != 1 || listed[0].PublicKey != clientKey.PublicKey {
+		t.Fatalf("Expected the added peer to be listed, got %+v", listed)
+	}
+
+	if err := client.RemovePeer(ctx, node, clientKey.PublicKey); err != nil {
+		t.Fatalf("RemovePeer failed: %v", err)
+	}
+
+	if len(peers.peers) != 0 {
+		t.Errorf("Expected no peers after removal, got %d", len(peers.peers))
+	}
+}
+
+func TestNodeAPIRejectsUnknownGateway(t *testing.T) {
+	nodeKey, _ := wireguard.GenerateKeyPair()
+	gatewayKey, _ := wireguard.GenerateKeyPair()
+	otherKey, _ := wireguard.GenerateKeyPair()
+
+	peers := &memoryPeers{peers: make(map[string]wireguard.PeerConfig)}
+	node := startNodeAPI(t, nodeKey, gatewayKey, peers)
+
+	client, err := nodeapi.NewClient(otherKey.PrivateKey, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if _, err := client.ListPeers(context.Background(), node); err == nil {
+		t.Error("Expected request from an untrusted gateway key to fail")
+	}
+
+	// A client trusting the wrong node key must not accept the node's answers
+	client, _ = nodeapi.NewClient(gatewayKey.PrivateKey, 5*time.Second)
+	node.PublicKey = otherKey.PublicKey
+	if _, err := client.ListPeers(context.Background(), node); err == nil {
+		t.Error("Expected response signed by a different node key to be rejected")
+	}
+}
@@ -0,0 +1,134 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/hdwallet"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/payment"
+	"github.com/nikola43/aureo-vpn/pkg/pricing"
+)
+
+func TestCreatePaymentDerivesUniqueAddresses(t *testing.T) {
+	setupTestDB(t, &models.User{}, &models.ExchangeRateSnapshot{}, &models.AddressDerivation{}, &models.Payment{}, &models.Plan{})
+
+	wallets, err := hdwallet.LoadWallets(map[string]string{"ETH": bip32VectorM0H, "BTC": ""})
+	if err != nil {
+		t.Fatalf("LoadWallets failed: %v", err)
+	}
+	rates := pricing.NewStaticProvider("test", map[string]float64{"ETH": 2000})
+	processor := payment.NewCryptoPaymentProcessor(rates, wallets, newTestPlans(t))
+
+	userID := uuid.New()
+	ctx := context.Background()
+	first, err := processor.CreatePayment(ctx, userID, "ETH", "basic", 1)
+	if err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+	second, err := processor.CreatePayment(ctx, userID, "ethereum", "basic", 1)
+	if err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+
+	for i, p := range []*models.Payment{first, second} {
+		want, _ := wallets["ETH"].Address(uint32(i))
+		if p.Address != want || p.DerivationIndex == nil || *p.DerivationIndex != uint32(i) {
+			t.Errorf("Expected payment %d to use address %s, got %s", i, want, p.Address)
+		}
+		if p.RateSnapshotID == nil || p.ExchangeRate != 2000 {
+			t.Errorf("Expected payment %d to record its exchange rate", i)
+		}
+	}
+
+	if _, err := processor.CreatePayment(ctx, userID, "BTC", "basic", 1); err == nil {
+		t.Error("Expected an error for a currency without a wallet")
+	}
+	if supported := processor.GetSupportedCryptocurrencies(); len(supported) != 1 || supported[0].Symbol != "ETH" {
+		t.Errorf("Expected only ETH to be supported, got %v", supported)
+	}
+}
+
+func TestCreatePaymentValidatesPlan(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.ExchangeRateSnapshot{}, &models.AddressDerivation{}, &models.Payment{}, &models.Plan{})
+	wallets, _ := hdwallet.LoadWallets(map[string]string{"ETH": bip32VectorM0H})
+	processor := payment.NewCryptoPaymentProcessor(pricing.NewStaticProvider("test", map[string]float64{"ETH": 2000}), wallets, newTestPlans(t))
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		tier     string
+		duration int
+	}{{"platinum", 1}, {"free", 1}, {"basic", 0}, {"basic", 25}} {
+		if _, err := processor.CreatePayment(ctx, uuid.New(), "ETH", tc.tier, tc.duration); !errors.Is(err, payment.ErrInvalidPlan) {
+			t.Errorf("Expected ErrInvalidPlan for %s/%d, got %v", tc.tier, tc.duration, err)
+		}
+	}
+
+	var count int64
+	db.Model(&models.Payment{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected no payments to be created, got %d", count)
+	}
+}
+
+func TestPaymentStateMachine(t *testing.T) {
+	transitions := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{models.PaymentPending, models.PaymentDetected, true},
+		{models.PaymentPending, models.PaymentExpired, true},
+		{models.PaymentPending, models.PaymentConfirmed, false},
+		{models.PaymentDetected, models.PaymentConfirmed, true},
+		{models.PaymentDetected, models.PaymentUnderpaid, true},
+		{models.PaymentConfirmed, models.PaymentRefunded, true},
+		{models.PaymentConfirmed, models.PaymentPending, false},
+		{models.PaymentExpired, models.PaymentConfirmed, false},
+		{models.PaymentExpired, models.PaymentLate, true},
+		{models.PaymentLate, models.PaymentRefunded, true},
+		{models.PaymentRefunded, models.PaymentConfirmed, false},
+	}
+	for _, tc := range transitions {
+		p := &models.Payment{Status: tc.from}
+		if got := p.CanTransitionTo(tc.to); got != tc.allowed {
+			t.Errorf("Expected %s -> %s allowed=%v, got %v", tc.from, tc.to, tc.allowed, got)
+		}
+	}
+}
+
+func TestRefundPayment(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.ExchangeRateSnapshot{}, &models.AddressDerivation{}, &models.Payment{}, &models.Plan{})
+	wallets, _ := hdwallet.LoadWallets(map[string]string{"ETH": bip32VectorM0H})
+	processor := payment.NewCryptoPaymentProcessor(pricing.NewStaticProvider("test", map[string]float64{"ETH": 2000}), wallets, newTestPlans(t))
+	ctx := context.Background()
+	userID := uuid.New()
+
+	p, err := processor.CreatePayment(ctx, userID, "ETH", "basic", 1)
+	if err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+
+	if err := processor.RefundPayment(ctx, p.ID); !errors.Is(err, payment.ErrInvalidTransition) {
+		t.Fatalf("Expected pending payments not to be refundable, got %v", err)
+	}
+
+	db.Model(&models.Payment{}).Where("id = ?", p.ID).Update("status", models.PaymentConfirmed)
+	if err := processor.RefundPayment(ctx, p.ID); err != nil {
+		t.Fatalf("RefundPayment failed: %v", err)
+	}
+
+	refunded, err := processor.GetPayment(ctx, userID, p.ID)
+	if err != nil {
+		t.Fatalf("GetPayment failed: %v", err)
+	}
+	if refunded.Status != models.PaymentRefunded || refunded.RefundedAt == nil || time.Since(*refunded.RefundedAt) > time.Minute {
+		t.Errorf("Expected the payment to be refunded with a timestamp, got %s", refunded.Status)
+	}
+
+	if _, err := processor.GetPayment(ctx, uuid.New(), p.ID); !errors.Is(err, payment.ErrPaymentNotFound) {
+		t.Errorf("Expected other users not to see the payment, got %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/blockchain"
+	"github.com/nikola43/aureo-vpn/pkg/hdwallet"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/payment"
+	"github.com/nikola43/aureo-vpn/pkg/pricing"
+	"gorm.io/gorm"
+)
+
+// fakeDeposits is an in-memory DepositScanner. Each address has a list of
+// deposits with their confirmation counts.
+type fakeDeposits struct {
+	deposits map[string][]fakeDeposit
+	watched  map[string]int
+}
+
+type fakeDeposit struct {
+	amount        float64
+	confirmations int64
+}
+
+func newFakeDeposits() *fakeDeposits {
+	return &fakeDeposits{deposits: make(map[string][]fakeDeposit), watched: make(map[string]int)}
+}
+
+func (f *fakeDeposits) WatchAddress(ctx context.Context, walletType, address string, since time.Time) error {
+	f.watched[address]++
+	return nil
+}
+
+func (f *fakeDeposits) ReceivedByAddress(ctx context.Context, walletType, address string, minConf int64) (*blockchain.Deposit, error) {
+	total := 0.0
+	for _, deposit := range f.deposits[address] {
+		if deposit.confirmations >= minConf {
+			total += deposit.amount
+		}
+	}
+	return &blockchain.Deposit{Address: address, Amount: big.NewFloat(total), TxHashes: []string{"tx-" + address}}, nil
+}
+
+func setupPaymentWatcher(t *testing.T) (*gorm.DB, *payment.CryptoPaymentProcessor, *fakeDeposits, *payment.Watcher) {
+	t.Helper()
+
+	db := setupTestDB(t, &models.User{}, &models.ExchangeRateSnapshot{}, &models.AddressDerivation{}, &models.Payment{}, &models.Plan{})
+
+	wallets, _ := hdwallet.LoadWallets(map[string]string{"ETH": bip32VectorM0H})
+	rates := pricing.NewStaticProvider("test", map[string]float64{"ETH": 999})
+	processor := payment.NewCryptoPaymentProcessor(rates, wallets, newTestPlans(t))
+	chain := newFakeDeposits()
+
+	return db, processor, chain, payment.NewWatcher(processor, chain, time.Minute, 0.005, 24*time.Hour)
+}
+
+func TestWatcherConfirmsPaymentOnce(t *testing.T) {
+	db, processor, chain, watcher := setupPaymentWatcher(t)
+	user := createPlanUser(t, db, "free", time.Time{})
+	ctx := context.Background()
+
+	p, err := processor.CreatePayment(ctx, user.ID, "ETH", "premium", 1)
+	if err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+
+	// Seen in the mempool
+	chain.deposits[p.Address] = []fakeDeposit{{amount: p.AmountCrypto, confirmations: 0}}
+	watcher.RunOnce(ctx)
+	if p, _ = processor.GetPayment(ctx, user.ID, p.ID); p.Status != models.PaymentDetected {
+		t.Fatalf("Expected the payment to be detected, got %s", p.Status)
+	}
+
+	// Confirmed, slightly overpaid
+	chain.deposits[p.Address] = []fakeDeposit{{amount: p.AmountCrypto * 1.1, confirmations: 12}}
+	watcher.RunOnce(ctx)
+	watcher.RunOnce(ctx)
+	if p, _ = processor.GetPayment(ctx, user.ID, p.ID); p.Status != models.PaymentConfirmed || p.TxHash == "" {
+		t.Fatalf("Expected the payment to be confirmed, got %s", p.Status)
+	}
+
+	var updated models.User
+	db.First(&updated, user.ID)
+	if updated.SubscriptionTier != "premium" {
+		t.Errorf("Expected the premium subscription to be active, got %s", updated.SubscriptionTier)
+	}
+
+	// Activated exactly once: one month from now, not two
+	if expiry := time.Until(updated.SubscriptionExpiry); expiry > 32*24*time.Hour {
+		t.Errorf("Expected a single month of subscription, got %s", expiry)
+	}
+	if chain.watched[p.Address] != 1 {
+		t.Errorf("Expected the address to be watched once, got %d", chain.watched[p.Address])
+	}
+}
+
+func TestWatcherExpiresAndFlagsUnderpayments(t *testing.T) {
+	db, processor, chain, watcher := setupPaymentWatcher(t)
+	user := createPlanUser(t, db, "free", time.Time{})
+	ctx := context.Background()
+
+	unpaid, _ := processor.CreatePayment(ctx, user.ID, "ETH", "basic", 1)
+	underpaid, _ := processor.CreatePayment(ctx, user.ID, "ETH", "basic", 1)
+	confirming, _ := processor.CreatePayment(ctx, user.ID, "ETH", "basic", 1)
+	db.Model(&models.Payment{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute))
+
+	chain.deposits[underpaid.Address] = []fakeDeposit{{amount: underpaid.AmountCrypto / 2, confirmations: 20}}
+	chain.deposits[confirming.Address] = []fakeDeposit{{amount: confirming.AmountCrypto, confirmations: 1}}
+	watcher.RunOnce(ctx)
+
+	want := map[uuid.UUID]string{
+		unpaid.ID:     models.PaymentExpired,
+		underpaid.ID:  models.PaymentUnderpaid,
+		confirming.ID: models.PaymentDetected, // Sent before expiry, still confirming
+	}
+	for id, status := range want {
+		if p, _ := processor.GetPayment(ctx, user.ID, id); p.Status != status {
+			t.Errorf("Expected payment %s to be %s, got %s", id, status, p.Status)
+		}
+	}
+
+	var updated models.User
+	db.First(&updated, user.ID)
+	if updated.SubscriptionTier != "free" {
+		t.Errorf("Expected no subscription to be activated, got %s", updated.SubscriptionTier)
+	}
+}
+
+func TestWatcherFlagsLateFundsForRefund(t *testing.T) {
+	db, processor, chain, watcher := setupPaymentWatcher(t)
+	user := createPlanUser(t, db, "free", time.Time{})
+	ctx := context.Background()
+
+	late, _ := processor.CreatePayment(ctx, user.ID, "ETH", "basic", 1)
+	underpaid, _ := processor.CreatePayment(ctx, user.ID, "ETH", "basic", 1)
+	forgotten, _ := processor.CreatePayment(ctx, user.ID, "ETH", "basic", 1)
+	db.Model(&models.Payment{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Hour))
+	db.Model(forgotten).Update("expires_at", time.Now().Add(-48*time.Hour))
+
+	chain.deposits[underpaid.Address] = []fakeDeposit{{amount: underpaid.AmountCrypto / 2, confirmations: 20}}
+	watcher.RunOnce(ctx)
+
+	// The full amount arrives after expiry, and the rest of the underpayment
+	chain.deposits[late.Address] = []fakeDeposit{{amount: late.AmountCrypto, confirmations: 20}}
+	chain.deposits[underpaid.Address] = append(chain.deposits[underpaid.Address], fakeDeposit{amount: underpaid.AmountCrypto / 2, confirmations: 20})
+	chain.deposits[forgotten.Address] = []fakeDeposit{{amount: forgotten.AmountCrypto, confirmations: 20}}
+	watcher.RunOnce(ctx)
+	watcher.RunOnce(ctx)
+
+	if p, _ := processor.GetPayment(ctx, user.ID, late.ID); p.Status != models.PaymentLate || p.LateAt == nil || p.AmountReceived != late.AmountCrypto {
+		t.Errorf("Expected the late payment to be flagged with its funds, got %s with %v", p.Status, p.AmountReceived)
+	}
+	if p, _ := processor.GetPayment(ctx, user.ID, underpaid.ID); p.Status != models.PaymentUnderpaid || p.AmountReceived != underpaid.AmountCrypto {
+		t.Errorf("Expected the underpayment to track the late funds, got %s with %v", p.Status, p.AmountReceived)
+	}
+	if p, _ := processor.GetPayment(ctx, user.ID, forgotten.ID); p.Status != models.PaymentExpired {
+		t.Errorf("Expected payments past the grace period to stay expired, got %s", p.Status)
+	}
+
+	var updated models.User
+	db.First(&updated, user.ID)
+	if updated.SubscriptionTier != "free" {
+		t.Errorf("Expected late funds not to activate a subscription, got %s", updated.SubscriptionTier)
+	}
+
+	// Late funds are refunded like underpayments
+	if err := processor.RefundPayment(ctx, late.ID); err != nil {
+		t.Errorf("RefundPayment failed: %v", err)
+	}
+}
+
+func TestBitcoinClientWatchesDepositsInDescriptorWallet(t *testing.T) {
+	// A stand-in for a regtest bitcoind with a descriptor payout wallet
+	wallets := map[string]bool{"payouts": true}
+	var imported []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		json.Unmarshal(body, &req)
+
+		wallet := strings.TrimPrefix(r.URL.Path, "/wallet/")
+		reply := func(result interface{}, code int, message string) {
+			response := map[string]interface{}{"result": result, "error": nil, "id": "aureo-vpn"}
+			if code != 0 {
+				response["error"] = map[string]interface{}{"code": code, "message": message}
+			}
+			json.NewEncoder(w).Encode(response)
+		}
+
+		switch req.Method {
+		case "getblockchaininfo":
+			reply(map[string]interface{}{"chain": "regtest"}, 0, "")
+		case "loadwallet":
+			reply(nil, -18, "Wallet file not found")
+		case "createwallet":
+			if req.Params[1] != true {
+				t.Errorf("Expected a wallet without private keys, got %v", req.Params)
+			}
+			wallets[req.Params[0].(string)] = true
+			reply(map[string]interface{}{"name": req.Params[0]}, 0, "")
+		case "getdescriptorinfo":
+			reply(map[string]interface{}{"descriptor": req.Params[0].(string) + "#checksum"}, 0, "")
+		case "importdescriptors", "listreceivedbyaddress":
+			if !wallets[wallet] || wallet == "payouts" {
+				reply(nil, -18, "Requested wallet does not exist or is not loaded")
+				return
+			}
+			if req.Method == "importdescriptors" {
+				requests := req.Params[0].([]interface{})
+				imported = append(imported, requests[0].(map[string]interface{}))
+				reply([]map[string]interface{}{{"success": true}}, 0, "")
+				return
+			}
+			reply([]map[string]interface{}{
+				{"address": "bcrt1qtest", "amount": 0.25, "confirmations": 3, "txids": []string{"abc"}},
+			}, 0, "")
+		default:
+			reply(nil, -32601, "Method not found")
+		}
+	}))
+	defer server.Close()
+
+	client, err := blockchain.NewBitcoinClient(server.URL+"/wallet/payouts", "user", "pass", logger.Global())
+	if err != nil {
+		t.Fatalf("NewBitcoinClient failed: %v", err)
+	}
+
+	created := time.Now().Add(-time.Hour)
+	if err := client.WatchAddress(context.Background(), "bcrt1qtest", created); err != nil {
+		t.Fatalf("WatchAddress failed: %v", err)
+	}
+	if len(imported) != 1 || imported[0]["desc"] != "addr(bcrt1qtest)#checksum" || imported[0]["timestamp"] != float64(created.Unix()) {
+		t.Fatalf("Expected the address to be imported as a descriptor rescanned from its creation, got %v", imported)
+	}
+
+	deposit, err := client.ReceivedByAddress(context.Background(), "bcrt1qtest", 1)
+	if err != nil {
+		t.Fatalf("ReceivedByAddress failed: %v", err)
+	}
+	if amount, _ := deposit.Amount.Float64(); amount != 0.25 {
+		t.Errorf("Expected 0.25 BTC from the watch-only wallet, got %v", amount)
+	}
+}
+
+func TestBitcoinClientReceivedByAddress(t *testing.T) {
+	// A stand-in for a regtest bitcoind
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		json.Unmarshal(body, &req)
+
+		var result interface{}
+		switch req.Method {
+		case "listreceivedbyaddress":
+			if req.Params[0].(float64) > 3 {
+				result = []interface{}{}
+			} else {
+				result = []map[string]interface{}{
+					{"address": "bcrt1qtest", "amount": 0.25, "confirmations": 3, "txids": []string{"abc"}},
+					{"address": "bcrt1qother", "amount": 1.0, "confirmations": 3, "txids": []string{"def"}},
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": result, "error": nil, "id": "aureo-vpn"})
+	}))
+	defer server.Close()
+
+	client, err := blockchain.NewBitcoinClient(server.URL, "user", "pass", logger.Global())
+	if err != nil {
+		t.Fatalf("NewBitcoinClient failed: %v", err)
+	}
+
+	deposit, err := client.ReceivedByAddress(context.Background(), "bcrt1qtest", 1)
+	if err != nil {
+		t.Fatalf("ReceivedByAddress failed: %v", err)
+	}
+	if amount, _ := deposit.Amount.Float64(); amount != 0.25 || len(deposit.TxHashes) != 1 {
+		t.Errorf("Expected 0.25 BTC in one transaction, got %v in %v", amount, deposit.TxHashes)
+	}
+
+	deposit, _ = client.ReceivedByAddress(context.Background(), "bcrt1qtest", 6)
+	if amount, _ := deposit.Amount.Float64(); amount != 0 {
+		t.Errorf("Expected nothing with 6 confirmations, got %v", amount)
+	}
+}
@@ -0,0 +1,295 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/blockchain"
+	"github.com/nikola43/aureo-vpn/pkg/config"
+	"github.com/nikola43/aureo-vpn/pkg/ledger"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/pricing"
+	"github.com/nikola43/aureo-vpn/pkg/rewards"
+	"gorm.io/gorm"
+)
+
+// fakeChain is an in-memory TransactionSender
+type fakeChain struct {
+	signErr       error
+	broadcastErr  error
+	signs         int
+	sent          float64
+	broadcasts    []string
+	status        string
+	confirmations int64
+}
+
+func (c *fakeChain) SignTransaction(ctx context.Context, walletType, toAddress string, amount float64) (*blockchain.SignedTransaction, error) {
+	c.signs++
+	c.sent = amount
+	if c.signErr != nil {
+		return nil, c.signErr
+	}
+	return &blockchain.SignedTransaction{TxHash: "0xfeed", Raw: fmt.Sprintf("0xsigned%d", c.signs)}, nil
+}
+
+func (c *fakeChain) BroadcastTransaction(ctx context.Context, walletType, raw string) error {
+	c.broadcasts = append(c.broadcasts, raw)
+	return c.broadcastErr
+}
+
+func (c *fakeChain) GetTransactionStatus(ctx context.Context, walletType, txHash string) (*blockchain.Transaction, error) {
+	return &blockchain.Transaction{TxHash: txHash, Status: c.status, Confirmations: c.confirmations}, nil
+}
+
+func testPayoutConfig() config.PayoutConfig {
+	return config.PayoutConfig{
+		PollInterval:   time.Millisecond,
+		MaxAttempts:    2,
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  time.Millisecond,
+		LeaseDuration:  time.Minute,
+		Confirmations:  map[string]int64{"ethereum": 12},
+	}
+}
+
+// setupPayout creates an operator with $20 of earnings and queues a payout for it
+func setupPayout(t *testing.T) (*gorm.DB, *rewards.RewardService, *models.NodeOperator) {
+	t.Helper()
+
+	db := setupTestDB(t,
+		&models.User{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{},
+		&models.OperatorEarning{}, &models.OperatorPayout{}, &models.PayoutJob{}, &models.ExchangeRateSnapshot{},
+		&models.JournalEntry{}, &models.LedgerPosting{},
+	)
+
+	operator := &models.NodeOperator{UserID: uuid.New(), WalletAddress: "0xdef", WalletType: "ethereum", Status: "active"}
+	db.Create(operator)
+
+	earning := &models.OperatorEarning{OperatorID: operator.ID, NodeID: uuid.New(), SessionID: uuid.New(), AmountUSD: 20}
+	db.Create(earning)
+	ledger.PostEarning(db, earning)
+	ledger.RefreshOperator(db, operator.ID)
+
+	rates := pricing.NewStaticProvider("test", map[string]float64{"ETH": 2000})
+	service := rewards.NewRewardService(logger.Global(), rates)
+	if err := service.ProcessPayouts(context.Background(), 10); err != nil {
+		t.Fatalf("ProcessPayouts failed: %v", err)
+	}
+
+	return db, service, operator
+}
+
+func loadPayoutJob(t *testing.T, db *gorm.DB) (models.PayoutJob, models.OperatorPayout) {
+	t.Helper()
+
+	var job models.PayoutJob
+	if err := db.First(&job).Error; err != nil {
+		t.Fatalf("Failed to load payout job: %v", err)
+	}
+	var payout models.OperatorPayout
+	if err := db.First(&payout, job.PayoutID).Error; err != nil {
+		t.Fatalf("Failed to load payout: %v", err)
+	}
+	return job, payout
+}
+
+func TestPayoutWorkerCompletesAfterConfirmations(t *testing.T) {
+	db, service, operator := setupPayout(t)
+	chain := &fakeChain{status: "confirmed", confirmations: 3}
+	worker := rewards.NewPayoutWorker(logger.Global(), service, chain, testPayoutConfig())
+	ctx := context.Background()
+
+	job, payout := loadPayoutJob(t, db)
+	var snapshot models.ExchangeRateSnapshot
+	if payout.RateSnapshotID == nil || db.First(&snapshot, *payout.RateSnapshotID).Error != nil {
+		t.Fatal("Expected the payout to reference its exchange rate snapshot")
+	}
+	if snapshot.Symbol != "ETH" || snapshot.RateUSD != 2000 || payout.CryptoAmount != 0.01 {
+		t.Errorf("Expected 0.01 ETH at $2000, got %v %s at $%v", payout.CryptoAmount, snapshot.Symbol, snapshot.RateUSD)
+	}
+
+	worker.RunOnce(ctx)
+	job, payout = loadPayoutJob(t, db)
+	if job.State != models.PayoutJobSubmitted || payout.Status != "processing" || payout.TransactionHash != "0xfeed" {
+		t.Fatalf("Expected a submitted job and processing payout, got %s and %s", job.State, payout.Status)
+	}
+
+	// Below the confirmation target the payout stays in flight
+	time.Sleep(2 * time.Millisecond)
+	worker.RunOnce(ctx)
+	if job, _ = loadPayoutJob(t, db); job.State != models.PayoutJobSubmitted || job.Confirmations != 3 {
+		t.Fatalf("Expected the job to wait for confirmations, got %s with %d", job.State, job.Confirmations)
+	}
+
+	chain.confirmations = 12
+	time.Sleep(2 * time.Millisecond)
+	worker.RunOnce(ctx)
+	job, payout = loadPayoutJob(t, db)
+	if job.State != models.PayoutJobCompleted || payout.Status != "completed" {
+		t.Fatalf("Expected a completed payout, got job %s and payout %s", job.State, payout.Status)
+	}
+	if chain.signs != 1 || len(chain.broadcasts) != 1 || chain.sent != payout.CryptoAmount {
+		t.Errorf("Expected one transaction of %v ETH, got %d of %v", payout.CryptoAmount, chain.signs, chain.sent)
+	}
+
+	balances, _ := ledger.GetOperatorBalances(db, operator.ID)
+	if balances.Paid != ledger.FromUSD(20) || balances.InFlight != 0 {
+		t.Errorf("Expected $20 paid and nothing in flight, got %+v", *balances)
+	}
+}
+
+func TestPayoutWorkerRetriesThenFails(t *testing.T) {
+	db, service, operator := setupPayout(t)
+	chain := &fakeChain{signErr: errors.New("rpc unavailable")}
+	worker := rewards.NewPayoutWorker(logger.Global(), service, chain, testPayoutConfig())
+	ctx := context.Background()
+
+	worker.RunOnce(ctx)
+	job, _ := loadPayoutJob(t, db)
+	if job.State != models.PayoutJobQueued || job.Attempts != 1 || job.LastError == "" {
+		t.Fatalf("Expected the job to be retried, got %s after %d attempts", job.State, job.Attempts)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	worker.RunOnce(ctx)
+	job, payout := loadPayoutJob(t, db)
+	if job.State != models.PayoutJobFailed || payout.Status != "failed" {
+		t.Fatalf("Expected a failed payout after max attempts, got job %s and payout %s", job.State, payout.Status)
+	}
+
+	balances, _ := ledger.GetOperatorBalances(db, operator.ID)
+	if balances.Payable != ledger.FromUSD(20) || balances.InFlight != 0 {
+		t.Errorf("Expected the $20 to be payable again, got %+v", *balances)
+	}
+
+	drifts, err := ledger.Reconcile(db)
+	if err != nil || len(drifts) != 0 {
+		t.Errorf("Expected a consistent ledger, got %v (%v)", drifts, err)
+	}
+}
+
+func TestPayoutWorkerDoesNotResendInterruptedPayouts(t *testing.T) {
+	db, service, _ := setupPayout(t)
+	chain := &fakeChain{status: "confirmed", confirmations: 12}
+
+	// A worker that crashed after marking the job as sending
+	expired := time.Now().Add(-time.Minute)
+	db.Model(&models.PayoutJob{}).Where("1 = 1").Updates(map[string]interface{}{
+		"state":            models.PayoutJobSending,
+		"attempts":         1,
+		"lease_owner":      "crashed",
+		"lease_expires_at": expired,
+	})
+
+	worker := rewards.NewPayoutWorker(logger.Global(), service, chain, testPayoutConfig())
+	worker.RunOnce(context.Background())
+
+	job, payout := loadPayoutJob(t, db)
+	if job.State != models.PayoutJobReview {
+		t.Errorf("Expected the job to need review, got %s", job.State)
+	}
+	if payout.Status == "completed" || payout.Status == "failed" {
+		t.Errorf("Expected the payout to stay unsettled, got %s", payout.Status)
+	}
+	if chain.signs != 0 || len(chain.broadcasts) != 0 {
+		t.Errorf("Expected no transaction to be sent, got %d", chain.signs)
+	}
+}
+
+func TestPayoutWorkerRebroadcastsTheSignedTransaction(t *testing.T) {
+	db, service, operator := setupPayout(t)
+	chain := &fakeChain{broadcastErr: errors.New("timeout awaiting response")}
+	worker := rewards.NewPayoutWorker(logger.Global(), service, chain, testPayoutConfig())
+	ctx := context.Background()
+
+	// The transaction is stored before the broadcast that may have reached
+	// the network
+	worker.RunOnce(ctx)
+	job, payout := loadPayoutJob(t, db)
+	if job.State != models.PayoutJobQueued || job.SignedTransaction != "0xsigned1" || payout.TransactionHash != "0xfeed" {
+		t.Fatalf("Expected a queued job holding its signed transaction, got %s with %q", job.State, job.SignedTransaction)
+	}
+
+	// A worker that crashed while broadcasting again
+	db.Model(&models.PayoutJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+		"state":            models.PayoutJobSending,
+		"lease_owner":      "crashed",
+		"lease_expires_at": time.Now().Add(-time.Minute),
+	})
+	chain.broadcastErr = nil
+	worker.RunOnce(ctx)
+
+	job, _ = loadPayoutJob(t, db)
+	if job.State != models.PayoutJobSubmitted || job.TransactionHash != "0xfeed" {
+		t.Fatalf("Expected the stored transaction to be submitted, got %s", job.State)
+	}
+	if chain.signs != 1 || len(chain.broadcasts) != 2 || chain.broadcasts[1] != "0xsigned1" {
+		t.Errorf("Expected the one signed transaction to be broadcast twice, got %d signed and %v", chain.signs, chain.broadcasts)
+	}
+
+	balances, _ := ledger.GetOperatorBalances(db, operator.ID)
+	if balances.InFlight != ledger.FromUSD(20) {
+		t.Errorf("Expected $20 in flight, got %+v", *balances)
+	}
+}
+
+func TestPayoutWorkerReviewsUnbroadcastPayouts(t *testing.T) {
+	db, service, operator := setupPayout(t)
+	chain := &fakeChain{broadcastErr: errors.New("connection reset")}
+	worker := rewards.NewPayoutWorker(logger.Global(), service, chain, testPayoutConfig())
+	ctx := context.Background()
+
+	worker.RunOnce(ctx)
+	time.Sleep(2 * time.Millisecond)
+	worker.RunOnce(ctx)
+
+	// The transaction may be on the network, so the payout is not failed
+	job, payout := loadPayoutJob(t, db)
+	if job.State != models.PayoutJobReview || payout.Status == "failed" {
+		t.Fatalf("Expected the job to need review, got job %s and payout %s", job.State, payout.Status)
+	}
+	if chain.signs != 1 || len(chain.broadcasts) != 2 {
+		t.Errorf("Expected one transaction broadcast twice, got %d signed and %d broadcasts", chain.signs, len(chain.broadcasts))
+	}
+
+	balances, _ := ledger.GetOperatorBalances(db, operator.ID)
+	if balances.InFlight != ledger.FromUSD(20) || balances.Payable != 0 {
+		t.Errorf("Expected the $20 to stay in flight, got %+v", *balances)
+	}
+}
+
+func TestPayoutWorkerWithoutChainLeavesPayoutsQueued(t *testing.T) {
+	db, service, operator := setupPayout(t)
+	worker := rewards.NewPayoutWorker(logger.Global(), service, nil, testPayoutConfig())
+	ctx := context.Background()
+
+	if processed, err := worker.RunOnce(ctx); err != nil || processed != 0 {
+		t.Fatalf("Expected no jobs to be processed, got %d: %v", processed, err)
+	}
+	job, payout := loadPayoutJob(t, db)
+	if job.State != models.PayoutJobQueued || job.Attempts != 0 || payout.TransactionHash != "" {
+		t.Fatalf("Expected the job to stay queued, got %s after %d attempts", job.State, job.Attempts)
+	}
+
+	// A payout submitted by a worker with a chain is not settled either
+	db.Model(&models.PayoutJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+		"state":            models.PayoutJobSubmitted,
+		"transaction_hash": "0xfeed",
+	})
+	worker.RunOnce(ctx)
+
+	job, payout = loadPayoutJob(t, db)
+	if job.State != models.PayoutJobSubmitted || payout.Status == "completed" {
+		t.Errorf("Expected the payout to stay unsettled, got job %s and payout %s", job.State, payout.Status)
+	}
+	balances, _ := ledger.GetOperatorBalances(db, operator.ID)
+	if balances.Paid != 0 {
+		t.Errorf("Expected nothing paid, got %+v", *balances)
+	}
+}
@@ -0,0 +1,146 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	apperrors "github.com/nikola43/aureo-vpn/pkg/errors"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"gorm.io/gorm"
+)
+
+// newTestPlans creates the default plans in the test database
+func newTestPlans(t *testing.T) *plans.Service {
+	t.Helper()
+
+	service := plans.NewService()
+	if err := service.InitializePlans(context.Background()); err != nil {
+		t.Fatalf("InitializePlans failed: %v", err)
+	}
+	return service
+}
+
+func createPlanUser(t *testing.T, db *gorm.DB, tier string, expiry time.Time) *models.User {
+	t.Helper()
+
+	user := &models.User{
+		Email:              uuid.NewString() + "@example.com",
+		Username:           uuid.NewString(),
+		PasswordHash:       "x",
+		SubscriptionTier:   tier,
+		SubscriptionExpiry: expiry,
+	}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	return user
+}
+
+// assertNotEntitled checks err is an entitlement error for feature
+func assertNotEntitled(t *testing.T, err error, feature string) {
+	t.Helper()
+
+	var appErr *apperrors.AppError
+	if !errors.As(err, &appErr) || appErr.Code != plans.ErrCodeNotEntitled {
+		t.Fatalf("Expected a %s entitlement error, got %v", feature, err)
+	}
+	if appErr.Details["feature"] != feature {
+		t.Errorf("Expected feature %s, got %v", feature, appErr.Details["feature"])
+	}
+}
+
+func TestInitializePlansKeepsExistingPlans(t *testing.T) {
+	db := setupTestDB(t, &models.Plan{})
+	service := newTestPlans(t)
+
+	db.Model(&models.Plan{}).Where("name = ?", "basic").Update("price_usd", 7.99)
+	if err := service.InitializePlans(context.Background()); err != nil {
+		t.Fatalf("InitializePlans failed: %v", err)
+	}
+
+	catalog, err := service.List(context.Background())
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(catalog) != len(plans.DefaultPlans) {
+		t.Fatalf("Expected %d plans, got %d", len(plans.DefaultPlans), len(catalog))
+	}
+	if catalog[0].Name != models.FreePlan || catalog[1].Name != "basic" || catalog[1].PriceUSD != 7.99 {
+		t.Errorf("Expected plans cheapest first with the edited price kept, got %s %s %.2f", catalog[0].Name, catalog[1].Name, catalog[1].PriceUSD)
+	}
+}
+
+func TestForUserFallsBackToFreePlan(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.Plan{})
+	service := newTestPlans(t)
+	ctx := context.Background()
+
+	active := createPlanUser(t, db, "premium", time.Now().Add(time.Hour))
+	expired := createPlanUser(t, db, "premium", time.Now().Add(-time.Hour))
+	retired := createPlanUser(t, db, "enterprise", time.Now().Add(time.Hour))
+
+	for user, want := range map[*models.User]string{active: "premium", expired: models.FreePlan, retired: models.FreePlan} {
+		_, plan, err := service.ForUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("ForUser failed: %v", err)
+		}
+		if plan.Name != want {
+			t.Errorf("Expected %s subscription to resolve to %s, got %s", user.SubscriptionTier, want, plan.Name)
+		}
+	}
+}
+
+// checkSession returns only the error of CheckSession
+func checkSession(service *plans.Service, userID uuid.UUID, protocol string, obfuscated bool) error {
+	_, err := service.CheckSession(context.Background(), userID, protocol, obfuscated)
+	return err
+}
+
+func TestCheckSessionEnforcesPlanLimits(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.Plan{})
+	service := newTestPlans(t)
+
+	free := createPlanUser(t, db, models.FreePlan, time.Time{})
+
+	assertNotEntitled(t, checkSession(service, free.ID, "openvpn", false), plans.FeatureProtocol)
+	assertNotEntitled(t, checkSession(service, free.ID, "wireguard", true), plans.FeatureObfuscation)
+
+	plan, err := service.CheckSession(context.Background(), free.ID, "wireguard", false)
+	if err != nil {
+		t.Fatalf("Expected a free session to be allowed, got %v", err)
+	}
+	if plan.Name != models.FreePlan || plan.DeviceLimit != 1 {
+		t.Errorf("Expected the free plan with its device limit, got %s with %d", plan.Name, plan.DeviceLimit)
+	}
+
+	db.Model(free).Update("cycle_data_gb", 10)
+	assertNotEntitled(t, checkSession(service, free.ID, "wireguard", false), plans.FeatureBandwidth)
+
+	// Ultimate has no cap
+	ultimate := createPlanUser(t, db, "ultimate", time.Now().Add(time.Hour))
+	db.Model(ultimate).Update("cycle_data_gb", 1000)
+	if err := checkSession(service, ultimate.ID, "openvpn", true); err != nil {
+		t.Errorf("Expected the ultimate plan to allow the session, got %v", err)
+	}
+}
+
+func TestRequireMultiHop(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.Plan{})
+	service := newTestPlans(t)
+	ctx := context.Background()
+
+	premium := createPlanUser(t, db, "premium", time.Now().Add(time.Hour))
+	ultimate := createPlanUser(t, db, "ultimate", time.Now().Add(time.Hour))
+
+	assertNotEntitled(t, service.Require(ctx, premium.ID, plans.FeatureMultiHop), plans.FeatureMultiHop)
+	if err := service.Require(ctx, premium.ID, plans.FeatureObfuscation); err != nil {
+		t.Errorf("Expected premium to include obfuscation, got %v", err)
+	}
+	if err := service.Require(ctx, ultimate.ID, plans.FeatureMultiHop); err != nil {
+		t.Errorf("Expected ultimate to include multi-hop, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/pricing"
+)
+
+// fakeRates is a RateProvider whose rate and age can be changed between calls
+type fakeRates struct {
+	usd   float64
+	age   time.Duration
+	err   error
+	calls int
+}
+
+func (f *fakeRates) GetRate(ctx context.Context, symbol string) (*pricing.Rate, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &pricing.Rate{Symbol: symbol, USD: f.usd, Source: "fake", FetchedAt: time.Now().Add(-f.age)}, nil
+}
+
+func TestSymbol(t *testing.T) {
+	tests := map[string]string{
+		"ethereum": "ETH",
+		"Bitcoin":  "BTC",
+		"ltc":      "LTC",
+		"XMR":      "XMR",
+	}
+	for input, want := range tests {
+		if got := pricing.Symbol(input); got != want {
+			t.Errorf("Symbol(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestStaticProvider(t *testing.T) {
+	provider := pricing.NewStaticProvider("test", map[string]float64{"ethereum": 2000})
+
+	rate, err := provider.GetRate(context.Background(), "ETH")
+	if err != nil {
+		t.Fatalf("GetRate failed: %v", err)
+	}
+	if rate.USD != 2000 || rate.Convert(500) != 0.25 {
+		t.Errorf("Expected $2000 per ETH, got %v", rate.USD)
+	}
+
+	if _, err := provider.GetRate(context.Background(), "DOGE"); !errors.Is(err, pricing.ErrUnsupportedSymbol) {
+		t.Errorf("Expected ErrUnsupportedSymbol, got %v", err)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	data := `{"updated_at": "2025-01-01T00:00:00Z", "rates": {"BTC": 45000}}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write rates file: %v", err)
+	}
+
+	rate, err := pricing.NewFileProvider(path).GetRate(context.Background(), "bitcoin")
+	if err != nil {
+		t.Fatalf("GetRate failed: %v", err)
+	}
+	if rate.USD != 45000 || rate.FetchedAt.Year() != 2025 {
+		t.Errorf("Expected $45000 as of 2025, got %v as of %v", rate.USD, rate.FetchedAt)
+	}
+}
+
+func TestCachingProvider(t *testing.T) {
+	source := &fakeRates{usd: 100}
+	provider := pricing.NewCachingProvider(source, time.Hour, 2*time.Hour)
+	ctx := context.Background()
+
+	provider.GetRate(ctx, "LTC")
+	provider.GetRate(ctx, "LTC")
+	if source.calls != 1 {
+		t.Errorf("Expected the second rate to be cached, got %d calls", source.calls)
+	}
+
+	// Rates from the source that are already too old are rejected
+	stale := pricing.NewCachingProvider(&fakeRates{usd: 100, age: 3 * time.Hour}, time.Hour, 2*time.Hour)
+	if _, err := stale.GetRate(ctx, "LTC"); !errors.Is(err, pricing.ErrStaleRate) {
+		t.Errorf("Expected ErrStaleRate, got %v", err)
+	}
+
+	// A failing source falls back to a cached rate younger than the max age
+	source = &fakeRates{usd: 100}
+	provider = pricing.NewCachingProvider(source, 0, time.Hour)
+	provider.GetRate(ctx, "LTC")
+	source.err = errors.New("unavailable")
+	rate, err := provider.GetRate(ctx, "LTC")
+	if err != nil || rate.USD != 100 {
+		t.Errorf("Expected the cached rate while the source is down, got %v (%v)", rate, err)
+	}
+}
+
+func TestMedianProvider(t *testing.T) {
+	ctx := context.Background()
+	provider := pricing.NewMedianProvider(2, time.Hour,
+		&fakeRates{usd: 2000},
+		&fakeRates{usd: 2010},
+		&fakeRates{usd: 9000},
+		&fakeRates{err: errors.New("unavailable")},
+	)
+
+	rate, err := provider.GetRate(ctx, "ETH")
+	if err != nil {
+		t.Fatalf("GetRate failed: %v", err)
+	}
+	if rate.USD != 2010 || !strings.HasPrefix(rate.Source, "median(") {
+		t.Errorf("Expected a median of $2010, got %v from %s", rate.USD, rate.Source)
+	}
+
+	// Stale and failed sources do not count towards the minimum
+	provider = pricing.NewMedianProvider(2, time.Hour,
+		&fakeRates{usd: 2000},
+		&fakeRates{usd: 2010, age: 2 * time.Hour},
+		&fakeRates{err: errors.New("unavailable")},
+	)
+	if _, err := provider.GetRate(ctx, "ETH"); err == nil {
+		t.Error("Expected an error with only one usable source")
+	}
+}
+
+func TestRecordSnapshotKeysOnRate(t *testing.T) {
+	db := setupTestDB(t, &models.ExchangeRateSnapshot{})
+	fetchedAt := time.Now().Add(-time.Minute)
+
+	first, err := pricing.RecordSnapshot(db, &pricing.Rate{Symbol: "BTC", USD: 45000, Source: "median", FetchedAt: fetchedAt})
+	if err != nil {
+		t.Fatalf("RecordSnapshot failed: %v", err)
+	}
+	again, err := pricing.RecordSnapshot(db, &pricing.Rate{Symbol: "BTC", USD: 45000, Source: "median", FetchedAt: fetchedAt})
+	if err != nil || again.ID != first.ID {
+		t.Fatalf("Expected the recorded rate to be reused, got %v", err)
+	}
+
+	// A median whose other sources refreshed keeps its fetch time
+	changed, err := pricing.RecordSnapshot(db, &pricing.Rate{Symbol: "BTC", USD: 45100.5, Source: "median", FetchedAt: fetchedAt})
+	if err != nil {
+		t.Fatalf("RecordSnapshot failed: %v", err)
+	}
+	if changed.ID == first.ID || changed.RateUSD != 45100.5 {
+		t.Errorf("Expected a new snapshot at $45100.5, got %v", changed.RateUSD)
+	}
+}
@@ -0,0 +1,211 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/internal/control"
+	"github.com/nikola43/aureo-vpn/pkg/controlapi"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/nodeapi"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+	"gorm.io/gorm"
+)
+
+// listenUDP opens a UDP port that drops everything, like WireGuard does
+// for unknown peers
+func listenUDP(t *testing.T) (net.PacketConn, int) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen on UDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// setupProbedNode starts the node API and WireGuard port of an online node
+// and a control server probing it
+func setupProbedNode(t *testing.T) (*control.Server, *gorm.DB, *models.VPNNode, *wireguard.FakeBackend, net.PacketConn) {
+	t.Helper()
+
+	db := setupTestDB(t, &models.VPNNode{})
+
+	nodeKey, _ := wireguard.GenerateKeyPair()
+	gatewayKey, _ := wireguard.GenerateKeyPair()
+	backend := wireguard.NewFakeBackend("wg0")
+	node := startNodeAPI(t, nodeKey, gatewayKey, backend)
+
+	wg, wgPort := listenUDP(t)
+
+	node.Hostname = "node.test"
+	node.Country = "Testland"
+	node.CountryCode = "TL"
+	node.City = "Test City"
+	node.Status = "online"
+	node.IsActive = true
+	node.LastHeartbeat = time.Now()
+	node.SupportsWireGuard = true
+	node.WireGuardPort = wgPort
+	if err := db.Create(node).Error; err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	nodeAPI, err := nodeapi.NewClient(gatewayKey.PrivateKey, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create node API client: %v", err)
+	}
+	server := control.NewServer(control.Config{
+		NodeAPI:               nodeAPI,
+		ProbeTimeout:          3 * time.Second,
+		ProbeFailureThreshold: 2,
+	})
+
+	return server, db, node, backend, wg
+}
+
+func TestHealthProbesDegradeUnreachableNodes(t *testing.T) {
+	server, db, node, _, wg := setupProbedNode(t)
+
+	server.CheckHealth()
+
+	var probed models.VPNNode
+	db.First(&probed, node.ID)
+	if probed.Status != "online" || probed.ProbeFailures != 0 || probed.LastHealthCheck.IsZero() {
+		t.Fatalf("Expected a reachable node to stay online, got %q with %d failures: %s", probed.Status, probed.ProbeFailures, probed.LastProbeError)
+	}
+
+	// The WireGuard port starts refusing handshakes
+	wg.Close()
+
+	server.CheckHealth()
+	db.First(&probed, node.ID)
+	if probed.Status != "online" || probed.ProbeFailures != 1 {
+		t.Errorf("Expected the node to stay online after 1 failed probe, got %q with %d failures", probed.Status, probed.ProbeFailures)
+	}
+
+	server.CheckHealth()
+	db.First(&probed, node.ID)
+	if probed.Status != "degraded" || !strings.HasPrefix(probed.LastProbeError, "wireguard") {
+		t.Errorf("Expected the node to be degraded by its WireGuard port, got %q: %s", probed.Status, probed.LastProbeError)
+	}
+
+	// Heartbeats alone do not bring a degraded node back
+	if err := server.Heartbeat(context.Background(), node.ID, controlapi.Heartbeat{Version: controlapi.HeartbeatVersion}); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	db.First(&probed, node.ID)
+	if probed.Status != "degraded" {
+		t.Errorf("Expected a heartbeat to keep the node degraded, got %q", probed.Status)
+	}
+
+	// A successful probe does
+	_, port := listenUDP(t)
+	db.Model(node).Update("wire_guard_port", port)
+
+	server.CheckHealth()
+	db.First(&probed, node.ID)
+	if probed.Status != "online" || probed.ProbeFailures != 0 || probed.LastProbeError != "" {
+		t.Errorf("Expected the node to recover, got %q with %d failures: %s", probed.Status, probed.ProbeFailures, probed.LastProbeError)
+	}
+}
+
+func TestHealthProbesCheckNodeAPI(t *testing.T) {
+	server, db, node, backend, _ := setupProbedNode(t)
+
+	// The node is up but its WireGuard interface is not
+	backend.SetError(errors.New("interface down"))
+	server.CheckHealth()
+	server.CheckHealth()
+
+	var probed models.VPNNode
+	db.First(&probed, node.ID)
+	if probed.Status != "degraded" || !strings.Contains(probed.LastProbeError, "interface down") {
+		t.Errorf("Expected the node to be degraded by its health endpoint, got %q: %s", probed.Status, probed.LastProbeError)
+	}
+
+	// Nodes without heartbeats are offline and not probed
+	backend.SetError(nil)
+	db.Model(node).Update("last_heartbeat", time.Now().Add(-time.Hour))
+
+	server.CheckHealth()
+	db.First(&probed, node.ID)
+	if probed.Status != "offline" || probed.ProbeFailures != 2 {
+		t.Errorf("Expected the node to be offline, got %q with %d failures", probed.Status, probed.ProbeFailures)
+	}
+}
+
+func TestHealthProbesSkipDisabledNodeAPI(t *testing.T) {
+	server, db, node, backend, _ := setupProbedNode(t)
+
+	// The node registers without a node API, e.g. GATEWAY_PUBLIC_KEY unset
+	if err := server.Register(context.Background(), node.ID, controlapi.RegisterRequest{PublicKey: node.PublicKey}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	backend.SetError(errors.New("interface down"))
+
+	server.CheckHealth()
+	server.CheckHealth()
+
+	var probed models.VPNNode
+	db.First(&probed, node.ID)
+	if probed.APIPort != 0 {
+		t.Errorf("Expected the disabled node API to be recorded, got port %d", probed.APIPort)
+	}
+	if probed.Status != "online" || probed.ProbeFailures != 0 {
+		t.Errorf("Expected only the VPN ports to be probed, got %q: %s", probed.Status, probed.LastProbeError)
+	}
+}
+
+func TestHealthProbesOnlyReportedProtocols(t *testing.T) {
+	server, db, node, _, _ := setupProbedNode(t)
+	ctx := context.Background()
+
+	// A node added when every node was assumed to serve OpenVPN, with
+	// nothing listening on its OpenVPN port
+	closed, closedPort := listenUDP(t)
+	closed.Close()
+	db.Model(node).Updates(map[string]interface{}{"supports_open_vpn": true, "open_vpn_port": closedPort})
+
+	register := func(protocols ...string) {
+		t.Helper()
+		req := controlapi.RegisterRequest{PublicKey: node.PublicKey, APIPort: node.APIPort, Protocols: protocols}
+		if err := server.Register(ctx, node.ID, req); err != nil {
+			t.Fatalf("Register failed: %v", err)
+		}
+	}
+
+	register(controlapi.ProtocolWireGuard)
+	server.CheckHealth()
+	server.CheckHealth()
+
+	var probed models.VPNNode
+	db.First(&probed, node.ID)
+	if probed.SupportsOpenVPN || probed.Status != "online" || probed.ProbeFailures != 0 {
+		t.Fatalf("Expected a WireGuard node to stay online with its OpenVPN port closed, got %q: %s", probed.Status, probed.LastProbeError)
+	}
+
+	// OpenVPN is probed over UDP once the node reports serving it
+	openvpn, openvpnPort := listenUDP(t)
+	db.Model(node).Update("open_vpn_port", openvpnPort)
+	register(controlapi.ProtocolWireGuard, controlapi.ProtocolOpenVPN)
+
+	server.CheckHealth()
+	db.First(&probed, node.ID)
+	if !probed.SupportsOpenVPN || probed.Status != "online" || probed.ProbeFailures != 0 {
+		t.Fatalf("Expected an OpenVPN node to stay online, got %q: %s", probed.Status, probed.LastProbeError)
+	}
+
+	openvpn.Close()
+	server.CheckHealth()
+	server.CheckHealth()
+	db.First(&probed, node.ID)
+	if probed.Status != "degraded" || !strings.HasPrefix(probed.LastProbeError, "openvpn") {
+		t.Errorf("Expected the node to be degraded by its OpenVPN port, got %q: %s", probed.Status, probed.LastProbeError)
+	}
+}
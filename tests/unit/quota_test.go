@@ -0,0 +1,184 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/config"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/quota"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+	"gorm.io/gorm"
+)
+
+// fakeLimiter records the rate limits applied to peers
+type fakeLimiter struct {
+	mu     sync.Mutex
+	limits map[string]int
+	err    error
+}
+
+func (f *fakeLimiter) LimitPeer(ctx context.Context, node *models.VPNNode, publicKey string, rateKbps int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.limits[publicKey] = rateKbps
+	return nil
+}
+
+func setupQuota(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := setupTestDB(t, &models.User{}, &models.Plan{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{})
+	newTestPlans(t)
+	return db
+}
+
+func newTestQuota(t *testing.T, action string, limiter quota.PeerLimiter) *quota.Service {
+	t.Helper()
+	cfg := config.QuotaConfig{Action: action, ThrottleKbps: 128, WarningPercents: []int{90, 80}}
+	sessions := session.NewService(logger.Global(), nil, nil, nil, "")
+	return quota.NewService(logger.Global(), newTestPlans(t), sessions, limiter, cfg)
+}
+
+// createQuotaSession connects a free plan user who has used usedGB of their 10GB cap
+func createQuotaSession(t *testing.T, db *gorm.DB, usedGB float64) (*models.User, *models.Session) {
+	t.Helper()
+
+	user := createPlanUser(t, db, models.FreePlan, time.Time{})
+	db.Model(user).Updates(map[string]interface{}{"cycle_data_gb": usedGB, "cycle_started_at": time.Now()})
+
+	node := &models.VPNNode{Name: "node-" + uuid.NewString(), Hostname: "node", PublicIP: "203.0.113.1", Status: "online"}
+	if err := db.Create(node).Error; err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	sess := &models.Session{
+		UserID:      user.ID,
+		NodeID:      node.ID,
+		Protocol:    "wireguard",
+		PublicKey:   uuid.NewString(),
+		ClientIP:    "198.51.100.1",
+		TunnelIP:    "10.8.0.2",
+		Status:      "active",
+		ConnectedAt: time.Now(),
+	}
+	if err := db.Create(sess).Error; err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	return user, sess
+}
+
+func reloadQuota(t *testing.T, db *gorm.DB, user *models.User, sess *models.Session) {
+	t.Helper()
+	userID, sessionID := user.ID, sess.ID
+	*user, *sess = models.User{}, models.Session{}
+	if err := db.First(user, userID).Error; err != nil {
+		t.Fatalf("Failed to reload user: %v", err)
+	}
+	if err := db.First(sess, sessionID).Error; err != nil {
+		t.Fatalf("Failed to reload session: %v", err)
+	}
+}
+
+func TestQuotaWarnsAtThresholds(t *testing.T) {
+	db := setupQuota(t)
+	service := newTestQuota(t, quota.ActionDisconnect, nil)
+	ctx := context.Background()
+
+	user, sess := createQuotaSession(t, db, 8.5)
+	if err := service.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	reloadQuota(t, db, user, sess)
+	if user.QuotaWarnedPercent != 80 || sess.Status != "active" {
+		t.Fatalf("Expected an 80%% warning and the session kept, got %d%% and %s", user.QuotaWarnedPercent, sess.Status)
+	}
+
+	db.Model(user).Update("cycle_data_gb", 9.5)
+	service.RunOnce(ctx)
+	reloadQuota(t, db, user, sess)
+	if user.QuotaWarnedPercent != 90 {
+		t.Errorf("Expected a 90%% warning, got %d%%", user.QuotaWarnedPercent)
+	}
+
+	usage, err := service.Usage(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("Usage failed: %v", err)
+	}
+	if usage.CapGB != 10 || usage.Percent != 95 || !usage.CycleEndsAt.After(usage.CycleStartedAt) {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+}
+
+func TestQuotaDisconnectsAtCap(t *testing.T) {
+	db := setupQuota(t)
+	service := newTestQuota(t, quota.ActionDisconnect, nil)
+
+	user, sess := createQuotaSession(t, db, 10)
+	if err := service.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+
+	reloadQuota(t, db, user, sess)
+	if user.QuotaExceededAt == nil || user.QuotaWarnedPercent != 100 {
+		t.Errorf("Expected the cap to be recorded as exceeded, got %v at %d%%", user.QuotaExceededAt, user.QuotaWarnedPercent)
+	}
+	if sess.Status != "terminated" {
+		t.Errorf("Expected the session to be terminated, got %s", sess.Status)
+	}
+}
+
+func TestQuotaThrottlesAndLiftsOnNewCycle(t *testing.T) {
+	db := setupQuota(t)
+	limiter := &fakeLimiter{limits: make(map[string]int)}
+	service := newTestQuota(t, quota.ActionThrottle, limiter)
+	ctx := context.Background()
+
+	user, sess := createQuotaSession(t, db, 12)
+	if err := service.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	reloadQuota(t, db, user, sess)
+	if sess.Status != "active" || sess.RateLimitKbps != 128 || limiter.limits[sess.PublicKey] != 128 {
+		t.Fatalf("Expected the session to be throttled to 128 kbps, got %s at %d kbps", sess.Status, sess.RateLimitKbps)
+	}
+
+	// The previous cycle ended a day ago
+	db.Model(user).Update("cycle_started_at", time.Now().AddDate(0, -1, -1))
+	if err := service.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	reloadQuota(t, db, user, sess)
+	if user.CycleDataGB != 0 || user.QuotaExceededAt != nil || user.QuotaWarnedPercent != 0 {
+		t.Errorf("Expected usage to reset, got %.1fGB exceeded at %v", user.CycleDataGB, user.QuotaExceededAt)
+	}
+	if sess.RateLimitKbps != 0 || limiter.limits[sess.PublicKey] != 0 {
+		t.Errorf("Expected throttling to be lifted, got %d kbps", sess.RateLimitKbps)
+	}
+	if !user.CycleStartedAt.After(time.Now().AddDate(0, 0, -2)) {
+		t.Errorf("Expected the new cycle to start a day ago, got %v", user.CycleStartedAt)
+	}
+}
+
+func TestQuotaDisconnectsWhenThrottlingFails(t *testing.T) {
+	db := setupQuota(t)
+	limiter := &fakeLimiter{limits: make(map[string]int), err: errors.New("node unreachable")}
+	service := newTestQuota(t, quota.ActionThrottle, limiter)
+
+	user, sess := createQuotaSession(t, db, 10)
+	if err := service.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+
+	reloadQuota(t, db, user, sess)
+	if sess.Status != "terminated" {
+		t.Errorf("Expected the session to be terminated, got %s", sess.Status)
+	}
+}
@@ -0,0 +1,234 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/auth"
+	"github.com/nikola43/aureo-vpn/pkg/metrics"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gorm.io/gorm"
+)
+
+// setupAuth creates an auth service and signs a new user in on a laptop
+func setupAuth(t *testing.T) (*auth.Service, *gorm.DB, *auth.AuthResponse) {
+	t.Helper()
+
+	db := setupTestDB(t, &models.User{}, &models.RefreshToken{})
+	tokenService := auth.NewTokenService("test-secret-key", 15*time.Minute, 7*24*time.Hour)
+	service := auth.NewService(tokenService, nil, nil, nil)
+
+	resp, err := service.Register(auth.RegisterRequest{
+		Email:      "test@example.com",
+		Password:   "correct-horse",
+		Username:   "testuser",
+		DeviceInfo: auth.DeviceInfo{DeviceName: "laptop", IPAddress: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	return service, db, resp
+}
+
+func TestRefreshTokenRotates(t *testing.T) {
+	service, db, signIn := setupAuth(t)
+	ctx := context.Background()
+
+	refreshed, err := service.RefreshToken(ctx, auth.RefreshRequest{RefreshToken: signIn.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+	if refreshed.RefreshToken == signIn.RefreshToken {
+		t.Error("Expected a new refresh token")
+	}
+
+	// Tokens are only stored hashed
+	var count int64
+	db.Model(&models.RefreshToken{}).Where("token_hash = ?", refreshed.RefreshToken).Count(&count)
+	if count != 0 {
+		t.Error("Refresh token should not be stored in plain text")
+	}
+
+	// The access token stays tied to the same sign-in
+	before, _ := service.VerifyAccessToken(ctx, signIn.AccessToken)
+	after, err := service.VerifyAccessToken(ctx, refreshed.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyAccessToken failed: %v", err)
+	}
+	if after.SessionID != before.SessionID {
+		t.Errorf("Expected session %s, got %s", before.SessionID, after.SessionID)
+	}
+
+	sessions, err := service.ListSessions(ctx, signIn.User.ID)
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].DeviceName != "laptop" {
+		t.Fatalf("Expected the laptop session, got %+v", sessions)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	service, _, signIn := setupAuth(t)
+	ctx := context.Background()
+
+	refreshed, err := service.RefreshToken(ctx, auth.RefreshRequest{RefreshToken: signIn.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+
+	// The first token is presented again, as if it had been stolen
+	_, err = service.RefreshToken(ctx, auth.RefreshRequest{RefreshToken: signIn.RefreshToken})
+	if !errors.Is(err, auth.ErrRefreshTokenReused) {
+		t.Fatalf("Expected ErrRefreshTokenReused, got %v", err)
+	}
+
+	// The whole session is signed out, including the latest tokens
+	_, err = service.RefreshToken(ctx, auth.RefreshRequest{RefreshToken: refreshed.RefreshToken})
+	if !errors.Is(err, auth.ErrInvalidRefreshToken) {
+		t.Errorf("Expected ErrInvalidRefreshToken, got %v", err)
+	}
+	if _, err := service.VerifyAccessToken(ctx, refreshed.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("Expected ErrTokenRevoked, got %v", err)
+	}
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	service, _, signIn := setupAuth(t)
+	ctx := context.Background()
+
+	phone, err := service.Login(auth.LoginRequest{
+		Email:      "test@example.com",
+		Password:   "correct-horse",
+		DeviceInfo: auth.DeviceInfo{DeviceName: "phone"},
+	})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	claims, err := service.VerifyAccessToken(ctx, signIn.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyAccessToken failed: %v", err)
+	}
+	if err := service.Logout(ctx, claims); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+
+	if _, err := service.VerifyAccessToken(ctx, signIn.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("Expected ErrTokenRevoked, got %v", err)
+	}
+	_, err = service.RefreshToken(ctx, auth.RefreshRequest{RefreshToken: signIn.RefreshToken})
+	if !errors.Is(err, auth.ErrInvalidRefreshToken) {
+		t.Errorf("Expected ErrInvalidRefreshToken, got %v", err)
+	}
+
+	// The phone stays signed in
+	if _, err := service.VerifyAccessToken(ctx, phone.AccessToken); err != nil {
+		t.Errorf("Expected the phone's token to stay valid, got %v", err)
+	}
+	sessions, _ := service.ListSessions(ctx, signIn.User.ID)
+	if len(sessions) != 1 || sessions[0].DeviceName != "phone" {
+		t.Errorf("Expected only the phone session, got %+v", sessions)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	service, _, signIn := setupAuth(t)
+	ctx := context.Background()
+
+	claims, err := service.VerifyAccessToken(ctx, signIn.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyAccessToken failed: %v", err)
+	}
+
+	// Only the user's own sessions can be revoked
+	if err := service.RevokeSession(ctx, claims.SessionID, claims.SessionID); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+
+	if err := service.RevokeSession(ctx, signIn.User.ID, claims.SessionID); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	if _, err := service.VerifyAccessToken(ctx, signIn.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("Expected ErrTokenRevoked, got %v", err)
+	}
+	if err := service.RevokeSession(ctx, signIn.User.ID, claims.SessionID); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound for a revoked session, got %v", err)
+	}
+}
+
+func TestUpdatePasswordSignsOutOtherSessions(t *testing.T) {
+	service, _, signIn := setupAuth(t)
+	ctx := context.Background()
+
+	phone, err := service.Login(auth.LoginRequest{
+		Email:      "test@example.com",
+		Password:   "correct-horse",
+		DeviceInfo: auth.DeviceInfo{DeviceName: "phone"},
+	})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	claims, _ := service.VerifyAccessToken(ctx, signIn.AccessToken)
+	if err := service.UpdatePassword(ctx, signIn.User.ID, claims.SessionID, "wrong", "battery-staple"); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials, got %v", err)
+	}
+	if err := service.UpdatePassword(ctx, signIn.User.ID, claims.SessionID, "correct-horse", "battery-staple"); err != nil {
+		t.Fatalf("UpdatePassword failed: %v", err)
+	}
+
+	// The phone was signed in with the old password
+	if _, err := service.VerifyAccessToken(ctx, phone.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("Expected ErrTokenRevoked, got %v", err)
+	}
+	_, err = service.RefreshToken(ctx, auth.RefreshRequest{RefreshToken: phone.RefreshToken})
+	if !errors.Is(err, auth.ErrInvalidRefreshToken) {
+		t.Errorf("Expected ErrInvalidRefreshToken, got %v", err)
+	}
+
+	// The laptop changed the password and stays signed in
+	if _, err := service.VerifyAccessToken(ctx, signIn.AccessToken); err != nil {
+		t.Errorf("Expected the laptop's token to stay valid, got %v", err)
+	}
+	sessions, _ := service.ListSessions(ctx, signIn.User.ID)
+	if len(sessions) != 1 || sessions[0].DeviceName != "laptop" {
+		t.Errorf("Expected only the laptop session, got %+v", sessions)
+	}
+}
+
+// unavailableRevocations is a revocation list whose store is down
+type unavailableRevocations struct{}
+
+func (unavailableRevocations) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	return errors.New("connection refused")
+}
+
+func (unavailableRevocations) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func TestRevocationListOutageIsCounted(t *testing.T) {
+	setupTestDB(t, &models.User{}, &models.RefreshToken{})
+	tokenService := auth.NewTokenService("test-secret-key", 15*time.Minute, 7*24*time.Hour)
+	service := auth.NewService(tokenService, unavailableRevocations{}, nil, nil)
+
+	resp, err := service.Register(auth.RegisterRequest{Email: "test@example.com", Password: "correct-horse", Username: "testuser"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	failures := metrics.RevocationCheckFailures.WithLabelValues("access")
+	before := testutil.ToFloat64(failures)
+
+	// Tokens are accepted while the list is down, but not silently
+	if _, err := service.VerifyAccessToken(context.Background(), resp.AccessToken); err != nil {
+		t.Fatalf("Expected the token to be accepted, got %v", err)
+	}
+	if got := testutil.ToFloat64(failures) - before; got != 1 {
+		t.Errorf("Expected 1 revocation check failure to be counted, got %v", got)
+	}
+}
@@ -0,0 +1,129 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/internal/control"
+	"github.com/nikola43/aureo-vpn/pkg/logger"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"github.com/nikola43/aureo-vpn/pkg/plans"
+	"github.com/nikola43/aureo-vpn/pkg/protocols/wireguard"
+	"github.com/nikola43/aureo-vpn/pkg/session"
+	"gorm.io/gorm"
+)
+
+// createSessionNode creates an online WireGuard node
+func createSessionNode(t *testing.T, db *gorm.DB, internalIP string) *models.VPNNode {
+	t.Helper()
+
+	keyPair, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate node keys: %v", err)
+	}
+
+	node := &models.VPNNode{
+		Name:              "node-" + uuid.NewString(),
+		Hostname:          "node.test",
+		PublicIP:          "192.0.2.10",
+		InternalIP:        internalIP,
+		Status:            "online",
+		IsActive:          true,
+		SupportsWireGuard: true,
+		WireGuardPort:     51820,
+		MaxConnections:    10,
+		PublicKey:         keyPair.PublicKey,
+	}
+	if err := db.Create(node).Error; err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	return node
+}
+
+func TestCreateSessionRejectsAtDeviceLimit(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.Plan{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{})
+	service := session.NewService(logger.Global(), nil, nil, newTestPlans(t), session.DeviceLimitReject)
+	ctx := context.Background()
+
+	user := createPlanUser(t, db, "basic", time.Now().Add(time.Hour))
+	first := createSessionNode(t, db, "10.8.0.1")
+	second := createSessionNode(t, db, "10.9.0.1")
+
+	if _, err := service.Create(ctx, user.ID, session.CreateRequest{NodeID: &first.ID}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// The limit applies across nodes
+	_, err := service.Create(ctx, user.ID, session.CreateRequest{NodeID: &second.ID})
+	assertNotEntitled(t, err, plans.FeatureDevices)
+}
+
+func TestCreateSessionEvictsOldestDevice(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.Plan{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{})
+	service := session.NewService(logger.Global(), nil, nil, newTestPlans(t), session.DeviceLimitEvictOldest)
+	ctx := context.Background()
+
+	user := createPlanUser(t, db, "basic", time.Now().Add(time.Hour))
+	first := createSessionNode(t, db, "10.8.0.1")
+	second := createSessionNode(t, db, "10.9.0.1")
+
+	old, err := service.Create(ctx, user.ID, session.CreateRequest{NodeID: &first.ID, DeviceType: "laptop", OSType: "linux"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	result, err := service.Create(ctx, user.ID, session.CreateRequest{NodeID: &second.ID, DeviceType: "phone", OSType: "android"})
+	if err != nil {
+		t.Fatalf("Expected the oldest session to be evicted, got %v", err)
+	}
+
+	if len(result.Evicted) != 1 {
+		t.Fatalf("Expected one evicted device, got %d", len(result.Evicted))
+	}
+	evicted := result.Evicted[0]
+	if evicted.SessionID != old.Session.ID || evicted.DeviceType != "laptop" || evicted.OSType != "linux" {
+		t.Errorf("Expected the linux laptop to be evicted, got %+v", evicted)
+	}
+
+	var ended models.Session
+	db.First(&ended, old.Session.ID)
+	if ended.Status != "evicted" || ended.DisconnectedAt == nil {
+		t.Errorf("Expected the old session to be evicted, got %s", ended.Status)
+	}
+
+	var node models.VPNNode
+	db.First(&node, first.ID)
+	if node.CurrentConnections != 0 {
+		t.Errorf("Expected the evicted session's connection to be released, got %d", node.CurrentConnections)
+	}
+}
+
+func TestSelectNodeByProtocol(t *testing.T) {
+	db := setupTestDB(t, &models.User{}, &models.NodeOperator{}, &models.VPNNode{}, &models.Session{})
+	service := session.NewService(logger.Global(), nil, nil, nil, "")
+	server := control.NewServer(control.Config{})
+
+	wireGuardOnly := createSessionNode(t, db, "10.8.0.1")
+	db.Model(wireGuardOnly).Update("supports_open_vpn", false)
+	openVPN := createSessionNode(t, db, "10.9.0.1")
+	db.Model(openVPN).Updates(map[string]interface{}{"supports_open_vpn": true, "load_score": 50})
+
+	for _, tc := range []struct {
+		protocol string
+		want     uuid.UUID
+	}{
+		{"wireguard", wireGuardOnly.ID},
+		{"openvpn", openVPN.ID},
+	} {
+		node, err := service.SelectNode(tc.protocol, "")
+		if err != nil || node.ID != tc.want {
+			t.Errorf("SelectNode(%s): expected node %s, got %v", tc.protocol, tc.want, err)
+		}
+		node, err = server.GetBestNode(tc.protocol, "")
+		if err != nil || node.ID != tc.want {
+			t.Errorf("GetBestNode(%s): expected node %s, got %v", tc.protocol, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikola43/aureo-vpn/pkg/telemetry"
+)
+
+// writeProc writes files of a fake procfs
+func writeProc(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestTelemetrySample(t *testing.T) {
+	proc := t.TempDir()
+	writeProc(t, proc, map[string]string{
+		"uptime":  "1000.00 3000.00\n",
+		"stat":    "cpu  300 0 100 1600 0 0 0 0 0 0\ncpu0 150 0 50 800 0 0 0 0 0 0\ncpu1 150 0 50 800 0 0 0 0 0 0\nintr 12345\n",
+		"loadavg": "1.50 1.00 0.50 2/300 4000\n",
+		"meminfo": "MemTotal: 2000 kB\nMemFree: 200 kB\nMemAvailable: 1500 kB\nCached: 1000 kB\n",
+		"net/dev": "Inter-|   Receive\n face |bytes packets errs drop fifo frame compressed multicast|bytes packets\n" +
+			"    lo: 5000 10 0 0 0 0 0 0 5000 10 0 0 0 0 0 0\n" +
+			"  eth0: 1000 10 0 0 0 0 0 0 2000 20 0 0 0 0 0 0\n",
+		"sys/net/netfilter/nf_conntrack_count": "120\n",
+		"sys/net/netfilter/nf_conntrack_max":   "65536\n",
+	})
+
+	collector := telemetry.NewCollector(telemetry.Config{ProcPath: proc, Interface: "eth0"})
+
+	// The first sample averages since boot
+	sample, err := collector.Sample()
+	if err != nil {
+		t.Fatalf("Sample failed: %v", err)
+	}
+	if sample.UptimeSeconds != 1000 || sample.CPUCount != 2 {
+		t.Errorf("Expected 1000s uptime on 2 CPUs, got %ds on %d", sample.UptimeSeconds, sample.CPUCount)
+	}
+	if sample.CPUPercent != 20 {
+		t.Errorf("Expected 20%% CPU usage, got %f", sample.CPUPercent)
+	}
+	if sample.MemoryPercent != 25 || sample.MemoryTotalKB != 2000 {
+		t.Errorf("Expected 25%% of 2000 KB memory in use, got %f%% of %d KB", sample.MemoryPercent, sample.MemoryTotalKB)
+	}
+	if sample.Load1 != 1.5 || sample.Load5 != 1 || sample.Load15 != 0.5 {
+		t.Errorf("Expected load averages 1.5 1 0.5, got %f %f %f", sample.Load1, sample.Load5, sample.Load15)
+	}
+	if sample.ConntrackCount != 120 || sample.ConntrackMax != 65536 {
+		t.Errorf("Expected 120 of 65536 tracked connections, got %d of %d", sample.ConntrackCount, sample.ConntrackMax)
+	}
+	if sample.RxMbps <= 0 || sample.TxMbps <= sample.RxMbps {
+		t.Errorf("Expected boot-averaged throughput, got rx %f tx %f", sample.RxMbps, sample.TxMbps)
+	}
+
+	// Later samples measure since the previous one: all 100 new ticks busy
+	// and 1.25 MB received on eth0 only
+	writeProc(t, proc, map[string]string{
+		"stat": "cpu  400 0 100 1600 0 0 0 0 0 0\ncpu0 200 0 50 800 0 0 0 0 0 0\ncpu1 200 0 50 800 0 0 0 0 0 0\n",
+		"net/dev": "Inter-|   Receive\n face |bytes packets errs drop fifo frame compressed multicast|bytes packets\n" +
+			"    lo: 9995000 10 0 0 0 0 0 0 5000 10 0 0 0 0 0 0\n" +
+			"  eth0: 1251000 10 0 0 0 0 0 0 2000 20 0 0 0 0 0 0\n",
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	sample, err = collector.Sample()
+	if err != nil {
+		t.Fatalf("Sample failed: %v", err)
+	}
+	if sample.CPUPercent != 100 {
+		t.Errorf("Expected 100%% CPU usage since the previous sample, got %f", sample.CPUPercent)
+	}
+	if sample.RxMbps < 50 || sample.RxMbps > 100 || sample.TxMbps != 0 {
+		t.Errorf("Expected 10 Mbit received in about 0.1s and nothing sent, got rx %f tx %f", sample.RxMbps, sample.TxMbps)
+	}
+}
+
+func TestTelemetryOptionalMetrics(t *testing.T) {
+	proc := t.TempDir()
+	writeProc(t, proc, map[string]string{
+		"uptime":  "10.00 10.00\n",
+		"stat":    "cpu  10 0 10 80 0 0 0 0 0 0\ncpu0 10 0 10 80 0 0 0 0 0 0\n",
+		"loadavg": "0.00 0.00 0.00 1/50 100\n",
+		// Kernels before 3.14 do not report available memory
+		"meminfo": "MemTotal: 1000 kB\nMemFree: 200 kB\nBuffers: 100 kB\nCached: 300 kB\n",
+	})
+
+	// Without network stats or connection tracking the sample still succeeds
+	sample, err := telemetry.NewCollector(telemetry.Config{ProcPath: proc}).Sample()
+	if err != nil {
+		t.Fatalf("Sample failed: %v", err)
+	}
+	if sample.MemoryPercent != 40 {
+		t.Errorf("Expected 40%% memory usage, got %f", sample.MemoryPercent)
+	}
+	if sample.RxMbps != 0 || sample.ConntrackCount != 0 {
+		t.Errorf("Expected no network figures, got rx %f conntrack %d", sample.RxMbps, sample.ConntrackCount)
+	}
+
+	// CPU and memory are required
+	os.Remove(filepath.Join(proc, "meminfo"))
+	if _, err := telemetry.NewCollector(telemetry.Config{ProcPath: proc}).Sample(); err == nil {
+		t.Error("Expected an error without memory stats")
+	}
+}
@@ -0,0 +1,206 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikola43/aureo-vpn/pkg/auth"
+	"github.com/nikola43/aureo-vpn/pkg/crypto"
+	"github.com/nikola43/aureo-vpn/pkg/models"
+	"gorm.io/gorm"
+)
+
+// setupTwoFactor registers a user and enables two-factor authentication,
+// returning their TOTP secret and recovery codes
+func setupTwoFactor(t *testing.T) (*auth.Service, *gorm.DB, uuid.UUID, string, []string) {
+	t.Helper()
+
+	db := setupTestDB(t, &models.User{}, &models.RefreshToken{}, &models.RecoveryCode{})
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	encryption, err := crypto.NewEncryptionService(key)
+	if err != nil {
+		t.Fatalf("Failed to create encryption service: %v", err)
+	}
+	service := auth.NewService(auth.NewTokenService("test-secret-key", 15*time.Minute, 7*24*time.Hour), nil, encryption, nil)
+	ctx := context.Background()
+
+	resp, err := service.Register(auth.RegisterRequest{
+		Email:    "test@example.com",
+		Password: "correct-horse",
+		Username: "testuser",
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	userID := resp.User.ID
+
+	setup, err := service.SetupTwoFactor(ctx, userID)
+	if err != nil {
+		t.Fatalf("SetupTwoFactor failed: %v", err)
+	}
+
+	if _, err := service.EnableTwoFactor(ctx, userID, "000000"); !errors.Is(err, auth.ErrInvalidTwoFactorCode) {
+		t.Fatalf("Expected ErrInvalidTwoFactorCode, got %v", err)
+	}
+
+	code, err := auth.TOTPCode(setup.Secret, time.Now())
+	if err != nil {
+		t.Fatalf("TOTPCode failed: %v", err)
+	}
+	recoveryCodes, err := service.EnableTwoFactor(ctx, userID, code)
+	if err != nil {
+		t.Fatalf("EnableTwoFactor failed: %v", err)
+	}
+
+	return service, db, userID, setup.Secret, recoveryCodes
+}
+
+// loginChallenge signs in and returns the MFA token of the challenge
+func loginChallenge(t *testing.T, service *auth.Service) string {
+	t.Helper()
+
+	resp, err := service.Login(auth.LoginRequest{Email: "test@example.com", Password: "correct-horse"})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if !resp.MFARequired || resp.MFAToken == "" || resp.AccessToken != "" || resp.RefreshToken != "" {
+		t.Fatalf("Expected an MFA challenge without tokens, got %+v", resp)
+	}
+	return resp.MFAToken
+}
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	// The SHA-1 test vector from RFC 6238, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+
+	code, err := auth.TOTPCode(secret, time.Unix(59, 0))
+	if err != nil {
+		t.Fatalf("TOTPCode failed: %v", err)
+	}
+	if code != "287082" {
+		t.Errorf("Expected 287082, got %s", code)
+	}
+}
+
+func TestTwoFactorSecretEncrypted(t *testing.T) {
+	_, db, userID, secret, recoveryCodes := setupTwoFactor(t)
+
+	var user models.User
+	db.First(&user, userID)
+	if !user.TwoFactorEnabled {
+		t.Error("Expected two-factor authentication to be enabled")
+	}
+	if user.TwoFactorSecret == "" || user.TwoFactorSecret == secret {
+		t.Error("Expected the secret to be stored encrypted")
+	}
+
+	if len(recoveryCodes) != 10 {
+		t.Fatalf("Expected 10 recovery codes, got %d", len(recoveryCodes))
+	}
+	var count int64
+	db.Model(&models.RecoveryCode{}).Where("code_hash = ?", recoveryCodes[0]).Count(&count)
+	if count != 0 {
+		t.Error("Recovery codes should not be stored in plain text")
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	service, _, _, secret, _ := setupTwoFactor(t)
+	ctx := context.Background()
+
+	mfaToken := loginChallenge(t, service)
+
+	// The MFA token is not an access token
+	if _, err := service.VerifyAccessToken(ctx, mfaToken); err == nil {
+		t.Error("Expected the MFA token to be rejected as an access token")
+	}
+
+	// Codes no newer than the one used to enable two-factor authentication are
+	// refused, though still within the clock drift window
+	oldCode, _ := auth.TOTPCode(secret, time.Now().Add(-30*time.Second))
+	_, err := service.VerifyTwoFactorLogin(ctx, auth.TwoFactorLoginRequest{MFAToken: mfaToken, Code: oldCode})
+	if !errors.Is(err, auth.ErrInvalidTwoFactorCode) {
+		t.Fatalf("Expected ErrInvalidTwoFactorCode for an old code, got %v", err)
+	}
+
+	code, _ := auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+	resp, err := service.VerifyTwoFactorLogin(ctx, auth.TwoFactorLoginRequest{MFAToken: mfaToken, Code: code})
+	if err != nil {
+		t.Fatalf("VerifyTwoFactorLogin failed: %v", err)
+	}
+	if _, err := service.VerifyAccessToken(ctx, resp.AccessToken); err != nil {
+		t.Errorf("Expected a valid access token, got %v", err)
+	}
+
+	// The MFA token can only be used once
+	_, err = service.VerifyTwoFactorLogin(ctx, auth.TwoFactorLoginRequest{MFAToken: mfaToken, Code: code})
+	if !errors.Is(err, auth.ErrInvalidMFAToken) {
+		t.Errorf("Expected ErrInvalidMFAToken, got %v", err)
+	}
+}
+
+func TestTwoFactorRecoveryCode(t *testing.T) {
+	service, _, _, _, recoveryCodes := setupTwoFactor(t)
+	ctx := context.Background()
+
+	// Recovery codes are accepted regardless of case
+	resp, err := service.VerifyTwoFactorLogin(ctx, auth.TwoFactorLoginRequest{
+		MFAToken: loginChallenge(t, service),
+		Code:     strings.ToUpper(recoveryCodes[0]),
+	})
+	if err != nil {
+		t.Fatalf("VerifyTwoFactorLogin with a recovery code failed: %v", err)
+	}
+	if resp.AccessToken == "" {
+		t.Error("Expected an access token")
+	}
+
+	// Each recovery code works once
+	_, err = service.VerifyTwoFactorLogin(ctx, auth.TwoFactorLoginRequest{
+		MFAToken: loginChallenge(t, service),
+		Code:     recoveryCodes[0],
+	})
+	if !errors.Is(err, auth.ErrInvalidTwoFactorCode) {
+		t.Errorf("Expected ErrInvalidTwoFactorCode for a used recovery code, got %v", err)
+	}
+}
+
+func TestDisableTwoFactorRequiresPassword(t *testing.T) {
+	service, db, userID, _, _ := setupTwoFactor(t)
+	ctx := context.Background()
+
+	if err := service.DisableTwoFactor(ctx, userID, "wrong-password"); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials, got %v", err)
+	}
+
+	if err := service.DisableTwoFactor(ctx, userID, "correct-horse"); err != nil {
+		t.Fatalf("DisableTwoFactor failed: %v", err)
+	}
+
+	var user models.User
+	db.First(&user, userID)
+	if user.TwoFactorEnabled || user.TwoFactorSecret != "" {
+		t.Error("Expected two-factor authentication to be disabled and the secret removed")
+	}
+	var count int64
+	db.Model(&models.RecoveryCode{}).Where("user_id = ?", userID).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected recovery codes to be deleted, got %d", count)
+	}
+
+	// Login no longer needs a code
+	resp, err := service.Login(auth.LoginRequest{Email: "test@example.com", Password: "correct-horse"})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if resp.MFARequired || resp.AccessToken == "" {
+		t.Errorf("Expected tokens without a challenge, got %+v", resp)
+	}
+}